@@ -10,21 +10,29 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
 
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-getter"
 )
 
 type URLHelper struct {
 	urlTemplate    *template.Template
 	urlSumTemplate *template.Template
+	// archNames maps GOARCH values to the names upstream uses in URLs,
+	// where they differ, e.g. "arm" to "armv7".
+	archNames map[string]string
+	// releases, if non-nil, lists the versions published upstream.
+	releases *releaseLister
 }
 
 func NewURLHelper(mainURL, sumURL string) (*URLHelper, error) {
@@ -54,10 +62,34 @@ const prometheusURLTemplateBase = "https://github.com/prometheus/{{ .Package }}/
 const prometheusURLTemplate = prometheusURLTemplateBase + "{{ .Package }}-{{ .Version }}.{{ .OS }}-{{ .Arch }}.tar.gz"
 const prometheusURLSumTemplate = prometheusURLTemplateBase + "sha256sums.txt"
 
-var hashicorpURLHelper, prometheusURLHelper *URLHelper
+const thanosURLTemplateBase = "https://github.com/thanos-io/{{ .Package }}/releases/download/v{{ .Version }}/"
+const thanosURLTemplate = thanosURLTemplateBase + "{{ .Package }}-{{ .Version }}.{{ .OS }}-{{ .Arch }}.tar.gz"
+const thanosURLSumTemplate = thanosURLTemplateBase + "sha256sums.txt"
+
+// MinIO is distributed as a bare binary rather than an archive.
+const minioURLTemplateBase = "https://dl.min.io/server/{{ .Package }}/release/{{ .OS }}-{{ .Arch }}/archive/"
+const minioURLTemplate = minioURLTemplateBase + "{{ .Package }}.RELEASE.{{ .Version }}"
+const minioURLSumTemplate = minioURLTemplate + ".sha256sum"
+
+const grafanaURLTemplate = "https://dl.grafana.com/oss/release/{{ .Package }}-{{ .Version }}.{{ .OS }}-{{ .Arch }}.tar.gz"
+const grafanaURLSumTemplate = grafanaURLTemplate + ".sha256"
+
+const lokiURLTemplateBase = "https://github.com/grafana/{{ .Package }}/releases/download/v{{ .Version }}/"
+const lokiURLTemplate = lokiURLTemplateBase + "{{ .Package }}-{{ .OS }}-{{ .Arch }}.zip"
+const lokiURLSumTemplate = lokiURLTemplateBase + "SHA256SUMS"
+
+// Envoy archives don't come with a checksum file we can use.
+const envoyURLTemplate = "https://archive.tetratelabs.io/envoy/download/v{{ .Version }}/envoy-v{{ .Version }}-{{ .OS }}-{{ .Arch }}.tar.xz"
+
+var hashicorpURLHelper, prometheusURLHelper, thanosURLHelper, minioURLHelper, grafanaURLHelper, lokiURLHelper, envoyURLHelper *URLHelper
 
 var Default Manager
 
+// DefaultWorkDir returns the work dir of Default.
+func DefaultWorkDir() string {
+	return filepath.Join(os.TempDir(), "yurt/binaries")
+}
+
 func init() {
 	u, err := NewURLHelper(hashicorpURLTemplate, hashicorpURLSumTemplate)
 	if err != nil {
@@ -69,18 +101,122 @@ func init() {
 	if err != nil {
 		panic(err.Error())
 	}
+	u.archNames = map[string]string{"arm": "armv7"}
 	prometheusURLHelper = u
 
-	Default, err = NewDownloadManager(filepath.Join(os.TempDir(), "yurt/binaries"))
+	hashicorpURLHelper.releases, err = newReleaseLister(hashicorpReleasesURLTemplate, "", parseHashicorpReleases)
+	if err != nil {
+		panic(err.Error())
+	}
+	prometheusURLHelper.releases, err = newReleaseLister(githubReleasesURLTemplate, "prometheus", parseGithubReleases)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	u, err = NewURLHelper(thanosURLTemplate, thanosURLSumTemplate)
+	if err != nil {
+		panic(err.Error())
+	}
+	u.releases, err = newReleaseLister(githubReleasesURLTemplate, "thanos-io", parseGithubReleases)
+	if err != nil {
+		panic(err.Error())
+	}
+	thanosURLHelper = u
+
+	u, err = NewURLHelper(minioURLTemplate, minioURLSumTemplate)
+	if err != nil {
+		panic(err.Error())
+	}
+	minioURLHelper = u
+
+	u, err = NewURLHelper(grafanaURLTemplate, grafanaURLSumTemplate)
+	if err != nil {
+		panic(err.Error())
+	}
+	grafanaURLHelper = u
+
+	u, err = NewURLHelper(lokiURLTemplate, lokiURLSumTemplate)
+	if err != nil {
+		panic(err.Error())
+	}
+	u.releases, err = newReleaseLister(githubReleasesURLTemplate, "grafana", parseGithubReleases)
+	if err != nil {
+		panic(err.Error())
+	}
+	lokiURLHelper = u
+
+	u, err = NewURLHelper(envoyURLTemplate, "")
+	if err != nil {
+		panic(err.Error())
+	}
+	envoyURLHelper = u
+
+	Default, err = NewDownloadManager(DefaultWorkDir())
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 type registryEntry struct {
+	// name is the upstream package name used in URLs, which differs from
+	// the registry key for variants like "vault-enterprise".
 	name    string
 	version string
 	from    *URLHelper
+	// raw is true if the URL points to the binary itself, not an archive.
+	raw bool
+	// binary is the path of the binary within the archive, a template like
+	// the URL's.  If empty, it's a file called name.  Leading directories
+	// that are alone in their parent needn't be included.
+	binary string
+	// license lists env vars of which at least one must be set to fetch
+	// the package, e.g. enterprise binaries that won't run without one.
+	license []string
+	// platforms overrides the entry for some "os/arch" pairs, where
+	// upstream publishes differently or not at all.
+	platforms map[string]platformEntry
+}
+
+// platformEntry overrides fields of a registryEntry for one platform.
+type platformEntry struct {
+	// arch, if given, is fetched instead of the requested arch, e.g.
+	// "amd64" to run under Rosetta on Apple Silicon when upstream has no
+	// darwin/arm64 build.
+	arch string
+	// from, if non-nil, replaces the entry's URLHelper.
+	from *URLHelper
+	// binary, if given, replaces the entry's binary.
+	binary string
+	// unsupported is true if there's no build usable on the platform.
+	unsupported bool
+}
+
+// forPlatform returns the entry with any overrides for osName and arch
+// applied, and the arch to fetch.
+func (o registryEntry) forPlatform(osName, arch string) (registryEntry, string, error) {
+	p, ok := o.platforms[osName+"/"+arch]
+	if !ok {
+		return o, arch, nil
+	}
+	if p.unsupported {
+		return o, "", fmt.Errorf("%s is not available for %s/%s", o.name, osName, arch)
+	}
+	if p.arch != "" {
+		arch = p.arch
+	}
+	if p.from != nil {
+		o.from = p.from
+	}
+	if p.binary != "" {
+		o.binary = p.binary
+	}
+	return o, arch, nil
+}
+
+// darwinAMD64 is a platform override for packages that have no
+// darwin/arm64 build, whose darwin/amd64 build runs under Rosetta.
+var darwinAMD64 = map[string]platformEntry{
+	"darwin/arm64": {arch: "amd64"},
 }
 
 func registry() map[string]registryEntry {
@@ -108,27 +244,129 @@ func registry() map[string]registryEntry {
 			from:    prometheusURLHelper,
 		},
 		"consul_exporter": {
-			name:    "consul_exporter",
-			version: "0.7.1",
-			from:    prometheusURLHelper,
+			name:      "consul_exporter",
+			version:   "0.7.1",
+			from:      prometheusURLHelper,
+			platforms: darwinAMD64,
 		},
 		"node_exporter": {
 			name:    "node_exporter",
 			version: "1.3.1",
 			from:    prometheusURLHelper,
 		},
+		"blackbox_exporter": {
+			name:    "blackbox_exporter",
+			version: "0.19.0",
+			from:    prometheusURLHelper,
+		},
+		"pushgateway": {
+			name:    "pushgateway",
+			version: "1.4.2",
+			from:    prometheusURLHelper,
+		},
+		"nomad-autoscaler": {
+			name:      "nomad-autoscaler",
+			version:   "0.3.5",
+			from:      hashicorpURLHelper,
+			platforms: darwinAMD64,
+		},
+		"thanos": {
+			name:    "thanos",
+			version: "0.24.0",
+			from:    thanosURLHelper,
+		},
+		"minio": {
+			name:    "minio",
+			version: "2022-01-08T03-11-54Z",
+			from:    minioURLHelper,
+			raw:     true,
+		},
+		"alertmanager": {
+			name:    "alertmanager",
+			version: "0.23.0",
+			from:    prometheusURLHelper,
+		},
+		"grafana": {
+			name:    "grafana",
+			version: "8.3.3",
+			from:    grafanaURLHelper,
+			// The homepath grafana-server needs is the dir above bin.
+			binary:    "bin/grafana-server",
+			platforms: darwinAMD64,
+		},
+		"loki": {
+			name:    "loki",
+			version: "2.4.1",
+			from:    lokiURLHelper,
+			binary:  "loki-{{ .OS }}-{{ .Arch }}",
+		},
+		"envoy": {
+			name:    "envoy",
+			version: "1.20.1",
+			from:    envoyURLHelper,
+		},
+		"consul-enterprise": {
+			name:    "consul",
+			version: "1.11.1+ent",
+			from:    hashicorpURLHelper,
+			license: []string{"CONSUL_LICENSE", "CONSUL_LICENSE_PATH"},
+		},
+		"nomad-enterprise": {
+			name:    "nomad",
+			version: "1.2.3+ent",
+			from:    hashicorpURLHelper,
+			license: []string{"NOMAD_LICENSE", "NOMAD_LICENSE_PATH"},
+		},
+		"vault-enterprise": {
+			name:    "vault",
+			version: "1.9.2+ent",
+			from:    hashicorpURLHelper,
+			license: []string{"VAULT_LICENSE", "VAULT_LICENSE_PATH"},
+		},
 	}
 }
 
+// Licensed returns an error if packageName is an enterprise package, or a
+// version of a package ending in "+ent", and none of the env vars that hold
+// its license are set.  Enterprise binaries inherit these env vars when run.
+func Licensed(packageName, version string) error {
+	reg := registry()
+	o, ok := reg[packageName]
+	if !ok {
+		return fmt.Errorf("unknown package name %q", packageName)
+	}
+	if strings.HasSuffix(version, "+ent") {
+		if ent, ok := reg[o.name+"-enterprise"]; ok {
+			o = ent
+		}
+	}
+	if len(o.license) == 0 {
+		return nil
+	}
+	for _, env := range o.license {
+		if os.Getenv(env) != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s requires a license, set one of $%s", packageName, strings.Join(o.license, ", $"))
+}
+
+// Manager provides binaries by package name, e.g. "consul".  An empty
+// version means the registry default.
 type Manager interface {
-	Get(packageName string) (string, error)
+	Get(packageName, version string) (string, error)
 	GetOSArch(packageName, os, arch, version string) (string, error)
 }
 
 type EnvPathManager struct {
 }
 
-func (e EnvPathManager) Get(packageName string) (string, error) {
+// Get returns the packageName found in $PATH.  Since whatever version is
+// installed there is used, requesting a specific version is an error.
+func (e EnvPathManager) Get(packageName, version string) (string, error) {
+	if version != "" {
+		return "", fmt.Errorf("can't select version %s of %s from $PATH", version, packageName)
+	}
 	return exec.LookPath(packageName)
 }
 
@@ -142,14 +380,80 @@ type DownloadManager struct {
 	l       sync.Mutex
 	cache   map[string]string
 	workDir string
+	opts    DownloadOptions
+	getters map[string]getter.Getter
+	// client is used for requests made other than by go-getter, e.g. to
+	// list releases.
+	client *http.Client
 }
 
 var _ Manager = &DownloadManager{}
 
+// Env vars read by DownloadOptionsFromEnv.
+const (
+	MirrorEnvVar  = "YURT_BINARIES_MIRROR"
+	ProxyEnvVar   = "YURT_BINARIES_PROXY"
+	OfflineEnvVar = "YURT_BINARIES_OFFLINE"
+)
+
+// DownloadOptions configure where a DownloadManager fetches from, e.g. for
+// air-gapped CI environments.
+type DownloadOptions struct {
+	// Mirror, if given, is a URL prefix under which artifacts are fetched
+	// instead of from their origin: the origin host and path are appended,
+	// e.g. https://releases.hashicorp.com/consul/... becomes
+	// <Mirror>/releases.hashicorp.com/consul/...
+	Mirror string
+	// Proxy, if given, is the URL of an HTTP proxy to fetch through.  By
+	// default the usual proxy env vars like HTTPS_PROXY are honored.
+	Proxy string
+	// Offline means never fetch anything: packages must already be in the
+	// work dir, see CheckCached.
+	Offline bool
+}
+
+// DownloadOptionsFromEnv returns options based on MirrorEnvVar,
+// ProxyEnvVar, and OfflineEnvVar, the latter being true if set to anything
+// other than "", "0" or "false".
+func DownloadOptionsFromEnv() DownloadOptions {
+	offline := os.Getenv(OfflineEnvVar)
+	return DownloadOptions{
+		Mirror:  os.Getenv(MirrorEnvVar),
+		Proxy:   os.Getenv(ProxyEnvVar),
+		Offline: offline != "" && offline != "0" && offline != "false",
+	}
+}
+
+// NewDownloadManager returns a manager that downloads to workDir, configured
+// using DownloadOptionsFromEnv.
 func NewDownloadManager(workDir string) (*DownloadManager, error) {
+	return NewDownloadManagerWithOptions(workDir, DownloadOptionsFromEnv())
+}
+
+func NewDownloadManagerWithOptions(workDir string, opts DownloadOptions) (*DownloadManager, error) {
 	m := &DownloadManager{
 		workDir: workDir,
 		cache:   make(map[string]string),
+		opts:    opts,
+		client:  cleanhttp.DefaultPooledClient(),
+	}
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy URL: %w", err)
+		}
+		transport := cleanhttp.DefaultPooledTransport()
+		transport.Proxy = http.ProxyURL(proxy)
+		m.client = &http.Client{Transport: transport}
+		httpGetter := &getter.HttpGetter{
+			Netrc:  true,
+			Client: m.client,
+		}
+		m.getters = map[string]getter.Getter{}
+		for k, v := range getter.Getters {
+			m.getters[k] = v
+		}
+		m.getters["http"], m.getters["https"] = httpGetter, httpGetter
 	}
 	if err := os.MkdirAll(m.workDir, 0755); err != nil {
 		return nil, err
@@ -157,6 +461,51 @@ func NewDownloadManager(workDir string) (*DownloadManager, error) {
 	return m, nil
 }
 
+// mirrored returns u rewritten to use the mirror, if there is one.
+func (m *DownloadManager) mirrored(u string) string {
+	if m.opts.Mirror == "" || u == "" {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return strings.TrimSuffix(m.opts.Mirror, "/") + "/" + parsed.Host + parsed.Path
+}
+
+// MissingError is returned by an offline DownloadManager when asked for
+// packages that haven't been fetched.
+type MissingError struct {
+	// Missing lists the missing artifacts as "name version: URL".
+	Missing []string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("offline and missing %d artifact(s):\n  %s", len(e.Missing), strings.Join(e.Missing, "\n  "))
+}
+
+// CheckCached returns a *MissingError listing every package in packages,
+// a map from package name to version ("" for the default), that would
+// have to be downloaded for the current OS and arch.  Use it to fail fast
+// in offline mode rather than on the first missing package.
+func (m *DownloadManager) CheckCached(packages map[string]string) error {
+	var missing []string
+	for name, version := range packages {
+		a, err := m.artifact(name, runtime.GOOS, runtime.GOARCH, version)
+		if err != nil {
+			return err
+		}
+		if _, err := a.findBinary(a.extractDir); err != nil {
+			missing = append(missing, a.describe())
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &MissingError{Missing: missing}
+	}
+	return nil
+}
+
 // dldirToBinary takes as input dldir, a directory that go-getter wrote to,
 // and the name of an upstream package defined in the registry package variable
 // (e.g. "consul").
@@ -185,21 +534,46 @@ func dldirToBinary(dldir, packageName string) (string, error) {
 	return "", fmt.Errorf("didn't find %s under %s", packageName, dldir)
 }
 
-func (m *DownloadManager) Get(packageName string) (string, error) {
-	return m.GetOSArch(packageName, runtime.GOOS, runtime.GOARCH, "")
+// dldirToBinaryPath is like dldirToBinary for archives whose binary isn't
+// named after the package or isn't at the top, e.g. grafana's bin dir.
+// binPath is relative to the first directory that isn't alone in its parent.
+// The binary is made executable, since not all archives preserve modes.
+func dldirToBinaryPath(dldir, binPath string) (string, error) {
+	path := filepath.Join(dldir, binPath)
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		if err := os.Chmod(path, fi.Mode()|0111); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+
+	fis, err := ioutil.ReadDir(dldir)
+	if err != nil {
+		return "", err
+	}
+	if len(fis) == 1 && fis[0].IsDir() {
+		return dldirToBinaryPath(filepath.Join(dldir, fis[0].Name()), binPath)
+	}
+	return "", fmt.Errorf("didn't find %s under %s", binPath, dldir)
+}
+
+func (m *DownloadManager) Get(packageName, version string) (string, error) {
+	return m.GetOSArch(packageName, runtime.GOOS, runtime.GOARCH, version)
 }
 
 func (m *DownloadManager) GetOSArch(packageName, os, arch, version string) (string, error) {
+	key := strings.Join([]string{packageName, version, os, arch}, ":")
 	m.l.Lock()
-	defer m.l.Unlock()
-
-	if binPath, ok := m.cache[packageName+":"+version]; ok {
+	binPath, ok := m.cache[key]
+	m.l.Unlock()
+	if ok {
 		return binPath, nil
 	}
 
-	var binPath string
+	// The lock isn't held while fetching, so that different packages can be
+	// fetched concurrently; fetches of the same package are serialized by
+	// lock files.
 	var err error
-
 	if packageName == "yurt-run" {
 		binPath, err = m.buildLocalBin(packageName, os, arch)
 	} else {
@@ -209,59 +583,192 @@ func (m *DownloadManager) GetOSArch(packageName, os, arch, version string) (stri
 	if err != nil {
 		return "", err
 	}
-	m.cache[packageName+":"+version] = binPath
+	m.l.Lock()
+	m.cache[key] = binPath
+	m.l.Unlock()
 	return binPath, nil
 }
 
-// Fetch fetches the packageName based on its registry entry,
-// if it's not already present on disk with the correct checksum.
-// Then it extracts the archive and finds the binary with the same name as packageName.
-// Returns the absolute path (located under m.workDir) where the binary was found.
-func (m *DownloadManager) Fetch(packageName, osName, arch, version string) (string, error) {
-	workdir := m.workDir
+// TestPackages lists the packages yurt's own tests fetch, e.g. to warm the
+// cache in CI using PrefetchParallel.
+var TestPackages = []string{
+	"consul",
+	"nomad",
+	"vault",
+	"prometheus",
+	"node_exporter",
+	"pushgateway",
+	"thanos",
+	"minio",
+	"envoy",
+	"nomad-autoscaler",
+}
+
+// Prefetch fetches packages for the current OS and arch, e.g. to warm the
+// cache once before running test packages in parallel.  Each element of
+// packages is a package name, optionally followed by "@" and a version.
+func (m *DownloadManager) Prefetch(packages []string) error {
+	return m.PrefetchParallel(packages, 1)
+}
+
+// PrefetchParallel is like Prefetch, but fetches up to parallelism packages
+// at a time.
+func (m *DownloadManager) PrefetchParallel(packages []string, parallelism int) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	errs := make([]error, len(packages))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, p := range packages {
+		name, version := p, ""
+		if j := strings.Index(p, "@"); j >= 0 {
+			name, version = p[:j], p[j+1:]
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name, version string) {
+			defer wg.Done()
+			_, errs[i] = m.Get(name, version)
+			<-sem
+		}(i, name, version)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", packages[i], err))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("prefetch failed:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// artifact describes where a package version comes from and where it goes.
+type artifact struct {
+	entry      registryEntry
+	name       string
+	version    string
+	sourceURL  string
+	sumURL     string
+	localFile  string
+	extractDir string
+	findBinary func(dir string) (string, error)
+}
+
+func (a artifact) describe() string {
+	return fmt.Sprintf("%s %s: %s", a.name, a.version, a.sourceURL)
+}
+
+func (m *DownloadManager) artifact(packageName, osName, arch, version string) (*artifact, error) {
 	o, ok := registry()[packageName]
 	if !ok {
-		return "", fmt.Errorf("unknown package name %q", packageName)
+		return nil, fmt.Errorf("unknown package name %q", packageName)
 	}
 
 	if version == "" {
 		version = o.version
 	}
 
-	var sumURL bytes.Buffer
-	err := o.from.urlSumTemplate.Execute(&sumURL, struct {
-		Package string
-		Version string
-	}{
-		Package: packageName,
-		Version: version,
-	})
+	o, fetchArch, err := o.forPlatform(osName, arch)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if name, ok := o.from.archNames[fetchArch]; ok {
+		fetchArch = name
 	}
 
-	var sourceURL bytes.Buffer
-	err = o.from.urlTemplate.Execute(&sourceURL, struct {
+	urlVars := struct {
 		Package string
 		Version string
 		OS      string
 		Arch    string
 	}{
-		Package: packageName,
+		Package: o.name,
 		Version: version,
 		OS:      osName,
-		Arch:    arch,
-	})
+		Arch:    fetchArch,
+	}
+	var sumURL bytes.Buffer
+	err = o.from.urlSumTemplate.Execute(&sumURL, urlVars)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var sourceURL bytes.Buffer
+	err = o.from.urlTemplate.Execute(&sourceURL, urlVars)
+	if err != nil {
+		return nil, err
 	}
 
 	sourceURLParsed, err := url.Parse(sourceURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	a := &artifact{
+		entry:     o,
+		name:      packageName,
+		version:   version,
+		sourceURL: m.mirrored(sourceURL.String()),
+		sumURL:    m.mirrored(sumURL.String()),
+		localFile: filepath.Join(m.workDir, packageName, filepath.Base(sourceURLParsed.Path)),
+		// The platform is part of the extract dir so that e.g. linux binaries
+		// for docker can live alongside native darwin ones.
+		extractDir: filepath.Join(m.workDir, packageName, fmt.Sprintf("%s-%s-%s", version, osName, arch)),
+		findBinary: func(dir string) (string, error) {
+			return dldirToBinary(dir, o.name)
+		},
+	}
+	if o.binary != "" {
+		tmpl, err := template.New("binary").Parse(o.binary)
+		if err != nil {
+			return nil, fmt.Errorf("bad binary template: %v", err)
+		}
+		var binary bytes.Buffer
+		if err := tmpl.Execute(&binary, urlVars); err != nil {
+			return nil, err
+		}
+		a.findBinary = func(dir string) (string, error) {
+			return dldirToBinaryPath(dir, binary.String())
+		}
+	}
+	return a, nil
+}
+
+// Fetch fetches the packageName based on its registry entry,
+// if it's not already present on disk with the correct checksum.
+// Then it extracts the archive and finds the binary with the same name as packageName.
+// Returns the absolute path (located under m.workDir) where the binary was found.
+// In offline mode, only previously extracted binaries are returned, and a
+// *MissingError otherwise.
+func (m *DownloadManager) Fetch(packageName, osName, arch, version string) (string, error) {
+	a, err := m.artifact(packageName, osName, arch, version)
 	if err != nil {
 		return "", err
 	}
+	o, version := a.entry, a.version
+	if err := Licensed(packageName, version); err != nil {
+		return "", err
+	}
+	if m.opts.Offline {
+		if binPath, err := a.findBinary(a.extractDir); err == nil {
+			return binPath, nil
+		}
+		return "", &MissingError{Missing: []string{a.describe()}}
+	}
 
-	localPackage := filepath.Join(workdir, packageName, filepath.Base(sourceURLParsed.Path))
+	// Other processes may be fetching the same package into our work dir.
+	unlock, err := lockFile(filepath.Join(m.workDir, packageName, ".lock"))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	localPackage := a.localFile
 	beforeStat, err := os.Stat(localPackage)
 	if err != nil && !os.IsNotExist(err) {
 		return "", err
@@ -270,11 +777,16 @@ func (m *DownloadManager) Fetch(packageName, osName, arch, version string) (stri
 	// First download the package archive file, using a checksum URL to validate
 	// its contents.  This also allows us to skip the download if the file
 	// already exists with the valid checksum.
+	src := a.sourceURL
+	if a.sumURL != "" {
+		src += "?checksum=file:" + a.sumURL
+	}
 	client := &getter.Client{
-		Src:           sourceURL.String() + "?checksum=file:" + sumURL.String(),
+		Src:           src,
 		Dst:           localPackage,
 		Mode:          getter.ClientModeFile,
 		Decompressors: map[string]getter.Decompressor{},
+		Getters:       m.getters,
 	}
 	if err := client.Get(); err != nil {
 		return "", fmt.Errorf("go-getter error: %w", err)
@@ -288,11 +800,11 @@ func (m *DownloadManager) Fetch(packageName, osName, arch, version string) (stri
 	// But we could also allow go-getter to do the work of figuring out how.
 	// Unless of course the archive file is unchanged and we see an existing
 	// extract dir, in which case we do nothing.
-	packageExtract := filepath.Join(workdir, packageName, version)
+	packageExtract := a.extractDir
 	_, err = os.Stat(localPackage)
 	_, err2 := os.Stat(packageExtract)
 	if err == nil && err2 == nil && beforeStat != nil && beforeStat.ModTime().Equal(afterStat.ModTime()) {
-		return dldirToBinary(packageExtract, packageName)
+		return a.findBinary(packageExtract)
 	}
 
 	// If we reached this point we might have re-downloaded something due to a
@@ -307,17 +819,39 @@ func (m *DownloadManager) Fetch(packageName, osName, arch, version string) (stri
 		return "", err
 	}
 
-	client = &getter.Client{
-		Src:  localPackage,
-		Dst:  packageExtractTmp,
-		Mode: getter.ClientModeDir,
+	if o.raw {
+		err = copyExecutable(localPackage, filepath.Join(packageExtractTmp, o.name))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		client = &getter.Client{
+			Src:  localPackage,
+			Dst:  packageExtractTmp,
+			Mode: getter.ClientModeDir,
+		}
+		if err := client.Get(); err != nil {
+			return "", fmt.Errorf("go-getter error: %w", err)
+		}
 	}
-	if err := client.Get(); err != nil {
-		return "", fmt.Errorf("go-getter error: %w", err)
+	if err := os.Rename(packageExtractTmp, packageExtract); err != nil {
+		return "", err
 	}
-	err = os.Rename(packageExtractTmp, packageExtract)
 
-	return dldirToBinary(packageExtract, packageName)
+	return a.findBinary(packageExtract)
+}
+
+// copyExecutable copies the file src to dst, creating dst's parent dir, and
+// makes dst executable.
+func copyExecutable(src, dst string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0755)
 }
 
 // Work upwards through the directory tree starting at the current directory,
@@ -381,7 +915,15 @@ func (m *DownloadManager) buildLocalBin(name, osname, arch string) (string, erro
 	}
 
 	dest := filepath.Join(m.workDir, name)
-	cmd := exec.Command(fqfn, "build", "-o", dest)
+	unlock, err := lockFile(dest + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Build elsewhere and rename so that nobody runs a half-written binary.
+	tmp := dest + ".tmp"
+	cmd := exec.Command(fqfn, "build", "-o", tmp)
 	cmd.Dir = filepath.Join(proot, "cmd", name)
 	for _, e := range os.Environ() {
 		switch {
@@ -403,6 +945,9 @@ func (m *DownloadManager) buildLocalBin(name, osname, arch string) (string, erro
 	if err != nil {
 		return "", err
 	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
 
 	return dest, nil
 }
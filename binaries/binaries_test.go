@@ -1,13 +1,23 @@
 package binaries
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBinaries(t *testing.T) {
-	for name := range registry() {
-		path, err := Default.Get(name)
+	for name, o := range registry() {
+		if err := Licensed(name, o.version); err != nil {
+			t.Logf("skipping %s: %v", name, err)
+			continue
+		}
+		path, err := Default.Get(name, "")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -22,3 +32,215 @@ func TestBinaries(t *testing.T) {
 		}
 	}
 }
+
+func TestGoBuildManager(t *testing.T) {
+	src := t.TempDir()
+	for name, contents := range map[string]string{
+		"go.mod":  "module example.com/hello\n\ngo 1.17\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=yurt", "-c", "user.email=yurt@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if _, err := git(src, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewGoBuildManager(t.TempDir(), map[string]GoSource{"hello": {Dir: src}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := m.Get("hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.Get("hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatalf("expected cached build %s, got %s", first, again)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "main.go"), []byte("package main\n\nfunc main() { println() }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty, err := m.Get("hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty == first {
+		t.Fatalf("expected uncommitted changes to trigger a new build")
+	}
+
+	if _, err := m.Get("consul", ""); err == nil {
+		t.Fatal("expected error for package without source or fallback")
+	}
+}
+
+func TestDownloadManagerOffline(t *testing.T) {
+	m, err := NewDownloadManagerWithOptions(t.TempDir(), DownloadOptions{
+		Mirror:  "https://mirror.example.com/artifacts/",
+		Offline: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Get("consul", "")
+	var missing *MissingError
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected MissingError, got %v", err)
+	}
+	want := "consul 1.11.1: https://mirror.example.com/artifacts/releases.hashicorp.com/consul/1.11.1/consul_1.11.1_" +
+		runtime.GOOS + "_" + runtime.GOARCH + ".zip"
+	if len(missing.Missing) != 1 || missing.Missing[0] != want {
+		t.Fatalf("expected %q, got %v", want, missing.Missing)
+	}
+
+	err = m.CheckCached(map[string]string{"consul": "", "nomad": "1.2.0"})
+	if !errors.As(err, &missing) || len(missing.Missing) != 2 {
+		t.Fatalf("expected 2 missing artifacts, got %v", err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no flock on windows")
+	}
+	path := filepath.Join(t.TempDir(), "pkg", ".lock")
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlock2, err := lockFile(path)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock2()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected second lock to block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected second lock to succeed after unlock")
+	}
+}
+
+func TestPrefetchOffline(t *testing.T) {
+	m, err := NewDownloadManagerWithOptions(t.TempDir(), DownloadOptions{Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Prefetch([]string{"consul", "nomad@1.2.0"})
+	if err == nil || !strings.Contains(err.Error(), "nomad@1.2.0") {
+		t.Fatalf("expected prefetch error mentioning nomad@1.2.0, got %v", err)
+	}
+}
+
+func TestPlatformURLs(t *testing.T) {
+	m, err := NewDownloadManagerWithOptions(t.TempDir(), DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, os, arch, want string
+	}{
+		{"consul", "darwin", "arm64", "https://releases.hashicorp.com/consul/1.11.1/consul_1.11.1_darwin_arm64.zip"},
+		{"consul", "linux", "arm64", "https://releases.hashicorp.com/consul/1.11.1/consul_1.11.1_linux_arm64.zip"},
+		{"prometheus", "darwin", "arm64", "https://github.com/prometheus/prometheus/releases/download/v2.32.1/prometheus-2.32.1.darwin-arm64.tar.gz"},
+		{"prometheus", "linux", "arm", "https://github.com/prometheus/prometheus/releases/download/v2.32.1/prometheus-2.32.1.linux-armv7.tar.gz"},
+		{"grafana", "darwin", "arm64", "https://dl.grafana.com/oss/release/grafana-8.3.3.darwin-amd64.tar.gz"},
+		{"grafana", "linux", "arm64", "https://dl.grafana.com/oss/release/grafana-8.3.3.linux-arm64.tar.gz"},
+	} {
+		a, err := m.artifact(tc.name, tc.os, tc.arch, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.sourceURL != tc.want {
+			t.Errorf("%s %s/%s: expected %s, got %s", tc.name, tc.os, tc.arch, tc.want, a.sourceURL)
+		}
+	}
+
+	amd64, err := m.artifact("consul", "linux", "amd64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64, err := m.artifact("consul", "linux", "arm64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amd64.extractDir == arm64.extractDir {
+		t.Fatalf("expected distinct extract dirs per platform, got %s", amd64.extractDir)
+	}
+}
+
+func TestReleasesOffline(t *testing.T) {
+	m, err := NewDownloadManagerWithOptions(t.TempDir(), DownloadOptions{Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LatestVersion("consul"); err == nil {
+		t.Fatal("expected error listing releases offline")
+	}
+}
+
+func TestSortReleases(t *testing.T) {
+	releases, err := parseGithubReleases([]byte(`[
+		{"tag_name": "v2.31.2"},
+		{"tag_name": "v2.33.0-rc.0", "prerelease": true},
+		{"tag_name": "v2.32.1"},
+		{"tag_name": "v2.34.0", "draft": true},
+		{"tag_name": "v2.32.0-rc.1"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sortReleases(releases)
+	want := []Release{
+		{"2.33.0-rc.0", true},
+		{"2.32.1", false},
+		{"2.32.0-rc.1", true},
+		{"2.31.2", false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestFindChecksum(t *testing.T) {
+	sums := []byte("0123  consul_1.11.1_darwin_amd64.zip\n4567 *consul_1.11.1_linux_amd64.zip\n")
+	if got, err := findChecksum(sums, "consul_1.11.1_linux_amd64.zip"); err != nil || got != "4567" {
+		t.Fatalf("expected 4567, got %q, %v", got, err)
+	}
+	if _, err := findChecksum(sums, "consul_1.11.1_linux_arm64.zip"); err == nil {
+		t.Fatal("expected error for file without checksum")
+	}
+	if got, err := findChecksum([]byte("89ab\n"), "grafana-8.3.3.linux-amd64.tar.gz"); err != nil || got != "89ab" {
+		t.Fatalf("expected 89ab, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,122 @@
+package binaries
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoChecksum is returned by Verify for packages whose vendor doesn't
+// publish checksums.
+var ErrNoChecksum = errors.New("no checksum published")
+
+// Cached returns the path of the binary of packageName if it has already
+// been fetched for osName and arch, and a *MissingError otherwise.  Nothing
+// is downloaded.
+func (m *DownloadManager) Cached(packageName, osName, arch, version string) (string, error) {
+	a, err := m.artifact(packageName, osName, arch, version)
+	if err != nil {
+		return "", err
+	}
+	binPath, err := a.findBinary(a.extractDir)
+	if err != nil {
+		return "", &MissingError{Missing: []string{a.describe()}}
+	}
+	return binPath, nil
+}
+
+// Verify checks the previously downloaded archive of packageName against
+// the SHA256 checksums published by its vendor, returning its hex SHA256
+// digest.  The digest is returned even if verification fails, as long as the
+// archive could be read.  Packages without published checksums yield
+// ErrNoChecksum.  The checksums are always fetched, so Verify fails when
+// offline.
+func (m *DownloadManager) Verify(packageName, osName, arch, version string) (string, error) {
+	a, err := m.artifact(packageName, osName, arch, version)
+	if err != nil {
+		return "", err
+	}
+	digest, err := fileSHA256(a.localFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", &MissingError{Missing: []string{a.describe()}}
+		}
+		return "", err
+	}
+	if a.sumURL == "" {
+		return digest, fmt.Errorf("can't verify %s %s: %w", a.name, a.version, ErrNoChecksum)
+	}
+	if m.opts.Offline {
+		return digest, fmt.Errorf("can't fetch checksums for %s %s when offline", a.name, a.version)
+	}
+
+	resp, err := m.client.Get(a.sumURL)
+	if err != nil {
+		return digest, err
+	}
+	defer resp.Body.Close()
+	sums, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return digest, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return digest, fmt.Errorf("error fetching checksums from %s: %s", a.sumURL, resp.Status)
+	}
+
+	want, err := findChecksum(sums, filepath.Base(a.localFile))
+	if err != nil {
+		return digest, fmt.Errorf("error reading checksums from %s: %w", a.sumURL, err)
+	}
+	if !strings.EqualFold(want, digest) {
+		return digest, fmt.Errorf("checksum mismatch for %s: got %s, %s says %s", a.localFile, digest, a.sumURL, want)
+	}
+	return digest, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findChecksum returns the checksum of fileName from sums, in the format
+// written by sha256sum.  A file holding a lone checksum, as some vendors
+// publish per artifact, is also accepted.
+func findChecksum(sums []byte, fileName string) (string, error) {
+	var lines [][]string
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if len(lines) == 1 && len(lines[0]) == 1 {
+		return lines[0][0], nil
+	}
+	for _, fields := range lines {
+		// sha256sum marks files read in binary mode with a leading "*".
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", fileName)
+}
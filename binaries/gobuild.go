@@ -0,0 +1,198 @@
+package binaries
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// GoSource says where GoBuildManager should build a package from.  Either
+// Dir or Module must be given.
+type GoSource struct {
+	// Dir is a local checkout, e.g. ~/src/consul.  Uncommitted changes to
+	// tracked files are included in the build.
+	Dir string
+	// Module is a module path, e.g. github.com/hashicorp/consul, which is
+	// cloned over https into the manager's work dir.
+	Module string
+	// Ref is the branch, tag or commit of Module to build, default the
+	// remote's HEAD.  A version passed to Get overrides it.
+	Ref string
+	// Pkg is the package to build relative to the module root, default ".".
+	Pkg string
+	// Tags are passed to go build -tags.
+	Tags []string
+}
+
+// GoBuildManager is a Manager that builds some packages from source with
+// go build, e.g. to run clusters using work-in-progress consul, nomad or
+// vault binaries, and gets the rest from another Manager.  Builds are cached
+// in the work dir keyed on the commit, so an unchanged checkout is only
+// built once.
+type GoBuildManager struct {
+	l        sync.Mutex
+	workDir  string
+	sources  map[string]GoSource
+	fallback Manager
+}
+
+var _ Manager = &GoBuildManager{}
+
+// NewGoBuildManager returns a manager that builds the packages in sources,
+// keyed by package name, and gets any others from fallback, which may be nil.
+func NewGoBuildManager(workDir string, sources map[string]GoSource, fallback Manager) (*GoBuildManager, error) {
+	for name, src := range sources {
+		if (src.Dir == "") == (src.Module == "") {
+			return nil, fmt.Errorf("source for %s must have exactly one of Dir and Module", name)
+		}
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, err
+	}
+	return &GoBuildManager{
+		workDir:  workDir,
+		sources:  sources,
+		fallback: fallback,
+	}, nil
+}
+
+func (m *GoBuildManager) Get(packageName, version string) (string, error) {
+	return m.GetOSArch(packageName, runtime.GOOS, runtime.GOARCH, version)
+}
+
+func (m *GoBuildManager) GetOSArch(packageName, osName, arch, version string) (string, error) {
+	src, ok := m.sources[packageName]
+	if !ok {
+		if m.fallback == nil {
+			return "", fmt.Errorf("no source for package %q", packageName)
+		}
+		return m.fallback.GetOSArch(packageName, osName, arch, version)
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	dir := src.Dir
+	if dir == "" {
+		ref := src.Ref
+		if version != "" {
+			ref = version
+		}
+		var err error
+		dir, err = m.checkout(packageName, src.Module, ref)
+		if err != nil {
+			return "", err
+		}
+	} else if version != "" {
+		return "", fmt.Errorf("can't select version %s of %s built from %s", version, packageName, dir)
+	}
+
+	key, err := sourceKey(dir)
+	if err != nil {
+		return "", err
+	}
+	binPath := filepath.Join(m.workDir, packageName, fmt.Sprintf("%s-%s-%s", key, osName, arch), packageName)
+	if fi, err := os.Stat(binPath); err == nil && fi.Mode().IsRegular() {
+		return binPath, nil
+	}
+
+	pkg := src.Pkg
+	if pkg == "" {
+		pkg = "."
+	}
+	args := []string{"build", "-o", binPath}
+	if len(src.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(src.Tags, ","))
+	}
+	args = append(args, pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(goEnv(), "GOOS="+osName, "GOARCH="+arch)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Print("running command:", cmd)
+	if err := cmd.Run(); err != nil {
+		// Don't leave a partial binary to be mistaken for a cached one.
+		_ = os.Remove(binPath)
+		return "", fmt.Errorf("error building %s from %s: %w", packageName, dir, err)
+	}
+	return binPath, nil
+}
+
+// checkout clones module into the work dir if needed, and checks out ref,
+// returning the dir of the checkout.
+func (m *GoBuildManager) checkout(packageName, module, ref string) (string, error) {
+	dir := filepath.Join(m.workDir, packageName, "src")
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := git("", "clone", "--filter=blob:none", "https://"+module, dir); err != nil {
+			return "", err
+		}
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := git(dir, "fetch", "origin", ref); err != nil {
+		return "", err
+	}
+	if _, err := git(dir, "checkout", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// sourceKey returns a key identifying the source in the checkout dir: the
+// commit, plus a hash of the uncommitted changes if there are any.
+func sourceKey(dir string) (string, error) {
+	commit, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	status, err := git(dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return "", err
+	}
+	if status == "" {
+		return commit, nil
+	}
+	diff, err := git(dir, "diff", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(diff))
+	return fmt.Sprintf("%s-dirty-%x", commit, sum[:6]), nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// goEnv returns the environment minus the settings that would interfere
+// with building a module for a given OS and arch.
+func goEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		switch {
+		case strings.HasPrefix(e, "GOOS="):
+		case strings.HasPrefix(e, "GOARCH="):
+		case strings.HasPrefix(e, "GOFLAGS="):
+		default:
+			env = append(env, e)
+		}
+	}
+	return env
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package binaries
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFile only creates path on Windows, where there's no flock: sharing a
+// work dir between processes isn't safe there.
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
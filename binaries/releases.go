@@ -0,0 +1,186 @@
+package binaries
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/go-version"
+)
+
+const hashicorpReleasesURLTemplate = "https://api.releases.hashicorp.com/v1/releases/{{ .Package }}?limit=20{{ if .Enterprise }}&license_class=enterprise{{ end }}"
+const githubReleasesURLTemplate = "https://api.github.com/repos/{{ .Owner }}/{{ .Package }}/releases?per_page=50"
+
+// Release is a published version of a package.
+type Release struct {
+	Version    string
+	Prerelease bool
+}
+
+// releaseLister knows how to ask upstream which versions of a package exist.
+type releaseLister struct {
+	urlTemplate *template.Template
+	// owner is the GitHub user or organisation publishing the packages.
+	owner string
+	parse func([]byte) ([]Release, error)
+}
+
+func newReleaseLister(urlTemplate, owner string, parse func([]byte) ([]Release, error)) (*releaseLister, error) {
+	tmpl, err := template.New("releases").Parse(urlTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("bad releases URL template: %v", err)
+	}
+	return &releaseLister{urlTemplate: tmpl, owner: owner, parse: parse}, nil
+}
+
+func parseHashicorpReleases(b []byte) ([]Release, error) {
+	var releases []struct {
+		Version      string `json:"version"`
+		IsPrerelease bool   `json:"is_prerelease"`
+	}
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return nil, err
+	}
+	var ret []Release
+	for _, r := range releases {
+		ret = append(ret, Release{Version: r.Version, Prerelease: r.IsPrerelease})
+	}
+	return ret, nil
+}
+
+func parseGithubReleases(b []byte) ([]Release, error) {
+	var releases []struct {
+		TagName    string `json:"tag_name"`
+		Prerelease bool   `json:"prerelease"`
+		Draft      bool   `json:"draft"`
+	}
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return nil, err
+	}
+	var ret []Release
+	for _, r := range releases {
+		if r.Draft {
+			continue
+		}
+		ret = append(ret, Release{Version: strings.TrimPrefix(r.TagName, "v"), Prerelease: r.Prerelease})
+	}
+	return ret, nil
+}
+
+// Releases returns the versions of packageName published upstream, newest
+// first.  Only recent releases are included.
+func (m *DownloadManager) Releases(packageName string) ([]Release, error) {
+	if m.opts.Offline {
+		return nil, fmt.Errorf("can't list releases of %s when offline", packageName)
+	}
+	o, ok := registry()[packageName]
+	if !ok {
+		return nil, fmt.Errorf("unknown package name %q", packageName)
+	}
+	lister := o.from.releases
+	if lister == nil {
+		return nil, fmt.Errorf("listing releases of %s isn't supported", packageName)
+	}
+
+	var u bytes.Buffer
+	err := lister.urlTemplate.Execute(&u, struct {
+		Package    string
+		Owner      string
+		Enterprise bool
+	}{
+		Package:    o.name,
+		Owner:      lister.owner,
+		Enterprise: len(o.license) > 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing releases of %s from %s: %s", packageName, u.String(), resp.Status)
+	}
+	releases, err := lister.parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing releases of %s: %w", packageName, err)
+	}
+	return sortReleases(releases), nil
+}
+
+// sortReleases returns releases ordered newest first, omitting any whose
+// version can't be parsed.  Upstream order isn't reliable, e.g. GitHub orders
+// by creation, so a patch release of an old minor version can come first.
+// Versions with a prerelease suffix like "-rc1" are marked as prereleases.
+func sortReleases(releases []Release) []Release {
+	type parsed struct {
+		Release
+		v *version.Version
+	}
+	var ps []parsed
+	for _, r := range releases {
+		v, err := version.NewVersion(r.Version)
+		if err != nil {
+			continue
+		}
+		ps = append(ps, parsed{Release{r.Version, r.Prerelease || v.Prerelease() != ""}, v})
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i].v.GreaterThan(ps[j].v)
+	})
+	var ret []Release
+	for _, p := range ps {
+		ret = append(ret, p.Release)
+	}
+	return ret
+}
+
+// LatestVersion returns the newest stable version of packageName published
+// upstream.  It's recorded in the work dir, see CachedLatestVersion.
+func (m *DownloadManager) LatestVersion(packageName string) (string, error) {
+	releases, err := m.Releases(packageName)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range releases {
+		if r.Prerelease {
+			continue
+		}
+		path := m.latestFile(packageName)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path, []byte(r.Version+"\n"), 0644); err != nil {
+			return "", err
+		}
+		return r.Version, nil
+	}
+	return "", fmt.Errorf("no stable releases of %s found", packageName)
+}
+
+// CachedLatestVersion returns the version most recently found by
+// LatestVersion, without going online.
+func (m *DownloadManager) CachedLatestVersion(packageName string) (string, error) {
+	b, err := ioutil.ReadFile(m.latestFile(packageName))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (m *DownloadManager) latestFile(packageName string) string {
+	return filepath.Join(m.workDir, packageName, "latest")
+}
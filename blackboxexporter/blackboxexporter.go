@@ -0,0 +1,162 @@
+package blackboxexporter
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/prometheus/common/model"
+)
+
+type Ports struct {
+	HTTP int
+}
+
+var PortNames = struct {
+	HTTP string
+}{
+	"http",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP: 9115,
+	}
+}
+
+func (c Ports) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "blackbox",
+		NameOrder: []string{
+			PortNames.HTTP,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// Descriptor describes blackbox_exporter for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "blackbox_exporter",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"agent"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/metrics"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/-/healthy"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// ModuleHTTP2xx is the module that probes an HTTP(S) URL, succeeding if it
+// returns a 2xx status.  Server certificates aren't verified, since the
+// exporter doesn't know which CA each probed cluster uses; we're measuring
+// availability and latency, not testing TLS.
+const ModuleHTTP2xx = "http_2xx"
+
+// Config describes how to run blackbox_exporter, which probes endpoints on
+// behalf of Prometheus.
+type Config struct {
+	Common runner.Config
+}
+
+func (c Config) Config() runner.Config {
+	return c.Common
+}
+
+func (c Config) Name() string {
+	return "blackbox_exporter"
+}
+
+func NewConfig() Config {
+	return Config{
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (c Config) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func (c Config) Args() []string {
+	port := c.Common.Ports.ByName[PortNames.HTTP].Number
+	addr := "127.0.0.1"
+	if c.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	return []string{
+		fmt.Sprintf("--config.file=%s/blackbox.yml", c.Common.ConfigDir),
+		fmt.Sprintf("--web.listen-address=%s:%d", addr, port),
+	}
+}
+
+func (c Config) Env() []string {
+	return nil
+}
+
+func (c Config) Files() map[string]string {
+	return map[string]string{
+		"blackbox.yml": fmt.Sprintf(`
+modules:
+  %s:
+    prober: http
+    timeout: 5s
+    http:
+      preferred_ip_protocol: ip4
+      tls_config:
+        insecure_skip_verify: true
+`, ModuleHTTP2xx),
+	}
+}
+
+// ProbeScrapeConfig returns a Prometheus job that has the blackbox_exporter
+// at exporterAddr (host:port) probe each of the job's targets using module.
+// Targets are URLs, e.g. as returned by ProbeTarget, and become the instance
+// label of the resulting probe_* metrics.
+func ProbeScrapeConfig(job, module, exporterAddr string) prometheus.ScrapeConfig {
+	return prometheus.ScrapeConfig{
+		JobName:     job,
+		MetricsPath: "/probe",
+		Params:      url.Values{"module": []string{module}},
+		RelabelConfigs: []prometheus.RelabelConfig{
+			{
+				Action:       prometheus.Replace,
+				SourceLabels: model.LabelNames{model.AddressLabel},
+				TargetLabel:  model.ParamLabelPrefix + "target",
+			},
+			{
+				Action:       prometheus.Replace,
+				SourceLabels: model.LabelNames{model.ParamLabelPrefix + "target"},
+				TargetLabel:  model.InstanceLabel,
+			},
+			{
+				Action:      prometheus.Replace,
+				TargetLabel: model.AddressLabel,
+				Replacement: exporterAddr,
+			},
+		},
+	}
+}
+
+// ProbeTarget returns the URL to probe for the given endpoint of node.
+func ProbeTarget(node yurt.Node, scheme string, ep yurt.Endpoint) (string, error) {
+	addr, err := node.Address(ep.Port)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     addr,
+		Path:     ep.Path,
+		RawQuery: ep.Params.Encode(),
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,210 @@
+// chaos injects faults into the nodes of yurt envs, so that tests can
+// exercise how clusters behave when things go wrong.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	dockerapi "github.com/docker/docker/client"
+	"github.com/ncabatoff/yurt/docker"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// fillName is the name of the file written to fill a data dir.
+const fillName = "yurt-fill"
+
+// DiskLimit is a fixed-size filesystem mounted over a dir.
+type DiskLimit struct {
+	Dir string
+	// Image is the file backing the filesystem.
+	Image string
+	Size  int64
+}
+
+// LimitDir mounts a new ext4 filesystem of size bytes at dir, backed by a
+// loopback image file alongside it, so that whatever writes to dir runs out
+// of space once it's full.  Any existing contents of dir are copied into the
+// new filesystem.  It's only supported on Linux, and needs root, or at least
+// permission to run mkfs.ext4, mount and umount.
+func LimitDir(dir string, size int64) (*DiskLimit, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("limiting dir size is only supported on linux")
+	}
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	image := dir + ".img"
+	f, err := os.OpenFile(image, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// On failure, put dir back the way we found it and remove the image.
+	var orig string
+	mounted := false
+	fail := func(err error) (*DiskLimit, error) {
+		if mounted {
+			_ = run("umount", "-l", dir)
+		}
+		if orig != "" {
+			_ = os.Remove(dir)
+			_ = os.Rename(orig, dir)
+		}
+		_ = os.Remove(image)
+		return nil, err
+	}
+
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := run("mkfs.ext4", "-q", "-F", "-m", "0", image); err != nil {
+		return fail(err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fail(err)
+	}
+	if len(entries) > 0 {
+		_ = os.RemoveAll(dir + ".orig")
+		if err := os.Rename(dir, dir+".orig"); err != nil {
+			return fail(err)
+		}
+		orig = dir + ".orig"
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return fail(err)
+		}
+	}
+	if err := run("mount", "-o", "loop", image, dir); err != nil {
+		return fail(err)
+	}
+	mounted = true
+	if orig != "" {
+		if err := run("cp", "-a", orig+"/.", dir); err != nil {
+			return fail(err)
+		}
+		_ = os.RemoveAll(orig)
+	}
+	l := &DiskLimit{Dir: dir, Image: image, Size: size}
+	return l, nil
+}
+
+// Release unmounts the filesystem and removes its image.  The unmount is
+// lazy, so it succeeds even if a process still has files open in Dir.
+func (l *DiskLimit) Release() error {
+	if err := run("umount", "-l", l.Dir); err != nil {
+		return err
+	}
+	return os.Remove(l.Image)
+}
+
+func run(name string, args ...string) error {
+	out, err := osexec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// Fill is a file written to use up the free space of a dir.
+type Fill struct {
+	// Path is the path of the file, within the container for docker nodes.
+	Path   string
+	remove func() error
+}
+
+// Release removes the file, relieving the disk pressure.
+func (f *Fill) Release() error {
+	return f.remove()
+}
+
+// FillDir writes a file in dir until the filesystem it's on is full, then
+// shrinks it to leave roughly leave bytes free.  Only use it on a size-limited
+// dir, e.g. one returned by LimitDir, lest it fill the host's disk.
+func FillDir(dir string, leave int64) (*Fill, error) {
+	path := filepath.Join(dir, fillName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fill := &Fill{Path: path, remove: func() error { return os.Remove(path) }}
+
+	buf := make([]byte, 1<<20)
+	var size int64
+	for {
+		n, err := f.Write(buf)
+		size += int64(n)
+		if errors.Is(err, syscall.ENOSPC) {
+			break
+		}
+		if err != nil {
+			_ = f.Close()
+			_ = fill.Release()
+			return nil, err
+		}
+	}
+	if leave > size {
+		leave = size
+	}
+	if err := f.Truncate(size - leave); err != nil {
+		_ = f.Close()
+		_ = fill.Release()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		_ = fill.Release()
+		return nil, err
+	}
+	return fill, nil
+}
+
+// FillDataDir fills the data dir of the node run by h, leaving roughly leave
+// bytes free, so that the node runs out of disk.  It supports nodes run by an
+// ExecEnv, whose data dir should have been limited using LimitDir, e.g. via
+// ExecEnv.DataDirLimits, and nodes run by a DockerEnv, whose data dir should
+// be a size-limited tmpfs, e.g. via DockerEnv.DataDirLimits.  cli is the
+// docker client of the DockerEnv, and may be nil for exec nodes.
+func FillDataDir(ctx context.Context, cli *dockerapi.Client, h runner.Harness, leave int64) (*Fill, error) {
+	dh, ok := h.(interface{ DataDir() string })
+	if !ok {
+		return nil, fmt.Errorf("harness %T doesn't expose its data dir", h)
+	}
+	ch, ok := h.(interface{ ContainerID() string })
+	if !ok {
+		return FillDir(dh.DataDir(), leave)
+	}
+	if cli == nil {
+		return nil, fmt.Errorf("filling the data dir of a container requires a docker client")
+	}
+
+	// The path is within the container, so always use forward slashes.
+	path := strings.TrimSuffix(dh.DataDir(), "/") + "/" + fillName
+	// dd fails once the disk is full, which is what we want.
+	script := fmt.Sprintf(`dd if=/dev/zero of=%[1]s bs=65536 2>/dev/null
+sz=$(stat -c %%s %[1]s)
+if [ "$sz" -gt %[2]d ]; then truncate -s $((sz - %[2]d)) %[1]s; else truncate -s 0 %[1]s; fi`, path, leave)
+	if _, err := docker.Exec(ctx, cli, ch.ContainerID(), []string{"/bin/sh", "-c", script}); err != nil {
+		return nil, err
+	}
+	return &Fill{
+		Path: path,
+		remove: func() error {
+			_, err := docker.Exec(context.Background(), cli, ch.ContainerID(), []string{"rm", "-f", path})
+			return err
+		},
+	}, nil
+}
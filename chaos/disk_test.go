@@ -0,0 +1,131 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// tmpfs mounts a tmpfs of size bytes in a temp dir, skipping the test if
+// that's not possible, e.g. because we're not root.
+func tmpfs(t *testing.T, size string) string {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("tmpfs is only supported on linux")
+	}
+	dir := t.TempDir()
+	if err := run("mount", "-t", "tmpfs", "-o", "size="+size, "tmpfs", dir); err != nil {
+		t.Skipf("can't mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := run("umount", dir); err != nil {
+			t.Error(err)
+		}
+	})
+	return dir
+}
+
+func TestFillDir(t *testing.T) {
+	dir := tmpfs(t, "4m")
+	fill, err := FillDir(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	// Allow for the odd block or two of overhead.
+	if free := int64(st.Bavail) * st.Bsize; free < 1<<20-64<<10 || free > 1<<20+64<<10 {
+		t.Fatalf("expected about 1MB free, got %d", free)
+	}
+	if err := fill.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fill.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected fill file to be removed, got %v", err)
+	}
+}
+
+// dataDirHarness is a harness for a node whose data dir is dir.
+type dataDirHarness struct {
+	runner.Harness
+	dir string
+}
+
+func (h dataDirHarness) DataDir() string {
+	return h.dir
+}
+
+// TestOutOfDisk verifies that once a data dir is filled, writes to it fail
+// with ENOSPC until the fill is released.
+func TestOutOfDisk(t *testing.T) {
+	dir := tmpfs(t, "4m")
+	path := filepath.Join(dir, "raft.db")
+	data := make([]byte, 256<<10)
+
+	fill, err := FillDataDir(context.Background(), nil, dataDirHarness{dir: dir}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected write to a full data dir to fail with ENOSPC, got %v", err)
+	}
+
+	if err := fill.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("expected write to succeed once the fill is released, got %v", err)
+	}
+
+	if _, err := FillDataDir(context.Background(), nil, struct{ runner.Harness }{}, 0); err == nil {
+		t.Fatal("expected error filling the data dir of a harness without one")
+	}
+}
+
+func TestLimitDir(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("limiting dirs requires root on linux")
+	}
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LimitDir(dir, 8<<20)
+	if err != nil {
+		t.Skipf("can't limit dir: %v", err)
+	}
+	defer func() {
+		if err := l.Release(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "existing")); err != nil || string(b) != "keep" {
+		t.Fatalf("expected existing contents to be copied into the limited dir, got %q, %v", b, err)
+	}
+	fill, err := FillDir(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fill.Release()
+	fi, err := os.Stat(fill.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 8<<20 {
+		t.Fatalf("expected no more than 8MB to fit in the limited dir, wrote %d", fi.Size())
+	}
+}
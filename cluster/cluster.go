@@ -1,8 +1,11 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -10,7 +13,10 @@ import (
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/ncabatoff/yurt"
 	"github.com/ncabatoff/yurt/consul"
+	consuldns "github.com/ncabatoff/yurt/consul/dns"
+	"github.com/ncabatoff/yurt/events"
 	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/nomadautoscaler"
 	"github.com/ncabatoff/yurt/pki"
 	"github.com/ncabatoff/yurt/runenv"
 	"github.com/ncabatoff/yurt/runner"
@@ -30,13 +36,137 @@ func (c ConsulCertificateMaker) MakeCertificate(ctx context.Context, hostname, i
 	return c.ca.ConsulServerTLS(ctx, ip, c.ttl)
 }
 
+type NomadCertificateMaker struct {
+	ca  *pki.CertificateAuthority
+	ttl string
+}
+
+var _ yurt.CertificateMaker = &NomadCertificateMaker{}
+
+func (c NomadCertificateMaker) MakeCertificate(ctx context.Context, hostname, ip string) (*pki.TLSConfigPEM, error) {
+	return c.ca.NomadServerTLS(ctx, ip, c.ttl)
+}
+
+type VaultCertificateMaker struct {
+	ca  *pki.CertificateAuthority
+	ttl string
+}
+
+var _ yurt.CertificateMaker = &VaultCertificateMaker{}
+
+func (c VaultCertificateMaker) MakeCertificate(ctx context.Context, hostname, ip string) (*pki.TLSConfigPEM, error) {
+	return c.ca.VaultServerTLS(ctx, ip, c.ttl)
+}
+
+// NewCertificateMakers returns CertificateMakers for the "consul", "nomad"
+// and "vault" service kinds that issue certs from ca with the given TTL.
+// Replace or add entries to customize issuance for some services only.
+func NewCertificateMakers(ca *pki.CertificateAuthority, ttl string) yurt.CertificateMakers {
+	return yurt.CertificateMakers{
+		"consul": ConsulCertificateMaker{ca: ca, ttl: ttl},
+		"nomad":  NomadCertificateMaker{ca: ca, ttl: ttl},
+		"vault":  VaultCertificateMaker{ca: ca, ttl: ttl},
+	}
+}
+
+// serverTLS returns the cert for node, a server or agent of the given kind,
+// made by the maker for kind in certs if there is one, otherwise by ca.  It
+// returns nil if neither is given, i.e. TLS isn't used.
+func serverTLS(ctx context.Context, certs yurt.CertificateMakers, ca *pki.CertificateAuthority, kind string, node yurt.Node) (*pki.TLSConfigPEM, error) {
+	if certs[kind] != nil {
+		return certs.MakeCertificate(ctx, kind, node)
+	}
+	if ca == nil {
+		return nil, nil
+	}
+	switch kind {
+	case "consul":
+		return ca.ConsulServerTLS(ctx, "", "1h")
+	case "nomad":
+		return ca.NomadServerTLS(ctx, "", "1h")
+	case "vault":
+		return ca.VaultServerTLS(ctx, "", "1h")
+	}
+	return nil, fmt.Errorf("no certificate maker for %s", kind)
+}
+
+// ConnectCertificateMaker makes Connect leaf certificates for services, see
+// ConsulCluster.ConnectCertificateMaker.
+type ConnectCertificateMaker struct {
+	ca          *pki.CertificateAuthority
+	trustDomain string
+	datacenter  string
+	ttl         string
+}
+
+var _ yurt.CertificateMaker = &ConnectCertificateMaker{}
+
+// MakeCertificate returns a Connect leaf certificate for the service named
+// hostname.  The ip is ignored: Connect identifies services by SPIFFE ID.
+func (c ConnectCertificateMaker) MakeCertificate(ctx context.Context, hostname, ip string) (*pki.TLSConfigPEM, error) {
+	return c.ca.ConnectLeafTLS(ctx, c.SPIFFEID(hostname), c.ttl)
+}
+
+// SPIFFEID returns the ID certs made for service will have.
+func (c ConnectCertificateMaker) SPIFFEID(service string) pki.SPIFFEID {
+	return pki.SPIFFEID{
+		TrustDomain: c.trustDomain,
+		Datacenter:  c.datacenter,
+		Service:     service,
+	}
+}
+
 // NewConsulCluster creates a Consul cluster in the given env.  If ca is given,
 // it will be used to create certificates; otherwise, the cluster won't use TLS.
 func NewConsulCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string, nodeCount int) (*ConsulCluster, error) {
-	cluster := ConsulCluster{group: &errgroup.Group{}}
+	return NewConsulClusterWithOptions(ctx, e, ConsulClusterOptions{
+		Name:      name,
+		NodeCount: nodeCount,
+		CA:        ca,
+	})
+}
+
+// ConsulClusterOptions describes the Consul cluster to create.
+type ConsulClusterOptions struct {
+	Name      string
+	NodeCount int
+	// CA, if given, is used to create certificates; otherwise the cluster
+	// won't use TLS.
+	CA *pki.CertificateAuthority
+	// Autopilot, if given, configures autopilot on the servers.
+	Autopilot *consul.AutopilotConfig
+	// MutualTLS makes the servers' HTTPS listeners require API clients to
+	// present a certificate issued by CA.  Clients obtained from the
+	// cluster's harnesses will do so.
+	MutualTLS bool
+	// Certs, if it has a "consul" entry, is used instead of CA to make the
+	// certificates of the cluster's servers and client agents.
+	Certs yurt.CertificateMakers
+	// Versions, if it has a "consul" entry, gives the version the servers
+	// run, see runenv.WithVersions.  Client agents use the version of the
+	// env passed to ClientAgent, so they may differ from the servers.
+	Versions map[string]string
+}
+
+// NewConsulClusterWithOptions creates a Consul cluster in the given env as
+// described by opts.
+func NewConsulClusterWithOptions(ctx context.Context, e runenv.Env, opts ConsulClusterOptions) (*ConsulCluster, error) {
+	ca := opts.CA
+	e = runenv.WithVersions(e, opts.Versions)
+	cluster := ConsulCluster{group: &errgroup.Group{}, name: opts.Name, autopilot: opts.Autopilot, certs: opts.Certs, versions: opts.Versions}
+	if opts.MutualTLS {
+		if ca == nil {
+			return nil, fmt.Errorf("mutual TLS requires a CA")
+		}
+		var err error
+		cluster.clientTLS, err = ca.ConsulClientTLS(ctx, "1h")
+		if err != nil {
+			return nil, err
+		}
+	}
 	var nodes []yurt.Node
-	for i := 0; i < nodeCount; i++ {
-		node, err := e.AllocNode(name+"-consul-srv", consul.DefPorts().RunnerPorts())
+	for i := 0; i < opts.NodeCount; i++ {
+		node, err := e.AllocNode(opts.Name+"-consul-srv", consul.DefPorts().RunnerPorts())
 		if err != nil {
 			return nil, err
 		}
@@ -56,16 +186,14 @@ func NewConsulCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuth
 	}
 
 	for _, node := range nodes {
-		var tls *pki.TLSConfigPEM
-		if ca != nil {
-			var err error
-			tls, err = ca.ConsulServerTLS(ctx, "", "1h")
-			if err != nil {
-				return nil, err
-			}
+		tls, err := serverTLS(ctx, cluster.certs, ca, "consul", node)
+		if err != nil {
+			return nil, err
+		}
+		if tls != nil {
 			cluster.tls.CA = tls.CA
 		}
-		cfg := consul.NewConfig(true, cluster.joinAddrs, tls)
+		cfg := consul.NewConfig(true, cluster.joinAddrs, tls).WithAutopilot(opts.Autopilot).WithClientTLS(cluster.clientTLS)
 		h, err := e.Run(ctx, cfg, node)
 		if err != nil {
 			return nil, err
@@ -77,38 +205,354 @@ func NewConsulCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuth
 	if err := consul.LeadersHealthy(ctx, cluster.servers, cluster.peerAddrs); err != nil {
 		return nil, err
 	}
+	runenv.EventBus(e).Publish(events.Event{Kind: events.LeaderElected, Cluster: opts.Name + "-consul"})
 
+	cluster.nodes = nodes
 	return &cluster, nil
 }
 
 type ConsulCluster struct {
+	name      string
+	autopilot *consul.AutopilotConfig
+	nodes     []yurt.Node
 	servers   []runner.Harness
 	group     *errgroup.Group
 	joinAddrs []string
 	peerAddrs []string
 	tls       pki.TLSConfigPEM
+	clientTLS *pki.TLSConfigPEM
+	certs     yurt.CertificateMakers
+	versions  map[string]string
 }
 
 func (c *ConsulCluster) PeerAddrs() []string {
 	return append([]string{}, c.peerAddrs...)
 }
 
+// Servers returns the harnesses of the server nodes, in the same order as Nodes.
+func (c *ConsulCluster) Servers() []runner.Harness {
+	return append([]runner.Harness{}, c.servers...)
+}
+
+// Nodes returns the server nodes, in the same order as Servers.
+func (c *ConsulCluster) Nodes() []yurt.Node {
+	return append([]yurt.Node{}, c.nodes...)
+}
+
 func (c *ConsulCluster) ClientAgent(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string) (runner.Harness, error) {
-	var tls *pki.TLSConfigPEM
-	if ca != nil {
-		var err error
-		tls, err = ca.ConsulServerTLS(ctx, "", "1h")
-		if err != nil {
-			return nil, err
-		}
-	}
 	n, err := e.AllocNode(name, consul.DefPorts().RunnerPorts())
 	if err != nil {
 		return nil, err
 	}
+	tls, err := serverTLS(ctx, c.certs, ca, "consul", n)
+	if err != nil {
+		return nil, err
+	}
 	return e.Run(ctx, consul.NewConfig(false, c.joinAddrs, tls), n)
 }
 
+// ConsulGateway is a Connect gateway along with the Consul client agent it
+// registers with.
+type ConsulGateway struct {
+	Kind           consul.GatewayKind
+	AgentHarness   runner.Harness
+	GatewayHarness runner.Harness
+}
+
+// Gateway launches a Consul client agent joined to the cluster, and a gateway
+// of the given kind registered with that agent as service.  envoyBinary is
+// the path to envoy, e.g. as returned by binaries.Default.Get("envoy", ""); if
+// empty envoy must be in $PATH.
+func (c *ConsulCluster) Gateway(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, kind consul.GatewayKind, service, envoyBinary string) (*ConsulGateway, error) {
+	agent, err := c.ClientAgent(ctx, e, ca, service+"-consul-cli")
+	if err != nil {
+		return nil, err
+	}
+	httpAddr, err := agent.Endpoint(consul.PortNames.HTTP, false)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	grpcAddr, err := agent.Endpoint(consul.PortNames.GRPC, false)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	if err := consul.LeadersHealthy(ctx, []runner.Harness{agent}, c.peerAddrs); err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+
+	cfg := consul.NewGatewayConfig(kind, service, httpAddr.Address.Host, grpcAddr.Address.Host, envoyBinary)
+	cfg.Common.TLS.CA = c.tls.CA
+	n, err := e.AllocNode(service, consul.DefGatewayPorts().RunnerPorts())
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	gw, err := e.Run(ctx, cfg, n)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	return &ConsulGateway{
+		Kind:           kind,
+		AgentHarness:   agent,
+		GatewayHarness: gw,
+	}, nil
+}
+
+func (g *ConsulGateway) Stop() {
+	_ = g.GatewayHarness.Stop()
+	_ = g.AgentHarness.Stop()
+}
+
+func (g *ConsulGateway) Kill() {
+	g.GatewayHarness.Kill()
+	g.AgentHarness.Kill()
+}
+
+func (g *ConsulGateway) Wait() error {
+	var eg errgroup.Group
+	eg.Go(g.GatewayHarness.Wait)
+	eg.Go(g.AgentHarness.Wait)
+	return eg.Wait()
+}
+
+// ConsulSidecar is a Connect sidecar proxy along with the Consul client agent
+// it gets its certs from.
+type ConsulSidecar struct {
+	Service      string
+	AgentHarness runner.Harness
+	ProxyHarness runner.Harness
+}
+
+// Sidecar launches a Consul client agent joined to the cluster, and Consul's
+// built-in Connect proxy as the sidecar of service, forwarding the mTLS
+// connections it accepts to serviceAddr.
+func (c *ConsulCluster) Sidecar(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, service, serviceAddr string) (*ConsulSidecar, error) {
+	agent, err := c.ClientAgent(ctx, e, ca, service+"-consul-cli")
+	if err != nil {
+		return nil, err
+	}
+	httpAddr, err := agent.Endpoint(consul.PortNames.HTTP, false)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	if err := consul.LeadersHealthy(ctx, []runner.Harness{agent}, c.peerAddrs); err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+
+	cfg := consul.NewProxyConfig(service, serviceAddr, httpAddr.Address.Host)
+	cfg.Common.TLS.CA = c.tls.CA
+	n, err := e.AllocNode(service+"-sidecar", cfg.Common.Ports)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	proxy, err := e.Run(ctx, cfg, n)
+	if err != nil {
+		_ = agent.Stop()
+		return nil, err
+	}
+	return &ConsulSidecar{
+		Service:      service,
+		AgentHarness: agent,
+		ProxyHarness: proxy,
+	}, nil
+}
+
+func (s *ConsulSidecar) Stop() {
+	_ = s.ProxyHarness.Stop()
+	_ = s.AgentHarness.Stop()
+}
+
+// SetVaultConnectCA makes the cluster's Connect CA provider the Vault cluster
+// backing ca, using the same root as ca so that mesh certificates and the
+// TLS certificates issued by ca share a root.
+func (c *ConsulCluster) SetVaultConnectCA(ctx context.Context, ca *pki.CertificateAuthority) error {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return err
+	}
+	vca := ca.ConnectVaultCAConfig()
+	_, err = clients[0].Connect().CASetConfig(&consulapi.CAConfig{
+		Provider: "vault",
+		Config: map[string]interface{}{
+			"Address":             vca.Address,
+			"Token":               vca.Token,
+			"RootPKIPath":         vca.RootPKIPath,
+			"IntermediatePKIPath": vca.IntermediatePKIPath,
+		},
+	}, (&consulapi.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error setting Connect CA config: %w", err)
+	}
+	return nil
+}
+
+// ConnectCertificateMaker returns a CertificateMaker that uses ca to issue
+// Connect leaf certs in the cluster's trust domain and datacenter, which
+// sidecars will accept once the Connect CA uses ca's root, see
+// SetVaultConnectCA.
+func (c *ConsulCluster) ConnectCertificateMaker(ctx context.Context, ca *pki.CertificateAuthority, ttl string) (*ConnectCertificateMaker, error) {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return nil, err
+	}
+	roots, _, err := clients[0].Connect().CARoots((&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error reading Connect CA roots: %w", err)
+	}
+	self, err := clients[0].Agent().Self()
+	if err != nil {
+		return nil, fmt.Errorf("error reading agent config: %w", err)
+	}
+	dc, _ := self["Config"]["Datacenter"].(string)
+	if roots.TrustDomain == "" || dc == "" {
+		return nil, fmt.Errorf("missing trust domain %q or datacenter %q", roots.TrustDomain, dc)
+	}
+	return &ConnectCertificateMaker{
+		ca:          ca,
+		trustDomain: roots.TrustDomain,
+		datacenter:  dc,
+		ttl:         ttl,
+	}, nil
+}
+
+// Snapshot saves the state of the cluster using the snapshot API, returning
+// the snapshot in the form accepted by Restore.
+func (c *ConsulCluster) Snapshot(ctx context.Context) ([]byte, error) {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := clients[0].Snapshot().Save((&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error saving snapshot: %w", err)
+	}
+	defer rc.Close()
+	snap, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// Restore replaces the state of the cluster with that in snap, which was
+// created by Snapshot, possibly on a different cluster.
+func (c *ConsulCluster) Restore(ctx context.Context, snap []byte) error {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return err
+	}
+	err = clients[0].Snapshot().Restore((&consulapi.WriteOptions{}).WithContext(ctx), bytes.NewReader(snap))
+	if err != nil {
+		return fmt.Errorf("error restoring snapshot: %w", err)
+	}
+	return nil
+}
+
+// WipeAndRestart stops every server, deletes its data, and starts it again
+// on the same node, leaving an empty cluster at the same addresses, e.g. to
+// verify that a snapshot taken with Snapshot brings back what was lost.  The
+// data dirs of docker nodes start out empty anyway, except when the env uses
+// docker volumes for them, which isn't supported.
+func (c *ConsulCluster) WipeAndRestart(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority) error {
+	e = runenv.WithVersions(e, c.versions)
+	c.Stop()
+	for _, h := range c.servers {
+		if _, ok := h.(interface{ ContainerID() string }); ok {
+			continue
+		}
+		dh, ok := h.(interface{ DataDir() string })
+		if !ok {
+			return fmt.Errorf("can't wipe data of harness %T", h)
+		}
+		if err := os.RemoveAll(dh.DataDir()); err != nil {
+			return err
+		}
+	}
+
+	for i, node := range c.nodes {
+		tls, err := serverTLS(ctx, c.certs, ca, "consul", node)
+		if err != nil {
+			return err
+		}
+		cfg := consul.NewConfig(true, c.joinAddrs, tls).WithAutopilot(c.autopilot).WithClientTLS(c.clientTLS)
+		h, err := e.Run(ctx, cfg, node)
+		if err != nil {
+			return err
+		}
+		c.servers[i] = h
+		c.group.Go(h.Wait)
+	}
+	return consul.LeadersHealthy(ctx, c.servers, sortedCopy(c.peerAddrs))
+}
+
+// ApplyConfigEntries writes the given config entries, e.g. proxy-defaults,
+// service-defaults or service-router, in the order given.  Order matters
+// because Consul validates some entries against existing ones, e.g. routers
+// require the service protocol to be defined first.
+func (c *ConsulCluster) ApplyConfigEntries(ctx context.Context, entries ...consulapi.ConfigEntry) error {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		_, _, err := clients[0].ConfigEntries().Set(entry, (&consulapi.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("error writing config entry %s/%s: %w", entry.GetKind(), entry.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// SetIntention creates or updates the intention from service src to dst,
+// allowing or denying the connection depending on allow.
+func (c *ConsulCluster) SetIntention(ctx context.Context, src, dst string, allow bool) error {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return err
+	}
+	connect := clients[0].Connect()
+
+	action := consulapi.IntentionActionDeny
+	if allow {
+		action = consulapi.IntentionActionAllow
+	}
+
+	matches, _, err := connect.IntentionMatch(&consulapi.IntentionMatch{
+		By:    consulapi.IntentionMatchDestination,
+		Names: []string{dst},
+	}, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error listing intentions for %s: %w", dst, err)
+	}
+	for _, ixn := range matches[dst] {
+		if ixn.SourceName == src && ixn.DestinationName == dst {
+			ixn.Action = action
+			if _, err := connect.IntentionUpdate(ixn, (&consulapi.WriteOptions{}).WithContext(ctx)); err != nil {
+				return fmt.Errorf("error updating intention %s->%s: %w", src, dst, err)
+			}
+			return nil
+		}
+	}
+
+	_, _, err = connect.IntentionCreate(&consulapi.Intention{
+		SourceName:      src,
+		DestinationName: dst,
+		SourceType:      consulapi.IntentionSourceConsul,
+		Action:          action,
+	}, (&consulapi.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error creating intention %s->%s: %w", src, dst, err)
+	}
+	return nil
+}
+
 func (c *ConsulCluster) Wait() error {
 	return c.group.Wait()
 }
@@ -165,7 +609,56 @@ func NewConsulClusterAndClient(name string, e runenv.Env, ca *pki.CertificateAut
 }
 
 func NewNomadCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string, nodeCount int, consulCluster *ConsulCluster) (*NomadCluster, error) {
-	cluster := NomadCluster{group: &errgroup.Group{}}
+	return NewNomadClusterWithOptions(ctx, e, NomadClusterOptions{
+		Name:      name,
+		NodeCount: nodeCount,
+		CA:        ca,
+		Consul:    consulCluster,
+	})
+}
+
+// NomadClusterOptions describes a Nomad cluster to launch.
+type NomadClusterOptions struct {
+	Name      string
+	NodeCount int
+	// CA is used to create certificates if given, otherwise TLS isn't used.
+	CA *pki.CertificateAuthority
+	// Consul is the cluster whose client agents the Nomad servers use.
+	Consul *ConsulCluster
+	// Vault, if given, enables the Vault integration using workload identity
+	// on servers and on clients created by ClientAgent, see
+	// NomadVaultConfig and ConfigureVaultWorkloadIdentity.
+	Vault *nomad.VaultConfig
+	// MutualTLS makes the servers' HTTPS listeners require API clients to
+	// present a certificate issued by CA.  Clients obtained from the
+	// cluster's harnesses will do so.
+	MutualTLS bool
+	// Certs, if it has a "nomad" entry, is used instead of CA to make the
+	// certificates of the cluster's servers, client agents and autoscalers.
+	// The Consul client agents use the Consul cluster's settings.
+	Certs yurt.CertificateMakers
+	// Versions gives the versions of the servers and of the Consul client
+	// agents started for them, by product, e.g. {"nomad": "1.2.3", "consul":
+	// "1.11.1"}, see runenv.WithVersions.
+	Versions map[string]string
+}
+
+// NewNomadClusterWithOptions launches a Nomad cluster described by opts.
+func NewNomadClusterWithOptions(ctx context.Context, e runenv.Env, opts NomadClusterOptions) (*NomadCluster, error) {
+	name, nodeCount, ca, consulCluster := opts.Name, opts.NodeCount, opts.CA, opts.Consul
+	e = runenv.WithVersions(e, opts.Versions)
+	cluster := NomadCluster{group: &errgroup.Group{}, vault: opts.Vault, certs: opts.Certs}
+	var clientTLS *pki.TLSConfigPEM
+	if opts.MutualTLS {
+		if ca == nil {
+			return nil, fmt.Errorf("mutual TLS requires a CA")
+		}
+		var err error
+		clientTLS, err = ca.NomadClientTLS(ctx, "1h")
+		if err != nil {
+			return nil, err
+		}
+	}
 	var nodes []yurt.Node
 	for i := 0; i < nodeCount; i++ {
 		node, err := e.AllocNode(name+"-nomad-srv", nomad.DefPorts().RunnerPorts())
@@ -191,15 +684,15 @@ func NewNomadCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 			return nil, err
 		}
 
-		var tls *pki.TLSConfigPEM
-		if ca != nil {
-			var err error
-			tls, err = ca.NomadServerTLS(ctx, "", "1h")
-			if err != nil {
-				return nil, err
-			}
+		tls, err := serverTLS(ctx, cluster.certs, ca, "nomad", node)
+		if err != nil {
+			cluster.Stop()
+			return nil, err
+		}
+		if tls != nil {
+			cluster.caPEM = tls.CA
 		}
-		cfg := nomad.NewConfig(nodeCount, consulAddr.Address.Host, tls)
+		cfg := nomad.NewConfig(nodeCount, consulAddr.Address.Host, tls).WithVault(cluster.vault).WithClientTLS(clientTLS)
 		nomadHarness, err := e.Run(ctx, cfg, node)
 		if err != nil {
 			cluster.Stop()
@@ -213,15 +706,38 @@ func NewNomadCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 		cluster.Stop()
 		return nil, err
 	}
+	runenv.EventBus(e).Publish(events.Event{Kind: events.LeaderElected, Cluster: name + "-nomad"})
 
+	cluster.nodes = nodes
 	return &cluster, nil
 }
 
 type NomadCluster struct {
+	nodes        []yurt.Node
 	consulAgents []runner.Harness
 	servers      []runner.Harness
 	group        *errgroup.Group
 	peerAddrs    []string
+	vault        *nomad.VaultConfig
+	certs        yurt.CertificateMakers
+	// caPEM is the CA of the servers' certs, if they use TLS.
+	caPEM string
+}
+
+// Servers returns the harnesses of the server nodes, in the same order as Nodes.
+func (c *NomadCluster) Servers() []runner.Harness {
+	return append([]runner.Harness{}, c.servers...)
+}
+
+// Nodes returns the server nodes, in the same order as Servers.
+func (c *NomadCluster) Nodes() []yurt.Node {
+	return append([]yurt.Node{}, c.nodes...)
+}
+
+// ConsulAgents returns the harnesses of the Consul client agents used by
+// the Nomad servers, in the same order as Servers.
+func (c *NomadCluster) ConsulAgents() []runner.Harness {
+	return append([]runner.Harness{}, c.consulAgents...)
 }
 
 func (c *NomadCluster) Wait() error {
@@ -259,35 +775,98 @@ func (c *NomadCluster) ClientAPIs() ([]*nomadapi.Client, error) {
 }
 
 func (c *NomadCluster) ClientAgent(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name, consulAddr string) (runner.Harness, error) {
-	var tls *pki.TLSConfigPEM
-	if ca != nil {
-		var err error
-		tls, err = ca.NomadServerTLS(ctx, "", "1h")
-		if err != nil {
-			return nil, err
-		}
+	return c.clientAgent(ctx, e, ca, name, consulAddr, nomadClientOptions{})
+}
+
+// Autoscaler runs a Nomad Autoscaler agent against the cluster's first
+// server.  If promAddr is non-empty, e.g. MonitoredEnv.PromAddr, it is used as
+// the address of the "prometheus" APM plugin.  The autoscaler is healthy when
+// this returns.
+func (c *NomadCluster) Autoscaler(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name, promAddr string) (runner.Harness, error) {
+	nomadAddr, err := c.servers[0].Endpoint(nomad.PortNames.HTTP, false)
+	if err != nil {
+		return nil, err
 	}
+	n, err := e.AllocNode(name, nomadautoscaler.DefPorts().RunnerPorts())
+	if err != nil {
+		return nil, err
+	}
+	tls, err := serverTLS(ctx, c.certs, ca, "nomad", n)
+	if err != nil {
+		return nil, err
+	}
+	cfg := nomadautoscaler.NewConfig(nomadAddr.Address.String(), promAddr, tls).
+		WithIntervals(time.Second, time.Second)
+	h, err := e.Run(ctx, cfg, n)
+	if err != nil {
+		return nil, err
+	}
+	apiCfg, err := h.Endpoint(nomadautoscaler.PortNames.HTTP, true)
+	if err == nil {
+		err = nomadautoscaler.HealthCheck(ctx, apiCfg.Address.String())
+	}
+	if err != nil {
+		h.Kill()
+		return nil, err
+	}
+	return h, nil
+}
+
+// nomadClientOptions holds the optional client settings used by
+// ConsulNomadCluster.NomadClient.
+type nomadClientOptions struct {
+	consulDNSAddr string
+	hostVolumes   []nomad.HostVolume
+	dockerPlugin  *nomad.DockerPluginConfig
+}
+
+func (c *NomadCluster) clientAgent(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name, consulAddr string, opts nomadClientOptions) (runner.Harness, error) {
 	n, err := e.AllocNode(name, nomad.DefPorts().RunnerPorts())
 	if err != nil {
 		return nil, err
 	}
-	return e.Run(ctx, nomad.NewConfig(0, consulAddr, tls), n)
+	tls, err := serverTLS(ctx, c.certs, ca, "nomad", n)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := nomad.NewConfig(0, consulAddr, tls).WithConsulDNS(opts.consulDNSAddr)
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.WithHostVolumes(opts.hostVolumes).
+		WithDockerPlugin(opts.dockerPlugin).
+		WithVault(c.vault)
+	return e.Run(ctx, cfg, n)
 }
 
 type ConsulNomadCluster struct {
 	Name   string
 	Consul *ConsulCluster
 	Nomad  *NomadCluster
+	// ClientConsulDNS, if true, makes NomadClient publish the address of the
+	// Consul agent's DNS interface in the Nomad client's node meta.
+	ClientConsulDNS bool
+	// ClientHostVolumes are exposed by Nomad clients created by NomadClient.
+	ClientHostVolumes []nomad.HostVolume
+	// ClientDockerPlugin, if given, configures the docker driver of Nomad
+	// clients created by NomadClient.
+	ClientDockerPlugin *nomad.DockerPluginConfig
 }
 
 func NewConsulNomadCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string, nodeCount int) (*ConsulNomadCluster, error) {
-	consulCluster, err := NewConsulCluster(ctx, e, ca, name, nodeCount)
+	return NewConsulNomadClusterWithCounts(ctx, e, ca, name, nodeCount, nodeCount)
+}
+
+// NewConsulNomadClusterWithCounts is like NewConsulNomadCluster, but the
+// number of Consul and Nomad servers may differ.
+func NewConsulNomadClusterWithCounts(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string, consulServers, nomadServers int) (*ConsulNomadCluster, error) {
+	consulCluster, err := NewConsulCluster(ctx, e, ca, name, consulServers)
 	if err != nil {
 		return nil, err
 	}
 	e.Go(consulCluster.Wait)
 
-	nomadCluster, err := NewNomadCluster(ctx, e, ca, name, nodeCount, consulCluster)
+	nomadCluster, err := NewNomadCluster(ctx, e, ca, name, nomadServers, consulCluster)
 	if err != nil {
 		return nil, err
 	}
@@ -347,7 +926,18 @@ func (c *ConsulNomadCluster) NomadClient(e runenv.Env, ca *pki.CertificateAuthor
 	if err != nil {
 		return nil, err
 	}
-	nomadHarness, err := c.Nomad.ClientAgent(e.Context(), e, ca, c.Name+"-nomad-cli", consulAddr.Address.Host)
+	opts := nomadClientOptions{
+		hostVolumes:  c.ClientHostVolumes,
+		dockerPlugin: c.ClientDockerPlugin,
+	}
+	if c.ClientConsulDNS {
+		opts.consulDNSAddr, err = consuldns.HarnessToAddr(consulHarness, false)
+		if err != nil {
+			_ = consulHarness.Stop()
+			return nil, err
+		}
+	}
+	nomadHarness, err := c.Nomad.clientAgent(e.Context(), e, ca, c.Name+"-nomad-cli", consulAddr.Address.Host, opts)
 	if err != nil {
 		_ = consulHarness.Stop()
 		return nil, err
@@ -377,15 +967,84 @@ func (c *NomadClient) Wait() error {
 
 // NewVaultCluster launches a vault cluster, possibly restoring a previous state
 // for the given cluster name, depending on how e creates nodes.  If consulAddrs
-// are given they will be used for
+// are given they will be used for storage, and a Consul agent must already
 // be running.  Otherwise, Integrated Storage (raft) will be used.
+//
+// Deprecated: new settings only get added to VaultClusterOptions, use
+// NewVaultClusterWithOptions, or yurtapi.NewVaultCluster from outside yurt.
 func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority,
-	name string, nodeCount int, consulAddrs []string, seal *vault.Seal, raftPerfMultiplier int) (ret *VaultCluster, err error) {
+	name string, nodeCount int, consulAddrs []string, seal *vault.Seal, raftPerfMultiplier int) (*VaultCluster, error) {
+
+	return NewVaultClusterWithOptions(ctx, e, VaultClusterOptions{
+		Name:               name,
+		NodeCount:          nodeCount,
+		CA:                 ca,
+		ConsulAddrs:        consulAddrs,
+		Seal:               seal,
+		RaftPerfMultiplier: raftPerfMultiplier,
+	})
+}
+
+// VaultClusterOptions describes a Vault cluster to launch.
+type VaultClusterOptions struct {
+	Name      string
+	NodeCount int
+	// CA is used to create certificates if given, otherwise TLS isn't used.
+	CA *pki.CertificateAuthority
+	// ConsulAddrs are the addresses of the Consul agents to use for storage,
+	// one per node.  If empty, Integrated Storage (raft) is used.
+	ConsulAddrs        []string
+	Seal               *vault.Seal
+	RaftPerfMultiplier int
+	// RootToken and UnsealKeys are needed to unseal and use a cluster that was
+	// initialized in a previous run.  If not given they're read from StateFile.
+	RootToken  string
+	UnsealKeys []string
+	// StateFile is optional.  If given, the root token and unseal keys are
+	// written to it when the cluster is initialized, and read from it when
+	// resuming a cluster that was initialized previously.
+	StateFile string
+	// MutualTLS requires API clients to present a certificate issued by CA.
+	// Clients obtained from the cluster's harnesses will do so.
+	MutualTLS bool
+	// AgentProxies runs a Vault Agent caching proxy beside each node, see
+	// VaultCluster.AgentProxy.
+	AgentProxies bool
+	// RedundancyZones, if given, assigns node i to zone i%len(RedundancyZones).
+	// Like UpgradeVersion, this requires Vault Enterprise.
+	RedundancyZones []string
+	// UpgradeVersion overrides the version autopilot considers the nodes to
+	// be running, see VaultCluster.AddUpgradeNodes.
+	UpgradeVersion string
+	// Certs, if it has a "vault" entry, is used instead of CA to make the
+	// certificates of the cluster's nodes and agents.
+	Certs yurt.CertificateMakers
+	// Versions, if it has a "vault" entry, gives the version the nodes run,
+	// see runenv.WithVersions.
+	Versions map[string]string
+	// Autopilot, if given, is applied once the cluster is up, see
+	// VaultCluster.SetAutopilotConfig.  It requires raft storage.
+	Autopilot *vaultapi.AutopilotConfig
+}
+
+// NewVaultClusterWithOptions launches a vault cluster described by opts,
+// possibly restoring a previous state for the given cluster name, depending
+// on how e creates nodes.
+func NewVaultClusterWithOptions(ctx context.Context, e runenv.Env, opts VaultClusterOptions) (ret *VaultCluster, err error) {
+	name, nodeCount, ca := opts.Name, opts.NodeCount, opts.CA
+	e = runenv.WithVersions(e, opts.Versions)
+	consulAddrs, raftPerfMultiplier := opts.ConsulAddrs, opts.RaftPerfMultiplier
 
 	cluster := &VaultCluster{
+		name:        name,
 		group:       &errgroup.Group{},
 		consulAddrs: consulAddrs,
-		seal:        seal,
+		seal:        opts.Seal,
+		rootToken:   opts.RootToken,
+		unsealKeys:  opts.UnsealKeys,
+		autopilot:   map[string]nodeAutopilot{},
+		certs:       opts.Certs,
+		versions:    opts.Versions,
 	}
 	defer func() {
 		if err != nil {
@@ -393,6 +1052,26 @@ func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 		}
 	}()
 
+	if opts.MutualTLS {
+		if ca == nil {
+			return nil, fmt.Errorf("mutual TLS requires a CA")
+		}
+		cluster.clientTLS, err = ca.VaultClientTLS(ctx, "1h")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StateFile != "" && len(cluster.unsealKeys) == 0 {
+		state, err := vault.LoadInitState(opts.StateFile)
+		switch {
+		case err == nil:
+			cluster.rootToken, cluster.unsealKeys = state.RootToken, state.UnsealKeys
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
 	nodes := make([]yurt.Node, nodeCount)
 	for i := 0; i < nodeCount; i++ {
 		var err error
@@ -400,6 +1079,11 @@ func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 		if err != nil {
 			return nil, err
 		}
+		ap := nodeAutopilot{upgradeVersion: opts.UpgradeVersion}
+		if len(opts.RedundancyZones) > 0 {
+			ap.zone = opts.RedundancyZones[i%len(opts.RedundancyZones)]
+		}
+		cluster.autopilot[nodes[i].Name] = ap
 		joinAddr, err := nodes[i].Address(vault.PortNames.HTTP)
 		if err != nil {
 			return nil, err
@@ -436,12 +1120,25 @@ func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 		if err != nil {
 			return nil, err
 		}
+		if opts.StateFile != "" {
+			err = vault.SaveInitState(opts.StateFile, vault.InitState{
+				RootToken:  cluster.rootToken,
+				UnsealKeys: cluster.unsealKeys,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if len(cluster.unsealKeys) == 0 && status.Sealed && cluster.seal == nil {
+		return nil, fmt.Errorf("vault cluster %s was previously initialized but no unseal keys were provided", name)
 	}
-	if !status.Initialized || status.Sealed {
+	bus := runenv.EventBus(e)
+	if (!status.Initialized || status.Sealed) && len(cluster.unsealKeys) > 0 {
 		err = vault.Unseal(ctx, client, cluster.unsealKeys[0], false)
 		if err != nil {
 			return nil, err
 		}
+		bus.Publish(events.Event{Kind: events.UnsealCompleted, Cluster: name + "-vault", Node: nodes[0].Name})
 	}
 	if !status.Initialized {
 		// Raft clusters seem to come up quicker if we wait for the first node to be healthy
@@ -458,11 +1155,13 @@ func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 			if err != nil {
 				return nil, err
 			}
-			if status.Sealed {
+			if status.Sealed && len(cluster.unsealKeys) > 0 {
+				nodeName := nodes[i].Name
 				g.Go(func() error {
 					for gctx.Err() == nil {
 						err = vault.Unseal(gctx, client, cluster.unsealKeys[0], false)
 						if err == nil {
+							bus.Publish(events.Event{Kind: events.UnsealCompleted, Cluster: name + "-vault", Node: nodeName})
 							return nil
 						}
 						time.Sleep(100 * time.Millisecond)
@@ -481,24 +1180,45 @@ func NewVaultCluster(ctx context.Context, e runenv.Env, ca *pki.CertificateAutho
 	if err := vault.LeadersHealthy(ctx, cluster.servers); err != nil {
 		return nil, err
 	}
+	bus.Publish(events.Event{Kind: events.LeaderElected, Cluster: name + "-vault"})
 
+	if opts.Autopilot != nil {
+		if err := cluster.SetAutopilotConfig(ctx, opts.Autopilot); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cluster.servers) > 1 && len(consulAddrs) > 0 && cluster.rootToken != "" {
+		// With Consul storage, a standby only takes part in HA once it has
+		// checked in with the active node.
+		if err := vault.LeaderPeersHealthy(ctx, cluster.servers, cluster.rootToken); err != nil {
+			return nil, err
+		}
+	}
 	if len(cluster.servers) > 1 && len(consulAddrs) == 0 {
 		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 		if err := vault.RaftAutopilotHealthy(ctx, cluster.servers, cluster.rootToken); err != nil {
-			return nil, err
-		}
-
-		if err != nil {
 			return nil, fmt.Errorf("timed out waiting for raft autopilot health, err=%w", err)
 		}
 	}
 
 	cluster.nodes = nodes
+
+	if opts.AgentProxies {
+		for i := range cluster.servers {
+			h, err := cluster.AgentProxy(ctx, e, ca, name+"-vault-agent", i)
+			if err != nil {
+				return nil, err
+			}
+			cluster.agents = append(cluster.agents, h)
+		}
+	}
 	return cluster, nil
 }
 
 type VaultCluster struct {
+	name        string
 	nodes       []yurt.Node
 	servers     []runner.Harness
 	group       *errgroup.Group
@@ -508,6 +1228,19 @@ type VaultCluster struct {
 	unsealKeys  []string
 	seal        *vault.Seal
 	oldSeal     *vault.Seal
+	clientTLS   *pki.TLSConfigPEM
+	agents      []runner.Harness
+	autopilot   map[string]nodeAutopilot
+	certs       yurt.CertificateMakers
+	versions    map[string]string
+	// caPEM is the CA of the nodes' certs, if they use TLS.
+	caPEM string
+}
+
+// nodeAutopilot holds the per-node enterprise autopilot settings.
+type nodeAutopilot struct {
+	zone           string
+	upgradeVersion string
 }
 
 func (c *VaultCluster) Go(name string, f func() error) {
@@ -531,14 +1264,15 @@ func (c *VaultCluster) addNode(ctx context.Context, e runenv.Env, node yurt.Node
 
 func (c *VaultCluster) startVault(ctx context.Context, e runenv.Env, node yurt.Node,
 	consulAddr string, ca *pki.CertificateAuthority, raftPerfMultiplier int) (runner.Harness, error) {
+	// Nodes replaced or migrated after creation keep the cluster's version.
+	e = runenv.WithVersions(e, c.versions)
 
-	var tls *pki.TLSConfigPEM
-	if ca != nil {
-		var err error
-		tls, err = ca.VaultServerTLS(ctx, "", "1h")
-		if err != nil {
-			return nil, err
-		}
+	tls, err := serverTLS(ctx, c.certs, ca, "vault", node)
+	if err != nil {
+		return nil, err
+	}
+	if tls != nil {
+		c.caPEM = tls.CA
 	}
 	var cfg vault.VaultConfig
 	if consulAddr != "" {
@@ -548,23 +1282,19 @@ func (c *VaultCluster) startVault(ctx context.Context, e runenv.Env, node yurt.N
 	}
 	cfg.Seal = c.seal
 	cfg.OldSeal = c.oldSeal
+	cfg.RedundancyZone = c.autopilot[node.Name].zone
+	cfg.UpgradeVersion = c.autopilot[node.Name].upgradeVersion
+	if tls != nil {
+		cfg = cfg.WithClientTLS(c.clientTLS)
+	}
 
 	return e.Run(ctx, cfg, node)
 }
 
 func (c *VaultCluster) ReplaceNode(ctx context.Context, e runenv.Env, idx int, ca *pki.CertificateAuthority, migrate bool) error {
-	err := c.servers[idx].Stop()
-	if err != nil {
+	if err := c.stopServers(ctx, c.servers[idx]); err != nil {
 		return err
 	}
-	// Wait could return an error, but it may simply be because the old server died badly.
-	// So for now I guess we ignore it.
-	// Oh, but wait: we can't call Wait twice, and it's already being called in
-	// our group.
-	// err = c.servers[idx].Wait()
-	// if err != nil { return err }
-	// TODO add polling to make sure no one's listening anymore
-	time.Sleep(3 * time.Second)
 
 	consulAddr := ""
 	if len(c.consulAddrs) > idx {
@@ -586,6 +1316,7 @@ func (c *VaultCluster) ReplaceNode(ctx context.Context, e runenv.Env, idx int, c
 	for ctx.Err() == nil {
 		err = vault.Unseal(ctx, client, c.unsealKeys[0], migrate)
 		if err == nil {
+			runenv.EventBus(e).Publish(events.Event{Kind: events.UnsealCompleted, Cluster: c.name + "-vault", Node: c.nodes[idx].Name})
 			return nil
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -593,6 +1324,60 @@ func (c *VaultCluster) ReplaceNode(ctx context.Context, e runenv.Env, idx int, c
 	return errors.Wrap(err, ctx.Err().Error())
 }
 
+// stopServers stops the given servers, returning once they're no longer
+// listening, so that their replacements can bind the same addresses.  Wait
+// would tell us they've exited, but what the replacements need is the ports
+// to be free, so we wait for those to close instead.
+func (c *VaultCluster) stopServers(ctx context.Context, servers ...runner.Harness) error {
+	for _, s := range servers {
+		if err := s.Stop(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := runner.WaitClosed(ctx, s, vault.PortNames.HTTP, vault.PortNames.Cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAutopilotConfig applies cfg to the cluster's raft autopilot, e.g. to
+// shorten the server stabilization time so that replaced nodes become voters
+// sooner.
+func (c *VaultCluster) SetAutopilotConfig(ctx context.Context, cfg *vaultapi.AutopilotConfig) error {
+	if len(c.consulAddrs) > 0 {
+		return fmt.Errorf("autopilot requires raft storage")
+	}
+	return vault.AnyVault(ctx, c.servers, func(client *vaultapi.Client) error {
+		client.SetToken(c.rootToken)
+		return client.Sys().PutRaftAutopilotConfiguration(cfg)
+	})
+}
+
+// WaitAutopilotStable polls until the cluster has settled, e.g. after a node
+// has been replaced.  With raft, that means autopilot reporting all the
+// servers as healthy voters, so it takes at least the server stabilization
+// time after a node joins.  With Consul storage, which has no autopilot, it
+// means the servers agreeing on a leader and all taking part in HA.
+func (c *VaultCluster) WaitAutopilotStable(ctx context.Context) error {
+	if len(c.consulAddrs) == 0 {
+		return vault.RaftAutopilotStable(ctx, c.servers, c.rootToken, len(c.servers))
+	}
+	return vault.LeaderPeersHealthy(ctx, c.servers, c.rootToken)
+}
+
+// waitReplaced is WaitAutopilotStable with a timeout suited to replacing
+// nodes in clusters whose autopilot is configured with short last-contact and
+// server-stabilization times, as tests do.
+func (c *VaultCluster) waitReplaced(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return c.WaitAutopilotStable(ctx)
+}
+
 func (c *VaultCluster) client(i int) (*vaultapi.Client, error) {
 	cli, err := vault.HarnessToAPI(c.servers[i])
 	if err != nil {
@@ -614,17 +1399,135 @@ func (c *VaultCluster) Clients() ([]*vaultapi.Client, error) {
 	return clients, nil
 }
 
+// Servers returns the harnesses of the Vault nodes, in the same order as Nodes.
+func (c *VaultCluster) Servers() []runner.Harness {
+	return append([]runner.Harness{}, c.servers...)
+}
+
+// Nodes returns the Vault nodes, in the same order as Servers.
+func (c *VaultCluster) Nodes() []yurt.Node {
+	return append([]yurt.Node{}, c.nodes...)
+}
+
+// RootToken returns the root token obtained when the cluster was initialized.
+func (c *VaultCluster) RootToken() string {
+	return c.rootToken
+}
+
+// UnsealKeys returns the unseal keys obtained when the cluster was initialized,
+// or the recovery keys if an auto-unseal seal is used.
+func (c *VaultCluster) UnsealKeys() []string {
+	return append([]string{}, c.unsealKeys...)
+}
+
+// JoinAddrs returns the API addresses (host:port) of the cluster nodes, as
+// used by raft retry_join.
+func (c *VaultCluster) JoinAddrs() []string {
+	return append([]string{}, c.joinAddrs...)
+}
+
+// ActiveNode returns the index of the active node, polling until one of the
+// nodes claims to be active or ctx is done.
+func (c *VaultCluster) ActiveNode(ctx context.Context) (int, error) {
+	clients, err := c.Clients()
+	if err != nil {
+		return -1, err
+	}
+	for ctx.Err() == nil {
+		for i, client := range clients {
+			resp, err := client.Sys().Leader()
+			if err == nil && resp.IsSelf {
+				return i, nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return -1, ctx.Err()
+}
+
+// AgentProxy runs a Vault Agent caching proxy in front of node idx, returning
+// once the agent is serving requests.  vault.HarnessToAPI on the returned
+// harness yields a client whose requests go through the agent's cache.  The
+// agent is stopped along with the cluster.
+func (c *VaultCluster) AgentProxy(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name string, idx int) (runner.Harness, error) {
+	serverAddr, err := c.servers[idx].Endpoint(vault.PortNames.HTTP, false)
+	if err != nil {
+		return nil, err
+	}
+	node, err := e.AllocNode(name, vault.DefAgentPorts().RunnerPorts())
+	if err != nil {
+		return nil, err
+	}
+	tls, err := serverTLS(ctx, c.certs, ca, "vault", node)
+	if err != nil {
+		return nil, err
+	}
+	cfg := vault.NewAgentConfig(serverAddr.Address.String(), tls).WithClientTLS(c.clientTLS)
+	h, err := e.Run(ctx, cfg, node)
+	if err != nil {
+		return nil, err
+	}
+	c.Go(node.Name, h.Wait)
+
+	cli, err := vault.HarnessToAPI(h)
+	if err == nil {
+		cli.SetToken(c.rootToken)
+		for ctx.Err() == nil {
+			_, err = cli.Auth().Token().LookupSelf()
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		h.Kill()
+		return nil, err
+	}
+	return h, nil
+}
+
+// AgentProxies returns the harnesses of the agents created due to
+// VaultClusterOptions.AgentProxies, in the same order as Servers.
+func (c *VaultCluster) AgentProxies() []runner.Harness {
+	return append([]runner.Harness{}, c.agents...)
+}
+
+// ProxyClients returns root token clients that talk to the cluster via the
+// agents created due to VaultClusterOptions.AgentProxies.
+func (c *VaultCluster) ProxyClients() ([]*vaultapi.Client, error) {
+	var clients []*vaultapi.Client
+	for _, agent := range c.agents {
+		client, err := vault.HarnessToAPI(agent)
+		if err != nil {
+			return nil, err
+		}
+		client.SetToken(c.rootToken)
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
 func (c *VaultCluster) Wait() error {
 	return c.group.Wait()
 }
 
 func (c *VaultCluster) Stop() {
+	for _, a := range c.agents {
+		_ = a.Stop()
+	}
 	for _, s := range c.servers {
 		_ = s.Stop()
 	}
 }
 
 func (c *VaultCluster) Kill() {
+	for _, a := range c.agents {
+		a.Kill()
+	}
 	for _, s := range c.servers {
 		s.Kill()
 	}
@@ -701,10 +1604,15 @@ func (c *VaultCluster) ReplaceAllActiveLast(e runenv.Env, migrateSeal bool) erro
 	if err != nil {
 		return err
 	}
-	leader, err := vault.Leader(c.servers)
+	// oldLeader is the api_addr the active node advertises, as reported by
+	// sys/leader, which is what the new leader must be told apart from.
+	oldLeader, err := vault.Leader(c.servers)
+	if err != nil {
+		return err
+	}
 	leaderIdx := -1
 	for i, client := range clients {
-		if client.Address() == leader {
+		if client.Address() == oldLeader {
 			if leaderIdx != -1 {
 				return fmt.Errorf("leader found twice")
 			}
@@ -723,15 +1631,8 @@ func (c *VaultCluster) ReplaceAllActiveLast(e runenv.Env, migrateSeal bool) erro
 		if err != nil {
 			return err
 		}
-		// 10s because right now this is used only by tests which configure
-		// autopilot for 5s last-contact and server-stabilization times.
-		// If it's a consul cluster, well, it won't hurt.
-		time.Sleep(10 * time.Second)
-		if len(c.consulAddrs) == 0 {
-			err = vault.RaftAutopilotHealthy(e.Context(), c.servers, c.rootToken)
-			if err != nil {
-				return err
-			}
+		if err := c.waitReplaced(e.Context()); err != nil {
+			return err
 		}
 	}
 
@@ -742,12 +1643,18 @@ func (c *VaultCluster) ReplaceAllActiveLast(e runenv.Env, migrateSeal bool) erro
 		return err
 	}
 
-	for e.Context().Err() == nil {
-		time.Sleep(time.Second)
-		leader, err = vault.Leader(c.servers)
-		if err == nil && leader != "" {
+	ctx, cancel := context.WithTimeout(e.Context(), time.Minute)
+	defer cancel()
+	for ctx.Err() == nil {
+		// Until a new leader is elected, nodes may report none.
+		leader, err := vault.Leader(c.servers)
+		if err == nil && leader != "" && leader != oldLeader {
 			break
 		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("no new leader after step-down: %w", ctx.Err())
 	}
 
 	// The former leader should *not* be unsealed with migrate, because
@@ -757,13 +1664,18 @@ func (c *VaultCluster) ReplaceAllActiveLast(e runenv.Env, migrateSeal bool) erro
 	if err != nil {
 		return err
 	}
-	time.Sleep(10 * time.Second)
-	if len(c.consulAddrs) == 0 {
-		err = vault.RaftAutopilotHealthy(e.Context(), c.servers, c.rootToken)
-		if err != nil {
-			return err
-		}
+	if err := c.waitReplaced(e.Context()); err != nil {
+		return err
 	}
 
+	if migrateSeal {
+		sealType := "shamir"
+		if c.seal != nil {
+			sealType = c.seal.Type
+		}
+		ctx, cancel := context.WithTimeout(e.Context(), time.Minute)
+		defer cancel()
+		return vault.SealMigrated(ctx, c.servers, sealType)
+	}
 	return nil
 }
@@ -2,13 +2,23 @@ package cluster
 
 import (
 	"context"
+	"fmt"
 	"github.com/ncabatoff/yurt/pki"
+	"net/url"
+	"runtime"
 	"testing"
 	"time"
 
+	consulapi "github.com/hashicorp/consul/api"
 	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/consul"
+	consuldns "github.com/ncabatoff/yurt/consul/dns"
 	"github.com/ncabatoff/yurt/helper/testhelper"
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/nomadautoscaler"
 	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
 	"github.com/ncabatoff/yurt/vault"
 )
 
@@ -20,13 +30,384 @@ func testConsulCluster(name string, e runenv.Env, ca *pki.CertificateAuthority)
 }
 
 func TestConsulExecCluster(t *testing.T) {
-	e, cleanup := runenv.NewExecTestEnv(t, 20*time.Second)
+	e, cleanup := runenv.NewExecTestEnv(t, 20*time.Second, runenv.FailOnLeaks())
 	defer cleanup()
 	if err := testConsulCluster(t.Name(), e, nil); err != nil {
 		t.Fatal(err)
 	}
 }
 
+// sharedCA returns runenv.SharedCA's CA, releasing it when t is done.
+func sharedCA(t *testing.T) *pki.CertificateAuthority {
+	t.Helper()
+	ca, err := runenv.SharedCA.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(runenv.SharedCA.Release)
+	return ca
+}
+
+func TestConsulExecClusterTLS(t *testing.T) {
+	ca := sharedCA(t)
+	e, cleanup := runenv.NewExecTestEnv(t, 30*time.Second, runenv.FailOnLeaks())
+	defer cleanup()
+	if err := testConsulCluster(t.Name(), e, ca); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulExecClusterDNS(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 30*time.Second, runenv.FailOnLeaks())
+	defer cleanup()
+
+	cc, client, err := NewConsulClusterAndClient(t.Name(), e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+
+	addr, err := consuldns.HarnessToAddr(client, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consuldns.ServiceResolvable(e.Context(), addr, "consul", 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulExecClusterMeshGateway(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	envoy, err := binaries.Default.Get("envoy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := NewConsulCluster(e.Context(), e, nil, t.Name(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+
+	gw, err := cc.Gateway(e.Context(), e, nil, consul.MeshGateway, "mesh-gateway", envoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Stop()
+
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for e.Context().Err() == nil {
+		svcs, _, err := clients[0].Catalog().Service("mesh-gateway", "", nil)
+		if err == nil && len(svcs) == 1 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("mesh gateway never registered")
+}
+
+func TestConsulExecClusterConfigEntries(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 30*time.Second)
+	defer cleanup()
+
+	cc, err := NewConsulCluster(e.Context(), e, nil, t.Name(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+
+	err = cc.ApplyConfigEntries(e.Context(),
+		&consulapi.ProxyConfigEntry{
+			Kind:   consulapi.ProxyDefaults,
+			Name:   consulapi.ProxyConfigGlobal,
+			Config: map[string]interface{}{"protocol": "http"},
+		},
+		&consulapi.ServiceConfigEntry{
+			Kind:     consulapi.ServiceDefaults,
+			Name:     "web",
+			Protocol: "http",
+		},
+		&consulapi.ServiceRouterConfigEntry{
+			Kind: consulapi.ServiceRouter,
+			Name: "web",
+			Routes: []consulapi.ServiceRoute{
+				{
+					Match: &consulapi.ServiceRouteMatch{
+						HTTP: &consulapi.ServiceRouteHTTPMatch{PathPrefix: "/admin"},
+					},
+					Destination: &consulapi.ServiceRouteDestination{Service: "admin"},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, allow := range []bool{false, true} {
+		if err := cc.SetIntention(e.Context(), "web", "db", allow); err != nil {
+			t.Fatal(err)
+		}
+		clients, err := cc.ClientAPIs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed, _, err := clients[0].Connect().IntentionCheck(&consulapi.IntentionCheck{
+			Source:      "web",
+			Destination: "db",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != allow {
+			t.Fatalf("expected allowed=%v, got %v", allow, allowed)
+		}
+	}
+}
+
+func TestConsulExecClusterAutopilot(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 40*time.Second)
+	defer cleanup()
+
+	cc, err := NewConsulClusterWithOptions(e.Context(), e, ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		Autopilot: &consul.AutopilotConfig{
+			CleanupDeadServers:      true,
+			LastContactThreshold:    time.Second,
+			ServerStabilizationTime: 2 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+	if err := consul.ConsulAutopilotHealthy(e.Context(), cc.Servers()); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apcfg, err := clients[0].Operator().AutopilotGetConfiguration(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apcfg.ServerStabilizationTime.Duration() != 2*time.Second {
+		t.Fatalf("expected server stabilization time 2s, got %v", apcfg.ServerStabilizationTime)
+	}
+}
+
+func TestConsulExecClusterReplaceServers(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 90*time.Second)
+	defer cleanup()
+
+	cc, err := NewConsulClusterWithOptions(e.Context(), e, ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		Autopilot: &consul.AutopilotConfig{
+			CleanupDeadServers:      true,
+			ServerStabilizationTime: time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	if err := ReplaceConsulServers(e.Context(), e, cc, nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulExecClusterSnapshotRestore(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 40*time.Second)
+	defer cleanup()
+	testConsulSnapshotRestore(t, e, nil)
+}
+
+// testConsulSnapshotRestore verifies that a snapshot taken from one cluster
+// can be restored to a brand new cluster with empty data dirs.
+func testConsulSnapshotRestore(t *testing.T, e runenv.Env, ca *pki.CertificateAuthority) {
+	t.Helper()
+	cc, err := NewConsulCluster(e.Context(), e, ca, t.Name()+"-a", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = clients[0].KV().Put(&consulapi.KVPair{Key: "snaptest", Value: []byte("before")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := cc.Snapshot(e.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Stop()
+
+	restored, err := NewConsulCluster(e.Context(), e, ca, t.Name()+"-b", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	if err := restored.Restore(e.Context(), snap); err != nil {
+		t.Fatal(err)
+	}
+	clients, err = restored.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, _, err := clients[0].KV().Get("snaptest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair == nil || string(pair.Value) != "before" {
+		t.Fatalf("expected restored key, got %v", pair)
+	}
+}
+
+// TestConsulExecClusterWipeRestore verifies that data lost by wiping the
+// servers' data dirs comes back when a snapshot is restored.
+func TestConsulExecClusterWipeRestore(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 40*time.Second)
+	defer cleanup()
+
+	cc, err := NewConsulCluster(e.Context(), e, nil, t.Name(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Stop()
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = clients[0].KV().Put(&consulapi.KVPair{Key: "wipetest", Value: []byte("before")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := cc.Snapshot(e.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cc.WipeAndRestart(e.Context(), e, nil); err != nil {
+		t.Fatal(err)
+	}
+	clients, err = cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, _, err := clients[0].KV().Get("wipetest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair != nil {
+		t.Fatalf("expected key to be wiped, got %v", pair)
+	}
+
+	if err := cc.Restore(e.Context(), snap); err != nil {
+		t.Fatal(err)
+	}
+	pair, _, err = clients[0].KV().Get("wipetest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair == nil || string(pair.Value) != "before" {
+		t.Fatalf("expected restored key, got %v", pair)
+	}
+}
+
+func TestConsulExecClusterVersions(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	versions := []string{"1.10.6", "1.11.1"}
+	clusters, err := NewConsulClustersByVersion(e.Context(), e, nil, t.Name(), 1, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ForEachVersion(versions, func(version string) error {
+		clients, err := clusters[version].ClientAPIs()
+		if err != nil {
+			return err
+		}
+		self, err := clients[0].Agent().Self()
+		if err != nil {
+			return err
+		}
+		if v := self["Config"]["Version"]; v != version {
+			return fmt.Errorf("expected consul %s, got %v", version, v)
+		}
+		if _, err := clients[0].KV().Put(&consulapi.KVPair{Key: "version", Value: []byte(version)}, nil); err != nil {
+			return err
+		}
+		pair, _, err := clients[0].KV().Get("version", nil)
+		if err != nil {
+			return err
+		}
+		if pair == nil || string(pair.Value) != version {
+			return fmt.Errorf("expected %q, got %v", version, pair)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulExecClusterMixedVersions(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	const serverVersion, clientVersion = "1.10.6", "1.11.1"
+	cc, err := NewConsulClusterWithOptions(e.Context(), e, ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 1,
+		Versions:  map[string]string{"consul": serverVersion},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	ce := runenv.WithVersions(e, map[string]string{"consul": clientVersion})
+	client, err := cc.ClientAgent(e.Context(), ce, nil, t.Name()+"-consul-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(client.Wait)
+
+	servers, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientAPI, err := consul.HarnessToAPI(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for version, api := range map[string]*consulapi.Client{serverVersion: servers[0], clientVersion: clientAPI} {
+		testhelper.UntilPass(t, e.Context(), func() error {
+			self, err := api.Agent().Self()
+			if err != nil {
+				return err
+			}
+			if v := self["Config"]["Version"]; v != version {
+				return fmt.Errorf("expected consul %s, got %v", version, v)
+			}
+			return nil
+		})
+	}
+}
+
 func TestConsulDockerCluster(t *testing.T) {
 	e, cleanup := runenv.NewDockerTestEnv(t, 20*time.Second)
 	defer cleanup()
@@ -35,10 +416,41 @@ func TestConsulDockerCluster(t *testing.T) {
 	}
 }
 
+// TestNomadDockerCluster runs a raw_exec prometheus job, whose binary must
+// be baked into the Nomad image since the client runs in a container.
 func TestNomadDockerCluster(t *testing.T) {
-	t.Skip("still need to copy prom bin into nomad client container for this to work")
-	//e, cleanup := runenv.NewDockerTestEnv(t, 40*time.Second)
-	//defer cleanup()
+	e, cleanup := runenv.NewDockerTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	promcmd, err := binaries.Default.GetOSArch("prometheus", "linux", runtime.GOARCH, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.BuildImage(e.Context(), "nomad", `
+ARG BASE
+FROM $BASE
+COPY prometheus /bin/prometheus
+`, map[string]string{"prometheus": promcmd})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnc, _, err := NewConsulNomadClusterAndClient(t.Name(), e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consulAPIs, err := cnc.Consul.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nomadAPIs, err := cnc.Nomad.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.TestNomadJobs(t, e.Context(), consulAPIs[0], nomadAPIs[0],
+		"prometheus", testhelper.RawExecJobHCL("/bin/prometheus"), testhelper.TestPrometheus)
 }
 
 func TestNomadExecCluster(t *testing.T) {
@@ -63,6 +475,67 @@ func TestNomadExecCluster(t *testing.T) {
 		"prometheus", testhelper.ExecDockerJobHCL(t), testhelper.TestPrometheus)
 }
 
+// TestNomadAutoscalerExecCluster registers a job whose scaling policy queries
+// a constant from the MonitoredEnv Prometheus, and verifies that the
+// autoscaler scales it out to the policy max.
+func TestNomadAutoscalerExecCluster(t *testing.T) {
+	e, cleanup := runenv.NewMonitoredExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	cnc, _, err := NewConsulNomadClusterAndClient(t.Name(), e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := cnc.Nomad.Autoscaler(e.Context(), e, nil, t.Name()+"-autoscaler", e.PromAddr().Address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(as.Wait)
+
+	nomadAPIs, err := cnc.Nomad.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nomad.DeployJob(e.Context(), nomadAPIs[0], scaledJobHCL); err != nil {
+		t.Fatal(err)
+	}
+	if err := nomadautoscaler.WaitGroupCount(e.Context(), nomadAPIs[0], "scaled", "scaled", 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scaledJobHCL defines a job with a horizontal scaling policy whose metric is
+// always 3 times the target, so it should be scaled out to max.
+const scaledJobHCL = `
+job "scaled" {
+  datacenters = ["dc1"]
+  group "scaled" {
+    count = 1
+    scaling {
+      min = 1
+      max = 3
+      policy {
+        check "constant" {
+          source = "prometheus"
+          query = "vector(3)"
+          strategy "target-value" {
+            target = 1
+          }
+        }
+      }
+    }
+    task "sleep" {
+      driver = "raw_exec"
+      config {
+        command = "/bin/sleep"
+        args = ["600"]
+      }
+    }
+  }
+}
+`
+
 func TestVaultExecCluster(t *testing.T) {
 	e, cleanup := runenv.NewExecTestEnv(t, 90*time.Second)
 	defer cleanup()
@@ -75,6 +548,126 @@ func TestVaultExecCluster(t *testing.T) {
 	e.Go(vc.Wait)
 }
 
+func TestVaultExecClusterAgentProxy(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	vc, err := NewVaultClusterWithOptions(e.Context(), e, VaultClusterOptions{
+		Name:         t.Name(),
+		NodeCount:    1,
+		AgentProxies: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(vc.Wait)
+
+	proxied, err := vc.ProxyClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxied[0].Sys().Mount("kv", &vaultapi.MountInput{Type: "kv"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxied[0].Logical().Write("kv/foo", map[string]interface{}{"bar": "baz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	direct, err := vc.Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := direct[0].Logical().Read("kv/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil || secret.Data["bar"] != "baz" {
+		t.Fatalf("expected to read value written via proxy, got %v", secret)
+	}
+}
+
+func TestVaultExecClusterBootstrap(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	vc, err := NewVaultCluster(e.Context(), e, nil, t.Name(), 1, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(vc.Wait)
+
+	cli, err := vc.client(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := vault.Bootstrap(e.Context(), cli, vault.DefaultProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := result.AppRoles["app"]
+	secret, err := cli.Logical().Write("auth/approle/login", map[string]interface{}{
+		"role_id":   creds.RoleID,
+		"secret_id": creds.SecretID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetToken(secret.Auth.ClientToken)
+	resp, err := cli.Logical().Read("secret/data/app/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || resp.Data["data"] == nil {
+		t.Fatalf("expected to read bootstrapped secret, got %v", resp)
+	}
+}
+
+// TestVaultExecClusterPerfReplication verifies that a performance secondary
+// is left with a root token that works on it, since the primary's doesn't.
+func TestVaultExecClusterPerfReplication(t *testing.T) {
+	const version = "1.9.2+ent"
+	if err := binaries.Licensed("vault", version); err != nil {
+		t.Skip(err)
+	}
+	e, cleanup := runenv.NewExecTestEnv(t, 120*time.Second)
+	defer cleanup()
+
+	var clusters []*VaultCluster
+	for _, name := range []string{"primary", "secondary"} {
+		vc, err := NewVaultClusterWithOptions(e.Context(), e, VaultClusterOptions{
+			Name:      t.Name() + "-" + name,
+			NodeCount: 1,
+			Versions:  map[string]string{"vault": version},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Go(vc.Wait)
+		clusters = append(clusters, vc)
+	}
+	primary, secondary := clusters[0], clusters[1]
+
+	pair, err := NewVaultReplicationPair(e.Context(), PerformanceReplication, primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondary.RootToken() == primary.RootToken() {
+		t.Fatal("expected the performance secondary to get a root token of its own")
+	}
+	cli, err := pair.Secondary.client(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Logical().Write("auth/token/create", map[string]interface{}{"ttl": "5m"}); err != nil {
+		t.Fatalf("expected the secondary's root token to work on it: %v", err)
+	}
+	cli.SetToken(primary.RootToken())
+	if _, err := cli.Logical().Write("auth/token/create", map[string]interface{}{"ttl": "5m"}); err == nil {
+		t.Fatal("expected the primary's root token not to work on the performance secondary")
+	}
+}
+
 func TestVaultPrometheusExecCluster(t *testing.T) {
 	e, cleanup := runenv.NewMonitoredExecTestEnv(t, 60*time.Second)
 	defer cleanup()
@@ -168,20 +761,19 @@ func testVaultClusterMigrateSeals(t *testing.T, e runenv.Env, oldSeal, newSeal *
 	defer vc.Stop()
 	e.Go(vc.Wait)
 
-	cli, err := vc.client(0)
-	if err != nil {
-		t.Fatal(err)
-	}
-	err = cli.Sys().PutRaftAutopilotConfiguration(&vaultapi.AutopilotConfig{
-		LastContactThreshold: 5 * time.Second,
-		//MaxTrailingLogs:                10,
+	err = vc.SetAutopilotConfig(e.Context(), &vaultapi.AutopilotConfig{
+		LastContactThreshold:    5 * time.Second,
 		ServerStabilizationTime: 5 * time.Second,
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(10 * time.Second)
+	ctx, cancel := context.WithTimeout(e.Context(), time.Minute)
+	defer cancel()
+	if err := vc.WaitAutopilotStable(ctx); err != nil {
+		t.Fatal(err)
+	}
 	vc.oldSeal = oldSeal
 	vc.seal = newSeal
 
@@ -189,11 +781,6 @@ func testVaultClusterMigrateSeals(t *testing.T, e runenv.Env, oldSeal, newSeal *
 	if err != nil {
 		t.Fatal(err)
 	}
-	// There's no way for us to monitor what raft has applied on the
-	// node (or is there? can we look at seal config in storage using sys/raw?)
-	// so for now sleep in the hope that will ensure the former leader
-	// has the seal migration changes applied locally.
-	time.Sleep(15 * time.Second)
 	vc.oldSeal = nil
 
 	t.Log("doing postMigrate")
@@ -256,6 +843,38 @@ func TestConsulVaultExecCluster(t *testing.T) {
 	e.Go(cluster.Wait)
 }
 
+func TestConsulVaultExecClusterMigrateToRaft(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 90*time.Second)
+	defer cleanup()
+
+	cluster, err := NewConsulVaultCluster(e.Context(), e, nil, t.Name(), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cluster.Wait)
+
+	cli, err := cluster.Vault.client(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Sys().PutPolicy("migrated", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Vault.MigrateConsulToRaft(e.Context(), e, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err = cluster.Vault.client(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := cli.Sys().GetPolicy("migrated")
+	if err != nil || policy == "" {
+		t.Fatalf("policy not migrated, err=%v", err)
+	}
+}
+
 func TestConsulVaultDockerCluster(t *testing.T) {
 	e, cleanup := runenv.NewDockerTestEnv(t, 60*time.Second)
 	defer cleanup()
@@ -277,3 +896,27 @@ func TestVaultDockerCluster(t *testing.T) {
 	}
 	e.Go(vc.Wait)
 }
+
+// addrHarness serves every endpoint at addr.
+type addrHarness struct {
+	runner.Harness
+	addr string
+}
+
+func (h addrHarness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
+	return &runner.APIConfig{Address: url.URL{Scheme: "https", Host: h.addr}}, nil
+}
+
+func TestNomadVaultConfig(t *testing.T) {
+	vc := &VaultCluster{
+		servers: []runner.Harness{addrHarness{addr: "10.0.0.1:8200"}},
+		caPEM:   "ca",
+	}
+	cfg, err := NomadVaultConfig(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != "https://10.0.0.1:8200" || cfg.CA != "ca" || cfg.JWTAuthPath == "" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// AddServer starts a new server node that joins the cluster, returning once
+// the cluster is healthy with the new server as a peer.
+func (c *ConsulCluster) AddServer(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority) error {
+	e = runenv.WithVersions(e, c.versions)
+	node, err := e.AllocNode(c.name+"-consul-srv", consul.DefPorts().RunnerPorts())
+	if err != nil {
+		return err
+	}
+	joinAddr, err := node.Address(consul.PortNames.SerfLAN)
+	if err != nil {
+		return err
+	}
+	serverAddr, err := node.Address(consul.PortNames.Server)
+	if err != nil {
+		return err
+	}
+
+	tls, err := serverTLS(ctx, c.certs, ca, "consul", node)
+	if err != nil {
+		return err
+	}
+	joinAddrs := append(append([]string{}, c.joinAddrs...), joinAddr)
+	cfg := consul.NewConfig(true, joinAddrs, tls).WithAutopilot(c.autopilot).WithClientTLS(c.clientTLS)
+	h, err := e.Run(ctx, cfg, node)
+	if err != nil {
+		return err
+	}
+	c.group.Go(h.Wait)
+
+	c.nodes = append(c.nodes, node)
+	c.servers = append(c.servers, h)
+	c.joinAddrs = joinAddrs
+	c.peerAddrs = append(c.peerAddrs, serverAddr)
+	return consul.LeadersHealthy(ctx, c.servers, sortedCopy(c.peerAddrs))
+}
+
+// RemoveServer kills server idx without it leaving the cluster, as happens
+// when a host dies, and forgets about it.  Unless autopilot cleans up dead
+// servers, the remaining servers will still count it as a peer.
+func (c *ConsulCluster) RemoveServer(idx int) {
+	c.servers[idx].Kill()
+	c.nodes = append(c.nodes[:idx:idx], c.nodes[idx+1:]...)
+	c.servers = append(c.servers[:idx:idx], c.servers[idx+1:]...)
+	c.joinAddrs = append(c.joinAddrs[:idx:idx], c.joinAddrs[idx+1:]...)
+	c.peerAddrs = append(c.peerAddrs[:idx:idx], c.peerAddrs[idx+1:]...)
+}
+
+// RetireServer removes server idx from the raft peers, then stops it and
+// forgets about it, so that the remaining servers don't have to wait for
+// autopilot to notice it's gone.
+func (c *ConsulCluster) RetireServer(ctx context.Context, idx int) error {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return err
+	}
+	if len(clients) == 1 {
+		return fmt.Errorf("can't retire the only server")
+	}
+	cli := clients[(idx+1)%len(clients)]
+	err = cli.Operator().RaftRemovePeerByAddress(c.peerAddrs[idx], (&consulapi.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error removing raft peer %s: %w", c.peerAddrs[idx], err)
+	}
+	// Stop it first so that it exits cleanly rather than being killed.
+	_ = c.servers[idx].Stop()
+	c.RemoveServer(idx)
+	return nil
+}
+
+func sortedCopy(s []string) []string {
+	ret := append([]string{}, s...)
+	sort.Strings(ret)
+	return ret
+}
+
+// LeaderWatch polls a Consul agent for the current leader until stopped,
+// keeping track of the longest period without one.
+type LeaderWatch struct {
+	cancel func()
+	done   chan struct{}
+
+	l           sync.Mutex
+	lastLeader  time.Time
+	maxGap      time.Duration
+	leaderAddrs map[string]struct{}
+}
+
+// WatchLeader starts watching the leader as seen by the agent behind cli.
+func WatchLeader(ctx context.Context, cli *consulapi.Client) *LeaderWatch {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &LeaderWatch{
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		lastLeader:  time.Now(),
+		leaderAddrs: map[string]struct{}{},
+	}
+	go func() {
+		defer close(w.done)
+		for ctx.Err() == nil {
+			leader, err := cli.Status().Leader()
+			now := time.Now()
+			w.l.Lock()
+			if err == nil && leader != "" {
+				w.lastLeader = now
+				w.leaderAddrs[leader] = struct{}{}
+			} else if gap := now.Sub(w.lastLeader); gap > w.maxGap {
+				w.maxGap = gap
+			}
+			w.l.Unlock()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	return w
+}
+
+// Stop stops watching, returning the longest period without a leader and
+// the number of distinct leaders seen.
+func (w *LeaderWatch) Stop() (time.Duration, int) {
+	w.cancel()
+	<-w.done
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.maxGap, len(w.leaderAddrs)
+}
+
+// ReplaceConsulServers replaces every server of c, one at a time, with a
+// brand new node: a new server is added, then the oldest is killed, and we
+// wait for autopilot to remove the dead server from the raft peers.  c must
+// have been created with autopilot CleanupDeadServers enabled.  A client agent
+// is used to watch the leader throughout, and an error is returned if the
+// cluster was ever without a leader for longer than maxLeaderless.
+func ReplaceConsulServers(ctx context.Context, e runenv.Env, c *ConsulCluster, ca *pki.CertificateAuthority, maxLeaderless time.Duration) error {
+	if c.autopilot == nil || !c.autopilot.CleanupDeadServers {
+		return fmt.Errorf("cluster must be created with autopilot dead server cleanup")
+	}
+
+	agent, err := c.ClientAgent(ctx, e, ca, c.name+"-consul-watch")
+	if err != nil {
+		return err
+	}
+	defer agent.Kill()
+	cli, err := consul.HarnessToAPI(agent)
+	if err != nil {
+		return err
+	}
+	if err := consul.LeadersHealthy(ctx, []runner.Harness{agent}, sortedCopy(c.peerAddrs)); err != nil {
+		return err
+	}
+
+	watch := WatchLeader(ctx, cli)
+	originals := len(c.servers)
+	for i := 0; i < originals; i++ {
+		if err := c.AddServer(ctx, e, ca); err != nil {
+			watch.Stop()
+			return fmt.Errorf("error adding server %d: %w", i, err)
+		}
+		c.RemoveServer(0)
+		if err := consul.LeadersHealthy(ctx, c.servers, sortedCopy(c.peerAddrs)); err != nil {
+			watch.Stop()
+			return fmt.Errorf("dead server not cleaned up after replacing server %d: %w", i, err)
+		}
+		if err := consul.ConsulAutopilotHealthy(ctx, c.servers); err != nil {
+			watch.Stop()
+			return fmt.Errorf("autopilot unhealthy after replacing server %d: %w", i, err)
+		}
+	}
+
+	gap, _ := watch.Stop()
+	if gap > maxLeaderless {
+		return fmt.Errorf("cluster was without a leader for %s", gap)
+	}
+	return nil
+}
@@ -3,7 +3,8 @@ package cluster
 import (
 	"context"
 	"fmt"
-	"github.com/ncabatoff/yurt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,9 +13,16 @@ import (
 	"github.com/docker/docker/api/types/container"
 	dockerapi "github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-multierror"
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/ncabatoff/yurt"
 	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/consul"
 	"github.com/ncabatoff/yurt/docker"
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runner"
 )
 
 type YurtRunClusterOptions struct {
@@ -30,13 +38,26 @@ type YurtRunClusterOptions struct {
 	BaseImage string
 	// WorkDir is where all files are created, excluding binaries.
 	WorkDir string
+	// ConfigFile, if given, is the path of a yurt-run config file to run each
+	// node with instead of command-line flags.  It must specify consul_bin
+	// as /bin/consul and nomad_bin as /bin/nomad, and if tls is true, CA must
+	// be given as well.
+	ConfigFile string
+	// CA, if given, is used to provision each node with a certificate before
+	// launching yurt-run with TLS enabled.
+	CA *pki.CertificateAuthority
+	// LogDir, if given, gets a file per node containing its container output,
+	// instead of it going to stdout.
+	LogDir string
 }
 
-// YurtRunCluster is used for testing yurt-run.
+// YurtRunCluster runs yurt-run in docker containers, e.g. to test yurt-run
+// itself, or to validate yurt-run config files before deploying them.
 type YurtRunCluster struct {
 	YurtRunClusterOptions
 	docker     *dockerapi.Client
 	containers []types.ContainerJSON
+	logs       []io.Closer
 }
 
 func NewYurtRunCluster(options YurtRunClusterOptions, cli *dockerapi.Client) (*YurtRunCluster, error) {
@@ -46,7 +67,8 @@ func NewYurtRunCluster(options YurtRunClusterOptions, cli *dockerapi.Client) (*Y
 	}, nil
 }
 
-// Start launches the cluster server nodes.
+// Start launches the cluster server nodes.  Use WaitHealthy to wait for
+// the clusters they form to become usable.
 func (y *YurtRunCluster) Start(ctx context.Context) error {
 	for i, ip := range y.ConsulServerIPs {
 		if err := y.startNode(ctx, i, ip); err != nil {
@@ -63,16 +85,166 @@ func (y *YurtRunCluster) Stop(ctx context.Context) error {
 			errs.Errors = append(errs.Errors, err)
 		}
 	}
+	for _, l := range y.logs {
+		_ = l.Close()
+	}
 	return errs.ErrorOrNil()
 }
 
+// Wait blocks until all the containers have exited.
+func (y *YurtRunCluster) Wait() error {
+	var errs multierror.Error
+	for _, cont := range y.containers {
+		if err := docker.Wait(y.docker, cont.ID); err != nil {
+			errs.Errors = append(errs.Errors, fmt.Errorf("container %s: %w", cont.Name, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// WaitHealthy waits until both the Consul and Nomad clusters have a leader
+// and all server nodes as peers.
+func (y *YurtRunCluster) WaitHealthy(ctx context.Context) error {
+	consulClients, err := y.ConsulAPIs()
+	if err != nil {
+		return err
+	}
+	nomadClients, err := y.NomadAPIs()
+	if err != nil {
+		return err
+	}
+
+	var consulAPIs, nomadAPIs []runner.LeaderPeersAPI
+	var consulPeers, nomadPeers []string
+	for i, ip := range y.ConsulServerIPs {
+		consulAPIs = append(consulAPIs, consulClients[i].Status())
+		nomadAPIs = append(nomadAPIs, nomadClients[i].Status())
+		consulPeers = append(consulPeers, fmt.Sprintf("%s:%d", ip, consul.DefPorts().Server))
+		nomadPeers = append(nomadPeers, fmt.Sprintf("%s:%d", ip, nomad.DefPorts().RPC))
+	}
+
+	if err := runner.LeaderPeerAPIsHealthy(ctx, consulAPIs, consulPeers); err != nil {
+		return fmt.Errorf("consul cluster not healthy: %w", err)
+	}
+	if err := runner.LeaderPeerAPIsHealthy(ctx, nomadAPIs, nomadPeers); err != nil {
+		return fmt.Errorf("nomad cluster not healthy: %w", err)
+	}
+	return nil
+}
+
+// hostPort returns the host port that port/tcp of container i is published on.
+func (y *YurtRunCluster) hostPort(i, port int) (string, error) {
+	ports := y.containers[i].NetworkSettings.NetworkSettingsBase.Ports[nat.Port(fmt.Sprintf("%d/tcp", port))]
+	if len(ports) == 0 {
+		return "", fmt.Errorf("no binding for port %d", port)
+	}
+	return ports[0].HostPort, nil
+}
+
+// ConsulAPIs returns a client for the Consul API of each node.
+func (y *YurtRunCluster) ConsulAPIs() ([]*consulapi.Client, error) {
+	var ret []*consulapi.Client
+	for i := range y.containers {
+		port, err := y.hostPort(i, consul.DefPorts().HTTP)
+		if err != nil {
+			return nil, err
+		}
+		apiConfig := consulapi.DefaultNonPooledConfig()
+		apiConfig.Address = fmt.Sprintf("%s:%s", "127.0.0.1", port)
+		if y.CA != nil {
+			// With TLS, Consul serves HTTPS on its usual HTTP port.
+			apiConfig.Scheme = "https"
+			apiConfig.TLSConfig.CAFile = filepath.Join(y.nodeDir(i), "ca.pem")
+			apiConfig.TLSConfig.Address = "localhost"
+		}
+		client, err := consulapi.NewClient(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, client)
+	}
+
+	return ret, nil
+}
+
+// NomadAPIs returns a client for the Nomad API of each node.
+func (y *YurtRunCluster) NomadAPIs() ([]*nomadapi.Client, error) {
+	var ret []*nomadapi.Client
+	for i := range y.containers {
+		port, err := y.hostPort(i, nomad.DefPorts().HTTP)
+		if err != nil {
+			return nil, err
+		}
+		apiConfig := nomadapi.DefaultConfig()
+		scheme := "http"
+		if y.CA != nil {
+			scheme = "https"
+			apiConfig.TLSConfig.CACert = filepath.Join(y.nodeDir(i), "ca.pem")
+			apiConfig.TLSConfig.TLSServerName = "localhost"
+		}
+		apiConfig.Address = fmt.Sprintf("%s://%s:%s", scheme, "127.0.0.1", port)
+		client, err := nomadapi.NewClient(apiConfig)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, client)
+	}
+
+	return ret, nil
+}
+
+func (y *YurtRunCluster) nodeName(node int) string {
+	return fmt.Sprintf("yurt%d", node+1)
+}
+
+func (y *YurtRunCluster) nodeDir(node int) string {
+	return filepath.Join(y.WorkDir, y.nodeName(node))
+}
+
+// writeTLS provisions the node dir with the files yurt-run looks for when
+// TLS is enabled.
+func (y *YurtRunCluster) writeTLS(ctx context.Context, nodeDir, ip string) error {
+	tls, err := y.CA.ConsulServerTLS(ctx, ip, "168h")
+	if err != nil {
+		return err
+	}
+	for name, contents := range map[string]string{
+		"ca.pem":         tls.CA,
+		"consul.pem":     tls.Cert,
+		"consul-key.pem": tls.PrivateKey,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(nodeDir, name), []byte(contents), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (y *YurtRunCluster) startNode(ctx context.Context, node int, ip string) error {
-	nodeName := fmt.Sprintf("yurt%d", node+1)
-	nodeDir := filepath.Join(y.WorkDir, nodeName)
+	nodeName := y.nodeName(node)
+	nodeDir := y.nodeDir(node)
 	err := os.MkdirAll(nodeDir, 0755)
 	if err != nil {
 		return err
 	}
+	if y.CA != nil {
+		if err := y.writeTLS(ctx, nodeDir, ip); err != nil {
+			return err
+		}
+	}
+
+	var output io.Writer
+	if y.LogDir != "" {
+		if err := os.MkdirAll(y.LogDir, 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(y.LogDir, nodeName+".log"))
+		if err != nil {
+			return err
+		}
+		y.logs = append(y.logs, f)
+		output = f
+	}
 
 	exposedPorts := nat.PortSet{
 		"4646/tcp": {},
@@ -100,19 +272,29 @@ func (y *YurtRunCluster) startNode(ctx context.Context, node int, ip string) err
 		copyFromTo[bin] = filepath.Join("/bin", name)
 	}
 
+	cmd := []string{
+		"-consul-server-ips=" + strings.Join(y.ConsulServerIPs, ","),
+		"-consul-bin=/bin/consul",
+		"-nomad-bin=/bin/nomad",
+	}
+	if y.CA != nil {
+		cmd = append(cmd, "-tls")
+	}
+	if y.ConfigFile != "" {
+		copyFromTo[y.ConfigFile] = "/etc/yurt.yml"
+		cmd = []string{"-config-file=/etc/yurt.yml"}
+	}
+
 	cont, err := docker.Start(ctx, y.docker, docker.RunOptions{
 		ContainerName: nodeName,
 		IP:            ip,
 		NetName:       y.Network.DockerNetName,
 		CopyFromTo:    copyFromTo,
+		Output:        output,
 		ContainerConfig: &container.Config{
 			Image:      y.BaseImage,
 			Entrypoint: []string{"/bin/yurt-run"},
-			Cmd: []string{
-				"-consul-server-ips=" + strings.Join(y.ConsulServerIPs, ","),
-				"-consul-bin=/bin/consul",
-				"-nomad-bin=/bin/nomad",
-			},
+			Cmd:        cmd,
 			Labels: map[string]string{
 				"yurt": "true",
 			},
@@ -127,45 +309,3 @@ func (y *YurtRunCluster) startNode(ctx context.Context, node int, ip string) err
 	y.containers = append(y.containers, *cont)
 	return nil
 }
-
-/*
-func (y *YurtRunCluster) ConsulAPIs() ([]*consulapi.Client, error) {
-	var ret []*consulapi.Client
-	for i := range y.ConsulServerIPs {
-		apiConfig := consulapi.DefaultNonPooledConfig()
-		guestport := runner.DefConsulPorts().HTTP
-		ports := y.containers[i].NetworkSettings.NetworkSettingsBase.Ports[nat.Port(fmt.Sprintf("%d/tcp", guestport))]
-		if len(ports) == 0 {
-			return nil, fmt.Errorf("no binding for Consul API port %d", guestport)
-		}
-		apiConfig.Address = fmt.Sprintf("%s:%s", "127.0.0.1", ports[0].HostPort)
-		client, err := consulapi.NewClient(apiConfig)
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, client)
-	}
-
-	return ret, nil
-}
-
-func (y *YurtRunCluster) NomadAPIs() ([]*nomadapi.Client, error) {
-	var ret []*nomadapi.Client
-	for i := range y.ConsulServerIPs {
-		apiConfig := nomadapi.DefaultConfig()
-		guestport := runner.DefNomadPorts().HTTP
-		ports := y.containers[i].NetworkSettings.NetworkSettingsBase.Ports[nat.Port(fmt.Sprintf("%d/tcp", guestport))]
-		if len(ports) == 0 {
-			return nil, fmt.Errorf("no binding for Nomad API port %d", guestport)
-		}
-		apiConfig.Address = fmt.Sprintf("%s://%s:%s", "http", "127.0.0.1", ports[0].HostPort)
-		client, err := nomadapi.NewClient(apiConfig)
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, client)
-	}
-
-	return ret, nil
-}
-*/
@@ -56,47 +56,7 @@ func TestYurtRunCluster_Start(t *testing.T) {
 		<-done
 	}()
 
-	/*
-		{
-			clients, err := y.ConsulAPIs()
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			var leaderAPIs []runner.LeaderAPI
-			for _, c := range clients {
-				leaderAPIs = append(leaderAPIs, c.Status())
-			}
-
-			var addrs []string
-			for _, ip := range y.ConsulServerIPs {
-				addrs = append(addrs, fmt.Sprintf("%s:%d", ip, runner.DefConsulPorts().Server))
-			}
-
-			if err := runner.LeaderAPIsHealthy(ctx, leaderAPIs, addrs); err != nil {
-				t.Fatal(err)
-			}
-		}
-
-		{
-			clients, err := y.NomadAPIs()
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			var leaderAPIs []runner.LeaderAPI
-			for _, c := range clients {
-				leaderAPIs = append(leaderAPIs, c.Status())
-			}
-
-			var addrs []string
-			for _, ip := range y.ConsulServerIPs {
-				addrs = append(addrs, fmt.Sprintf("%s:%d", ip, runner.DefNomadPorts().RPC))
-			}
-
-			if err := runner.LeaderAPIsHealthy(ctx, leaderAPIs, addrs); err != nil {
-				t.Fatal(err)
-			}
-		}
-	*/
+	if err := y.WaitHealthy(e.Context()); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/vault"
+	"github.com/pkg/errors"
+)
+
+// MigrateConsulToRaft stops all the nodes of a Consul-backed Vault cluster,
+// copies its storage to Integrated Storage (raft) using "vault operator migrate",
+// then relaunches the nodes using raft storage.  The migrated data is written
+// to the first node, and the other nodes join it.  The cluster's root token
+// and unseal keys are unchanged by the migration.
+func (c *VaultCluster) MigrateConsulToRaft(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority) error {
+	if len(c.consulAddrs) == 0 {
+		return fmt.Errorf("cluster is not using Consul storage")
+	}
+
+	if err := c.stopServers(ctx, c.servers...); err != nil {
+		return err
+	}
+
+	node := c.nodes[0]
+	clusterAddr, err := node.Address(vault.PortNames.Cluster)
+	if err != nil {
+		return err
+	}
+	cfg := vault.NewMigrateConfig(c.consulAddrs[0], "vault", clusterAddr)
+	tls, err := serverTLS(ctx, c.certs, ca, "vault", node)
+	if err != nil {
+		return err
+	}
+	if tls != nil {
+		cfg.Common.TLS = *tls
+	}
+	h, err := e.Run(ctx, cfg, node)
+	if err != nil {
+		return err
+	}
+	if err := h.Wait(); err != nil {
+		return fmt.Errorf("vault operator migrate failed: %w", err)
+	}
+
+	c.consulAddrs = nil
+	for i := range c.nodes {
+		h, err := c.startVault(ctx, e, c.nodes[i], "", ca, 0)
+		if err != nil {
+			return err
+		}
+		c.servers[i] = h
+		c.Go(c.nodes[i].Name, h.Wait)
+
+		if c.seal != nil {
+			continue
+		}
+		if err := c.unsealWithRetry(ctx, i); err != nil {
+			return err
+		}
+		if i == 0 {
+			if err := vault.LeadersHealthy(ctx, c.servers[:1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return vault.LeadersHealthy(ctx, c.servers)
+}
+
+// unsealWithRetry unseals node i, retrying until it succeeds or the timeout
+// expires.  Retries are needed because a node joining a raft cluster can't be
+// unsealed until it has contacted the leader.
+func (c *VaultCluster) unsealWithRetry(ctx context.Context, i int) error {
+	client, err := c.client(i)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for ctx.Err() == nil {
+		err = vault.Unseal(ctx, client, c.unsealKeys[0], false)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Wrap(err, ctx.Err().Error())
+}
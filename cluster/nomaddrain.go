@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// nodeID returns the ID of the Nomad client node with the given name.
+func (c *NomadCluster) nodeID(cli *nomadapi.Client, name string) (string, error) {
+	nodes, _, err := cli.Nodes().List(nil)
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes {
+		if node.Name == name {
+			return node.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no nomad node named %q", name)
+}
+
+func (c *NomadCluster) api() (*nomadapi.Client, error) {
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no nomad servers")
+	}
+	return clients[0], nil
+}
+
+// SetEligibility marks the named client node as eligible or ineligible for
+// scheduling.  Existing allocations aren't affected.
+func (c *NomadCluster) SetEligibility(ctx context.Context, name string, eligible bool) error {
+	cli, err := c.api()
+	if err != nil {
+		return err
+	}
+	id, err := c.nodeID(cli, name)
+	if err != nil {
+		return err
+	}
+	_, err = cli.Nodes().ToggleEligibility(id, eligible, nil)
+	return err
+}
+
+// DrainNode drains the named client node, with allocations that haven't
+// migrated after deadline being stopped, and system jobs left in place.
+// It returns once the drain is complete and the allocations that were running
+// on the node are running elsewhere, or when ctx is done.  The node is left
+// ineligible; use SetEligibility to make it schedulable again.
+func (c *NomadCluster) DrainNode(ctx context.Context, name string, deadline time.Duration) error {
+	cli, err := c.api()
+	if err != nil {
+		return err
+	}
+	id, err := c.nodeID(cli, name)
+	if err != nil {
+		return err
+	}
+
+	// Remember how many allocs of each job/group are running before the drain,
+	// so we can tell when their replacements are up.
+	type group struct{ job, group string }
+	running := map[group]int{}
+	allocs, _, err := cli.Nodes().Allocations(id, nil)
+	if err != nil {
+		return err
+	}
+	for _, alloc := range allocs {
+		if alloc.ClientStatus != nomadapi.AllocClientStatusRunning || alloc.Job == nil {
+			continue
+		}
+		if alloc.Job.Type != nil && *alloc.Job.Type == nomadapi.JobTypeSystem {
+			continue
+		}
+		running[group{alloc.JobID, alloc.TaskGroup}] = 0
+	}
+	for g := range running {
+		summary, _, err := cli.Jobs().Summary(g.job, nil)
+		if err != nil {
+			return err
+		}
+		running[g] = summary.Summary[g.group].Running
+	}
+
+	_, err = cli.Nodes().UpdateDrain(id, &nomadapi.DrainSpec{
+		Deadline:         deadline,
+		IgnoreSystemJobs: true,
+	}, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var node *nomadapi.Node
+		node, _, err = cli.Nodes().Info(id, nil)
+		if err != nil {
+			continue
+		}
+		if node.Drain {
+			err = fmt.Errorf("node %s still draining", name)
+			continue
+		}
+		for g, count := range running {
+			var summary *nomadapi.JobSummary
+			summary, _, err = cli.Jobs().Summary(g.job, nil)
+			if err != nil {
+				break
+			}
+			if s := summary.Summary[g.group]; s.Running < count {
+				err = fmt.Errorf("job %s group %s has %d allocs running, want %d", g.job, g.group, s.Running, count)
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for drain of %s, last err: %w", name, err)
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+// NomadVaultConfig returns the settings needed for Nomad agents to use vc via
+// workload identity, for use in NomadClusterOptions.Vault.  Workload identity
+// requires Nomad 1.7+, so the Nomad cluster may need to be created in a
+// runenv.VersionedEnv.  If vc uses TLS, the config trusts the CA that issued
+// its certs.
+func NomadVaultConfig(vc *VaultCluster) (*nomad.VaultConfig, error) {
+	addr, err := vc.Servers()[0].Endpoint(vault.PortNames.HTTP, false)
+	if err != nil {
+		return nil, err
+	}
+	wi := vault.DefaultNomadWorkloadIdentity("")
+	cfg := &nomad.VaultConfig{
+		Address:     addr.Address.String(),
+		JWTAuthPath: wi.AuthPath,
+		Audience:    wi.Audience,
+		CA:          vc.caPEM,
+	}
+	return cfg, nil
+}
+
+// ConfigureVaultWorkloadIdentity configures the JWT auth method of vc to
+// trust the workload identities signed by c's servers, with the default role
+// granting policies.  c must have been created with a Vault config from
+// NomadVaultConfig.
+func (c *NomadCluster) ConfigureVaultWorkloadIdentity(ctx context.Context, vc *VaultCluster, policies []string) error {
+	if c.vault == nil {
+		return fmt.Errorf("nomad cluster wasn't created with a vault config")
+	}
+	addr, err := c.servers[0].Endpoint(nomad.PortNames.HTTP, false)
+	if err != nil {
+		return err
+	}
+	wi := vault.DefaultNomadWorkloadIdentity(addr.Address.String())
+	wi.AuthPath, wi.Audience, wi.Policies = c.vault.JWTAuthPath, c.vault.Audience, policies
+	wi.JWKSCA = c.caPEM
+
+	clients, err := vc.Clients()
+	if err != nil {
+		return err
+	}
+	return vault.ConfigureNomadWorkloadIdentity(ctx, clients[0], wi)
+}
@@ -0,0 +1,273 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+// ReplicationMode is the kind of Vault Enterprise replication to use.
+type ReplicationMode string
+
+const (
+	PerformanceReplication ReplicationMode = "performance"
+	DRReplication          ReplicationMode = "dr"
+)
+
+// VaultReplicationPair is a pair of Vault Enterprise clusters with replication
+// established between them.  Primary and Secondary are swapped by Failover.
+type VaultReplicationPair struct {
+	Mode      ReplicationMode
+	Primary   *VaultCluster
+	Secondary *VaultCluster
+	// drToken is a batch token created on the original primary that may be
+	// used as a DR operation token to promote a DR secondary.
+	drToken string
+}
+
+// NewVaultReplicationPair enables replication of the given mode on primary,
+// then makes secondary a secondary of it.  Both clusters must already be
+// running Vault Enterprise, initialized and unsealed.  Once this returns the
+// secondary is streaming WALs from the primary.
+// The secondary's storage is wiped when it joins, so its unseal keys are
+// replaced by the primary's.  A DR secondary shares the primary's root token,
+// while a performance secondary is given a new one of its own.
+func NewVaultReplicationPair(ctx context.Context, mode ReplicationMode, primary, secondary *VaultCluster) (*VaultReplicationPair, error) {
+	pair := &VaultReplicationPair{
+		Mode:      mode,
+		Primary:   primary,
+		Secondary: secondary,
+	}
+
+	pcli, err := primary.client(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writeWithContext(ctx, pcli, pair.path("primary/enable"), nil); err != nil {
+		return nil, fmt.Errorf("error enabling %s primary: %w", mode, err)
+	}
+	if err := waitReplicationState(ctx, primary, mode, "running"); err != nil {
+		return nil, err
+	}
+
+	if mode == DRReplication {
+		pair.drToken, err = createDROperationToken(ctx, pcli)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pair.joinSecondary(ctx, primary, secondary, "secondary/enable"); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (p *VaultReplicationPair) path(suffix string) string {
+	return fmt.Sprintf("sys/replication/%s/%s", p.Mode, suffix)
+}
+
+// joinSecondary generates a secondary activation token on primary and hands
+// it to secondary using the given endpoint, i.e. either secondary/enable or
+// secondary/update-primary.
+func (p *VaultReplicationPair) joinSecondary(ctx context.Context, primary, secondary *VaultCluster, endpoint string) error {
+	pcli, err := primary.client(0)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	resp, err := writeWithContext(ctx, pcli, p.path("primary/secondary-token"), map[string]interface{}{
+		"id":  id,
+		"ttl": "30m",
+	})
+	if err != nil {
+		return fmt.Errorf("error generating %s secondary token: %w", p.Mode, err)
+	}
+	if resp == nil || resp.WrapInfo == nil {
+		return fmt.Errorf("no wrapped secondary token returned by primary")
+	}
+
+	scli, err := secondary.client(0)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"token": resp.WrapInfo.Token,
+	}
+	if strings.HasPrefix(pcli.Address(), "https") {
+		data["ca_file"] = "ca.pem"
+	}
+	if endpoint == "secondary/update-primary" && p.Mode == DRReplication {
+		data["dr_operation_token"] = p.drToken
+	}
+	if _, err := writeWithContext(ctx, scli, p.path(endpoint), data); err != nil {
+		return fmt.Errorf("error calling %s on %s secondary: %w", endpoint, p.Mode, err)
+	}
+
+	secondary.unsealKeys = append([]string{}, primary.unsealKeys...)
+	if err := waitReplicationState(ctx, secondary, p.Mode, "stream-wals"); err != nil {
+		return err
+	}
+	if p.Mode == DRReplication {
+		// Tokens are replicated to DR secondaries.
+		secondary.rootToken = primary.rootToken
+		return nil
+	}
+	// A performance secondary has its own token store, so the primary's root
+	// token isn't valid there.
+	secondary.rootToken, err = vault.GenerateRoot(ctx, scli, secondary.unsealKeys)
+	if err != nil {
+		return fmt.Errorf("error generating root token on %s secondary: %w", p.Mode, err)
+	}
+	return nil
+}
+
+// createDROperationToken creates a batch token able to promote a DR secondary.
+// Batch tokens are replicated to DR secondaries and, unlike service tokens,
+// can be used on them without first generating an operation token using the
+// unseal keys.
+func createDROperationToken(ctx context.Context, cli *vaultapi.Client) (string, error) {
+	_, err := writeWithContext(ctx, cli, "sys/policy/dr-secondary-promotion", map[string]interface{}{"policy": `
+path "sys/replication/dr/secondary/promote" {
+  capabilities = ["update"]
+}
+
+path "sys/replication/dr/secondary/update-primary" {
+  capabilities = ["update"]
+}
+`})
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := writeWithContext(ctx, cli, "auth/token/create", map[string]interface{}{
+		"no_parent": true,
+		"type":      "batch",
+		"ttl":       "24h",
+		"policies":  []string{"dr-secondary-promotion"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", fmt.Errorf("no token returned creating DR operation token")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// writeWithContext is like Logical().Write, but honours ctx, which the
+// vault/api version we use doesn't support for logical requests.
+func writeWithContext(ctx context.Context, cli *vaultapi.Client, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	req := cli.NewRequest("PUT", "/v1/"+path)
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := cli.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 204 {
+		return nil, nil
+	}
+	return vaultapi.ParseSecret(resp.Body)
+}
+
+// waitReplicationState polls the replication status of the given mode on
+// each of the nodes in c until one of them reports the wanted state.
+func waitReplicationState(ctx context.Context, c *VaultCluster, mode ReplicationMode, want string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var err error
+	var state string
+	for ctx.Err() == nil {
+		state, err = replicationState(c, mode)
+		if err == nil && state == want {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for %s replication state %q, last state=%q err=%v", mode, want, state, err)
+}
+
+func replicationState(c *VaultCluster, mode ReplicationMode) (string, error) {
+	clients, err := c.Clients()
+	if err != nil {
+		return "", err
+	}
+	var lastErr error
+	for _, client := range clients {
+		resp, err := client.Logical().Read(fmt.Sprintf("sys/replication/%s/status", mode))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp == nil || resp.Data == nil {
+			continue
+		}
+		if state, ok := resp.Data["state"].(string); ok && state != "idle" {
+			return state, nil
+		}
+	}
+	return "", lastErr
+}
+
+// DemotePrimary demotes the current primary to a secondary.  It will not
+// receive updates until it's pointed at a new primary using UpdatePrimary.
+func (p *VaultReplicationPair) DemotePrimary(ctx context.Context) error {
+	cli, err := p.Primary.client(0)
+	if err != nil {
+		return err
+	}
+	if _, err := writeWithContext(ctx, cli, p.path("primary/demote"), nil); err != nil {
+		return fmt.Errorf("error demoting %s primary: %w", p.Mode, err)
+	}
+	return nil
+}
+
+// PromoteSecondary promotes the current secondary to a primary.
+func (p *VaultReplicationPair) PromoteSecondary(ctx context.Context) error {
+	cli, err := p.Secondary.client(0)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{}
+	if p.Mode == DRReplication {
+		data["dr_operation_token"] = p.drToken
+	}
+	if _, err := writeWithContext(ctx, cli, p.path("secondary/promote"), data); err != nil {
+		return fmt.Errorf("error promoting %s secondary: %w", p.Mode, err)
+	}
+	return waitReplicationState(ctx, p.Secondary, p.Mode, "running")
+}
+
+// UpdatePrimary points the current secondary at the current primary, e.g.
+// after a failover has swapped them.
+func (p *VaultReplicationPair) UpdatePrimary(ctx context.Context) error {
+	return p.joinSecondary(ctx, p.Primary, p.Secondary, "secondary/update-primary")
+}
+
+// Failover demotes the primary, promotes the secondary, then makes the former
+// primary a secondary of the new one.  On success Primary and Secondary have
+// been swapped.
+func (p *VaultReplicationPair) Failover(ctx context.Context) error {
+	if err := p.DemotePrimary(ctx); err != nil {
+		return err
+	}
+	if err := p.PromoteSecondary(ctx); err != nil {
+		return err
+	}
+	p.Primary, p.Secondary = p.Secondary, p.Primary
+	return p.UpdatePrimary(ctx)
+}
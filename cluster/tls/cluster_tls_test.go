@@ -2,12 +2,26 @@ package tls
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt"
 	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/consul"
 	"github.com/ncabatoff/yurt/helper/testhelper"
+	"github.com/ncabatoff/yurt/pki"
 	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner/exec"
 )
 
 func TestConsulExecClusterTLS(t *testing.T) {
@@ -19,6 +33,211 @@ func TestConsulExecClusterTLS(t *testing.T) {
 	}
 }
 
+func TestConsulExecClusterMutualTLS(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 20*time.Second)
+	defer cleanup()
+
+	cc, err := cluster.NewConsulClusterWithOptions(e.Context(), e, cluster.ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		CA:        VaultCA,
+		MutualTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients[0].Status().Leader(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the listener really does reject clients without a cert.
+	apicfg, err := cc.Servers()[0].Endpoint("http", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := consulapi.DefaultConfig()
+	cfg.Address = apicfg.Address.String()
+	cfg.TLSConfig.CAFile = apicfg.CAFile
+	cli, err := consulapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Status().Leader(); err == nil {
+		t.Fatal("expected request without client cert to fail")
+	}
+}
+
+func TestConsulExecClusterVaultConnectCA(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 30*time.Second)
+	defer cleanup()
+	c, _, err := cluster.NewConsulClusterAndClient(t.Name(), e, VaultCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetVaultConnectCA(e.Context(), VaultCA); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := VaultCLI.Logical().Read(VaultCA.ConnectVaultCAConfig().RootPKIPath + "/cert/ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSpace(resp.Data["certificate"].(string))
+
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.UntilPass(t, e.Context(), func() error {
+		roots, _, err := clients[0].Connect().CARoots(nil)
+		if err != nil {
+			return err
+		}
+		for _, root := range roots.Roots {
+			if root.Active && strings.TrimSpace(root.RootCertPEM) == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("active Connect root doesn't match Vault PKI root")
+	})
+}
+
+func TestConsulExecClusterConnectLeafCert(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+	c, _, err := cluster.NewConsulClusterAndClient(t.Name(), e, VaultCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetVaultConnectCA(e.Context(), VaultCA); err != nil {
+		t.Fatal(err)
+	}
+	maker, err := c.ConnectCertificateMaker(e.Context(), VaultCA, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := maker.MakeCertificate(e.Context(), "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode([]byte(leaf.Cert))
+	if block == nil {
+		t.Fatal("no cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := maker.SPIFFEID("web").URI()
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != want {
+		t.Fatalf("expected URI SAN %s, got %v", want, cert.URIs)
+	}
+
+	clients, err := c.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inter := x509.NewCertPool()
+	inter.AppendCertsFromPEM([]byte(leaf.CA))
+	testhelper.UntilPass(t, e.Context(), func() error {
+		roots, _, err := clients[0].Connect().CARoots(nil)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		for _, root := range roots.Roots {
+			if root.Active {
+				pool.AppendCertsFromPEM([]byte(root.RootCertPEM))
+			}
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: inter,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	})
+
+	// Now check that a real sidecar accepts our leaf as coming from web, and
+	// presents its own cert for db.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	sidecar, err := c.Sidecar(e.Context(), e, VaultCA, "db", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sidecar.Stop()
+	public, err := sidecar.ProxyHarness.Endpoint(consul.ProxyPortNames.Public, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sidecar's leaf is signed by Connect's intermediate, which it may not
+	// send along, so trust it too.
+	connectInt, err := VaultCLI.Logical().Read(VaultCA.ConnectVaultCAConfig().IntermediatePKIPath + "/cert/ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.UntilPass(t, e.Context(), func() error {
+		roots, _, err := clients[0].Connect().CARoots(nil)
+		if err != nil {
+			return err
+		}
+		pems := []string{connectInt.Data["certificate"].(string)}
+		for _, root := range roots.Roots {
+			pems = append(pems, root.RootCertPEM)
+		}
+		return testhelper.ConnectHandshake(e.Context(), public.Address.Host, leaf, pems, maker.SPIFFEID("db").URI())
+	})
+}
+
+// ecdsaMaker is a custom CertificateMaker, standing in for an external
+// issuer, that makes ECDSA certs.
+type ecdsaMaker struct{}
+
+func (ecdsaMaker) MakeCertificate(ctx context.Context, hostname, ip string) (*pki.TLSConfigPEM, error) {
+	return VaultCA.ServerTLSWithOptions(ctx, "consul", pki.IssueOptions{KeyType: "ec", TTL: "1h"})
+}
+
+func TestConsulExecClusterCertificateMaker(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 20*time.Second)
+	defer cleanup()
+
+	cc, err := cluster.NewConsulClusterWithOptions(e.Context(), e, cluster.ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		Certs:     yurt.CertificateMakers{"consul": ecdsaMaker{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	for i, h := range cc.Servers() {
+		block, _ := pem.Decode([]byte(h.(*exec.Harness).Config.TLS.Cert))
+		if block == nil {
+			t.Fatalf("server %d: no cert", i)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.PublicKeyAlgorithm != x509.ECDSA {
+			t.Fatalf("server %d: expected ECDSA key, got %v", i, cert.PublicKeyAlgorithm)
+		}
+	}
+}
+
 func TestConsulDockerClusterTLS(t *testing.T) {
 	e, cleanup := runenv.NewDockerTestEnv(t, 30*time.Second)
 	defer cleanup()
@@ -50,6 +269,57 @@ func TestNomadExecClusterTLS(t *testing.T) {
 		"prometheus", testhelper.ExecDockerJobHCL(t), testhelper.TestPrometheus)
 }
 
+func TestNomadExecClusterMutualTLS(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	cc, err := cluster.NewConsulClusterWithOptions(e.Context(), e, cluster.ConsulClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		CA:        VaultCA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	nc, err := cluster.NewNomadClusterWithOptions(e.Context(), e, cluster.NomadClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		CA:        VaultCA,
+		Consul:    cc,
+		MutualTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(nc.Wait)
+
+	clients, err := nc.ClientAPIs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients[0].Status().Leader(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the listener really does reject clients without a cert.
+	apicfg, err := nc.Servers()[0].Endpoint("http", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := nomadapi.DefaultConfig()
+	cfg.Address = apicfg.Address.String()
+	cfg.TLSConfig.CACert = apicfg.CAFile
+	cli, err := nomadapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Status().Leader(); err == nil {
+		t.Fatal("expected request without client cert to fail")
+	}
+}
+
 func TestVaultExecClusterTLS(t *testing.T) {
 	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
 	defer cleanup()
@@ -61,6 +331,40 @@ func TestVaultExecClusterTLS(t *testing.T) {
 	e.Go(vc.Wait)
 }
 
+func TestVaultExecClusterMutualTLS(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 60*time.Second)
+	defer cleanup()
+
+	vc, err := cluster.NewVaultClusterWithOptions(e.Context(), e, cluster.VaultClusterOptions{
+		Name:      t.Name(),
+		NodeCount: 3,
+		CA:        VaultCA,
+		MutualTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(vc.Wait)
+
+	clients, err := vc.Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the listener really does reject clients without a cert.
+	cfg := clients[0].CloneConfig()
+	tlsConfig := cfg.HttpClient.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = nil
+	cfg.HttpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Sys().Health(); err == nil {
+		t.Fatal("expected request without client cert to fail")
+	}
+}
+
 func TestConsulVaultExecClusterTLS(t *testing.T) {
 	e, cleanup := runenv.NewExecTestEnv(t, 30*time.Second)
 	defer cleanup()
@@ -87,3 +391,156 @@ func TestCertificateAuthority_ConsulServerTLS(t *testing.T) {
 		t.Fatal("no key")
 	}
 }
+
+func TestCertificateAuthority_ServerTLSWithOptions(t *testing.T) {
+	tlspem, err := VaultCA.ServerTLSWithOptions(context.Background(), "consul", pki.IssueOptions{
+		KeyType:  "ec",
+		KeyBits:  256,
+		TTL:      "30s",
+		MaxTTL:   "1m",
+		AltNames: []string{"consul.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(tlspem.Cert))
+	if block == nil {
+		t.Fatal("no cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.PublicKeyAlgorithm != x509.ECDSA {
+		t.Fatalf("expected ECDSA key, got %v", cert.PublicKeyAlgorithm)
+	}
+	if ttl := time.Until(cert.NotAfter); ttl > time.Minute {
+		t.Fatalf("expected TTL of at most 1m, got %v", ttl)
+	}
+	if err := cert.VerifyHostname("consul.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateAuthority_SaveLoad(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "ca.json")
+	if err := VaultCA.Save(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := pki.LoadCertificateAuthority(ctx, VaultCLI, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Path() != VaultCA.Path() {
+		t.Fatalf("loaded CA has path %s, expected %s", ca.Path(), VaultCA.Path())
+	}
+
+	// Reopening by path must not create new mounts.
+	mounts, err := VaultCLI.Sys().ListMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pki.OpenCertificateAuthority(ctx, VaultCLI, VaultCA.Path()); err != nil {
+		t.Fatal(err)
+	}
+	after, err := VaultCLI.Sys().ListMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(mounts) {
+		t.Fatalf("expected %d mounts, got %d", len(mounts), len(after))
+	}
+
+	if _, err := ca.ConsulServerTLS(ctx, "", "1h"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpenCertificateAuthority_Race verifies that callers racing to create the
+// same CA all end up using it, rather than all but one failing to mount.
+func TestOpenCertificateAuthority_Race(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const n = 4
+	path := strings.ReplaceAll(t.Name(), "/", "-")
+	errs := make(chan error, n)
+	cas := make(chan *pki.CertificateAuthority, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			ca, err := pki.OpenCertificateAuthority(ctx, VaultCLI, path)
+			if err == nil {
+				_, err = ca.ConsulServerTLS(ctx, "", "1h")
+			}
+			errs <- err
+			cas <- ca
+		}()
+	}
+	var chain string
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		c, err := (<-cas).CAChain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chain != "" && c != chain {
+			t.Fatal("callers ended up with different CAs")
+		}
+		chain = c
+	}
+}
+
+func TestConsulExecClusterRevokedServerCert(t *testing.T) {
+	e, cleanup := runenv.NewExecTestEnv(t, 20*time.Second)
+	defer cleanup()
+
+	cc, err := cluster.NewConsulCluster(e.Context(), e, VaultCA, t.Name(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(cc.Wait)
+
+	servers := cc.Servers()
+	revokedTLS := servers[0].(*exec.Harness).Config.TLS
+	serial, err := revokedTLS.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := VaultCA.Revoke(ctx, serial); err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs []string
+	for _, h := range servers {
+		dirs = append(dirs, h.(*exec.Harness).Config.ConfigDir)
+	}
+	if err := VaultCA.WriteCRL(ctx, dirs...); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := VaultCA.CRL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, h := range servers {
+		apicfg, err := h.Endpoint("http", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			err = testhelper.ServerCertRevoked(ctx, apicfg.Address.Host, revokedTLS.CA, crl)
+		} else {
+			err = testhelper.TLSHandshakeWithCRL(ctx, apicfg.Address.Host, revokedTLS.CA, crl)
+		}
+		if err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+	}
+}
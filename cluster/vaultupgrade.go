@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/vault"
+	"github.com/pkg/errors"
+)
+
+// AddUpgradeNodes adds one node per entry in zones (use "" for no zone),
+// running the given version of Vault Enterprise and advertising it as their
+// autopilot upgrade version.  Autopilot automated upgrades join them as
+// non-voters, then once there are as many new-version nodes as old ones,
+// promotes them, demotes the old nodes and transfers leadership; use
+// vault.AutopilotUpgraded to wait for that to happen.
+func (c *VaultCluster) AddUpgradeNodes(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority, name, version string, zones []string) error {
+	ve := runenv.NewVersionedEnv(e, vault.Descriptor.Name, version)
+	for _, zone := range zones {
+		node, err := ve.AllocNode(name+"-vault-srv", vault.DefPorts().RunnerPorts())
+		if err != nil {
+			return err
+		}
+		c.autopilot[node.Name] = nodeAutopilot{zone: zone, upgradeVersion: version}
+		if err := c.addNode(ctx, ve, node, "", ca, 0); err != nil {
+			return err
+		}
+		c.nodes = append(c.nodes, node)
+		joinAddr, err := node.Address(vault.PortNames.HTTP)
+		if err != nil {
+			return err
+		}
+		c.joinAddrs = append(c.joinAddrs, joinAddr)
+
+		if c.seal != nil || len(c.unsealKeys) == 0 {
+			continue
+		}
+		client, err := c.client(len(c.servers) - 1)
+		if err != nil {
+			return err
+		}
+		uctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		for uctx.Err() == nil {
+			err = vault.Unseal(uctx, client, c.unsealKeys[0], false)
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err == nil {
+			err = uctx.Err()
+		}
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "error unsealing %s", node.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+// NewConsulClustersByVersion stands up one Consul cluster per version side by
+// side in e, returning them keyed by version.  Each cluster's name has a
+// version suffix, and its nodes are scraped with a version label if e is
+// monitored.  On error any clusters already started are killed.
+func NewConsulClustersByVersion(ctx context.Context, e runenv.Env, ca *pki.CertificateAuthority,
+	name string, nodeCount int, versions []string) (map[string]*ConsulCluster, error) {
+
+	clusters := map[string]*ConsulCluster{}
+	for _, version := range versions {
+		ve := runenv.NewVersionedEnv(e, consul.Descriptor.Name, version)
+		c, err := NewConsulCluster(ctx, ve, ca, name+"-"+ve.NameSuffix(), nodeCount)
+		if err != nil {
+			for _, c := range clusters {
+				c.Kill()
+			}
+			return nil, fmt.Errorf("error starting consul %s cluster: %w", version, err)
+		}
+		e.Go(c.Wait)
+		clusters[version] = c
+	}
+	return clusters, nil
+}
+
+// NewVaultClustersByVersion is like NewConsulClustersByVersion for Vault; the
+// clusters are created using opts, with Name suffixed by version.
+func NewVaultClustersByVersion(ctx context.Context, e runenv.Env, opts VaultClusterOptions,
+	versions []string) (map[string]*VaultCluster, error) {
+
+	clusters := map[string]*VaultCluster{}
+	for _, version := range versions {
+		ve := runenv.NewVersionedEnv(e, vault.Descriptor.Name, version)
+		vopts := opts
+		vopts.Name = opts.Name + "-" + ve.NameSuffix()
+		c, err := NewVaultClusterWithOptions(ctx, ve, vopts)
+		if err != nil {
+			for _, c := range clusters {
+				c.Kill()
+			}
+			return nil, fmt.Errorf("error starting vault %s cluster: %w", version, err)
+		}
+		e.Go(c.Wait)
+		clusters[version] = c
+	}
+	return clusters, nil
+}
+
+// ForEachVersion runs suite once per version, e.g. against each of the
+// clusters returned by NewConsulClustersByVersion.  All versions are run even
+// if some fail; the errors returned are annotated with their version.
+func ForEachVersion(versions []string, suite func(version string) error) error {
+	var errs *multierror.Error
+	for _, version := range versions {
+		if err := suite(version); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("version %s: %w", version, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
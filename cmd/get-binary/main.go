@@ -1,26 +1,51 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/ncabatoff/yurt/binaries"
 )
 
 func main() {
 	var (
-		flagWorkDir = flag.String("workdir", "", "directory to store files")
-		flagVersion = flag.String("version", "", "override default version")
-		flagOS      = flag.String("os", runtime.GOOS, "override default OS")
-		flagArch    = flag.String("arch", runtime.GOARCH, "override default arch")
+		flagWorkDir  = flag.String("workdir", "", "directory to store files")
+		flagVersion  = flag.String("version", "", "override default version")
+		flagOS       = flag.String("os", runtime.GOOS, "override default OS")
+		flagArch     = flag.String("arch", runtime.GOARCH, "override default arch")
+		flagList     = flag.Bool("list", false, "list the versions published upstream, newest first, instead of fetching")
+		flagLatest   = flag.Bool("latest", false, "fetch the newest stable version published upstream")
+		flagVerify   = flag.Bool("verify", false, "verify the downloaded archive against the vendor's SHA256 checksums, and print its digest to stderr")
+		flagCheck    = flag.Bool("check-only", false, "don't download anything, only verify the already cached binary as for -verify")
+		flagAll      = flag.Bool("all", false, "fetch every package yurt's tests need for the current platform, instead of a single package")
+		flagManifest = flag.String("manifest", "", "fetch the packages listed in this file for the current platform, one package[@version] per line")
+		flagParallel = flag.Int("parallel", 4, "with -all or -manifest, how many packages to fetch at a time")
 	)
 	flag.Parse()
 
 	args := flag.Args()
+	if *flagAll || *flagManifest != "" {
+		if len(args) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := prefetch(*flagWorkDir, *flagAll, *flagManifest, *flagParallel); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(args) != 1 {
 		flag.Usage()
+		os.Exit(2)
+	}
+	if *flagLatest && *flagVersion != "" {
+		fmt.Fprintln(os.Stderr, "-latest and -version are mutually exclusive")
+		os.Exit(2)
 	}
 
 	if *flagWorkDir == "" {
@@ -32,10 +57,99 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	path, err := binmgr.GetOSArch(args[0], *flagOS, *flagArch, *flagVersion)
+
+	if *flagList {
+		releases, err := binmgr.Releases(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, r := range releases {
+			if r.Prerelease {
+				fmt.Println(r.Version, "(prerelease)")
+			} else {
+				fmt.Println(r.Version)
+			}
+		}
+		return
+	}
+
+	version := *flagVersion
+	if *flagLatest {
+		version, err = binmgr.LatestVersion(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var path string
+	if *flagCheck {
+		path, err = binmgr.Cached(args[0], *flagOS, *flagArch, version)
+	} else {
+		path, err = binmgr.GetOSArch(args[0], *flagOS, *flagArch, version)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if *flagVerify || *flagCheck {
+		digest, err := binmgr.Verify(args[0], *flagOS, *flagArch, version)
+		if digest != "" {
+			fmt.Fprintf(os.Stderr, "sha256:%s\n", digest)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	fmt.Println(path)
 }
+
+// prefetch fetches the test packages if all is true, and those listed in the
+// manifest file if given.  Unless workDir is given, they're stored where
+// binaries.Default looks for them, so that tests run afterwards find them.
+func prefetch(workDir string, all bool, manifest string, parallelism int) error {
+	if workDir == "" {
+		workDir = binaries.DefaultWorkDir()
+	}
+	var packages []string
+	if all {
+		packages = append(packages, binaries.TestPackages...)
+	}
+	if manifest != "" {
+		listed, err := readManifest(manifest)
+		if err != nil {
+			return err
+		}
+		packages = append(packages, listed...)
+	}
+
+	binmgr, err := binaries.NewDownloadManager(workDir)
+	if err != nil {
+		return err
+	}
+	return binmgr.PrefetchParallel(packages, parallelism)
+}
+
+// readManifest returns the packages listed in path, ignoring blank lines and
+// comments starting with "#".
+func readManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var packages []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			packages = append(packages, line)
+		}
+	}
+	return packages, sc.Err()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// controlAPI serves an HTTP API for inspecting and manipulating the running
+// clusters:
+//
+//	GET  /v1/clusters                       clusters and their server nodes
+//	GET  /v1/nodes                          all nodes, as in the state file
+//	GET  /v1/endpoints                      addresses and credentials, as for -output
+//	POST /v1/nodes/<node>/stop              stop a node gracefully
+//	POST /v1/nodes/<node>/kill              kill a node
+//	POST /v1/nodes/<node>/replace           replace a Consul server or Vault node
+//	POST /v1/clusters/<name>/snapshot       save a snapshot, ?product=consul|vault
+//	POST /v1/plan                           actions needed to match the topology posted, ?format=yaml|hcl
+//	POST /v1/apply                          execute those actions
+type controlAPI struct {
+	// l serializes operations that change the clusters.
+	l  sync.Mutex
+	e  runenv.Env
+	ca *pki.CertificateAuthority
+	sd *shutdown
+	// names are the cluster names in topology order.
+	names []string
+	// nodeEnvs are the envs whose nodes are reported, as for the state file.
+	nodeEnvs []runenv.Env
+	// topo is the topology the clusters were created or last updated to
+	// match.
+	topo *topology
+	// setVersions sets the versions of the products run by new nodes.
+	setVersions func(map[string]string)
+	// saveState rewrites the state file, recording topo.
+	saveState func(topo *topology) error
+}
+
+type clusterInfo struct {
+	Name   string   `json:"name"`
+	Consul []string `json:"consul,omitempty"`
+	Nomad  []string `json:"nomad,omitempty"`
+	Vault  []string `json:"vault,omitempty"`
+}
+
+func (a *controlAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/clusters", a.get(func() (interface{}, error) {
+		return a.clusters(), nil
+	}))
+	mux.HandleFunc("/v1/nodes", a.get(func() (interface{}, error) {
+		var s clusterState
+		for _, env := range a.nodeEnvs {
+			s.addNodes(env)
+		}
+		return s.Nodes, nil
+	}))
+	mux.HandleFunc("/v1/endpoints", a.get(func() (interface{}, error) {
+		return a.sd.endpoints()
+	}))
+	mux.HandleFunc("/v1/nodes/", a.post(a.nodeOp))
+	mux.HandleFunc("/v1/clusters/", a.post(a.snapshot))
+	mux.HandleFunc("/v1/plan", a.change(false))
+	mux.HandleFunc("/v1/apply", a.change(true))
+	return mux
+}
+
+func (a *controlAPI) get(f func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.l.Lock()
+		v, err := f()
+		a.l.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// post wraps handlers of POST requests to paths of the form
+// /v1/<kind>/<name>/<op>.
+func (a *controlAPI) post(f func(w http.ResponseWriter, r *http.Request, name, op string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 {
+			http.NotFound(w, r)
+			return
+		}
+		a.l.Lock()
+		defer a.l.Unlock()
+		if err := f(w, r, parts[2], parts[3]); err != nil {
+			var he httpError
+			if errors.As(err, &he) {
+				http.Error(w, he.msg, he.code)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+func (a *controlAPI) clusters() []clusterInfo {
+	infos := map[string]*clusterInfo{}
+	get := func(name string) *clusterInfo {
+		if infos[name] == nil {
+			infos[name] = &clusterInfo{Name: name}
+		}
+		return infos[name]
+	}
+	for _, cnc := range a.sd.cncs {
+		ci := get(cnc.Name)
+		ci.Consul = nodeNames(cnc.Consul.Nodes())
+		ci.Nomad = nodeNames(cnc.Nomad.Nodes())
+	}
+	for name, cc := range a.sd.consuls {
+		get(name).Consul = nodeNames(cc.Nodes())
+	}
+	for name, vc := range a.sd.vaults {
+		get(name).Vault = nodeNames(vc.Nodes())
+	}
+
+	var ret []clusterInfo
+	for _, name := range a.names {
+		if ci, ok := infos[name]; ok {
+			ret = append(ret, *ci)
+		}
+	}
+	return ret
+}
+
+func nodeNames(nodes []yurt.Node) []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func (a *controlAPI) harness(name string) (runner.Harness, bool) {
+	for _, env := range a.nodeEnvs {
+		if h, ok := env.Harness(name); ok {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+func (a *controlAPI) nodeOp(w http.ResponseWriter, r *http.Request, name, op string) error {
+	h, ok := a.harness(name)
+	if !ok {
+		return httpError{http.StatusNotFound, fmt.Sprintf("no node named %q", name)}
+	}
+	switch op {
+	case "stop":
+		if err := h.Stop(); err != nil {
+			return err
+		}
+	case "kill":
+		h.Kill()
+	case "replace":
+		if err := a.replace(r.Context(), name); err != nil {
+			return err
+		}
+	default:
+		return httpError{http.StatusNotFound, fmt.Sprintf("unknown operation %q", op)}
+	}
+	log.Printf("%s node %s via API", op, name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// replace replaces the named node.  Vault nodes are restarted in place,
+// while Consul servers are replaced by a new server, after which the old one
+// is removed.
+func (a *controlAPI) replace(ctx context.Context, name string) error {
+	for _, vc := range a.sd.vaults {
+		for i, n := range vc.Nodes() {
+			if n.Name == name {
+				return vc.ReplaceNode(ctx, a.e, i, a.ca, false)
+			}
+		}
+	}
+	var consuls []*cluster.ConsulCluster
+	for _, cnc := range a.sd.cncs {
+		consuls = append(consuls, cnc.Consul)
+	}
+	for _, cc := range a.sd.consuls {
+		consuls = append(consuls, cc)
+	}
+	for _, cc := range consuls {
+		for i, n := range cc.Nodes() {
+			if n.Name == name {
+				if err := cc.AddServer(ctx, a.e, a.ca); err != nil {
+					return err
+				}
+				return cc.RetireServer(ctx, i)
+			}
+		}
+	}
+	return httpError{http.StatusBadRequest, fmt.Sprintf("node %s isn't a Consul server or Vault node", name)}
+}
+
+// snapshot writes a snapshot of the named cluster's Consul or Vault raft
+// state to the response.
+func (a *controlAPI) snapshot(w http.ResponseWriter, r *http.Request, name, op string) error {
+	if op != "snapshot" {
+		return httpError{http.StatusNotFound, fmt.Sprintf("unknown operation %q", op)}
+	}
+	cc := a.sd.consuls[name]
+	for _, cnc := range a.sd.cncs {
+		if cnc.Name == name {
+			cc = cnc.Consul
+		}
+	}
+	vc, haveVault := a.sd.vaults[name]
+	// Default to Consul, unless the cluster only has Vault.
+	product := r.URL.Query().Get("product")
+	if product == "" {
+		product = "consul"
+		if cc == nil && haveVault {
+			product = "vault"
+		}
+	}
+
+	switch product {
+	case "consul":
+		if cc == nil {
+			return httpError{http.StatusNotFound, fmt.Sprintf("cluster %s has no Consul servers", name)}
+		}
+		snap, err := cc.Snapshot(r.Context())
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(snap)
+		return err
+	case "vault":
+		if !haveVault {
+			return httpError{http.StatusNotFound, fmt.Sprintf("cluster %s has no Vault", name)}
+		}
+		idx, err := vc.ActiveNode(r.Context())
+		if err != nil {
+			return err
+		}
+		clients, err := vc.Clients()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		return clients[idx].Sys().RaftSnapshot(w)
+	}
+	return httpError{http.StatusBadRequest, fmt.Sprintf("invalid product %q, must be consul or vault", product)}
+}
+
+// serveAPI serves a's handler on addr until ctx is done.
+func serveAPI(ctx context.Context, addr string, a *controlAPI) error {
+	srv := &http.Server{Addr: addr, Handler: a.handler()}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	log.Printf("serving control API on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
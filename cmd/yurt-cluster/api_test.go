@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+func testAPI(t *testing.T) (*controlAPI, *fakeHarness, *httptest.Server) {
+	t.Helper()
+	h := &fakeHarness{}
+	env := &fakeEnv{
+		nodes:     map[string]yurt.Node{"c1-consul-cli-1": testNode("c1-consul-cli-1", 8500)},
+		harnesses: map[string]runner.Harness{"c1-consul-cli-1": h},
+	}
+	var saved *topology
+	a := &controlAPI{
+		sd:          &shutdown{},
+		names:       []string{"c1", "old"},
+		nodeEnvs:    []runenv.Env{env},
+		topo:        testTopology(t, "clusters: [{name: c1}, {name: old}]"),
+		setVersions: func(map[string]string) {},
+		saveState: func(topo *topology) error {
+			saved = topo
+			return nil
+		},
+	}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		if saved != nil && saved != a.topo {
+			t.Error("expected saved topology to be current")
+		}
+	})
+	return a, h, srv
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestAPINodes(t *testing.T) {
+	_, h, srv := testAPI(t)
+
+	code, body := request(t, http.MethodGet, srv.URL+"/v1/nodes", "")
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+	var nodes []nodeState
+	if err := json.Unmarshal([]byte(body), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "c1-consul-cli-1" || nodes[0].Ports["http"] != 8500 {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+
+	if code, _ := request(t, http.MethodPost, srv.URL+"/v1/nodes", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to be rejected, got %d", code)
+	}
+	if code, _ := request(t, http.MethodGet, srv.URL+"/v1/nodes/c1-consul-cli-1/stop", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be rejected, got %d", code)
+	}
+	if code, _ := request(t, http.MethodPost, srv.URL+"/v1/nodes/nosuch/stop", ""); code != http.StatusNotFound {
+		t.Fatalf("expected unknown node to be not found, got %d", code)
+	}
+	if code, _ := request(t, http.MethodPost, srv.URL+"/v1/nodes/c1-consul-cli-1/explode", ""); code != http.StatusNotFound {
+		t.Fatalf("expected unknown op to be not found, got %d", code)
+	}
+	if code, _ := request(t, http.MethodPost, srv.URL+"/v1/nodes/c1-consul-cli-1/replace", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected replacing a client agent to be rejected, got %d", code)
+	}
+
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/nodes/c1-consul-cli-1/stop", ""); code != http.StatusNoContent || !h.stopped {
+		t.Fatalf("expected node to be stopped, got %d: %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/nodes/c1-consul-cli-1/kill", ""); code != http.StatusNoContent || !h.killed {
+		t.Fatalf("expected node to be killed, got %d: %s", code, body)
+	}
+}
+
+func TestAPIClusters(t *testing.T) {
+	_, _, srv := testAPI(t)
+
+	code, body := request(t, http.MethodGet, srv.URL+"/v1/clusters", "")
+	if code != http.StatusOK || strings.TrimSpace(body) != "null" {
+		t.Fatalf("expected no clusters, got %d: %s", code, body)
+	}
+	for _, product := range []string{"", "consul", "vault"} {
+		code, body := request(t, http.MethodPost, srv.URL+"/v1/clusters/c1/snapshot?product="+product, "")
+		if code != http.StatusNotFound {
+			t.Fatalf("expected %q snapshot of missing cluster to be not found, got %d: %s", product, code, body)
+		}
+	}
+	if code, _ := request(t, http.MethodPost, srv.URL+"/v1/clusters/c1/snapshot?product=nomad", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected invalid product to be rejected, got %d", code)
+	}
+}
+
+func TestAPIPlanApply(t *testing.T) {
+	a, _, srv := testAPI(t)
+
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/plan", "clusters: [{name: c1, nodez: 3}]"); code != http.StatusBadRequest {
+		t.Fatalf("expected bad topology to be rejected, got %d: %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/plan", "tls: true\nclusters: [{name: c1}]"); code != http.StatusBadRequest {
+		t.Fatalf("expected tls change to be rejected, got %d: %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/plan?format=toml", "clusters: [{name: c1}]"); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown format to be rejected, got %d: %s", code, body)
+	}
+	// HCL needs the format given, since it isn't valid YAML.
+	hclTopo := "cluster \"c1\" {}\ncluster \"old\" {}\n"
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/plan", hclTopo); code != http.StatusBadRequest {
+		t.Fatalf("expected HCL without format to be rejected, got %d: %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, srv.URL+"/v1/plan?format=hcl", hclTopo); code != http.StatusOK {
+		t.Fatalf("expected HCL topology to be planned, got %d: %s", code, body)
+	}
+
+	// No servers are running, so c1 needs all of its Consul servers created.
+	code, body := request(t, http.MethodPost, srv.URL+"/v1/plan", "clusters: [{name: c1}]")
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+	var actions []action
+	if err := json.Unmarshal([]byte(body), &actions); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, act := range actions {
+		got = append(got, act.Op+" "+act.Kind+" "+act.Cluster)
+	}
+	expected := []string{
+		"destroy cluster old",
+		"create consul-server c1",
+		"create consul-server c1",
+		"create consul-server c1",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+	if len(a.names) != 2 {
+		t.Fatalf("expected plan to change nothing, got clusters %v", a.names)
+	}
+
+	// There's no Consul cluster for the servers to join.
+	code, body = request(t, http.MethodPost, srv.URL+"/v1/apply", "clusters: [{name: c1}]")
+	if code != http.StatusInternalServerError || !strings.Contains(body, "has no Consul servers") {
+		t.Fatalf("expected apply to fail, got %d: %s", code, body)
+	}
+	// Cluster old was destroyed before the failure, and that's been recorded.
+	if got := strings.Join(a.topo.clusterNames(), ","); got != "c1" {
+		t.Fatalf("expected clusters c1 after partial apply, got %s", got)
+	}
+	if got := strings.Join(a.names, ","); got != "c1" {
+		t.Fatalf("expected cluster names c1 after partial apply, got %s", got)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// change returns a handler that reads a topology from the request body, in
+// YAML or, given ?format=hcl, HCL, and responds with the actions needed to
+// make the clusters match it, first executing them if apply is true.
+func (a *controlAPI) change(apply bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// parseTopology goes by the extension of the name it's given.
+		name := "request"
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "yaml":
+		case "hcl":
+			name = "request.hcl"
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+		a.l.Lock()
+		defer a.l.Unlock()
+		want, err := desiredTopology(contents, name, a.topo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		actions, err := planChanges(a.topo, want, a.inventory())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if apply {
+			if err := a.apply(r.Context(), want, actions); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, actions)
+	}
+}
+
+// inventory returns the nodes of the running clusters.
+func (a *controlAPI) inventory() inventory {
+	inv := inventory{}
+	addNodes := func(name, kind string, nodes []string) {
+		for _, node := range nodes {
+			inv.add(name, kind, node)
+		}
+	}
+	for _, cnc := range a.sd.cncs {
+		addNodes(cnc.Name, kindConsulServer, nodeNames(cnc.Consul.Nodes()))
+		addNodes(cnc.Name, kindNomadServer, nodeNames(cnc.Nomad.Nodes()))
+	}
+	for name, cc := range a.sd.consuls {
+		addNodes(name, kindConsulServer, nodeNames(cc.Nodes()))
+	}
+	for name, vc := range a.sd.vaults {
+		addNodes(name, kindVaultNode, nodeNames(vc.Nodes()))
+	}
+	for _, nc := range a.sd.nomadClients {
+		node := a.nodeName(nc.NomadHarness)
+		if name, _, _, ok := parseNodeName(node); ok {
+			inv.add(name, kindNomadClient, node)
+		}
+	}
+	return inv
+}
+
+// nodeName returns the name of the node h was started as.
+func (a *controlAPI) nodeName(h runner.Harness) string {
+	for _, env := range a.nodeEnvs {
+		for _, name := range env.NodeNames() {
+			if nh, ok := env.Harness(name); ok && nh == h {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// apply executes actions to make the clusters match want, then records want
+// in the state file.  If an action fails, the clusters created or destroyed
+// so far are recorded instead, so that the state file still describes what's
+// running and the topology can be applied again.
+func (a *controlAPI) apply(ctx context.Context, want *topology, actions []action) error {
+	// Nodes created from here on, including replacements, run the versions
+	// wanted.
+	a.setVersions(want.Versions)
+	done := *a.topo
+	done.Clusters = append([]clusterSpec{}, a.topo.Clusters...)
+	for _, act := range actions {
+		log.Printf("applying: %s", act)
+		if err := a.execute(ctx, want, act); err != nil {
+			err = fmt.Errorf("%s: %w", act, err)
+			a.topo = &done
+			a.names = done.clusterNames()
+			if serr := a.saveState(&done); serr != nil {
+				log.Printf("error saving state: %v", serr)
+			}
+			return err
+		}
+		if act.Kind != kindCluster {
+			continue
+		}
+		var clusters []clusterSpec
+		for _, c := range done.Clusters {
+			if c.Name != act.Cluster {
+				clusters = append(clusters, c)
+			}
+		}
+		if act.Op != opDestroy {
+			clusters = append(clusters, *want.cluster(act.Cluster))
+		}
+		done.Clusters = clusters
+	}
+	a.topo = want
+	a.names = want.clusterNames()
+	return a.saveState(want)
+}
+
+func (a *controlAPI) execute(ctx context.Context, want *topology, act action) error {
+	switch act.Kind {
+	case kindCluster:
+		if act.Op != opCreate {
+			a.stopCluster(act.Cluster)
+		}
+		if act.Op == opDestroy {
+			return nil
+		}
+		return startCluster(a.e, a.ca, *want.cluster(act.Cluster), false, a.sd)
+
+	case kindConsulServer:
+		if act.Op == opReplace {
+			return a.replace(ctx, act.Node)
+		}
+		cc := a.consul(act.Cluster)
+		if cc == nil {
+			return fmt.Errorf("cluster %s has no Consul servers", act.Cluster)
+		}
+		if act.Op == opCreate {
+			return cc.AddServer(ctx, a.e, a.ca)
+		}
+		for i, n := range cc.Nodes() {
+			if n.Name == act.Node {
+				return cc.RetireServer(ctx, i)
+			}
+		}
+		return fmt.Errorf("no Consul server named %s", act.Node)
+
+	case kindVaultNode:
+		if act.Op == opReplace {
+			return a.replace(ctx, act.Node)
+		}
+
+	case kindNomadClient:
+		switch act.Op {
+		case opCreate:
+			for _, cnc := range a.sd.cncs {
+				if cnc.Name == act.Cluster {
+					nc, err := cnc.NomadClient(a.e, a.ca)
+					if err != nil {
+						return err
+					}
+					a.sd.nomadClients = append(a.sd.nomadClients, nc)
+					a.e.Go(nc.Wait)
+					return nil
+				}
+			}
+			return fmt.Errorf("cluster %s has no Nomad servers", act.Cluster)
+		case opDestroy:
+			for i, nc := range a.sd.nomadClients {
+				if a.nodeName(nc.NomadHarness) == act.Node {
+					nc.Stop()
+					a.sd.nomadClients = append(a.sd.nomadClients[:i:i], a.sd.nomadClients[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("no Nomad client named %s", act.Node)
+		}
+	}
+	return fmt.Errorf("can't %s a %s", act.Op, act.Kind)
+}
+
+// consul returns the Consul servers of the named cluster, if it has any.
+func (a *controlAPI) consul(name string) *cluster.ConsulCluster {
+	for _, cnc := range a.sd.cncs {
+		if cnc.Name == name {
+			return cnc.Consul
+		}
+	}
+	return a.sd.consuls[name]
+}
+
+// stopCluster stops the clusters named name, along with their client agents
+// and any Vault created to provide their seal, and forgets about them.
+func (a *controlAPI) stopCluster(name string) {
+	owned := func(h runner.Harness, owner string) bool {
+		c, _, _, ok := parseNodeName(a.nodeName(h))
+		return ok && c == owner
+	}
+
+	var nomadClients []*cluster.NomadClient
+	for _, nc := range a.sd.nomadClients {
+		if owned(nc.NomadHarness, name) {
+			nc.Stop()
+		} else {
+			nomadClients = append(nomadClients, nc)
+		}
+	}
+	a.sd.nomadClients = nomadClients
+
+	var cncs []*cluster.ConsulNomadCluster
+	for _, cnc := range a.sd.cncs {
+		if cnc.Name == name {
+			cnc.Stop()
+		} else {
+			cncs = append(cncs, cnc)
+		}
+	}
+	a.sd.cncs = cncs
+
+	if vc, ok := a.sd.vaults[name]; ok {
+		vc.Stop()
+		delete(a.sd.vaults, name)
+	}
+	var sealers []*cluster.VaultCluster
+	for _, sealer := range a.sd.sealers {
+		if owned(sealer.Servers()[0], name+"-sealer") {
+			sealer.Stop()
+		} else {
+			sealers = append(sealers, sealer)
+		}
+	}
+	a.sd.sealers = sealers
+
+	var consulClients []runner.Harness
+	for _, h := range a.sd.consulClients {
+		if owned(h, name) {
+			_ = h.Stop()
+		} else {
+			consulClients = append(consulClients, h)
+		}
+	}
+	a.sd.consulClients = consulClients
+	if cc, ok := a.sd.consuls[name]; ok {
+		cc.Stop()
+		delete(a.sd.consuls, name)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// drain prepares for shutdown the way an operator would in production: Nomad
+// client nodes are drained, the services registered with Consul agents are
+// deregistered, and Vault leaders step down.  Errors are only logged, since
+// they shouldn't prevent shutdown.  Each step is given up to timeout.
+func (s *shutdown) drain(timeout time.Duration) {
+	for _, nc := range s.nomadClients {
+		nc := nc
+		drainStep("draining nomad client", func() error {
+			return drainNomadClient(nc.NomadHarness, timeout)
+		})
+	}
+
+	var agents []runner.Harness
+	for _, nc := range s.nomadClients {
+		agents = append(agents, nc.ConsulHarness)
+	}
+	for _, cnc := range s.cncs {
+		agents = append(agents, cnc.Nomad.ConsulAgents()...)
+	}
+	agents = append(agents, s.consulClients...)
+	for _, h := range agents {
+		h := h
+		drainStep("deregistering consul services", func() error {
+			return deregisterServices(h)
+		})
+	}
+
+	for name, vc := range s.vaults {
+		vc := vc
+		drainStep("stepping down "+name+" vault leader", func() error {
+			return stepDown(vc, timeout)
+		})
+	}
+}
+
+func drainStep(name string, f func() error) {
+	log.Print(name)
+	if err := f(); err != nil {
+		log.Printf("error %s: %v", name, err)
+	}
+}
+
+// drainNomadClient drains the client node whose agent is h, waiting up to
+// timeout for the drain to complete.  Allocations that haven't migrated by
+// then are stopped.
+func drainNomadClient(h runner.Harness, timeout time.Duration) error {
+	cli, err := nomad.HarnessToAPI(h)
+	if err != nil {
+		return err
+	}
+	self, err := cli.Agent().Self()
+	if err != nil {
+		return err
+	}
+	id := self.Stats["client"]["node_id"]
+	if id == "" {
+		return fmt.Errorf("agent isn't a nomad client")
+	}
+	_, err = cli.Nodes().UpdateDrain(id, &nomadapi.DrainSpec{Deadline: timeout}, false, nil)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		node, _, err := cli.Nodes().Info(id, nil)
+		if err == nil && !node.Drain {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for drain of node %s", id)
+}
+
+// deregisterServices removes all the services registered with the Consul
+// agent h.
+func deregisterServices(h runner.Harness) error {
+	cli, err := consul.HarnessToAPI(h)
+	if err != nil {
+		return err
+	}
+	services, err := cli.Agent().Services()
+	if err != nil {
+		return err
+	}
+	for id := range services {
+		if err := cli.Agent().ServiceDeregister(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepDown asks the active node of vc to give up leadership.
+func stepDown(vc *cluster.VaultCluster, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	idx, err := vc.ActiveNode(ctx)
+	if err != nil {
+		return err
+	}
+	clients, err := vc.Clients()
+	if err != nil {
+		return err
+	}
+	return clients[idx].Sys().StepDown()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAgentServer serves the given handlers, recording the method and path
+// of each request.
+func fakeAgentServer(t *testing.T, handlers map[string]interface{}) (*fakeHarness, func() []string) {
+	t.Helper()
+	var l sync.Mutex
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		reqs = append(reqs, r.Method+" "+r.URL.Path)
+		l.Unlock()
+		resp, ok := handlers[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	h := &fakeHarness{addr: strings.TrimPrefix(srv.URL, "http://")}
+	return h, func() []string {
+		l.Lock()
+		defer l.Unlock()
+		return append([]string{}, reqs...)
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeregisterServices(t *testing.T) {
+	h, reqs := fakeAgentServer(t, map[string]interface{}{
+		"/v1/agent/services": map[string]interface{}{
+			"web-1": map[string]interface{}{"ID": "web-1", "Service": "web"},
+			"db-1":  map[string]interface{}{"ID": "db-1", "Service": "db"},
+		},
+		"/v1/agent/service/deregister/web-1": nil,
+		"/v1/agent/service/deregister/db-1":  nil,
+	})
+	if err := deregisterServices(h); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"PUT /v1/agent/service/deregister/web-1", "PUT /v1/agent/service/deregister/db-1"} {
+		if !contains(reqs(), want) {
+			t.Fatalf("expected request %q, got %v", want, reqs())
+		}
+	}
+}
+
+func TestDrainNomadClient(t *testing.T) {
+	h, reqs := fakeAgentServer(t, map[string]interface{}{
+		"/v1/agent/self": map[string]interface{}{
+			"stats": map[string]map[string]string{"client": {"node_id": "n1"}},
+		},
+		"/v1/node/n1/drain": map[string]interface{}{},
+		"/v1/node/n1":       map[string]interface{}{"ID": "n1", "Drain": false},
+	})
+	if err := drainNomadClient(h, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(reqs(), "PUT /v1/node/n1/drain") {
+		t.Fatalf("expected drain request, got %v", reqs())
+	}
+
+	// A server agent has no client node to drain.
+	h, _ = fakeAgentServer(t, map[string]interface{}{
+		"/v1/agent/self": map[string]interface{}{"stats": map[string]map[string]string{}},
+	})
+	if err := drainNomadClient(h, time.Second); err == nil {
+		t.Fatal("expected error draining a server")
+	}
+}
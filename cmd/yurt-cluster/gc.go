@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/ncabatoff/yurt/docker"
+)
+
+// gc removes docker resources left behind by yurt runs that failed to clean
+// up, whether or not they were created by yurt-cluster.
+func gc(args []string) {
+	fs := flag.NewFlagSet("yurt-cluster gc", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", time.Hour, "only remove containers, networks and volumes created at least this long ago")
+	_ = fs.Parse(args)
+
+	cli, err := dockerClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	removed, err := docker.Cleanup(context.Background(), cli, *olderThan)
+	if removed != nil {
+		for _, name := range removed.Containers {
+			log.Printf("removed container %s", name)
+		}
+		for _, name := range removed.Networks {
+			log.Printf("removed network %s", name)
+		}
+		for _, name := range removed.Volumes {
+			log.Printf("removed volume %s", name)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,38 +3,194 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/ncabatoff/yurt/binaries"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/events"
 	"github.com/ncabatoff/yurt/nomad"
 	"github.com/ncabatoff/yurt/pki"
 	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/ncabatoff/yurt/util"
+	"github.com/ncabatoff/yurt/vault"
 	"github.com/skratchdot/open-golang/open"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status", "stop", "destroy":
+			manage(os.Args[1], os.Args[2:])
+			return
+		case "gc":
+			gc(os.Args[2:])
+			return
+		case "plan", "apply":
+			reconcile(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		flagMode       = flag.String("mode", "exec", "cluster creation mode: exec or docker")
 		flagFirstPort  = flag.Int("first-port", 23000, "first port to allocate to cluster, only for mode=exec")
 		flagCIDR       = flag.String("cidr", "", "cidr to allocate to cluster, only for mode=docker")
-		flagNodes      = flag.Int("nodes", 3, "number of server nodes")
+		flagNodes      = flag.Int("nodes", defaultNodes, "number of server nodes")
+		flagConsulSrvs = flag.Int("consul-servers", 0, "number of Consul server nodes, defaults to -nodes")
+		flagNomadSrvs  = flag.Int("nomad-servers", 0, "number of Nomad server nodes, defaults to -nodes")
+		flagNomadClis  = flag.Int("nomad-clients", 1, "number of Nomad client nodes")
+		flagVaultNodes = flag.Int("vault-nodes", 0, "number of Vault nodes, defaults to -nodes")
 		flagOpen       = flag.Bool("open", true, "open browser to Consul and Nomad UIs")
 		flagTLS        = flag.Bool("tls", false, "generate certs and enable TLS authentication")
 		flagWorkDir    = flag.String("workdir", "/tmp/yurt", "directory to store files")
 		flagVault      = flag.Bool("vault", true, "create a Vault cluster")
+		flagStorage    = flag.String("vault-storage", "raft", "Vault storage: raft or consul")
+		flagSeal       = flag.String("vault-seal", "shamir", "Vault seal: shamir, transit or awskms; transit uses a Vault created to provide it")
+		flagSealConfig = flag.String("vault-seal-config", "", "comma-separated key=value settings for the -vault-seal stanza, e.g. kms_key_id=... for awskms")
 		flagNomad      = flag.Bool("nomad", true, "create a Nomad cluster")
+		flagClients    = flag.Int("consul-clients", 0, "number of Consul client agents to run when neither -nomad nor -vault is given")
 		flagPrometheus = flag.Bool("prometheus", true, "create a Prometheus server")
 		flagBinaries   = flag.String("binaries", "download", "either 'download' or 'path' to fetch binaries from the internet or $PATH")
+		flagStopWait   = flag.Duration("stop-timeout", 15*time.Second, "how long to wait for each component to stop gracefully before killing it")
+		flagDrain      = flag.Bool("drain", true, "on shutdown, drain Nomad clients, deregister Consul services and step down Vault leaders before stopping anything")
+		flagCAVault    = flag.String("ca-vault-addr", "", "address of an existing Vault to use as the CA with -tls, instead of creating one; token is read from $VAULT_TOKEN")
+		flagSource     = flag.String("source", "", "comma-separated name=dir list of packages to build from local checkouts, e.g. consul=$HOME/src/consul")
+		flagCAState    = flag.String("ca-state", "", "with -ca-vault-addr, file to load the CA from if it exists, else to save the newly created CA to")
+		flagDetach     = flag.Bool("detach", false, "exit once the clusters are up, leaving them running; manage them using the status, stop and destroy subcommands")
+		flagConsulVer  = flag.String("consul-version", "", "Consul version to run, instead of the default")
+		flagNomadVer   = flag.String("nomad-version", "", "Nomad version to run, instead of the default")
+		flagVaultVer   = flag.String("vault-version", "", "Vault version to run, instead of the default")
+		flagPromVer    = flag.String("prometheus-version", "", "Prometheus version to run, instead of the default")
+		flagListen     = flag.String("listen", "", "address to serve the control API on, e.g. 127.0.0.1:8080; not compatible with -detach")
+		flagConfig     = flag.String("config", "", "YAML or HCL file describing the topology to create; flags given explicitly override it")
+		flagOutput     = flag.String("output", "", "file to write cluster addresses and credentials to once they're up, as JSON, in dotenv format if it ends in .env, or as shell exports if it ends in .sh")
+		flagContext    = flag.String("context", "", "once the clusters are up, save their addresses and credentials as the current context of this name in the yurtconfig file, see yurt-ctx")
 	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  yurt-cluster [flags]                     create clusters
+  yurt-cluster status|stop|destroy [flags] manage clusters created with the same -workdir
+  yurt-cluster gc [-older-than=DURATION]   remove stopped yurt containers and unused yurt networks and volumes
+  yurt-cluster plan|apply -config=FILE     show or make the changes needed for clusters to match FILE
+
+Flags:
+`)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if !*flagNomad && !*flagVault {
-		// We could easily support consul-only clusters, just haven't bothered yet
-		log.Fatal("must specify at least one of -vault=true and -nomad=true")
+	topo := &topology{
+		Monitoring: monitoringSpec{Prometheus: *flagPrometheus},
+		Clusters: []clusterSpec{
+			{Name: "cluster1", Nodes: *flagNodes, Nomad: *flagNomad, Vault: *flagVault},
+		},
+	}
+	if *flagConfig != "" {
+		var err error
+		topo, err = loadTopology(*flagConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+			topo.Mode = *flagMode
+		case "first-port":
+			topo.FirstPort = *flagFirstPort
+		case "cidr":
+			topo.CIDR = *flagCIDR
+		case "workdir":
+			topo.WorkDir = *flagWorkDir
+		case "tls":
+			topo.TLS = *flagTLS
+		case "prometheus":
+			topo.Monitoring.Prometheus = *flagPrometheus
+		case "nodes":
+			for i := range topo.Clusters {
+				topo.Clusters[i].Nodes = *flagNodes
+			}
+		case "nomad":
+			for i := range topo.Clusters {
+				topo.Clusters[i].Nomad = *flagNomad
+			}
+		case "vault":
+			for i := range topo.Clusters {
+				topo.Clusters[i].Vault = *flagVault
+			}
+		case "consul-servers":
+			for i := range topo.Clusters {
+				topo.Clusters[i].ConsulServers = *flagConsulSrvs
+			}
+		case "nomad-servers":
+			for i := range topo.Clusters {
+				topo.Clusters[i].NomadServers = *flagNomadSrvs
+			}
+		case "nomad-clients":
+			for i := range topo.Clusters {
+				topo.Clusters[i].NomadClients = flagNomadClis
+			}
+		case "vault-nodes":
+			for i := range topo.Clusters {
+				topo.Clusters[i].VaultNodes = *flagVaultNodes
+			}
+		case "vault-storage":
+			for i := range topo.Clusters {
+				topo.Clusters[i].VaultStorage = *flagStorage
+			}
+		case "vault-seal", "vault-seal-config":
+			seal, err := parseSeal(*flagSeal, *flagSealConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for i := range topo.Clusters {
+				topo.Clusters[i].Seal = seal
+			}
+		case "consul-version":
+			topo.setVersion("consul", *flagConsulVer)
+		case "nomad-version":
+			topo.setVersion("nomad", *flagNomadVer)
+		case "vault-version":
+			topo.setVersion("vault", *flagVaultVer)
+		case "prometheus-version":
+			topo.setVersion("prometheus", *flagPromVer)
+		case "consul-clients":
+			for i := range topo.Clusters {
+				topo.Clusters[i].ConsulClients = *flagClients
+			}
+		}
+	})
+	if topo.Mode == "" {
+		topo.Mode = *flagMode
+	}
+	if topo.FirstPort == 0 {
+		topo.FirstPort = *flagFirstPort
+	}
+	if topo.WorkDir == "" {
+		topo.WorkDir = *flagWorkDir
+	}
+	for i := range topo.Clusters {
+		if topo.Clusters[i].Nodes == 0 {
+			topo.Clusters[i].Nodes = *flagNodes
+		}
+		topo.Clusters[i].setDefaults()
+	}
+	if err := topo.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagListen != "" && *flagDetach {
+		log.Fatal("-listen requires yurt-cluster to keep running, so it can't be used with -detach")
+	}
+	if *flagCAState != "" && *flagCAVault == "" {
+		log.Fatal("-ca-state requires -ca-vault-addr")
 	}
 
 	var mgr binaries.Manager
@@ -42,120 +198,499 @@ func main() {
 	case "download":
 		mgr = binaries.Default
 	case "path":
+		if len(topo.Versions) > 0 && topo.Mode == "exec" {
+			log.Fatal("versions can't be selected with -binaries=path")
+		}
 		mgr = &binaries.EnvPathManager{}
 	default:
 		log.Fatal("-binaries must be one of 'download' or 'path'")
 	}
-	ee, err := runenv.NewExecEnv(context.Background(), "yurt-cluster", *flagWorkDir, *flagFirstPort, mgr)
+	if *flagSource != "" {
+		sources := map[string]binaries.GoSource{}
+		for _, kv := range strings.Split(*flagSource, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid -source entry %q, expected name=dir", kv)
+			}
+			sources[parts[0]] = binaries.GoSource{Dir: parts[1]}
+		}
+		var err error
+		mgr, err = binaries.NewGoBuildManager(filepath.Join(os.TempDir(), "yurt/build"), sources, mgr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := events.NewBus()
+	bus.Subscribe(func(ev events.Event) {
+		log.Print(ev)
+	})
+	ee, err := runenv.NewExecEnv(ctx, "yurt-cluster", topo.WorkDir, topo.FirstPort, mgr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ee.Versions = topo.Versions
+	ee.Events = bus
 
 	var e runenv.Env
-	switch *flagMode {
+	var de *runenv.DockerEnv
+	switch topo.Mode {
 	case "exec":
 		e = ee
 	case "docker":
-		de, err := runenv.NewDockerEnv(context.Background(), nil, "yurt-cluster", *flagWorkDir, *flagCIDR)
+		de, err = runenv.NewDockerEnv(ctx, nil, "yurt-cluster", topo.WorkDir, topo.CIDR)
 		if err != nil {
 			log.Fatal(err)
 		}
+		de.Versions = topo.Versions
+		de.Events = bus
 		e = de
-	default:
-		log.Fatalf("invalid mode %q", *flagMode)
 	}
 
+	if *flagDetach {
+		ee.Keep("*")
+		if de != nil {
+			de.Keep("*")
+		}
+	}
+
+	var sd shutdown
+
 	var ca *pki.CertificateAuthority
-	if *flagTLS {
-		ca, err = vaultCA(e)
+	switch {
+	case topo.TLS && *flagCAVault != "":
+		ca, err = externalCA(ctx, *flagCAVault, os.Getenv("VAULT_TOKEN"), *flagCAState)
 		if err != nil {
 			log.Fatal(err)
 		}
+	case topo.TLS:
+		cas := &runenv.CAService{Env: e}
+		ca, err = cas.Acquire(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sd.caVault = cas
 	}
-	if *flagPrometheus {
-		m, err := runenv.NewMonitoredEnv(e, ee)
+	if ca != nil {
+		ca.Events = bus
+	}
+	if topo.Monitoring.Prometheus {
+		m, err := runenv.NewMonitoredEnvWithOptions(e, ee, runenv.MonitoredEnvOptions{
+			Thanos:         topo.Monitoring.Thanos,
+			ExternalLabels: topo.Monitoring.ExternalLabels,
+			NodeExporter:   topo.Monitoring.NodeExporter,
+			Blackbox:       topo.Monitoring.Blackbox,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
 		e = m
+		sd.prometheus = m.PromHarness()
 		err = open.Start(m.PromAddr().Address.String())
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if *flagVault {
-		vc, err := cluster.NewVaultCluster(e.Context(), e, ca, "cluster1", *flagNodes, nil, nil, 0)
+	for _, spec := range topo.Clusters {
+		if err := startCluster(e, ca, spec, *flagOpen, &sd); err != nil {
+			log.Fatalf("error starting cluster %s: %v", spec.Name, err)
+		}
+	}
+
+	// saveState is also used by the control API once it has applied changes.
+	saveState := func(topo *topology) error {
+		st := &clusterState{Mode: topo.Mode, WorkDir: ee.WorkDir, Topology: topo}
+		if !*flagDetach {
+			st.Pid = os.Getpid()
+			st.PidStart, _ = procStartTime(st.Pid)
+			st.Listen = *flagListen
+		}
+		if de != nil {
+			st.DockerNetwork = de.NetConf.DockerNetName
+			st.addNodes(de)
+		}
+		st.addNodes(ee)
+		for name, vc := range sd.vaults {
+			if st.Vaults == nil {
+				st.Vaults = map[string]vaultState{}
+			}
+			st.Vaults[name] = vaultState{
+				RootToken:  vc.RootToken(),
+				UnsealKeys: vc.UnsealKeys(),
+			}
+		}
+		return st.save()
+	}
+	if err := saveState(topo); err != nil {
+		log.Fatal(err)
+	}
+	if *flagOutput != "" {
+		eps, err := sd.endpoints()
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer vc.Stop()
-		e.Go(vc.Wait)
+		if err := writeOutput(*flagOutput, topo.clusterNames(), eps); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagContext != "" {
+		if err := saveContext(*flagContext, topo, &sd); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagDetach {
+		log.Printf("clusters running, state saved to %s; use 'yurt-cluster stop -workdir=%s' to stop them",
+			statePath(ee.WorkDir), topo.WorkDir)
+		return
+	}
 
-		if *flagOpen {
-			clients, err := vc.Clients()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = open.Start(clients[0].Address())
-			if err != nil {
-				log.Fatal(err)
+	apiCtx, cancelAPI := context.WithCancel(ctx)
+	defer cancelAPI()
+	if *flagListen != "" {
+		nodeEnvs := []runenv.Env{ee}
+		if de != nil {
+			nodeEnvs = append(nodeEnvs, de)
+		}
+		api := &controlAPI{
+			e:        e,
+			ca:       ca,
+			sd:       &sd,
+			names:    topo.clusterNames(),
+			nodeEnvs: nodeEnvs,
+			topo:     topo,
+			setVersions: func(versions map[string]string) {
+				ee.Versions = versions
+				if de != nil {
+					de.Versions = versions
+				}
+			},
+			saveState: saveState,
+		}
+		go func() {
+			if err := serveAPI(apiCtx, *flagListen, api); err != nil {
+				log.Printf("control API failed: %v", err)
 			}
+		}()
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT)
+	signal.Notify(sigchan, syscall.SIGTERM)
+	sig := <-sigchan
+	log.Printf("received %v, shutting down", sig)
+	cancelAPI()
+
+	if *flagDrain {
+		sd.drain(*flagStopWait)
+	}
+	sd.run(*flagStopWait)
+
+	// Final sweep: cancelling the env context kills any processes and removes
+	// any containers that are still around.
+	cancel()
+	sweep := func(name string, wait func() error) {
+		done := make(chan struct{})
+		go func() {
+			_ = wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(*flagStopWait):
+			log.Printf("timed out waiting for %s env to clean up", name)
 		}
 	}
+	if de != nil {
+		sweep("docker", de.Group.Wait)
+	}
+	sweep("exec", ee.Group.Wait)
+}
+
+// startCluster creates the clusters described by spec, opening their UIs in
+// a browser if openUIs is true, and records them in sd.  If spec has neither
+// Nomad nor Vault, a standalone Consul cluster is created.
+func startCluster(e runenv.Env, ca *pki.CertificateAuthority, spec clusterSpec, openUIs bool, sd *shutdown) error {
+	if !spec.Nomad && !spec.Vault {
+		return startConsulCluster(e, ca, spec, openUIs, sd)
+	}
 
-	if *flagNomad {
-		cnc, err := cluster.NewConsulNomadCluster(e.Context(), e, ca, "cluster1", *flagNodes)
+	var consulCluster *cluster.ConsulCluster
+	if spec.Nomad {
+		cnc, err := cluster.NewConsulNomadClusterWithCounts(e.Context(), e, ca, spec.Name, spec.ConsulServers, spec.NomadServers)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		defer cnc.Stop()
+		sd.cncs = append(sd.cncs, cnc)
 		e.Go(cnc.Wait)
 
-		nomadClient, err := cnc.NomadClient(e, ca)
-		if err != nil {
-			log.Fatal(err)
+		for i := 0; i < *spec.NomadClients; i++ {
+			nomadClient, err := cnc.NomadClient(e, ca)
+			if err != nil {
+				return err
+			}
+			sd.nomadClients = append(sd.nomadClients, nomadClient)
+			e.Go(nomadClient.Wait)
 		}
-		defer nomadClient.Stop()
-		e.Go(nomadClient.Wait)
 
-		if *flagOpen {
+		if openUIs {
 			addrs, err := cnc.Consul.Addrs()
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 			err = open.Start(addrs[0])
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 
-			nc, err := nomad.HarnessToAPI(nomadClient.NomadHarness)
+			nc, err := nomad.HarnessToAPI(cnc.Nomad.Servers()[0])
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 			err = open.Start(nc.Address())
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 		}
+		consulCluster = cnc.Consul
 	}
 
-	sigchan := make(chan os.Signal)
-	signal.Notify(sigchan, syscall.SIGINT)
-	signal.Notify(sigchan, syscall.SIGTERM)
-	<-sigchan
+	if spec.Vault {
+		return startVaultCluster(e, ca, spec, consulCluster, openUIs, sd)
+	}
+	return nil
+}
+
+// startVaultCluster creates the Vault cluster described by spec.  For Consul
+// storage, a client agent of consulCluster is run for each node, creating
+// consulCluster first if it's nil.
+func startVaultCluster(e runenv.Env, ca *pki.CertificateAuthority, spec clusterSpec, consulCluster *cluster.ConsulCluster, openUIs bool, sd *shutdown) error {
+	ctx := e.Context()
+	var consulAddrs []string
+	if spec.VaultStorage == "consul" {
+		if consulCluster == nil {
+			var err error
+			consulCluster, err = cluster.NewConsulCluster(ctx, e, ca, spec.Name, spec.ConsulServers)
+			if err != nil {
+				return err
+			}
+			sd.addConsul(spec.Name, consulCluster)
+			e.Go(consulCluster.Wait)
+		}
+		for i := 0; i < spec.VaultNodes; i++ {
+			h, err := consulCluster.ClientAgent(ctx, e, ca, spec.Name+"-consul-cli")
+			if err != nil {
+				return err
+			}
+			sd.consulClients = append(sd.consulClients, h)
+			e.Go(h.Wait)
+			addr, err := h.Endpoint("http", false)
+			if err != nil {
+				return err
+			}
+			consulAddrs = append(consulAddrs, addr.Address.Host)
+		}
+	}
+
+	seal := spec.Seal.vaultSeal()
+	if spec.Seal.needsSealer() {
+		sealer, err := cluster.NewVaultCluster(ctx, e, ca, spec.Name+"-sealer", 1, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		sd.sealers = append(sd.sealers, sealer)
+		e.Go(sealer.Wait)
+		clients, err := sealer.Clients()
+		if err != nil {
+			return err
+		}
+		seal, err = vault.NewSealSource(ctx, clients[0], spec.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	vc, err := cluster.NewVaultCluster(ctx, e, ca, spec.Name, spec.VaultNodes, consulAddrs, seal, 0)
+	if err != nil {
+		return err
+	}
+	sd.addVault(spec.Name, vc)
+	e.Go(vc.Wait)
+
+	if openUIs {
+		clients, err := vc.Clients()
+		if err != nil {
+			return err
+		}
+		return open.Start(clients[0].Address())
+	}
+	return nil
 }
 
-func vaultCA(e runenv.Env) (*pki.CertificateAuthority, error) {
-	cluster, err := cluster.NewVaultCluster(e.Context(), e, nil, "yurt-vault-pki", 1, nil, nil, 0)
+// parseSeal returns the seal described by the -vault-seal and
+// -vault-seal-config flags.
+func parseSeal(sealType, config string) (*sealSpec, error) {
+	switch sealType {
+	case "shamir", "transit", "awskms":
+	default:
+		return nil, fmt.Errorf("invalid -vault-seal %q, must be shamir, transit or awskms", sealType)
+	}
+	seal := &sealSpec{Type: sealType}
+	if config != "" {
+		seal.Config = map[string]string{}
+		for _, kv := range strings.Split(config, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid -vault-seal-config entry %q, expected key=value", kv)
+			}
+			seal.Config[parts[0]] = parts[1]
+		}
+	}
+	return seal, nil
+}
+
+// startConsulCluster creates a Consul cluster along with any client agents
+// requested by spec.
+func startConsulCluster(e runenv.Env, ca *pki.CertificateAuthority, spec clusterSpec, openUIs bool, sd *shutdown) error {
+	cc, err := cluster.NewConsulCluster(e.Context(), e, ca, spec.Name, spec.ConsulServers)
+	if err != nil {
+		return err
+	}
+	sd.addConsul(spec.Name, cc)
+	e.Go(cc.Wait)
+
+	for i := 0; i < spec.ConsulClients; i++ {
+		h, err := cc.ClientAgent(e.Context(), e, ca, spec.Name+"-consul-cli")
+		if err != nil {
+			return err
+		}
+		sd.consulClients = append(sd.consulClients, h)
+		e.Go(h.Wait)
+	}
+
+	if openUIs {
+		addrs, err := cc.Addrs()
+		if err != nil {
+			return err
+		}
+		return open.Start(addrs[0])
+	}
+	return nil
+}
+
+// shutdown tracks what's been started so that it can be stopped in an order
+// that keeps each component's dependencies alive until it has exited.
+type shutdown struct {
+	nomadClients []*cluster.NomadClient
+	cncs         []*cluster.ConsulNomadCluster
+	vaults       map[string]*cluster.VaultCluster
+	// consuls and consulClients are the Consul-only clusters and their
+	// client agents.
+	consuls       map[string]*cluster.ConsulCluster
+	consulClients []runner.Harness
+	// sealers are the Vaults created to provide transit seals.
+	sealers    []*cluster.VaultCluster
+	prometheus runner.Harness
+	caVault    *runenv.CAService
+}
+
+func (s *shutdown) addConsul(name string, cc *cluster.ConsulCluster) {
+	if s.consuls == nil {
+		s.consuls = map[string]*cluster.ConsulCluster{}
+	}
+	s.consuls[name] = cc
+}
+
+func (s *shutdown) addVault(name string, vc *cluster.VaultCluster) {
+	if s.vaults == nil {
+		s.vaults = map[string]*cluster.VaultCluster{}
+	}
+	s.vaults[name] = vc
+}
+
+// run stops everything: nomad clients, nomad servers, vaults, the vaults
+// providing their seals, consul clients, consul servers, prometheus, and
+// finally the vault used as a CA.  Each step that takes longer than timeout is
+// killed.
+func (s *shutdown) run(timeout time.Duration) {
+	for _, nc := range s.nomadClients {
+		stopStep("nomad client", timeout, nc.NomadHarness.Stop, nc.NomadHarness.Kill)
+	}
+	for _, cnc := range s.cncs {
+		stopStep(cnc.Name+" nomad servers", timeout, noErr(cnc.Nomad.Stop), cnc.Nomad.Kill)
+	}
+	for name, vc := range s.vaults {
+		stopStep(name+" vault", timeout, noErr(vc.Stop), vc.Kill)
+	}
+	for _, vc := range s.sealers {
+		stopStep("vault sealer", timeout, noErr(vc.Stop), vc.Kill)
+	}
+	for _, nc := range s.nomadClients {
+		stopStep("consul client", timeout, nc.ConsulHarness.Stop, nc.ConsulHarness.Kill)
+	}
+	for _, h := range s.consulClients {
+		stopStep("consul client", timeout, h.Stop, h.Kill)
+	}
+	for _, cnc := range s.cncs {
+		stopStep(cnc.Name+" consul servers", timeout, noErr(cnc.Consul.Stop), cnc.Consul.Kill)
+	}
+	for name, cc := range s.consuls {
+		stopStep(name+" consul servers", timeout, noErr(cc.Stop), cc.Kill)
+	}
+	if s.prometheus != nil {
+		stopStep("prometheus", timeout, s.prometheus.Stop, s.prometheus.Kill)
+	}
+	if s.caVault != nil {
+		stopStep("vault CA", timeout, noErr(s.caVault.Release), func() {})
+	}
+}
+
+func noErr(f func()) func() error {
+	return func() error {
+		f()
+		return nil
+	}
+}
+
+// stopStep calls stop, and if it hasn't returned within timeout, calls kill.
+func stopStep(name string, timeout time.Duration, stop func() error, kill func()) {
+	log.Printf("stopping %s", name)
+	done := make(chan error, 1)
+	go func() {
+		done <- stop()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("error stopping %s: %v", name, err)
+		}
+	case <-time.After(timeout):
+		log.Printf("timed out stopping %s, killing it", name)
+		kill()
+	}
+}
+
+// externalCA returns a CA using the Vault at addr.  If stateFile exists, the
+// CA it describes is reused, otherwise a new one is created and saved there,
+// so that restarts don't accumulate PKI mounts.
+func externalCA(ctx context.Context, addr, token, stateFile string) (*pki.CertificateAuthority, error) {
+	cli, err := util.MakeVaultClient(addr, token)
 	if err != nil {
 		return nil, err
 	}
-	clients, err := cluster.Clients()
+	if stateFile == "" {
+		return pki.NewCertificateAuthority(cli)
+	}
+	if _, err := os.Stat(stateFile); err == nil {
+		return pki.LoadCertificateAuthority(ctx, cli, stateFile)
+	}
+	ca, err := pki.NewCertificateAuthority(cli)
 	if err != nil {
 		return nil, err
 	}
-	e.Go(cluster.Wait)
-
-	return pki.NewCertificateAuthority(clients[0])
+	if err := ca.Save(ctx, stateFile); err != nil {
+		return nil, err
+	}
+	return ca, nil
 }
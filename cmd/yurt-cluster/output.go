@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/ncabatoff/yurt/export"
+	"github.com/ncabatoff/yurt/yurtconfig"
+)
+
+// endpoints returns how to reach each of the clusters started.
+func (s *shutdown) endpoints() (export.Clusters, error) {
+	ret := export.Clusters{}
+	for _, cnc := range s.cncs {
+		if err := ret.AddConsulNomad(cnc); err != nil {
+			return nil, err
+		}
+	}
+	for name, cc := range s.consuls {
+		if err := ret.AddConsul(name, cc); err != nil {
+			return nil, err
+		}
+	}
+	for name, vc := range s.vaults {
+		if err := ret.AddVault(name, vc); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// writeOutput writes the endpoints of the clusters to path.  If path ends in
+// ".env", it's written in dotenv format, or if it ends in ".sh", as a file to
+// source: the first cluster's settings are given as is, and those of any
+// others are prefixed by their cluster name.  Otherwise it's written as JSON,
+// keyed by cluster name.
+func writeOutput(path string, names []string, eps export.Clusters) error {
+	var buf bytes.Buffer
+	var err error
+	switch filepath.Ext(path) {
+	case ".env":
+		err = eps.WriteDotenv(&buf, names)
+	case ".sh":
+		err = eps.WriteShell(&buf, names)
+	default:
+		err = eps.WriteJSON(&buf)
+	}
+	if err != nil {
+		return err
+	}
+	// Tokens and unseal keys are secrets.
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// saveContext records the clusters as the context named name in the
+// yurtconfig file, and makes it the current context.
+func saveContext(name string, topo *topology, sd *shutdown) error {
+	eps, err := sd.endpoints()
+	if err != nil {
+		return err
+	}
+	// The context may be used from anywhere, e.g. to stop the clusters.
+	workDir, err := filepath.Abs(topo.WorkDir)
+	if err != nil {
+		return err
+	}
+	ctx := yurtconfig.Context{
+		Name:     name,
+		WorkDir:  workDir,
+		Clusters: eps,
+	}
+	if names := topo.clusterNames(); len(names) > 0 {
+		ctx.DefaultCluster = names[0]
+	}
+
+	path := yurtconfig.DefaultPath()
+	cfg, err := yurtconfig.Load(path)
+	if err != nil {
+		return err
+	}
+	cfg.Set(ctx)
+	cfg.CurrentContext = name
+	return cfg.Save(path)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	opCreate  = "create"
+	opReplace = "replace"
+	opDestroy = "destroy"
+
+	kindCluster      = "cluster"
+	kindConsulServer = "consul-server"
+	kindConsulClient = "consul-client"
+	kindNomadServer  = "nomad-server"
+	kindNomadClient  = "nomad-client"
+	kindVaultNode    = "vault-node"
+)
+
+// action is a change needed to make the running clusters match a topology.
+type action struct {
+	// Op is create, replace or destroy.
+	Op      string `json:"op"`
+	Cluster string `json:"cluster"`
+	// Kind is what's acted on: a whole cluster, or a single Consul server,
+	// Nomad client or Vault node.
+	Kind string `json:"kind"`
+	// Node names the node acted on, unless it's yet to be created.
+	Node   string `json:"node,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (a action) String() string {
+	sym := map[string]string{opCreate: "+", opReplace: "~", opDestroy: "-"}[a.Op]
+	var s string
+	switch {
+	case a.Kind == kindCluster:
+		s = fmt.Sprintf("%s %s cluster %s", sym, a.Op, a.Cluster)
+	case a.Node != "":
+		s = fmt.Sprintf("%s %s %s %s", sym, a.Op, a.Kind, a.Node)
+	default:
+		s = fmt.Sprintf("%s %s %s in cluster %s", sym, a.Op, a.Kind, a.Cluster)
+	}
+	if a.Reason != "" {
+		s += ": " + a.Reason
+	}
+	return s
+}
+
+// inventory gives the names of the nodes of each cluster, keyed by cluster
+// name and then by kind, in the order they were created.
+type inventory map[string]map[string][]string
+
+func (inv inventory) add(cluster, kind, node string) {
+	if inv[cluster] == nil {
+		inv[cluster] = map[string][]string{}
+	}
+	inv[cluster][kind] = append(inv[cluster][kind], node)
+}
+
+// nodeNamePattern matches the names the cluster package gives nodes, e.g.
+// "mycluster-consul-srv-3".
+var nodeNamePattern = regexp.MustCompile(`^(.+)-(consul|nomad|vault)-(srv|cli)-(\d+)$`)
+
+var nodeKinds = map[string]string{
+	"consul-srv": kindConsulServer,
+	"consul-cli": kindConsulClient,
+	"nomad-srv":  kindNomadServer,
+	"nomad-cli":  kindNomadClient,
+	"vault-srv":  kindVaultNode,
+}
+
+// parseNodeName returns the cluster and kind of the named node, and its
+// number, which increases with each node allocated.
+func parseNodeName(name string) (cluster, kind string, num int, ok bool) {
+	m := nodeNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", 0, false
+	}
+	kind, ok = nodeKinds[m[2]+"-"+m[3]]
+	num, _ = strconv.Atoi(m[4])
+	return m[1], kind, num, ok
+}
+
+// inventory returns the nodes recorded in s.
+func (s *clusterState) inventory() inventory {
+	nodes := append([]nodeState{}, s.Nodes...)
+	num := func(name string) int {
+		_, _, n, _ := parseNodeName(name)
+		return n
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return num(nodes[i].Name) < num(nodes[j].Name)
+	})
+	inv := inventory{}
+	for _, n := range nodes {
+		if cluster, kind, _, ok := parseNodeName(n.Name); ok {
+			inv.add(cluster, kind, n.Name)
+		}
+	}
+	return inv
+}
+
+// desiredTopology parses the topology in contents, read from source, taking
+// the settings of the environment as a whole that it doesn't give from cur,
+// and filling in defaults as when creating clusters.
+func desiredTopology(contents []byte, source string, cur *topology) (*topology, error) {
+	want, err := parseTopology(contents, source)
+	if err != nil {
+		return nil, err
+	}
+	if want.Mode == "" {
+		want.Mode = cur.Mode
+	}
+	if want.FirstPort == 0 {
+		want.FirstPort = cur.FirstPort
+	}
+	if want.CIDR == "" {
+		want.CIDR = cur.CIDR
+	}
+	if want.WorkDir == "" {
+		want.WorkDir = cur.WorkDir
+	}
+	for i := range want.Clusters {
+		if want.Clusters[i].Nodes == 0 {
+			want.Clusters[i].Nodes = defaultNodes
+		}
+		want.Clusters[i].setDefaults()
+	}
+	if err := want.validate(); err != nil {
+		return nil, err
+	}
+	return want, nil
+}
+
+// planChanges returns the actions needed to go from the clusters created to
+// match cur, whose nodes are given by inv, to those described by want.
+// Consul servers and Nomad clients are added and removed individually, and
+// Consul servers and Vault nodes are replaced individually to change their
+// version.  Other changes to a cluster, such as to its number of Nomad
+// servers or Vault nodes, replace it entirely.  Changes to the environment as
+// a whole, e.g. its mode or monitoring, can't be made at all.
+func planChanges(cur, want *topology, inv inventory) ([]action, error) {
+	envChanges := []struct {
+		name     string
+		cur, new interface{}
+	}{
+		{"mode", cur.Mode, want.Mode},
+		{"first_port", cur.FirstPort, want.FirstPort},
+		{"cidr", cur.CIDR, want.CIDR},
+		{"workdir", cur.WorkDir, want.WorkDir},
+		{"tls", cur.TLS, want.TLS},
+		{"monitoring", cur.Monitoring, want.Monitoring},
+	}
+	for _, c := range envChanges {
+		if !reflect.DeepEqual(c.cur, c.new) {
+			return nil, fmt.Errorf("changing %s requires recreating the environment", c.name)
+		}
+	}
+	versions := versionChanges(cur.Versions, want.Versions)
+	if _, ok := versions["prometheus"]; ok {
+		return nil, fmt.Errorf("changing the prometheus version requires recreating the environment")
+	}
+
+	var actions []action
+	for _, c := range cur.Clusters {
+		if want.cluster(c.Name) == nil {
+			actions = append(actions, action{Op: opDestroy, Cluster: c.Name, Kind: kindCluster, Reason: "removed from topology"})
+		}
+	}
+	for _, n := range want.Clusters {
+		o := cur.cluster(n.Name)
+		if o == nil {
+			actions = append(actions, action{Op: opCreate, Cluster: n.Name, Kind: kindCluster, Reason: "added to topology"})
+			continue
+		}
+		actions = append(actions, planCluster(*o, n, versions, inv[n.Name])...)
+	}
+	return actions, nil
+}
+
+// versionChanges describes how each product's version differs between cur
+// and want, keyed by product.
+func versionChanges(cur, want map[string]string) map[string]string {
+	show := func(v string) string {
+		if v == "" {
+			return "default"
+		}
+		return v
+	}
+	changes := map[string]string{}
+	for _, m := range []map[string]string{cur, want} {
+		for product := range m {
+			if cur[product] != want[product] {
+				changes[product] = fmt.Sprintf("%s version %s -> %s", product, show(cur[product]), show(want[product]))
+			}
+		}
+	}
+	return changes
+}
+
+func planCluster(o, n clusterSpec, versions map[string]string, nodes map[string][]string) []action {
+	if reasons := replaceReasons(o, n, versions); len(reasons) > 0 {
+		return []action{{Op: opReplace, Cluster: n.Name, Kind: kindCluster, Reason: strings.Join(reasons, ", ")}}
+	}
+	var actions []action
+	if n.hasConsul() {
+		actions = append(actions, planNodes(n.Name, kindConsulServer, nodes[kindConsulServer], n.ConsulServers, versions["consul"])...)
+	}
+	if n.Vault {
+		actions = append(actions, planNodes(n.Name, kindVaultNode, nodes[kindVaultNode], n.VaultNodes, versions["vault"])...)
+	}
+	if n.Nomad {
+		actions = append(actions, planNodes(n.Name, kindNomadClient, nodes[kindNomadClient], *n.NomadClients, "")...)
+	}
+	return actions
+}
+
+// replaceReasons returns the changes from o to n that can only be made by
+// replacing the cluster.
+func replaceReasons(o, n clusterSpec, versions map[string]string) []string {
+	var reasons []string
+	changed := func(what string, from, to interface{}) {
+		if !reflect.DeepEqual(from, to) {
+			reasons = append(reasons, fmt.Sprintf("%s %v -> %v", what, from, to))
+		}
+	}
+	changed("nomad", o.Nomad, n.Nomad)
+	changed("vault", o.Vault, n.Vault)
+	if o.Nomad && n.Nomad {
+		changed("nomad_servers", o.NomadServers, n.NomadServers)
+		if v, ok := versions["nomad"]; ok {
+			reasons = append(reasons, v)
+		}
+	}
+	if o.Vault && n.Vault {
+		changed("vault_nodes", o.VaultNodes, n.VaultNodes)
+		storage := func(s string) string {
+			if s == "" {
+				return "raft"
+			}
+			return s
+		}
+		changed("vault_storage", storage(o.VaultStorage), storage(n.VaultStorage))
+		if !reflect.DeepEqual(o.Seal.vaultSeal(), n.Seal.vaultSeal()) {
+			reasons = append(reasons, "seal changed")
+		}
+	}
+	changed("consul_clients", o.ConsulClients, n.ConsulClients)
+	return reasons
+}
+
+// planNodes returns the actions needed to go from the existing nodes of the
+// given kind to want of them, replacing those that are kept if version is
+// non-empty, i.e. if their version has changed.  The newest nodes are the
+// ones destroyed.
+func planNodes(cluster, kind string, existing []string, want int, version string) []action {
+	var actions []action
+	keep := existing
+	if len(existing) > want {
+		keep = existing[:want]
+		for _, node := range existing[want:] {
+			actions = append(actions, action{Op: opDestroy, Cluster: cluster, Kind: kind, Node: node,
+				Reason: fmt.Sprintf("%d wanted, have %d", want, len(existing))})
+		}
+	}
+	if version != "" {
+		for _, node := range keep {
+			actions = append(actions, action{Op: opReplace, Cluster: cluster, Kind: kind, Node: node, Reason: version})
+		}
+	}
+	for i := len(existing); i < want; i++ {
+		actions = append(actions, action{Op: opCreate, Cluster: cluster, Kind: kind,
+			Reason: fmt.Sprintf("%d wanted, have %d", want, len(existing))})
+	}
+	return actions
+}
+
+// reconcile runs the plan and apply subcommands, which compare the topology
+// in -config with the one the clusters in -workdir were created or last
+// updated to match.  Only the yurt-cluster process that created the clusters
+// can change them, so apply requires it to be running with -listen.  Plan
+// asks it too if it is, and otherwise works from the state file.
+func reconcile(cmd string, args []string) {
+	fs := flag.NewFlagSet("yurt-cluster "+cmd, flag.ExitOnError)
+	workDir := fs.String("workdir", "/tmp/yurt", "directory the clusters were created in")
+	config := fs.String("config", "", "YAML or HCL file describing the topology wanted")
+	_ = fs.Parse(args)
+	if *config == "" {
+		log.Fatal("-config is required")
+	}
+
+	s, err := loadState(*workDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(*config)
+	if err != nil {
+		log.Fatalf("error reading config: %v", err)
+	}
+
+	var actions []action
+	switch {
+	case pidAlive(s.Pid, s.PidStart) && s.Listen != "":
+		actions, err = s.remoteChange(cmd, contents, *config)
+	case cmd == "apply":
+		err = fmt.Errorf("apply requires the yurt-cluster process that created the clusters to be running with -listen")
+	case s.Topology == nil:
+		err = fmt.Errorf("%s doesn't record the topology the clusters were created with", statePath(s.WorkDir))
+	default:
+		var want *topology
+		want, err = desiredTopology(contents, *config, s.Topology)
+		if err == nil {
+			actions, err = planChanges(s.Topology, want, s.inventory())
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(actions) == 0 {
+		fmt.Println("no changes")
+		return
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+}
+
+// remoteChange posts the topology in contents, read from path, to the control
+// API's plan or apply endpoint, given by cmd, returning the actions it
+// reports.
+func (s *clusterState) remoteChange(cmd string, contents []byte, path string) ([]action, error) {
+	host, port, err := net.SplitHostPort(s.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s/v1/%s", net.JoinHostPort(host, port), cmd)
+	contentType := "application/yaml"
+	if filepath.Ext(path) == ".hcl" {
+		url += "?format=hcl"
+		contentType = "application/hcl"
+	}
+	resp, err := http.Post(url, contentType, bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed: %s", cmd, strings.TrimSpace(string(body)))
+	}
+	var actions []action
+	if err := json.Unmarshal(body, &actions); err != nil {
+		return nil, fmt.Errorf("error parsing response from %s: %w", url, err)
+	}
+	return actions, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTopology(t *testing.T, contents string) *topology {
+	t.Helper()
+	cur := &topology{Mode: "exec", FirstPort: 23000, WorkDir: "/tmp/yurt"}
+	topo, err := desiredTopology([]byte(contents), t.Name(), cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topo
+}
+
+func TestPlanChanges(t *testing.T) {
+	cur := testTopology(t, `
+clusters:
+  - name: c1
+    nomad: true
+    vault: true
+    nomad_clients: 2
+  - name: old
+`)
+	inv := inventory{}
+	for _, n := range []string{"c1-consul-srv-1", "c1-consul-srv-2", "c1-consul-srv-3",
+		"c1-nomad-srv-4", "c1-nomad-srv-5", "c1-nomad-srv-6", "c1-nomad-cli-7", "c1-nomad-cli-8",
+		"c1-vault-srv-9", "c1-vault-srv-10", "c1-vault-srv-11",
+		"old-consul-srv-12", "old-consul-srv-13", "old-consul-srv-14"} {
+		c, kind, _, ok := parseNodeName(n)
+		if !ok {
+			t.Fatalf("can't parse %s", n)
+		}
+		inv.add(c, kind, n)
+	}
+
+	want := testTopology(t, `
+versions:
+  vault: 1.10.0
+clusters:
+  - name: c1
+    nomad: true
+    vault: true
+    consul_servers: 5
+    nomad_clients: 1
+  - name: new
+`)
+	actions, err := planChanges(cur, want, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range actions {
+		got = append(got, a.Op+" "+a.Kind+" "+a.Cluster+" "+a.Node)
+	}
+	expected := []string{
+		"destroy cluster old ",
+		"create consul-server c1 ",
+		"create consul-server c1 ",
+		"replace vault-node c1 c1-vault-srv-9",
+		"replace vault-node c1 c1-vault-srv-10",
+		"replace vault-node c1 c1-vault-srv-11",
+		"destroy nomad-client c1 c1-nomad-cli-8",
+		"create cluster new ",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+
+	want = testTopology(t, `
+clusters:
+  - name: c1
+    nomad: true
+    vault: true
+    vault_nodes: 5
+    nomad_clients: 2
+  - name: old
+`)
+	actions, err = planChanges(cur, want, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Op != opReplace || actions[0].Kind != kindCluster {
+		t.Fatalf("expected cluster replace, got %v", actions)
+	}
+
+	want = testTopology(t, `
+tls: true
+clusters:
+  - name: c1
+`)
+	if _, err := planChanges(cur, want, inv); err == nil {
+		t.Fatal("expected error changing tls")
+	}
+}
+
+func TestRemoteChange(t *testing.T) {
+	_, _, srv := testAPI(t)
+	s := &clusterState{Listen: strings.TrimPrefix(srv.URL, "http://")}
+
+	yamlTopo := "clusters: [{name: c1}, {name: old}]"
+	hclTopo := "cluster \"c1\" {}\ncluster \"old\" {}\n"
+	for path, contents := range map[string]string{"topo.yaml": yamlTopo, "topo.hcl": hclTopo} {
+		actions, err := s.remoteChange("plan", []byte(contents), path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if len(actions) != 6 {
+			t.Fatalf("%s: expected Consul servers to be created for both clusters, got %v", path, actions)
+		}
+	}
+	if _, err := s.remoteChange("plan", []byte(hclTopo), "topo.yaml"); err == nil {
+		t.Fatal("expected HCL to be rejected as YAML")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	dockerapi "github.com/docker/docker/client"
+	"github.com/ncabatoff/yurt/runenv"
+)
+
+// stateFileName is the name of the file within -workdir that describes the
+// clusters created by yurt-cluster, so that they can be managed later.
+const stateFileName = "yurt-cluster.json"
+
+// clusterState records what yurt-cluster started, so that status, stop and
+// destroy can operate on it from another process.
+type clusterState struct {
+	Mode    string `json:"mode"`
+	WorkDir string `json:"workdir"`
+	// Pid is the yurt-cluster process that created the clusters, or zero if
+	// it detached from them.
+	Pid int `json:"pid,omitempty"`
+	// PidStart is when Pid started, see procStartTime, so that a new process
+	// that reused the pid isn't mistaken for it.
+	PidStart      uint64      `json:"pid_start,omitempty"`
+	DockerNetwork string      `json:"docker_network,omitempty"`
+	Nodes         []nodeState `json:"nodes"`
+	// Vaults gives the credentials of each Vault cluster, by cluster name.
+	Vaults map[string]vaultState `json:"vaults,omitempty"`
+	// Listen is the address of the control API, if Pid is serving one.
+	Listen string `json:"listen,omitempty"`
+	// Topology is what the clusters were created or last updated to match.
+	Topology *topology `json:"topology,omitempty"`
+}
+
+type nodeState struct {
+	Name        string         `json:"name"`
+	Host        string         `json:"host"`
+	Ports       map[string]int `json:"ports"`
+	Pid         int            `json:"pid,omitempty"`
+	PidStart    uint64         `json:"pid_start,omitempty"`
+	ContainerID string         `json:"container_id,omitempty"`
+}
+
+type vaultState struct {
+	RootToken  string   `json:"root_token"`
+	UnsealKeys []string `json:"unseal_keys"`
+}
+
+// manage runs one of the subcommands that operate on existing clusters.
+func manage(cmd string, args []string) {
+	fs := flag.NewFlagSet("yurt-cluster "+cmd, flag.ExitOnError)
+	workDir := fs.String("workdir", "/tmp/yurt", "directory the clusters were created in")
+	stopWait := fs.Duration("stop-timeout", 15*time.Second, "how long to wait for each component to stop gracefully before killing it")
+	_ = fs.Parse(args)
+
+	s, err := loadState(*workDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	switch cmd {
+	case "status":
+		err = status(ctx, s)
+	case "stop":
+		err = stop(ctx, s, *stopWait)
+	case "destroy":
+		err = destroy(ctx, s, *stopWait)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func statePath(workDir string) string {
+	return filepath.Join(workDir, stateFileName)
+}
+
+// addNodes records the nodes of env that have been started.
+func (s *clusterState) addNodes(env runenv.Env) {
+	for _, name := range env.NodeNames() {
+		h, ok := env.Harness(name)
+		if !ok {
+			continue
+		}
+		node, _ := env.Node(name)
+		ns := nodeState{
+			Name:  name,
+			Host:  node.Host,
+			Ports: map[string]int{},
+		}
+		for pname, port := range node.Ports.ByName {
+			ns.Ports[pname] = port.Number
+		}
+		switch h := h.(type) {
+		case interface{ Pid() int }:
+			ns.Pid = h.Pid()
+			ns.PidStart, _ = procStartTime(ns.Pid)
+		case interface{ ContainerID() string }:
+			ns.ContainerID = h.ContainerID()
+		}
+		s.Nodes = append(s.Nodes, ns)
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool {
+		return s.Nodes[i].Name < s.Nodes[j].Name
+	})
+}
+
+func (s *clusterState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(s.WorkDir), b, 0600)
+}
+
+func loadState(workDir string) (*clusterState, error) {
+	b, err := ioutil.ReadFile(statePath(workDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no clusters found in %s", workDir)
+		}
+		return nil, err
+	}
+	var s clusterState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", statePath(workDir), err)
+	}
+	return &s, nil
+}
+
+func dockerClient() (*dockerapi.Client, error) {
+	return dockerapi.NewClientWithOpts(dockerapi.FromEnv, dockerapi.WithVersion("1.39"))
+}
+
+// pidAlive returns whether pid is running.  If start is nonzero, the process
+// must also have started at start, lest a process that reused the pid of one
+// that exited be mistaken for it.
+func pidAlive(pid int, start uint64) bool {
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	if start == 0 {
+		return true
+	}
+	got, err := procStartTime(pid)
+	// Without /proc, e.g. on macOS, the pid is all we have to go on.
+	return err != nil || got == start
+}
+
+// procStartTime returns the start time of pid, in clock ticks since boot,
+// from /proc.
+func procStartTime(pid int) (uint64, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name is in parens and may contain spaces, so skip past it.
+	// starttime is the 22nd field, the 20th after the name.
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("can't parse /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("can't parse /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// running returns whether the node's process or container is still running.
+func (n nodeState) running(ctx context.Context, cli *dockerapi.Client) bool {
+	if n.ContainerID != "" {
+		if cli == nil {
+			return false
+		}
+		cont, err := cli.ContainerInspect(ctx, n.ContainerID)
+		return err == nil && cont.State != nil && cont.State.Running
+	}
+	return pidAlive(n.Pid, n.PidStart)
+}
+
+// status writes a line per node to stdout giving its state.
+func status(ctx context.Context, s *clusterState) error {
+	cli, err := s.docker()
+	if err != nil {
+		return err
+	}
+	if pidAlive(s.Pid, s.PidStart) {
+		fmt.Printf("yurt-cluster running as pid %d\n", s.Pid)
+	}
+	for _, n := range s.Nodes {
+		state := "stopped"
+		if n.running(ctx, cli) {
+			state = "running"
+		}
+		id := fmt.Sprintf("pid=%d", n.Pid)
+		if n.ContainerID != "" {
+			id = "container=" + shortID(n.ContainerID)
+		}
+		fmt.Printf("%-30s %-8s %-22s host=%s ports=%v\n", n.Name, state, id, n.Host, n.Ports)
+	}
+	return nil
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func (s *clusterState) docker() (*dockerapi.Client, error) {
+	if s.Mode != "docker" {
+		return nil, nil
+	}
+	return dockerClient()
+}
+
+// stop stops everything described by s.  If the yurt-cluster process that
+// created the clusters is still running, it's asked to shut down, otherwise
+// the nodes are stopped directly, being killed if they don't exit within
+// timeout.
+func stop(ctx context.Context, s *clusterState, timeout time.Duration) error {
+	if pidAlive(s.Pid, s.PidStart) {
+		if err := syscall.Kill(s.Pid, syscall.SIGTERM); err != nil {
+			return err
+		}
+		// Allow for each of the shutdown steps taking up to timeout.
+		if waitPid(s.Pid, s.PidStart, 8*timeout) {
+			return nil
+		}
+		return fmt.Errorf("yurt-cluster pid %d didn't exit", s.Pid)
+	}
+
+	cli, err := s.docker()
+	if err != nil {
+		return err
+	}
+	for _, n := range s.Nodes {
+		if !n.running(ctx, cli) {
+			continue
+		}
+		log.Printf("stopping %s", n.Name)
+		if n.ContainerID != "" {
+			err = cli.ContainerStop(ctx, n.ContainerID, &timeout)
+		} else {
+			err = stopPid(n.Pid, n.PidStart, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("error stopping %s: %w", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// destroy stops everything described by s, then removes any containers, the
+// docker network, and the workdir.
+func destroy(ctx context.Context, s *clusterState, timeout time.Duration) error {
+	if err := stop(ctx, s, timeout); err != nil {
+		return err
+	}
+	cli, err := s.docker()
+	if err != nil {
+		return err
+	}
+	if cli != nil {
+		for _, n := range s.Nodes {
+			if n.ContainerID == "" {
+				continue
+			}
+			err := cli.ContainerRemove(ctx, n.ContainerID, types.ContainerRemoveOptions{Force: true})
+			if err != nil && !dockerapi.IsErrNotFound(err) {
+				return err
+			}
+		}
+		if s.DockerNetwork != "" {
+			err := cli.NetworkRemove(ctx, s.DockerNetwork)
+			if err != nil && !dockerapi.IsErrNotFound(err) {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(s.WorkDir)
+}
+
+// stopPid sends SIGTERM to pid, then SIGKILL if it's still around after
+// timeout.
+func stopPid(pid int, start uint64, timeout time.Duration) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	if waitPid(pid, start, timeout) {
+		return nil
+	}
+	log.Printf("timed out stopping pid %d, killing it", pid)
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// waitPid returns true once pid has exited, or false if it hasn't within
+// timeout.
+func waitPid(pid int, start uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !pidAlive(pid, start) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
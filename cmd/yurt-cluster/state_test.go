@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// fakeEnv is an env whose nodes are given up front, for testing what's
+// done with them.  Methods other than those about nodes panic.
+type fakeEnv struct {
+	runenv.Env
+	nodes     map[string]yurt.Node
+	harnesses map[string]runner.Harness
+}
+
+func (e *fakeEnv) Node(name string) (yurt.Node, bool) {
+	n, ok := e.nodes[name]
+	return n, ok
+}
+
+func (e *fakeEnv) Harness(name string) (runner.Harness, bool) {
+	h, ok := e.harnesses[name]
+	return h, ok
+}
+
+func (e *fakeEnv) NodeNames() []string {
+	var names []string
+	for name := range e.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fakeHarness serves the "http" endpoint at addr, and records the calls
+// made to stop it.
+type fakeHarness struct {
+	addr    string
+	pid     int
+	stopped bool
+	killed  bool
+}
+
+func (h *fakeHarness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
+	return &runner.APIConfig{Address: url.URL{Scheme: "http", Host: h.addr}}, nil
+}
+
+func (h *fakeHarness) Stop() error {
+	h.stopped = true
+	return nil
+}
+
+func (h *fakeHarness) Kill() {
+	h.killed = true
+}
+
+func (h *fakeHarness) Wait() error {
+	return nil
+}
+
+type fakeExecHarness struct {
+	fakeHarness
+}
+
+func (h *fakeExecHarness) Pid() int {
+	return h.pid
+}
+
+func testNode(name string, port int) yurt.Node {
+	return yurt.Node{
+		Name: name,
+		Host: "127.0.0.1",
+		Ports: yurt.Ports{ByName: map[string]yurt.Port{
+			"http": {Number: port},
+		}},
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	_, err := loadState(dir)
+	if err == nil || !strings.Contains(err.Error(), "no clusters found") {
+		t.Fatalf("expected no clusters error, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(statePath(dir), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(dir); err == nil {
+		t.Fatal("expected error parsing bad state file")
+	}
+
+	s := clusterState{
+		Mode:     "exec",
+		WorkDir:  dir,
+		Pid:      1234,
+		PidStart: 5678,
+		Nodes:    []nodeState{{Name: "c1-consul-srv-1", Host: "127.0.0.1", Pid: 99, PidStart: 100}},
+		Topology: &topology{Mode: "exec", Clusters: []clusterSpec{{Name: "c1"}}},
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Pid != 1234 || got.PidStart != 5678 || len(got.Nodes) != 1 || got.Nodes[0].PidStart != 100 ||
+		got.Topology == nil || got.Topology.Clusters[0].Name != "c1" {
+		t.Fatalf("unexpected state %+v", got)
+	}
+}
+
+func TestAddNodes(t *testing.T) {
+	env := &fakeEnv{
+		nodes: map[string]yurt.Node{
+			"c1-consul-srv-2": testNode("c1-consul-srv-2", 8500),
+			"c1-consul-srv-1": testNode("c1-consul-srv-1", 8501),
+			// Allocated but never run, so it shouldn't be recorded.
+			"c1-consul-srv-3": testNode("c1-consul-srv-3", 8502),
+		},
+		harnesses: map[string]runner.Harness{
+			"c1-consul-srv-1": &fakeExecHarness{fakeHarness{pid: os.Getpid()}},
+			"c1-consul-srv-2": &fakeHarness{},
+		},
+	}
+	var s clusterState
+	s.addNodes(env)
+	if len(s.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %+v", s.Nodes)
+	}
+	n := s.Nodes[0]
+	if n.Name != "c1-consul-srv-1" || n.Ports["http"] != 8501 || n.Pid != os.Getpid() || n.PidStart == 0 {
+		t.Fatalf("unexpected node %+v", n)
+	}
+	if n := s.Nodes[1]; n.Name != "c1-consul-srv-2" || n.Pid != 0 {
+		t.Fatalf("unexpected node %+v", n)
+	}
+}
+
+func TestPidAlive(t *testing.T) {
+	pid := os.Getpid()
+	start, err := procStartTime(pid)
+	if err != nil {
+		t.Skipf("no /proc: %v", err)
+	}
+	if !pidAlive(pid, 0) || !pidAlive(pid, start) {
+		t.Fatal("expected our own pid to be alive")
+	}
+	// As if the process recorded exited and something else reused its pid.
+	if pidAlive(pid, start+1) {
+		t.Fatal("expected a reused pid not to be alive")
+	}
+	if pidAlive(0, 0) {
+		t.Fatal("expected pid 0 not to be alive")
+	}
+}
+
+// startSleep starts a process that ignores SIGTERM if ignoreTerm is true,
+// returning its node state.
+func startSleep(t *testing.T, name string, ignoreTerm bool) nodeState {
+	t.Helper()
+	script := "exec sleep 60"
+	if ignoreTerm {
+		script = "trap '' TERM; while :; do sleep 0.1; done"
+	}
+	cmd := exec.Command("sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can't run sh: %v", err)
+	}
+	// Reap it, lest it linger as a zombie that still looks alive.
+	go func() { _ = cmd.Wait() }()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	start, _ := procStartTime(cmd.Process.Pid)
+	return nodeState{Name: name, Pid: cmd.Process.Pid, PidStart: start}
+}
+
+func TestStopDestroy(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "yurt")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s := &clusterState{
+		Mode:    "exec",
+		WorkDir: dir,
+		Nodes: []nodeState{
+			startSleep(t, "c1-consul-srv-1", false),
+			startSleep(t, "c1-consul-srv-2", true),
+		},
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := stop(ctx, s, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range s.Nodes {
+		if !waitPid(n.Pid, n.PidStart, 5*time.Second) {
+			t.Fatalf("%s still running after stop", n.Name)
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected stop to leave the workdir: %v", err)
+	}
+
+	if err := destroy(ctx, s, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected destroy to remove the workdir, got %v", err)
+	}
+}
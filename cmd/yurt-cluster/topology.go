@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/ncabatoff/yurt/vault"
+	"gopkg.in/yaml.v2"
+)
+
+// topology describes the environment yurt-cluster creates.  It's read from
+// the -config file if one is given, with any flags that are set explicitly
+// overriding it.  It's also recorded in the state file, so that plan and apply
+// can tell what has changed.
+type topology struct {
+	// Mode is either "exec" or "docker".
+	Mode string `yaml:"mode" hcl:"mode" json:"mode,omitempty"`
+	// FirstPort is the first port to allocate, only for mode exec.
+	FirstPort int `yaml:"first_port" hcl:"first_port" json:"first_port,omitempty"`
+	// CIDR is the network to allocate, only for mode docker.
+	CIDR    string `yaml:"cidr" hcl:"cidr" json:"cidr,omitempty"`
+	WorkDir string `yaml:"workdir" hcl:"workdir" json:"workdir,omitempty"`
+	// TLS makes all clusters use certificates issued by a Vault CA.
+	TLS bool `yaml:"tls" hcl:"tls" json:"tls,omitempty"`
+	// Versions gives the version to run of each product, e.g.
+	// {"consul": "1.11.1"}; products not listed use the default version.
+	Versions   map[string]string `yaml:"versions" hcl:"versions" json:"versions,omitempty"`
+	Monitoring monitoringSpec    `yaml:"monitoring" hcl:"monitoring" json:"monitoring,omitempty"`
+	Clusters   []clusterSpec     `yaml:"clusters" hcl:"cluster" json:"clusters,omitempty"`
+}
+
+type monitoringSpec struct {
+	// Prometheus runs a Prometheus server that scrapes all the clusters.
+	Prometheus bool `yaml:"prometheus" hcl:"prometheus" json:"prometheus,omitempty"`
+	// Thanos runs a Thanos sidecar beside Prometheus.
+	Thanos         bool              `yaml:"thanos" hcl:"thanos" json:"thanos,omitempty"`
+	ExternalLabels map[string]string `yaml:"external_labels" hcl:"external_labels" json:"external_labels,omitempty"`
+	// NodeExporter runs node_exporter for host metrics, and Blackbox runs
+	// blackbox_exporter to probe the health endpoints of the servers.
+	NodeExporter bool `yaml:"node_exporter" hcl:"node_exporter" json:"node_exporter,omitempty"`
+	Blackbox     bool `yaml:"blackbox" hcl:"blackbox" json:"blackbox,omitempty"`
+}
+
+// clusterSpec describes a set of clusters sharing a name.
+type clusterSpec struct {
+	Name string `yaml:"name" hcl:",key" json:"name,omitempty"`
+	// Nodes is the number of server nodes of each product, unless overridden
+	// by ConsulServers, NomadServers or VaultNodes.
+	Nodes         int  `yaml:"nodes" hcl:"nodes" json:"nodes,omitempty"`
+	ConsulServers int  `yaml:"consul_servers" hcl:"consul_servers" json:"consul_servers,omitempty"`
+	NomadServers  int  `yaml:"nomad_servers" hcl:"nomad_servers" json:"nomad_servers,omitempty"`
+	VaultNodes    int  `yaml:"vault_nodes" hcl:"vault_nodes" json:"vault_nodes,omitempty"`
+	Nomad         bool `yaml:"nomad" hcl:"nomad" json:"nomad,omitempty"`
+	Vault         bool `yaml:"vault" hcl:"vault" json:"vault,omitempty"`
+	// NomadClients is the number of Nomad client nodes, each with its own
+	// Consul client agent.  It defaults to 1.
+	NomadClients *int `yaml:"nomad_clients" hcl:"nomad_clients" json:"nomad_clients,omitempty"`
+	// ConsulClients is the number of Consul client agents to run, only for
+	// Consul-only clusters, i.e. those with neither Nomad nor Vault.
+	ConsulClients int `yaml:"consul_clients" hcl:"consul_clients" json:"consul_clients,omitempty"`
+	// VaultStorage is either "raft", the default, or "consul".  Consul storage
+	// uses the cluster's Consul servers if it has Nomad, otherwise a Consul
+	// cluster is created for it.
+	VaultStorage string `yaml:"vault_storage" hcl:"vault_storage" json:"vault_storage,omitempty"`
+	// Seal configures Vault auto-unseal; Shamir seals are used if it's nil.
+	Seal *sealSpec `yaml:"seal" hcl:"seal" json:"seal,omitempty"`
+}
+
+// sealSpec describes a Vault seal.  Type is "shamir", or the type of a seal
+// stanza, e.g. "awskms", in which case Config gives its settings.  A transit
+// seal without Config uses a single node Vault created for the purpose.
+type sealSpec struct {
+	Type   string            `yaml:"type" hcl:"type" json:"type,omitempty"`
+	Config map[string]string `yaml:"config" hcl:"config" json:"config,omitempty"`
+}
+
+func (t *topology) clusterNames() []string {
+	var names []string
+	for _, c := range t.Clusters {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func (t *topology) cluster(name string) *clusterSpec {
+	for i := range t.Clusters {
+		if t.Clusters[i].Name == name {
+			return &t.Clusters[i]
+		}
+	}
+	return nil
+}
+
+func (t *topology) setVersion(product, version string) {
+	if t.Versions == nil {
+		t.Versions = map[string]string{}
+	}
+	t.Versions[product] = version
+}
+
+// defaultNodes is the number of server nodes of each product when not given.
+const defaultNodes = 3
+
+// hasConsul returns true if the cluster has Consul servers: those without
+// them are Vault-only clusters with raft storage.
+func (c *clusterSpec) hasConsul() bool {
+	return c.Nomad || !c.Vault || c.VaultStorage == "consul"
+}
+
+// setDefaults fills in the node counts that weren't given.
+func (c *clusterSpec) setDefaults() {
+	for _, n := range []*int{&c.ConsulServers, &c.NomadServers, &c.VaultNodes} {
+		if *n == 0 {
+			*n = c.Nodes
+		}
+	}
+	if c.NomadClients == nil {
+		one := 1
+		c.NomadClients = &one
+	}
+}
+
+func (s *sealSpec) vaultSeal() *vault.Seal {
+	if s == nil || s.Type == "shamir" {
+		return nil
+	}
+	return &vault.Seal{Type: s.Type, Config: s.Config}
+}
+
+// needsSealer returns true if a Vault must be created to provide the seal.
+func (s *sealSpec) needsSealer() bool {
+	return s != nil && s.Type == "transit" && len(s.Config) == 0
+}
+
+func loadTopology(path string) (*topology, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	return parseTopology(contents, path)
+}
+
+// parseTopology parses contents as HCL if path has a .hcl extension,
+// otherwise as YAML.  In HCL, clusters are given as blocks labeled with their
+// name, e.g. cluster "dc1" { nodes = 3 }.
+func parseTopology(contents []byte, path string) (*topology, error) {
+	var t topology
+	if filepath.Ext(path) == ".hcl" {
+		f, err := hcl.ParseBytes(contents)
+		if err == nil {
+			err = checkHCLKeys(f.Node.(*ast.ObjectList), reflect.TypeOf(t))
+		}
+		if err == nil {
+			err = hcl.DecodeObject(&t, f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %w", path, err)
+		}
+		return &t, nil
+	}
+	// Strict, so that misspelled keys are reported rather than ignored.
+	if err := yaml.UnmarshalStrict(contents, &t); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// checkHCLKeys reports keys in list that don't match the hcl tag of any field
+// of typ, like yaml.UnmarshalStrict does for YAML.  The hcl package has no
+// such option, and ignores unknown keys.
+func checkHCLKeys(list *ast.ObjectList, typ reflect.Type) error {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("hcl"), ",")[0]
+		if name != "" {
+			fields[name] = typ.Field(i).Type
+		}
+	}
+	for _, item := range list.Items {
+		key := item.Keys[0].Token.Value().(string)
+		ft, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("line %d: unknown key %q", item.Pos().Line, key)
+		}
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if obj, ok := item.Val.(*ast.ObjectType); ok && ft.Kind() == reflect.Struct {
+			if err := checkHCLKeys(obj.List, ft); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *topology) validate() error {
+	switch t.Mode {
+	case "exec", "docker":
+	default:
+		return fmt.Errorf("invalid mode %q, must be exec or docker", t.Mode)
+	}
+	if len(t.Clusters) == 0 {
+		return fmt.Errorf("no clusters defined")
+	}
+	names := map[string]bool{}
+	for i, c := range t.Clusters {
+		if c.Name == "" {
+			return fmt.Errorf("cluster %d has no name", i)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate cluster name %q", c.Name)
+		}
+		names[c.Name] = true
+		counts := map[string]int{
+			"consul_servers": c.ConsulServers,
+			"nomad_servers":  c.NomadServers,
+			"vault_nodes":    c.VaultNodes,
+		}
+		for _, key := range []string{"consul_servers", "nomad_servers", "vault_nodes"} {
+			if counts[key] < 1 {
+				return fmt.Errorf("cluster %s: %s must be at least 1", c.Name, key)
+			}
+		}
+		if *c.NomadClients < 0 {
+			return fmt.Errorf("cluster %s: nomad_clients must not be negative", c.Name)
+		}
+		if c.ConsulClients < 0 {
+			return fmt.Errorf("cluster %s: consul_clients must not be negative", c.Name)
+		}
+		if c.ConsulClients > 0 && (c.Nomad || c.Vault) {
+			return fmt.Errorf("cluster %s: consul_clients is only supported for consul-only clusters", c.Name)
+		}
+		if c.Seal != nil && !c.Vault {
+			return fmt.Errorf("cluster %s: seal given without vault", c.Name)
+		}
+		if c.Seal != nil && c.Seal.Type == "" {
+			return fmt.Errorf("cluster %s: seal has no type", c.Name)
+		}
+		switch c.VaultStorage {
+		case "", "raft", "consul":
+		default:
+			return fmt.Errorf("cluster %s: invalid vault_storage %q, must be raft or consul", c.Name, c.VaultStorage)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTopology(t *testing.T) {
+	yamlTopo := `
+mode: docker
+tls: true
+versions:
+  consul: 1.11.1
+monitoring:
+  prometheus: true
+clusters:
+  - name: c1
+    nomad: true
+    consul_servers: 5
+  - name: c2
+    vault: true
+    seal:
+      type: transit
+`
+	hclTopo := `
+mode = "docker"
+tls = true
+versions {
+  consul = "1.11.1"
+}
+monitoring {
+  prometheus = true
+}
+cluster "c1" {
+  nomad = true
+  consul_servers = 5
+}
+cluster "c2" {
+  vault = true
+  seal {
+    type = "transit"
+  }
+}
+`
+	for path, contents := range map[string]string{"topo.yaml": yamlTopo, "topo.hcl": hclTopo} {
+		topo, err := parseTopology([]byte(contents), path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if topo.Mode != "docker" || !topo.TLS || topo.Versions["consul"] != "1.11.1" || !topo.Monitoring.Prometheus {
+			t.Fatalf("%s: unexpected topology %+v", path, topo)
+		}
+		if got := strings.Join(topo.clusterNames(), ","); got != "c1,c2" {
+			t.Fatalf("%s: expected clusters c1,c2, got %s", path, got)
+		}
+		c1, c2 := topo.cluster("c1"), topo.cluster("c2")
+		if !c1.Nomad || c1.ConsulServers != 5 || !c2.Vault || c2.Seal == nil || !c2.Seal.needsSealer() {
+			t.Fatalf("%s: unexpected clusters %+v %+v", path, c1, c2)
+		}
+	}
+
+	for path, contents := range map[string]string{
+		"topo.yaml": "clusters:\n  - name: c1\n    nodez: 3\n",
+		"topo.hcl":  "cluster \"c1\" {\n  nodez = 3\n}\n",
+	} {
+		if _, err := parseTopology([]byte(contents), path); err == nil || !strings.Contains(err.Error(), "nodez") {
+			t.Fatalf("%s: expected error for unknown key, got %v", path, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		topology string
+		err      string
+	}{
+		{"ok", "clusters: [{name: c1, nomad: true, vault: true}]", ""},
+		{"mode", "mode: ssh\nclusters: [{name: c1}]", "invalid mode"},
+		{"no clusters", "mode: exec", "no clusters"},
+		{"no name", "clusters: [{nomad: true}]", "has no name"},
+		{"duplicate", "clusters: [{name: c1}, {name: c1}]", "duplicate cluster name"},
+		{"servers", "clusters: [{name: c1, nodes: 3, consul_servers: -1}]", "consul_servers must be at least 1"},
+		{"nomad clients", "clusters: [{name: c1, nomad: true, nomad_clients: -1}]", "nomad_clients must not be negative"},
+		{"consul clients", "clusters: [{name: c1, nomad: true, consul_clients: 1}]", "only supported for consul-only"},
+		{"seal without vault", "clusters: [{name: c1, seal: {type: transit}}]", "seal given without vault"},
+		{"seal type", "clusters: [{name: c1, vault: true, seal: {config: {a: b}}}]", "seal has no type"},
+		{"storage", "clusters: [{name: c1, vault: true, vault_storage: file}]", "invalid vault_storage"},
+	}
+	cur := &topology{Mode: "exec"}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := desiredTopology([]byte(tc.topology), "topo.yaml", cur)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatal(err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
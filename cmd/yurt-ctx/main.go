@@ -0,0 +1,90 @@
+// yurt-ctx lists and selects the yurt environments described by a
+// yurtconfig file, and prints the shell commands needed to use them, e.g.
+//
+//	eval "$(yurt-ctx env dev)"
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ncabatoff/yurt/yurtconfig"
+)
+
+const usage = `usage: yurt-ctx [-config FILE] COMMAND [ARGS]
+
+commands:
+  list            list contexts, marking the current one with *
+  current         print the name of the current context
+  use NAME        make NAME the current context
+  env [NAME]      print export commands for NAME, or the current context
+  delete NAME     remove NAME from the config
+`
+
+func main() {
+	log.SetFlags(0)
+	flagConfig := flag.String("config", yurtconfig.DefaultPath(), "yurtconfig file, defaults to $"+yurtconfig.PathEnvVar+" or ~/.yurt/config")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := yurtconfig.Load(*flagConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "list" && len(args) == 0:
+		for _, name := range cfg.Names() {
+			mark := " "
+			if name == cfg.CurrentContext {
+				mark = "*"
+			}
+			fmt.Println(mark, name)
+		}
+	case cmd == "current" && len(args) == 0:
+		if cfg.CurrentContext == "" {
+			log.Fatal("no current context")
+		}
+		fmt.Println(cfg.CurrentContext)
+	case cmd == "use" && len(args) == 1:
+		if _, err := cfg.Select(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		cfg.CurrentContext = args[0]
+		if err := cfg.Save(*flagConfig); err != nil {
+			log.Fatal(err)
+		}
+	case cmd == "env" && len(args) <= 1:
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+		ctx, err := cfg.Select(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ctx.WriteExports(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case cmd == "delete" && len(args) == 1:
+		if !cfg.Remove(args[0]) {
+			log.Fatalf("no context named %q", args[0])
+		}
+		if err := cfg.Save(*flagConfig); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
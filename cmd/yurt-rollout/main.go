@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ncabatoff/yurt/rollout"
+)
+
+func main() {
+	var (
+		flagInventory = flag.String("inventory", "", "YAML file listing consul_server_ips and hosts to restart")
+		flagTimeout   = flag.Duration("health-timeout", 5*time.Minute, "how long to wait for the fleet to be healthy after each restart")
+	)
+	flag.Parse()
+
+	if *flagInventory == "" {
+		log.Fatal("-inventory is required")
+	}
+	inv, err := rollout.LoadInventory(*flagInventory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := rollout.Run(ctx, *inv, rollout.Options{HealthTimeout: *flagTimeout}); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("rollout of %d hosts complete", len(inv.Hosts))
+}
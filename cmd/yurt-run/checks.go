@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+// supervisedChecks returns the Consul checks describing the health of the
+// processes yurt-run manages other than Consul itself.
+func supervisedChecks(yc *yurtConfig) []*consulapi.AgentCheckRegistration {
+	scheme := "http"
+	if yc.NomadTLSConfig != nil {
+		scheme = "https"
+	}
+	var checks []*consulapi.AgentCheckRegistration
+	if yc.RunsNomad() {
+		checks = append(checks, &consulapi.AgentCheckRegistration{
+			ID:    "yurt-run:nomad",
+			Name:  "Nomad agent managed by yurt-run",
+			Notes: "Checks the local Nomad agent's health endpoint.",
+			AgentServiceCheck: consulapi.AgentServiceCheck{
+				HTTP:          fmt.Sprintf("%s://127.0.0.1:%d/v1/agent/health", scheme, nomad.DefPorts().HTTP),
+				TLSSkipVerify: true,
+				Interval:      "10s",
+				Timeout:       "5s",
+			},
+		})
+	}
+	if yc.Vault {
+		vaultScheme := "http"
+		if yc.VaultTLSConfig != nil {
+			vaultScheme = "https"
+		}
+		checks = append(checks, &consulapi.AgentCheckRegistration{
+			ID:    "yurt-run:vault",
+			Name:  "Vault server managed by yurt-run",
+			Notes: "Checks that the local Vault server is up, whether or not it's initialized and unsealed.",
+			AgentServiceCheck: consulapi.AgentServiceCheck{
+				HTTP:          fmt.Sprintf("%s://%s:%d/v1/sys/health?standbyok=true&uninitcode=200&sealedcode=200", vaultScheme, yc.serverIP, vault.DefPorts().HTTP),
+				TLSSkipVerify: true,
+				Interval:      "10s",
+				Timeout:       "5s",
+			},
+		})
+	}
+	return checks
+}
+
+// registerChecks registers supervisedChecks with the local Consul agent,
+// retrying until the agent is up or ctx is done.
+func registerChecks(ctx context.Context, yc *yurtConfig) error {
+	cfg := consulapi.DefaultNonPooledConfig()
+	cfg.Address = fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().HTTP)
+	if yc.consulHTTPS() {
+		// The agent's cert is valid for 127.0.0.1.
+		cfg.Scheme = "https"
+		cfg.TLSConfig.CAFile = yc.caFile()
+	}
+	cli, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, check := range supervisedChecks(yc) {
+		for ctx.Err() == nil {
+			err = cli.Agent().CheckRegister(check)
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		if err != nil {
+			return fmt.Errorf("error registering check %s: %w", check.ID, err)
+		}
+		logger.Info("registered consul check", "id", check.ID)
+	}
+	return nil
+}
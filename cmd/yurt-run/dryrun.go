@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type dryRunReport struct {
+	Valid        bool              `json:"valid"`
+	Error        string            `json:"error,omitempty"`
+	NetworkCIDR  string            `json:"network_cidr,omitempty"`
+	ServerIP     string            `json:"server_ip,omitempty"`
+	Interface    string            `json:"interface,omitempty"`
+	ConsulServer bool              `json:"consul_server"`
+	NomadRole    string            `json:"nomad_role"`
+	Vault        bool              `json:"vault"`
+	TLS          bool              `json:"tls"`
+	Commands     []renderedCommand `json:"commands,omitempty"`
+}
+
+type renderedCommand struct {
+	Name      string            `json:"name"`
+	Args      []string          `json:"args"`
+	ConfigDir string            `json:"config_dir"`
+	Files     map[string]string `json:"files"`
+}
+
+// dryRun prints a JSON report describing what yurt-run would do given yc,
+// which has already been resolved yielding err, and returns the exit code.
+// Nothing is written to disk and Vault isn't contacted: when TLS is enabled,
+// certificates are rendered only if they've already been provisioned.
+func dryRun(yc *yurtConfig, err error, vaultAddr string) int {
+	report := dryRunReport{
+		NetworkCIDR: yc.NetworkCIDR,
+		TLS:         yc.TLS || vaultAddr != "",
+	}
+	if err == nil && report.TLS {
+		caFile := yc.caFile()
+		for name := range yc.certIssuers(yc.serverIP) {
+			var tls *pki.TLSConfigPEM
+			tls, err = loadTLS(caFile, filepath.Join(yc.DataDir, name+".pem"), filepath.Join(yc.DataDir, name+"-key.pem"))
+			if err != nil {
+				break
+			}
+			yc.setTLS(name, tls)
+		}
+		if err == nil && yc.consulCAOnly() {
+			var ca []byte
+			ca, err = ioutil.ReadFile(caFile)
+			yc.setTLS("consul", &pki.TLSConfigPEM{CA: string(ca)})
+		}
+		if err != nil && vaultAddr != "" {
+			// We'd generate certs using Vault; render without them.
+			err = nil
+		}
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Valid = true
+		report.ServerIP = yc.serverIP
+		report.Interface = yc.serverIf
+		report.ConsulServer = yc.IsConsulServer()
+		switch {
+		case !yc.RunsNomad():
+			report.NomadRole = roleNone
+		case yc.IsNomadServer():
+			report.NomadRole = roleServer
+		default:
+			report.NomadRole = roleClient
+		}
+		report.Vault = yc.Vault
+
+		dataDir, _ := filepath.Abs(yc.DataDir)
+		commands := []runner.Command{consulCommand(yc)}
+		nodes := []yurt.Node{node()}
+		if yc.RunsNomad() {
+			commands = append(commands, nomadCommand(yc))
+			nodes = append(nodes, node())
+		}
+		if yc.Vault {
+			commands = append(commands, vaultCommand(yc))
+			nodes = append(nodes, vaultNode())
+		}
+		for i, command := range commands {
+			cfg := runenv.ExecRunnerConfig(dataDir, command, nodes[i])
+			command = command.WithConfig(cfg)
+			files := command.Files()
+			for name := range files {
+				if strings.HasSuffix(name, "-key.pem") {
+					files[name] = "<redacted>"
+				}
+			}
+			report.Commands = append(report.Commands, renderedCommand{
+				Name:      command.Name(),
+				Args:      command.Args(),
+				ConfigDir: cfg.ConfigDir,
+				Files:     files,
+			})
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// installOptions configure the install subcommand.
+type installOptions struct {
+	// ConfigFile is where the resolved config is written.
+	ConfigFile string
+	// UnitDir is where the systemd unit is written.
+	UnitDir string
+	// User runs the service and owns the data dir.
+	User string
+	// VaultAddr is passed along as -vault-addr; the token is read from
+	// EnvFile, which isn't written by install.
+	VaultAddr string
+	EnvFile   string
+}
+
+const unitName = "yurt-run.service"
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=yurt-run: Consul, Nomad and Vault node agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+User={{ .User }}
+EnvironmentFile=-{{ .EnvFile }}
+ExecStart={{ .Binary }} -config-file={{ .ConfigFile }}{{ if .VaultAddr }} -vault-addr={{ .VaultAddr }}{{ end }}
+KillMode=mixed
+Restart=on-failure
+RestartSec=5
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// install writes yc to a config file and a systemd unit that runs us with
+// it, creates the data dir owned by the service user, and enables and
+// starts the service.
+func install(yc *yurtConfig, opts installOptions) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	binary, err = filepath.EvalSymlinks(binary)
+	if err != nil {
+		return err
+	}
+
+	u, err := user.Lookup(opts.User)
+	if err != nil {
+		return fmt.Errorf("error looking up user %q: %w", opts.User, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	dataDir, err := filepath.Abs(yc.DataDir)
+	if err != nil {
+		return err
+	}
+	yc.DataDir = dataDir
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		return err
+	}
+	if err := os.Chown(dataDir, uid, gid); err != nil {
+		return fmt.Errorf("error setting owner of %s: %w", dataDir, err)
+	}
+
+	config, err := yaml.Marshal(yc)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.ConfigFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(opts.ConfigFile, config, 0644); err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	logger.Info("wrote config", "file", opts.ConfigFile)
+
+	var unit bytes.Buffer
+	err = unitTemplate.Execute(&unit, struct {
+		installOptions
+		Binary string
+	}{opts, binary})
+	if err != nil {
+		return err
+	}
+	unitFile := filepath.Join(opts.UnitDir, unitName)
+	if err := ioutil.WriteFile(unitFile, unit.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing unit: %w", err)
+	}
+	logger.Info("wrote systemd unit", "file", unitFile)
+
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", "--now", unitName},
+	} {
+		cmd := exec.Command("systemctl", args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("systemctl %v failed: %w", args, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// logger is replaced by setupLogging once the config is known.
+var logger = hclog.New(&hclog.LoggerOptions{Name: "yurt-run"})
+
+// setupLogging configures logger using level, e.g. "debug", and format,
+// "text" or "json".  The standard logger, used by libraries, is redirected
+// to it.
+func setupLogging(level, format string) error {
+	if level == "" {
+		level = "info"
+	}
+	lvl := hclog.LevelFromString(level)
+	if lvl == hclog.NoLevel {
+		return fmt.Errorf("bad log level %q, must be one of trace, debug, info, warn, error", level)
+	}
+	switch format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("bad log format %q, must be text or json", format)
+	}
+
+	logger = hclog.New(&hclog.LoggerOptions{
+		Name:       "yurt-run",
+		Level:      lvl,
+		JSONFormat: format == "json",
+		Output:     os.Stderr,
+	})
+	log.SetOutput(logger.StandardWriter(&hclog.StandardLoggerOptions{InferLevels: true}))
+	log.SetFlags(0)
+	return nil
+}
+
+// serviceOutput returns a writer that logs the output of cmd, one line per
+// entry, tagged with the command name.  Levels are inferred from the
+// "[INFO]"-style prefixes Consul, Nomad and Vault use.
+func serviceOutput(cmd runner.Command, _ yurt.Node) io.Writer {
+	return logger.Named(cmd.Name()).StandardWriter(&hclog.StandardLoggerOptions{InferLevels: true})
+}
+
+// fatal logs msg and args as an error and exits.
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
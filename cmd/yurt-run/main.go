@@ -8,12 +8,13 @@ import (
 	"github.com/ncabatoff/yurt/binaries"
 	"github.com/ncabatoff/yurt/consul"
 	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/vault"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/hashicorp/vault/sdk/helper/certutil"
@@ -25,19 +26,69 @@ import (
 )
 
 type yurtConfig struct {
-	DataDir         string   `yaml:"data_dir,omitempty"`
-	TLS             bool     `yaml:"tls,omitempty"`
+	DataDir string `yaml:"data_dir,omitempty"`
+	TLS     bool   `yaml:"tls,omitempty"`
+	// TLSCAOnly means Consul client agents get only the CA, not a cert of
+	// their own: they serve plain HTTP locally, and get a cert for RPC from
+	// the servers using auto_encrypt.  Nomad agents always need a cert when
+	// using TLS.
+	TLSCAOnly       bool     `yaml:"tls_ca_only,omitempty"`
 	NetworkCIDR     string   `yaml:"network_cidr,omitempty"`
 	ConsulServerIPs []string `yaml:"consul_server_ips,omitempty"`
-	ConsulBin       string   `yaml:"consul_bin,omitempty"`
-	NomadBin        string   `yaml:"nomad_bin,omitempty"`
-	CACertFile      string   `yaml:"ca_cert_file,omitempty"`
-	serverIP        string
-	network         sockaddr.SockAddr
-	TLSConfig       *pki.TLSConfigPEM
+	// NomadServerIPs lists the Nomad servers, if they're not the same hosts
+	// as the Consul servers.  It gives the Nomad bootstrap_expect, and the
+	// default Nomad role.
+	NomadServerIPs []string `yaml:"nomad_server_ips,omitempty"`
+	ConsulBin      string   `yaml:"consul_bin,omitempty"`
+	NomadBin       string   `yaml:"nomad_bin,omitempty"`
+	CACertFile     string   `yaml:"ca_cert_file,omitempty"`
+	// Role is "server" or "client", to force the Consul agent's role.  By
+	// default it's a server if our IP is in ConsulServerIPs.
+	Role string `yaml:"role,omitempty"`
+	// NomadRole is "server", "client", or "none" to not run Nomad.  By
+	// default it's the same as the Consul role.
+	NomadRole string `yaml:"nomad_role,omitempty"`
+	// Vault runs a Vault server using raft storage, whose peers are the
+	// other hosts in ConsulServerIPs.  Initializing and unsealing it is left
+	// to the operator.
+	Vault bool `yaml:"vault,omitempty"`
+	// Restart, RestartBackoff and RestartMaxAttempts give the restartPolicy
+	// used to supervise the processes we run.
+	Restart            string        `yaml:"restart,omitempty"`
+	RestartBackoff     time.Duration `yaml:"restart_backoff,omitempty"`
+	RestartMaxAttempts int           `yaml:"restart_max_attempts,omitempty"`
+	// StatusAddr, if given, is the address to serve /healthz and /status on.
+	StatusAddr string `yaml:"status_addr,omitempty"`
+	// LogLevel and LogFormat configure yurt-run's own logging, see
+	// setupLogging.
+	LogLevel  string `yaml:"log_level,omitempty"`
+	LogFormat string `yaml:"log_format,omitempty"`
+	serverIP  string
+	serverIf  string
+	network   sockaddr.SockAddr
+	// tlsLock guards the TLS configs once they may be renewed.
+	tlsLock        sync.Mutex
+	TLSConfig      *pki.TLSConfigPEM `yaml:"-"`
+	NomadTLSConfig *pki.TLSConfigPEM `yaml:"-"`
+	VaultTLSConfig *pki.TLSConfigPEM `yaml:"-"`
+	// getCA returns the CA to issue certificates from, set by setupTLS.
+	getCA func() (*pki.CertificateAuthority, error)
 }
 
+// Roles for Role and NomadRole.
+const (
+	roleServer = "server"
+	roleClient = "client"
+	roleNone   = "none"
+)
+
 func (c *yurtConfig) IsConsulServer() bool {
+	switch c.Role {
+	case roleServer:
+		return true
+	case roleClient:
+		return false
+	}
 	for _, ip := range c.ConsulServerIPs {
 		if c.serverIP == ip {
 			return true
@@ -46,6 +97,34 @@ func (c *yurtConfig) IsConsulServer() bool {
 	return false
 }
 
+func (c *yurtConfig) IsNomadServer() bool {
+	if c.NomadRole != "" {
+		return c.NomadRole == roleServer
+	}
+	if len(c.NomadServerIPs) == 0 {
+		return c.IsConsulServer()
+	}
+	for _, ip := range c.NomadServerIPs {
+		if c.serverIP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// nomadServerCount is how many Nomad servers the cluster is bootstrapped
+// with.
+func (c *yurtConfig) nomadServerCount() int {
+	if len(c.NomadServerIPs) > 0 {
+		return len(c.NomadServerIPs)
+	}
+	return len(c.ConsulServerIPs)
+}
+
+func (c *yurtConfig) RunsNomad() bool {
+	return c.NomadRole != roleNone
+}
+
 func main() {
 	var (
 		flagConfigFile  = flag.String("config-file", "", "optional config file")
@@ -54,94 +133,248 @@ func main() {
 		flagData        = flag.String("data", "/var/yurt", "directory to store state")
 		flagNetworkCIDR = flag.String("network-cidr", "", "network cidr, optional if consul-server-ips are on a /24")
 		flagNomadBin    = flag.String("nomad-bin", "", "path to Nomad binary, will download if empty")
+		flagRole        = flag.String("role", "", "consul role, server or client; by default server iff our IP is in consul-server-ips")
+		flagNomadRole   = flag.String("nomad-role", "", "nomad role, server, client, or none to not run nomad; by default server iff our IP is in nomad-server-ips")
+		flagNomadIPs    = flag.String("nomad-server-ips", "", "comma-separated list of nomad server IPs, if not the same as consul-server-ips")
 		flagTLS         = flag.Bool("tls", false, "enable TLS authentication")
+		flagTLSCAOnly   = flag.Bool("tls-ca-only", false, "with TLS, give consul client agents only the CA rather than a cert")
+		flagVault       = flag.Bool("vault", false, "also run a Vault server with raft storage, peered with the other consul-server-ips")
 		flagVaultAddr   = flag.String("vault-addr", "", "vault address for TLS cert gen, put token in $VAULT_TOKEN")
-		// restart policy
+		flagDryRun      = flag.Bool("dry-run", false, "validate config and print a JSON report of what would be run, without running anything")
+		flagRestart     = flag.String("restart", "", "restart policy for exited processes: always, on-failure (the default), or never")
+		flagBackoff     = flag.Duration("restart-backoff", 0, "delay before restarting, doubled for each consecutive restart (default 1s)")
+		flagStatusAddr  = flag.String("status-addr", "", "address to serve /healthz and /status on, e.g. :7070")
+		flagMaxAttempts = flag.Int("restart-max-attempts", 0, "consecutive restarts before giving up, 0 for no limit")
+		flagLogLevel    = flag.String("log-level", "info", "log level: trace, debug, info, warn, or error")
+		flagLogFormat   = flag.String("log-format", "text", "log format: text or json")
+
+		flagInstallConfig  = flag.String("install-config-file", "/etc/yurt/yurt-run.yaml", "install: where to write the config file")
+		flagInstallUnitDir = flag.String("install-unit-dir", "/etc/systemd/system", "install: where to write the systemd unit")
+		flagInstallUser    = flag.String("install-user", "root", "install: user to run as, which will own the data dir")
+		flagInstallEnvFile = flag.String("install-env-file", "/etc/yurt/yurt-run.env", "install: optional env file for the unit, e.g. holding VAULT_TOKEN")
 	)
-	flag.Parse()
-	noArgsGiven := yurtConfig{DataDir: "/var/yurt", ConsulServerIPs: []string{}}
-	yc := &yurtConfig{
-		ConsulBin:       *flagConsulBin,
-		ConsulServerIPs: strings.Split(*flagConsulIPs, ","),
-		DataDir:         *flagData,
-		NetworkCIDR:     *flagNetworkCIDR,
-		NomadBin:        *flagNomadBin,
-		TLS:             *flagTLS,
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [install] [flags]\n\n"+
+			"With install, writes the resolved config and a systemd unit running it, then enables and starts it.\n\n", os.Args[0])
+		flag.PrintDefaults()
 	}
+	installMode := len(os.Args) > 1 && os.Args[1] == "install"
+	if installMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Parse()
 
-	switch {
-	case *flagConfigFile == "":
-	case reflect.DeepEqual(*yc, noArgsGiven):
+	// Settings from the config file, if any, are overridden by flags that
+	// were given explicitly.
+	yc := &yurtConfig{}
+	if *flagConfigFile != "" {
 		var err error
 		yc, err = loadConfigFile(*flagConfigFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("error loading config file", "error", err)
 		}
-	default:
-		log.Fatal("cannot provide other arguments along with -config-file")
 	}
-
-	if yc.NetworkCIDR == "" {
-		// assume it's a /24 if not specified
-		last := strings.LastIndexByte(yc.ConsulServerIPs[0], '.')
-		if last == -1 {
-			log.Fatalf("bad consul ip: %q", yc.ConsulServerIPs[0])
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "consul-bin":
+			yc.ConsulBin = *flagConsulBin
+		case "consul-server-ips":
+			yc.ConsulServerIPs = strings.Split(*flagConsulIPs, ",")
+		case "data":
+			yc.DataDir = *flagData
+		case "network-cidr":
+			yc.NetworkCIDR = *flagNetworkCIDR
+		case "nomad-bin":
+			yc.NomadBin = *flagNomadBin
+		case "role":
+			yc.Role = *flagRole
+		case "nomad-role":
+			yc.NomadRole = *flagNomadRole
+		case "nomad-server-ips":
+			yc.NomadServerIPs = strings.Split(*flagNomadIPs, ",")
+		case "tls":
+			yc.TLS = *flagTLS
+		case "tls-ca-only":
+			yc.TLSCAOnly = *flagTLSCAOnly
+		case "vault":
+			yc.Vault = *flagVault
+		case "restart":
+			yc.Restart = *flagRestart
+		case "restart-backoff":
+			yc.RestartBackoff = *flagBackoff
+		case "restart-max-attempts":
+			yc.RestartMaxAttempts = *flagMaxAttempts
+		case "status-addr":
+			yc.StatusAddr = *flagStatusAddr
+		case "log-level":
+			yc.LogLevel = *flagLogLevel
+		case "log-format":
+			yc.LogFormat = *flagLogFormat
 		}
-
-		yc.NetworkCIDR = yc.ConsulServerIPs[0][:last] + ".0/24"
+	})
+	if yc.DataDir == "" {
+		yc.DataDir = *flagData
 	}
 
-	if netSA, err := sockaddr.NewSockAddr(yc.NetworkCIDR); err != nil {
-		log.Fatalf("bad cidr %q, err=%v", yc.NetworkCIDR, err)
-	} else {
-		yc.network = netSA
+	err := yc.resolve()
+	if *flagDryRun {
+		os.Exit(dryRun(yc, err, *flagVaultAddr))
 	}
-
-	for _, ip := range yc.ConsulServerIPs {
-		ipSA, err := sockaddr.NewSockAddr(ip)
+	if err := setupLogging(yc.LogLevel, yc.LogFormat); err != nil {
+		fatal("bad logging config", "error", err)
+	}
+	if err != nil {
+		fatal("bad config", "error", err)
+	}
+	if installMode {
+		err := install(yc, installOptions{
+			ConfigFile: *flagInstallConfig,
+			UnitDir:    *flagInstallUnitDir,
+			User:       *flagInstallUser,
+			VaultAddr:  *flagVaultAddr,
+			EnvFile:    *flagInstallEnvFile,
+		})
 		if err != nil {
-			log.Fatalf("bad consul ip %q, err=%v", ip, err)
+			fatal("install failed", "error", err)
 		}
-		if !yc.network.Contains(ipSA) {
-			log.Fatalf("consul ip %s is not contained in network %s", ipSA, yc.network)
+		return
+	}
+	logger.Info("resolved config", "ip", yc.serverIP, "interface", yc.serverIf)
+
+	if *flagVaultAddr != "" || yc.TLS {
+		if err := yc.setupTLS(*flagVaultAddr, yc.serverIP); err != nil {
+			fatal("error setting up TLS", "error", err)
 		}
 	}
 
-	ifAddrs, err := sockaddr.GetAllInterfaces()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e, err := runenv.NewExecEnv(ctx, "yurt", yc.DataDir, 16000, binaries.Default)
 	if err != nil {
-		log.Fatalf("error listing interfaces: %v", err)
+		fatal("error creating env", "error", err)
 	}
-	for _, ifAddr := range ifAddrs {
-		if yc.network.Contains(ifAddr.SockAddr) {
-			yc.serverIP = sockaddr.ToIPv4Addr(ifAddr.SockAddr).NetIP().String()
-			log.Print(yc.serverIP)
+	e.Output = serviceOutput
+
+	status := newStatusTracker()
+	status.setCert("consul", yc.TLSConfig)
+	status.setCert("nomad", yc.NomadTLSConfig)
+	status.setCert("vault", yc.VaultTLSConfig)
+	if yc.StatusAddr != "" {
+		e.Go(func() error {
+			return serveStatus(ctx, yc.StatusAddr, status)
+		})
+	}
+
+	policy := yc.restartPolicy()
+	// certUsers maps each certificate to the supervisors of the processes
+	// that must be reloaded when it's renewed.
+	certUsers := map[string][]*supervisor{}
+	supervise := func(name string, node yurt.Node, newCommand func(*yurtConfig) runner.Command) {
+		s := newSupervisor(e, node, func() runner.Command { return newCommand(yc) }, policy, status)
+		certUsers[name] = append(certUsers[name], s)
+		e.Go(func() error {
+			return s.run(ctx)
+		})
+	}
+	supervise("consul", node(), consulCommand)
+	if yc.RunsNomad() {
+		supervise("nomad", node(), nomadCommand)
+	}
+	if yc.Vault {
+		supervise("vault", vaultNode(), vaultCommand)
+	}
+	if *flagVaultAddr != "" {
+		yc.renewCerts(ctx, yc.serverIP, certUsers, status)
+	}
+	go func() {
+		if err := registerChecks(ctx, yc); err != nil {
+			logger.Error("error registering checks", "error", err)
 		}
+	}()
+
+	if err := e.Wait(); err != nil {
+		fatal("exiting", "error", err)
 	}
-	if yc.serverIP == "" {
-		log.Fatalf("network interface for network_cidr %s not found", yc.NetworkCIDR)
+}
+
+func (c *yurtConfig) restartPolicy() restartPolicy {
+	return restartPolicy{
+		When:        c.Restart,
+		Backoff:     c.RestartBackoff,
+		MaxAttempts: c.RestartMaxAttempts,
 	}
+}
 
-	if *flagVaultAddr != "" {
-		if err := yc.setupTLS(*flagVaultAddr, yc.serverIP); err != nil {
-			log.Fatal(err)
+// resolve validates the config, filling in the network if needed, and finds
+// the local IP and interface on that network.
+func (c *yurtConfig) resolve() error {
+	if err := c.restartPolicy().validate(); err != nil {
+		return fmt.Errorf("%w (check -restart* flags or restart* config keys)", err)
+	}
+	switch c.Role {
+	case "", roleServer, roleClient:
+	default:
+		return fmt.Errorf("bad role %q, must be %s or %s", c.Role, roleServer, roleClient)
+	}
+	switch c.NomadRole {
+	case "", roleServer, roleClient, roleNone:
+	default:
+		return fmt.Errorf("bad nomad role %q, must be %s, %s or %s", c.NomadRole, roleServer, roleClient, roleNone)
+	}
+	if len(c.ConsulServerIPs) == 0 || c.ConsulServerIPs[0] == "" {
+		return fmt.Errorf("no consul server ips given, use -consul-server-ips or consul_server_ips in the config file")
+	}
+	for _, ip := range c.ConsulServerIPs {
+		if strings.TrimSpace(ip) == "" {
+			return fmt.Errorf("empty entry in consul server ips %q", strings.Join(c.ConsulServerIPs, ","))
 		}
 	}
+	for _, ip := range c.NomadServerIPs {
+		if strings.TrimSpace(ip) == "" {
+			return fmt.Errorf("empty entry in nomad server ips %q", strings.Join(c.NomadServerIPs, ","))
+		}
+	}
+	if c.NetworkCIDR == "" {
+		// assume it's a /24 if not specified
+		last := strings.LastIndexByte(c.ConsulServerIPs[0], '.')
+		if last == -1 {
+			return fmt.Errorf("bad consul ip: %q, give network_cidr explicitly if it's not IPv4", c.ConsulServerIPs[0])
+		}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+		c.NetworkCIDR = c.ConsulServerIPs[0][:last] + ".0/24"
+	}
 
-	e, err := runenv.NewExecEnv(ctx, "yurt", *flagData, 16000, binaries.Default)
+	netSA, err := sockaddr.NewSockAddr(c.NetworkCIDR)
 	if err != nil {
-		log.Fatalf("error creating env: %v", err)
+		return fmt.Errorf("bad cidr %q, err=%v", c.NetworkCIDR, err)
 	}
+	c.network = netSA
 
-	// TODO should we handle restarts, or rely on OS?
-	e.Go(runConsul(ctx, e, yc).Wait)
-	e.Go(runNomad(ctx, e, yc).Wait)
+	for _, ip := range c.ConsulServerIPs {
+		ipSA, err := sockaddr.NewSockAddr(ip)
+		if err != nil {
+			return fmt.Errorf("bad consul ip %q, err=%v", ip, err)
+		}
+		if !c.network.Contains(ipSA) {
+			return fmt.Errorf("consul ip %s is not contained in network %s", ipSA, c.network)
+		}
+	}
 
-	if err := e.Wait(); err != nil {
-		log.Fatal(err)
+	ifAddrs, err := sockaddr.GetAllInterfaces()
+	if err != nil {
+		return fmt.Errorf("error listing interfaces: %v", err)
+	}
+	for _, ifAddr := range ifAddrs {
+		if c.network.Contains(ifAddr.SockAddr) {
+			c.serverIP = sockaddr.ToIPv4Addr(ifAddr.SockAddr).NetIP().String()
+			c.serverIf = ifAddr.Name
+		}
+	}
+	if c.serverIP == "" {
+		return fmt.Errorf("network interface for network_cidr %s not found", c.NetworkCIDR)
 	}
+	return nil
 }
 
 func loadConfigFile(path string) (*yurtConfig, error) {
@@ -150,18 +383,159 @@ func loadConfigFile(path string) (*yurtConfig, error) {
 		return nil, fmt.Errorf("error reading config: %w", err)
 	}
 
+	// Strict, so that misspelled keys are reported rather than ignored.
 	var c yurtConfig
-	if err := yaml.Unmarshal(contents, &c); err != nil {
-		return nil, fmt.Errorf("error parsing config: %w", err)
+	if err := yaml.UnmarshalStrict(contents, &c); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", path, err)
 	}
 	return &c, nil
 }
 
+func (c *yurtConfig) caFile() string {
+	if c.CACertFile != "" {
+		return c.CACertFile
+	}
+	return filepath.Join(c.DataDir, "ca.pem")
+}
+
+// consulHTTPS is true if the Consul agent serves its API over HTTPS, which
+// it does only if it has a cert of its own.
+func (c *yurtConfig) consulHTTPS() bool {
+	tls := c.tls("consul")
+	return tls != nil && tls.Cert != ""
+}
+
+// consulCAOnly is true if the Consul agent gets only the CA, see TLSCAOnly.
+func (c *yurtConfig) consulCAOnly() bool {
+	return c.TLSCAOnly && !c.IsConsulServer()
+}
+
+// certIssuers returns funcs to issue the certificates we need, keyed by
+// name, which is also the basename of their files in the data dir.
+func (c *yurtConfig) certIssuers(myIP string) map[string]func(*pki.CertificateAuthority) (*pki.TLSConfigPEM, error) {
+	issuers := map[string]func(*pki.CertificateAuthority) (*pki.TLSConfigPEM, error){}
+	if !c.consulCAOnly() {
+		issuers["consul"] = func(ca *pki.CertificateAuthority) (*pki.TLSConfigPEM, error) {
+			cert, err := ca.ConsulServerTLS(context.Background(), myIP, "168h")
+			if err != nil {
+				return nil, fmt.Errorf("error generating Consul server certificate for ip=%v: %w", myIP, err)
+			}
+			return cert, nil
+		}
+	}
+	if c.RunsNomad() {
+		issuers["nomad"] = func(ca *pki.CertificateAuthority) (*pki.TLSConfigPEM, error) {
+			cert, err := ca.NomadServerTLS(context.Background(), myIP, "168h")
+			if err != nil {
+				return nil, fmt.Errorf("error generating Nomad server certificate for ip=%v: %w", myIP, err)
+			}
+			return cert, nil
+		}
+	}
+	if c.Vault {
+		issuers["vault"] = func(ca *pki.CertificateAuthority) (*pki.TLSConfigPEM, error) {
+			cert, err := ca.VaultServerTLS(context.Background(), myIP, "168h")
+			if err != nil {
+				return nil, fmt.Errorf("error generating Vault server certificate for ip=%v: %w", myIP, err)
+			}
+			return cert, nil
+		}
+	}
+	return issuers
+}
+
+// tls returns the named certificate, see certIssuers.
+func (c *yurtConfig) tls(name string) *pki.TLSConfigPEM {
+	c.tlsLock.Lock()
+	defer c.tlsLock.Unlock()
+	return *c.tlsField(name)
+}
+
+func (c *yurtConfig) tlsField(name string) **pki.TLSConfigPEM {
+	switch name {
+	case "nomad":
+		return &c.NomadTLSConfig
+	case "vault":
+		return &c.VaultTLSConfig
+	}
+	return &c.TLSConfig
+}
+
+func (c *yurtConfig) setTLS(name string, tls *pki.TLSConfigPEM) {
+	c.tlsLock.Lock()
+	defer c.tlsLock.Unlock()
+	*c.tlsField(name) = tls
+}
+
 func (c *yurtConfig) setupTLS(vaultAddr, myIP string) error {
-	caFile := c.CACertFile
-	if caFile == "" {
-		caFile = filepath.Join(c.DataDir, "ca.pem")
+	var caLock sync.Mutex
+	var ca *pki.CertificateAuthority
+	c.getCA = func() (*pki.CertificateAuthority, error) {
+		caLock.Lock()
+		defer caLock.Unlock()
+		if ca != nil {
+			return ca, nil
+		}
+		if vaultAddr == "" {
+			return nil, fmt.Errorf("no usable certificate in %s and no Vault address given to generate one", c.DataDir)
+		}
+		var err error
+		ca, err = pki.NewExternalCertificateAuthority(vaultAddr, os.Getenv("VAULT_TOKEN"))
+		if err != nil {
+			return nil, fmt.Errorf("error setting up external certificate authority: %w", err)
+		}
+		return ca, nil
+	}
+
+	for name, issue := range c.certIssuers(myIP) {
+		tls, err := c.loadOrIssueTLS(name, issue)
+		if err != nil {
+			return err
+		}
+		c.setTLS(name, tls)
+	}
+
+	if c.consulCAOnly() {
+		ca, err := c.loadOrFetchCA()
+		if err != nil {
+			return err
+		}
+		c.setTLS("consul", &pki.TLSConfigPEM{CA: ca})
+	}
+	return nil
+}
+
+// loadOrFetchCA returns the CA cert from the CA file, or else from Vault,
+// in which case it's written to the CA file.
+func (c *yurtConfig) loadOrFetchCA() (string, error) {
+	contents, err := ioutil.ReadFile(c.caFile())
+	if err == nil {
+		if _, err := certutil.ParsePEMBundle(string(contents)); err == nil {
+			return string(contents), nil
+		}
+	}
+
+	ca, err := c.getCA()
+	if err != nil {
+		return "", err
+	}
+	chain, err := ca.CAChain(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("error reading CA chain: %w", err)
+	}
+	if err := ioutil.WriteFile(c.caFile(), []byte(chain), 0644); err != nil {
+		return "", fmt.Errorf("error writing CA: %v", err)
 	}
+	return chain, nil
+}
+
+// loadOrIssueTLS returns the certificate for name found in the data dir, as
+// written by a previous run or provisioned by the user, or else one issued
+// by the CA returned by getCA, which it writes to the data dir.
+func (c *yurtConfig) loadOrIssueTLS(name string, issue func(*pki.CertificateAuthority) (*pki.TLSConfigPEM, error)) (*pki.TLSConfigPEM, error) {
+	caFile := c.caFile()
+	certFile := filepath.Join(c.DataDir, name+".pem")
+	keyFile := filepath.Join(c.DataDir, name+"-key.pem")
 
 	contents, err := ioutil.ReadFile(caFile)
 	switch {
@@ -169,80 +543,132 @@ func (c *yurtConfig) setupTLS(vaultAddr, myIP string) error {
 		_, err := certutil.ParsePEMBundle(string(contents))
 		if err == nil {
 			c.CACertFile = caFile
-			return nil
+			tls, err := loadTLS(caFile, certFile, keyFile)
+			if err == nil {
+				return tls, nil
+			}
+			logger.Warn("error loading existing certificate", "cert", name, "error", err)
+		} else {
+			logger.Warn("error parsing CA file", "file", caFile, "error", err)
 		}
-		log.Printf("error parsing CA file %s: %v", caFile, err)
 	case errors.Is(err, os.ErrNotExist):
 	default:
-		log.Printf("error reading CA file %s: %v", caFile, err)
+		logger.Warn("error reading CA file", "file", caFile, "error", err)
 	}
 
-	ca, err := pki.NewExternalCertificateAuthority(vaultAddr, os.Getenv("VAULT_TOKEN"))
+	ca, err := c.getCA()
 	if err != nil {
-		return fmt.Errorf("error setting up external certificate authority: %w", err)
+		return nil, err
 	}
-
-	cert, err := ca.ConsulServerTLS(context.Background(), myIP, "168h")
+	cert, err := issue(ca)
 	if err != nil {
-		return fmt.Errorf("error generating Consul server certificate for ip=%v: %w", myIP, err)
+		return nil, err
 	}
+	if err := c.writeTLS(name, cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
 
-	certFile := filepath.Join(c.DataDir, "consul.pem")
-	err = ioutil.WriteFile(certFile, []byte(cert.Cert), 0644)
+// writeTLS writes cert to the data dir, where loadOrIssueTLS looks for it.
+func (c *yurtConfig) writeTLS(name string, cert *pki.TLSConfigPEM) error {
+	err := ioutil.WriteFile(filepath.Join(c.DataDir, name+".pem"), []byte(cert.Cert), 0644)
 	if err != nil {
 		return fmt.Errorf("error writing cert: %v", err)
 	}
 
-	keyFile := filepath.Join(c.DataDir, "consul-key.pem")
-	err = ioutil.WriteFile(keyFile, []byte(cert.PrivateKey), 0644)
+	err = ioutil.WriteFile(filepath.Join(c.DataDir, name+"-key.pem"), []byte(cert.PrivateKey), 0644)
 	if err != nil {
 		return fmt.Errorf("error writing cert key: %v", err)
 	}
 
-	err = ioutil.WriteFile(caFile, []byte(cert.CA), 0644)
+	err = ioutil.WriteFile(c.caFile(), []byte(cert.CA), 0644)
 	if err != nil {
 		return fmt.Errorf("error writing CA: %v", err)
 	}
-
-	c.TLSConfig = cert
 	return nil
 }
 
-func runConsul(ctx context.Context, e runenv.Env, yc *yurtConfig) runner.Harness {
+// loadTLS reads a previously generated or provisioned certificate.
+func loadTLS(caFile, certFile, keyFile string) (*pki.TLSConfigPEM, error) {
+	var contents [3][]byte
+	for i, file := range []string{caFile, certFile, keyFile} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		contents[i] = b
+	}
+	if _, err := certutil.ParsePEMBundle(string(contents[1]) + string(contents[2])); err != nil {
+		return nil, fmt.Errorf("error parsing %s and %s: %w", certFile, keyFile, err)
+	}
+	return &pki.TLSConfigPEM{
+		CA:         string(contents[0]),
+		Cert:       string(contents[1]),
+		PrivateKey: string(contents[2]),
+	}, nil
+}
+
+func node() yurt.Node {
 	myName, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("error getting hostname: %v", err)
+		fatal("error getting hostname", "error", err)
 	}
-
-	// TODO add tls when used
-	command := consul.NewConfig(yc.IsConsulServer(), yc.ConsulServerIPs, yc.TLSConfig)
-	r, err := e.Run(ctx, command, yurt.Node{
+	return yurt.Node{
 		Name: myName,
-	})
-	if err != nil {
-		log.Fatal(err)
 	}
-
-	return r
 }
 
-func runNomad(ctx context.Context, e runenv.Env, yc *yurtConfig) runner.Harness {
-	myName, err := os.Hostname()
-	if err != nil {
-		log.Fatalf("error getting hostname: %v", err)
+func consulCommand(yc *yurtConfig) runner.Command {
+	cc := consul.NewConfig(yc.IsConsulServer(), yc.ConsulServerIPs, yc.tls("consul"))
+	if yc.TLS && yc.TLSCAOnly {
+		// Servers still verify incoming RPC, so clients without a cert of
+		// their own need one from the servers to talk to them.
+		cc = cc.WithAutoEncrypt()
 	}
+	return cc
+}
 
+func nomadCommand(yc *yurtConfig) runner.Command {
 	expect := 0
-	if yc.IsConsulServer() {
-		expect = len(yc.ConsulServerIPs)
+	if yc.IsNomadServer() {
+		expect = yc.nomadServerCount()
 	}
-	command := nomad.NewConfig(expect, fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().HTTP), yc.TLSConfig)
-	r, err := e.Run(ctx, command, yurt.Node{
-		Name: myName,
-	})
-	if err != nil {
-		log.Fatal(err)
+	nc := nomad.NewConfig(expect, fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().HTTP), yc.tls("nomad"))
+	nc.ConsulHTTP = !yc.consulHTTPS()
+	return nc
+}
+
+// vaultNode is distinct from node so that Vault gets its own config and data
+// dirs: it would otherwise read the Consul and Nomad config files, and its
+// raft storage would collide with Consul's.
+func vaultNode() yurt.Node {
+	n := node()
+	n.Name += "-vault"
+	n.Ports = vault.DefPorts().RunnerPorts()
+	return n
+}
+
+func vaultCommand(yc *yurtConfig) runner.Command {
+	var joinAddrs []string
+	for _, ip := range yc.ConsulServerIPs {
+		joinAddrs = append(joinAddrs, fmt.Sprintf("%s:%d", ip, vault.DefPorts().HTTP))
 	}
+	vc := vault.NewRaftConfig(joinAddrs, yc.tls("vault"), 0)
+	vc.ServiceRegistrationAddr = fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().HTTP)
+	vc.ServiceRegistrationTLS = yc.consulHTTPS()
+	return networkCommand{Command: vc, network: yc.network}
+}
+
+// networkCommand sets the network in the config of the command it wraps,
+// which ExecEnv leaves unset, so that e.g. Vault listens on the yurt network
+// rather than on localhost.
+type networkCommand struct {
+	runner.Command
+	network sockaddr.SockAddr
+}
 
-	return r
+func (n networkCommand) WithConfig(cfg runner.Config) runner.Command {
+	cfg.NetworkConfig.Network = n.network
+	return networkCommand{Command: n.Command.WithConfig(cfg), network: n.network}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+func TestVaultCommandServiceRegistration(t *testing.T) {
+	tls := &pki.TLSConfigPEM{Cert: "cert", PrivateKey: "key", CA: "ca"}
+	for _, tc := range []struct {
+		name  string
+		yc    *yurtConfig
+		https bool
+	}{
+		{"plain", &yurtConfig{}, false},
+		{"tls", &yurtConfig{TLSConfig: tls, VaultTLSConfig: tls}, true},
+		{"ca-only", &yurtConfig{TLSConfig: &pki.TLSConfigPEM{CA: "ca"}, VaultTLSConfig: tls}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vc := vaultCommand(tc.yc).(networkCommand).Command.(vault.VaultConfig)
+			if vc.ServiceRegistrationTLS != tc.https {
+				t.Fatalf("expected ServiceRegistrationTLS=%v", tc.https)
+			}
+		})
+	}
+}
+
+func TestNomadBootstrapExpect(t *testing.T) {
+	consulIPs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	for _, tc := range []struct {
+		name     string
+		yc       *yurtConfig
+		expected int
+	}{
+		{"colocated server", &yurtConfig{ConsulServerIPs: consulIPs, serverIP: "10.0.0.1"}, 3},
+		{"colocated client", &yurtConfig{ConsulServerIPs: consulIPs, serverIP: "10.0.0.9"}, 0},
+		{"split server", &yurtConfig{ConsulServerIPs: consulIPs, NomadServerIPs: []string{"10.0.0.9"}, serverIP: "10.0.0.9"}, 1},
+		{"split consul server", &yurtConfig{ConsulServerIPs: consulIPs, NomadServerIPs: []string{"10.0.0.9"}, serverIP: "10.0.0.1"}, 0},
+		{"forced role", &yurtConfig{ConsulServerIPs: consulIPs, NomadServerIPs: []string{"10.0.0.8", "10.0.0.9"}, NomadRole: roleServer, serverIP: "10.0.0.1"}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nc := nomadCommand(tc.yc).(nomad.NomadConfig)
+			if nc.BootstrapExpect != tc.expected {
+				t.Fatalf("expected bootstrap_expect %d, got %d", tc.expected, nc.BootstrapExpect)
+			}
+		})
+	}
+}
+
+// TestCAOnlyConfig verifies that in CA-only mode, client agents get a cert
+// via auto_encrypt, and that Nomad talks to them over plain HTTP.
+func TestCAOnlyConfig(t *testing.T) {
+	certTLS := &pki.TLSConfigPEM{Cert: "cert", PrivateKey: "key", CA: "ca"}
+	for _, tc := range []struct {
+		name        string
+		yc          *yurtConfig
+		autoEncrypt string
+		nomadSSL    bool
+	}{
+		{"server", &yurtConfig{TLS: true, TLSCAOnly: true, Role: roleServer, TLSConfig: certTLS, NomadTLSConfig: certTLS}, `"allow_tls":true`, true},
+		{"client", &yurtConfig{TLS: true, TLSCAOnly: true, Role: roleClient, TLSConfig: &pki.TLSConfigPEM{CA: "ca"}, NomadTLSConfig: certTLS}, `"tls":true`, false},
+		{"full tls client", &yurtConfig{TLS: true, Role: roleClient, TLSConfig: certTLS, NomadTLSConfig: certTLS}, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			consulTLS := consulCommand(tc.yc).Files()["tls.json"]
+			switch {
+			case tc.autoEncrypt == "" && strings.Contains(consulTLS, "auto_encrypt"):
+				t.Fatalf("didn't expect auto_encrypt in %s", consulTLS)
+			case !strings.Contains(consulTLS, tc.autoEncrypt):
+				t.Fatalf("expected %s in %s", tc.autoEncrypt, consulTLS)
+			}
+
+			var nomadCfg struct {
+				Consul struct {
+					SSL bool `json:"ssl"`
+				} `json:"consul"`
+			}
+			if err := json.Unmarshal([]byte(nomadCommand(tc.yc).Files()["tls.json"]), &nomadCfg); err != nil {
+				t.Fatal(err)
+			}
+			if nomadCfg.Consul.SSL != tc.nomadSSL {
+				t.Fatalf("expected nomad consul ssl=%v", tc.nomadSSL)
+			}
+		})
+	}
+}
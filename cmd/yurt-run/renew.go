@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/ncabatoff/yurt/pki"
+)
+
+const (
+	// renewRetryMin and renewRetryMax bound the delay between attempts to
+	// renew a certificate, e.g. while Vault is unreachable.
+	renewRetryMin = 30 * time.Second
+	renewRetryMax = 10 * time.Minute
+)
+
+// renewCerts starts a goroutine per certificate we issue, which re-issues
+// it once 2/3 of its lifetime has passed, writes it to the data dir, and
+// reloads the processes in users that use it, keyed by certificate name.
+func (c *yurtConfig) renewCerts(ctx context.Context, myIP string, users map[string][]*supervisor, status *statusTracker) {
+	for name, issue := range c.certIssuers(myIP) {
+		go c.renewLoop(ctx, name, issue, users[name], status)
+	}
+}
+
+func (c *yurtConfig) renewLoop(ctx context.Context, name string, issue func(*pki.CertificateAuthority) (*pki.TLSConfigPEM, error), users []*supervisor, status *statusTracker) {
+	for {
+		at, err := renewalTime(c.tls(name))
+		if err != nil {
+			logger.Warn("error parsing certificate, renewing now", "cert", name, "error", err)
+			at = time.Now()
+		}
+		logger.Info("scheduled certificate renewal", "cert", name, "at", at)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(at)):
+		}
+
+		cert, err := c.renew(ctx, name, issue)
+		if err != nil {
+			return
+		}
+		c.setTLS(name, cert)
+		status.setCert(name, cert)
+		for _, s := range users {
+			if err := s.reload(); err != nil {
+				logger.Error("error reloading after renewing certificate", "cert", name, "error", err)
+			}
+		}
+	}
+}
+
+// renew issues and writes a new certificate, retrying with jittered
+// exponential backoff until it succeeds or ctx is done.
+func (c *yurtConfig) renew(ctx context.Context, name string, issue func(*pki.CertificateAuthority) (*pki.TLSConfigPEM, error)) (*pki.TLSConfigPEM, error) {
+	delay := renewRetryMin
+	for {
+		ca, err := c.getCA()
+		var cert *pki.TLSConfigPEM
+		if err == nil {
+			cert, err = issue(ca)
+		}
+		if err == nil {
+			err = c.writeTLS(name, cert)
+		}
+		if err == nil {
+			logger.Info("renewed certificate", "cert", name)
+			return cert, nil
+		}
+
+		jittered := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		logger.Warn("error renewing certificate", "cert", name, "retry_in", jittered, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jittered):
+		}
+		delay *= 2
+		if delay > renewRetryMax {
+			delay = renewRetryMax
+		}
+	}
+}
+
+// renewalTime returns when 2/3 of the lifetime of tls will have passed.
+func renewalTime(tls *pki.TLSConfigPEM) (time.Time, error) {
+	bundle, err := certutil.ParsePEMBundle(tls.Cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert := bundle.Certificate
+	if cert == nil {
+		return time.Time{}, fmt.Errorf("no certificate found")
+	}
+	return cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3), nil
+}
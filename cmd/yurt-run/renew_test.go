@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt/pki"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Now().Truncate(time.Second)
+	tls := testCert(t, notBefore, notBefore.Add(3*time.Hour))
+	got, err := renewalTime(tls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := notBefore.Add(2 * time.Hour); !got.Equal(want) {
+		t.Fatalf("expected renewal at %v, got %v", want, got)
+	}
+
+	if _, err := renewalTime(&pki.TLSConfigPEM{Cert: "not a cert"}); err == nil {
+		t.Fatal("expected error for bad cert")
+	}
+	if _, err := renewalTime(&pki.TLSConfigPEM{}); err == nil {
+		t.Fatal("expected error for missing cert")
+	}
+}
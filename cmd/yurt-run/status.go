@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/ncabatoff/yurt/pki"
+)
+
+// Service states reported by statusTracker.
+const (
+	stateStarting   = "starting"
+	stateRunning    = "running"
+	stateRestarting = "restarting"
+	stateExited     = "exited"
+)
+
+type serviceStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastExit  time.Time `json:"last_exit,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type certStatus struct {
+	Name     string    `json:"name"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+type statusReport struct {
+	Healthy  bool            `json:"healthy"`
+	Services []serviceStatus `json:"services"`
+	Certs    []certStatus    `json:"certs,omitempty"`
+}
+
+// statusTracker records the state of the processes supervise runs and of
+// our certificates, for serving over HTTP.
+type statusTracker struct {
+	l        sync.Mutex
+	services map[string]*serviceStatus
+	certs    map[string]time.Time
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		services: make(map[string]*serviceStatus),
+		certs:    make(map[string]time.Time),
+	}
+}
+
+func (t *statusTracker) service(name string) *serviceStatus {
+	s, ok := t.services[name]
+	if !ok {
+		s = &serviceStatus{Name: name, State: stateStarting}
+		t.services[name] = s
+	}
+	return s
+}
+
+func (t *statusTracker) started(name string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	s := t.service(name)
+	if !s.LastStart.IsZero() {
+		s.Restarts++
+	}
+	s.State, s.LastStart = stateRunning, time.Now()
+}
+
+func (t *statusTracker) exited(name string, err error, restarting bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	s := t.service(name)
+	s.State, s.LastExit, s.LastError = stateExited, time.Now(), ""
+	if restarting {
+		s.State = stateRestarting
+	}
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+// setCert records the expiry of the named certificate.
+func (t *statusTracker) setCert(name string, tls *pki.TLSConfigPEM) {
+	if tls == nil || tls.Cert == "" {
+		return
+	}
+	bundle, err := certutil.ParsePEMBundle(tls.Cert)
+	if err != nil || bundle.Certificate == nil {
+		logger.Error("error parsing certificate", "cert", name, "error", err)
+		return
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.certs[name] = bundle.Certificate.NotAfter
+}
+
+func (t *statusTracker) report() statusReport {
+	t.l.Lock()
+	defer t.l.Unlock()
+	r := statusReport{Healthy: len(t.services) > 0}
+	for _, s := range t.services {
+		r.Services = append(r.Services, *s)
+		if s.State != stateRunning {
+			r.Healthy = false
+		}
+	}
+	sort.Slice(r.Services, func(i, j int) bool {
+		return r.Services[i].Name < r.Services[j].Name
+	})
+	for name, notAfter := range t.certs {
+		r.Certs = append(r.Certs, certStatus{Name: name, NotAfter: notAfter})
+		if time.Now().After(notAfter) {
+			r.Healthy = false
+		}
+	}
+	sort.Slice(r.Certs, func(i, j int) bool {
+		return r.Certs[i].Name < r.Certs[j].Name
+	})
+	return r
+}
+
+// handler serves /healthz, which returns 200 if every service is running
+// and no certificate has expired, 503 otherwise, and /status, which returns
+// the full statusReport as JSON.
+func (t *statusTracker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !t.report().Healthy {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		report := t.report()
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	})
+	return mux
+}
+
+// serveStatus serves the tracker's handler on addr until ctx is done.
+func serveStatus(ctx context.Context, addr string, t *statusTracker) error {
+	srv := &http.Server{Addr: addr, Handler: t.handler()}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	logger.Info("serving status", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt/pki"
+)
+
+// testCert returns a self-signed cert valid from notBefore to notAfter.
+func testCert(t *testing.T, notBefore, notAfter time.Time) *pki.TLSConfigPEM {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pki.TLSConfigPEM{
+		Cert:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func getStatus(t *testing.T, srv *httptest.Server) (int, int, statusReport) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	healthz := resp.StatusCode
+
+	resp, err = http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report statusReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return healthz, resp.StatusCode, report
+}
+
+func TestStatusHandler(t *testing.T) {
+	tracker := newStatusTracker()
+	srv := httptest.NewServer(tracker.handler())
+	defer srv.Close()
+
+	// Nothing started yet isn't healthy.
+	if healthz, status, _ := getStatus(t, srv); healthz != http.StatusServiceUnavailable || status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503s before anything started, got %d %d", healthz, status)
+	}
+
+	tracker.started("consul")
+	tracker.started("nomad")
+	now := time.Now()
+	tracker.setCert("consul", testCert(t, now.Add(-time.Hour), now.Add(time.Hour)))
+	healthz, status, report := getStatus(t, srv)
+	if healthz != http.StatusOK || status != http.StatusOK || !report.Healthy {
+		t.Fatalf("expected healthy, got %d %d %+v", healthz, status, report)
+	}
+	if len(report.Services) != 2 || report.Services[0].Name != "consul" || report.Services[1].Name != "nomad" {
+		t.Fatalf("unexpected services %+v", report.Services)
+	}
+	if len(report.Certs) != 1 || report.Certs[0].Name != "consul" {
+		t.Fatalf("unexpected certs %+v", report.Certs)
+	}
+
+	tracker.exited("nomad", fmt.Errorf("exit status 1"), true)
+	healthz, status, report = getStatus(t, srv)
+	if healthz != http.StatusServiceUnavailable || status != http.StatusServiceUnavailable || report.Healthy {
+		t.Fatalf("expected unhealthy while restarting, got %d %d %+v", healthz, status, report)
+	}
+	if s := report.Services[1]; s.State != stateRestarting || s.LastError != "exit status 1" {
+		t.Fatalf("unexpected nomad status %+v", s)
+	}
+
+	tracker.started("nomad")
+	_, _, report = getStatus(t, srv)
+	if s := report.Services[1]; !report.Healthy || s.State != stateRunning || s.Restarts != 1 {
+		t.Fatalf("expected nomad to be running again after a restart, got %+v", report)
+	}
+
+	// An expired cert makes us unhealthy even if everything is running.
+	tracker.setCert("nomad", testCert(t, now.Add(-2*time.Hour), now.Add(-time.Hour)))
+	if healthz, _, _ := getStatus(t, srv); healthz != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with an expired cert, got %d", healthz)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/ncabatoff/yurt/runner/exec"
+	"github.com/ncabatoff/yurt/util"
+)
+
+// Restart policies.
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// restartPolicy says when supervise restarts a process that exited.
+type restartPolicy struct {
+	// When is one of the restart* consts, default restartOnFailure.
+	When string
+	// Backoff is the delay before the first restart, default 1s.  It
+	// doubles with each consecutive restart, up to maxRestartBackoff.
+	Backoff time.Duration
+	// MaxAttempts is how many consecutive restarts are made before giving
+	// up, or 0 for no limit.
+	MaxAttempts int
+}
+
+const (
+	maxRestartBackoff = time.Minute
+	// A process that ran for at least this long is considered to have been
+	// healthy, so restarting it starts over with the initial backoff.
+	healthyRunTime = 5 * time.Minute
+)
+
+func (p restartPolicy) validate() error {
+	switch p.When {
+	case "", restartNever, restartOnFailure, restartAlways:
+	default:
+		return fmt.Errorf("bad restart policy %q, must be one of %s, %s, %s", p.When, restartAlways, restartOnFailure, restartNever)
+	}
+	if p.Backoff < 0 {
+		return fmt.Errorf("bad restart backoff %v", p.Backoff)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("bad restart max attempts %d", p.MaxAttempts)
+	}
+	return nil
+}
+
+// shouldRestart says whether to restart a process that exited with err.
+func (p restartPolicy) shouldRestart(err error) bool {
+	switch p.When {
+	case restartNever:
+		return false
+	case restartAlways:
+		return true
+	default:
+		return err != nil
+	}
+}
+
+// initialBackoff returns the delay before the first of a run of restarts.
+func (p restartPolicy) initialBackoff() time.Duration {
+	if p.Backoff == 0 {
+		return time.Second
+	}
+	return p.Backoff
+}
+
+// nextBackoff returns the delay to use after one of delay.
+func nextBackoff(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxRestartBackoff {
+		delay = maxRestartBackoff
+	}
+	return delay
+}
+
+// supervisor runs a command, restarting it according to its policy.
+type supervisor struct {
+	env  *runenv.ExecEnv
+	node yurt.Node
+	// newCommand returns the command to run; it's called for every start
+	// and reload, so that e.g. renewed certificates are picked up.
+	newCommand func() runner.Command
+	policy     restartPolicy
+	status     *statusTracker
+
+	l sync.Mutex
+	h runner.Harness
+}
+
+func newSupervisor(e *runenv.ExecEnv, node yurt.Node, newCommand func() runner.Command, policy restartPolicy, status *statusTracker) *supervisor {
+	return &supervisor{
+		env:        e,
+		node:       node,
+		newCommand: newCommand,
+		policy:     policy,
+		status:     status,
+	}
+}
+
+// run runs the command until ctx is done, recording its state in status.
+// It returns an error if the process exits and won't be restarted, or can't
+// be started at all.
+func (s *supervisor) run(ctx context.Context) error {
+	policy, status := s.policy, s.status
+	backoff := policy.initialBackoff()
+	delay, attempts := backoff, 0
+	for {
+		start := time.Now()
+		command := s.newCommand()
+		h, err := s.env.Run(ctx, command, s.node)
+		if err == nil {
+			s.l.Lock()
+			s.h = h
+			s.l.Unlock()
+			status.started(command.Name())
+			err = h.Wait()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !policy.shouldRestart(err) {
+			status.exited(command.Name(), err, false)
+			if err != nil {
+				return fmt.Errorf("%s exited: %w", command.Name(), err)
+			}
+			logger.Info("exited cleanly, not restarting", "service", command.Name())
+			return nil
+		}
+
+		if time.Since(start) >= healthyRunTime {
+			delay, attempts = backoff, 0
+		}
+		attempts++
+		if policy.MaxAttempts > 0 && attempts > policy.MaxAttempts {
+			status.exited(command.Name(), err, false)
+			return fmt.Errorf("%s exited, giving up after %d restarts: %v", command.Name(), policy.MaxAttempts, err)
+		}
+		status.exited(command.Name(), err, true)
+		logger.Warn("exited, restarting", "service", command.Name(), "error", err, "delay", delay, "attempt", attempts)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		delay = nextBackoff(delay)
+	}
+}
+
+// reload rewrites the config files of the running process, and tells it to
+// reload them.
+func (s *supervisor) reload() error {
+	s.l.Lock()
+	h := s.h
+	s.l.Unlock()
+	eh, ok := h.(*exec.Harness)
+	if !ok {
+		return fmt.Errorf("no running process to reload")
+	}
+
+	command := s.newCommand()
+	cfg := runenv.ExecRunnerConfig(s.env.WorkDir, command, s.node)
+	for name, contents := range command.WithConfig(cfg).Files() {
+		if err := util.WriteConfig(cfg.ConfigDir, name, contents); err != nil {
+			return err
+		}
+	}
+	return eh.Reload()
+}
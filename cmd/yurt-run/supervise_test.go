@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyValidate(t *testing.T) {
+	for _, tc := range []struct {
+		policy restartPolicy
+		ok     bool
+	}{
+		{restartPolicy{}, true},
+		{restartPolicy{When: restartAlways, Backoff: time.Second, MaxAttempts: 3}, true},
+		{restartPolicy{When: "sometimes"}, false},
+		{restartPolicy{Backoff: -time.Second}, false},
+		{restartPolicy{MaxAttempts: -1}, false},
+	} {
+		if err := tc.policy.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: expected ok=%v, got %v", tc.policy, tc.ok, err)
+		}
+	}
+}
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	failed := fmt.Errorf("exit status 1")
+	for _, tc := range []struct {
+		when           string
+		clean, failure bool
+	}{
+		{"", false, true},
+		{restartOnFailure, false, true},
+		{restartAlways, true, true},
+		{restartNever, false, false},
+	} {
+		p := restartPolicy{When: tc.when}
+		if got := p.shouldRestart(nil); got != tc.clean {
+			t.Errorf("%q: clean exit: expected %v, got %v", tc.when, tc.clean, got)
+		}
+		if got := p.shouldRestart(failed); got != tc.failure {
+			t.Errorf("%q: failure: expected %v, got %v", tc.when, tc.failure, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := (restartPolicy{}).initialBackoff(); d != time.Second {
+		t.Fatalf("expected default backoff of 1s, got %v", d)
+	}
+	delay := (restartPolicy{Backoff: 10 * time.Second}).initialBackoff()
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, delay)
+		delay = nextBackoff(delay)
+	}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, maxRestartBackoff, maxRestartBackoff}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected delays %v, got %v", want, got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
@@ -22,6 +23,7 @@ type Ports struct {
 	SerfLAN int
 	SerfWAN int
 	Server  int
+	GRPC    int
 }
 
 var PortNames = struct {
@@ -30,12 +32,14 @@ var PortNames = struct {
 	SerfLAN string
 	SerfWAN string
 	Server  string
+	GRPC    string
 }{
 	"http",
 	"dns",
 	"serf-lan",
 	"serf-wan",
 	"server",
+	"grpc",
 }
 
 func DefPorts() Ports {
@@ -45,6 +49,7 @@ func DefPorts() Ports {
 		SerfWAN: 8302,
 		HTTP:    8500,
 		DNS:     8600,
+		GRPC:    8502,
 	}
 }
 
@@ -57,6 +62,7 @@ func (c Ports) RunnerPorts() yurt.Ports {
 			PortNames.SerfWAN,
 			PortNames.HTTP,
 			PortNames.DNS,
+			PortNames.GRPC,
 		},
 		ByName: map[string]yurt.Port{
 			PortNames.Server:  {c.Server, yurt.TCPOnly},
@@ -64,10 +70,37 @@ func (c Ports) RunnerPorts() yurt.Ports {
 			PortNames.SerfWAN: {c.SerfWAN, yurt.TCPAndUDP},
 			PortNames.HTTP:    {c.HTTP, yurt.TCPOnly},
 			PortNames.DNS:     {c.DNS, yurt.TCPAndUDP},
+			PortNames.GRPC:    {c.GRPC, yurt.TCPOnly},
 		},
 	}
 }
 
+// Descriptor describes Consul for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "consul",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server", "client"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/v1/agent/metrics", Params: url.Values{"format": []string{"prometheus"}}},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/v1/status/leader"},
+	},
+	Docker: &yurt.DockerDescriptor{
+		Image:     "consul:1.11.1",
+		ConfigDir: "/consul/config",
+		DataDir:   "/consul/data",
+		LogDir:    "/consul/logs",
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "Server", Type: "bool", Description: "run as a server rather than a client agent"},
+		{Name: "JoinAddrs", Type: "[]string", Description: "addresses of the servers to join"},
+		{Name: "Autopilot", Type: "*AutopilotConfig", Description: "autopilot settings for servers"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
 // ConsulConfig describes how to run a single Consul agent.
 type ConsulConfig struct {
 	Common runner.Config
@@ -75,6 +108,20 @@ type ConsulConfig struct {
 	// JoinAddrs specifies the addresses of the Consul servers.  If they have
 	// a :port suffix, it should be that of the SerfLAN port.
 	JoinAddrs []string
+	// Autopilot, if given, configures autopilot on servers.
+	Autopilot *AutopilotConfig
+	// AutoEncrypt lets client agents given only the CA get a cert for RPC
+	// from the servers: it sets auto_encrypt allow_tls on servers, and
+	// auto_encrypt tls on clients.  Servers must be given a cert.
+	AutoEncrypt bool
+}
+
+// AutopilotConfig holds the autopilot settings applied to servers at startup.
+// Zero durations mean the Consul default is used.
+type AutopilotConfig struct {
+	CleanupDeadServers      bool
+	LastContactThreshold    time.Duration
+	ServerStabilizationTime time.Duration
 }
 
 func (cc ConsulConfig) Config() runner.Config {
@@ -105,6 +152,28 @@ func (cc ConsulConfig) WithConfig(cfg runner.Config) runner.Command {
 	return cc
 }
 
+func (cc ConsulConfig) WithAutopilot(ap *AutopilotConfig) ConsulConfig {
+	cc.Autopilot = ap
+	return cc
+}
+
+// WithClientTLS returns a copy of cc that sets verify_incoming_https, so that
+// its HTTPS API only accepts clients presenting a certificate signed by our CA.
+// RPC and gossip are unaffected.  clientTLS is written to the config dir, which
+// is where HarnessToAPI looks for the cert to present.
+func (cc ConsulConfig) WithClientTLS(clientTLS *pki.TLSConfigPEM) ConsulConfig {
+	if clientTLS != nil {
+		cc.Common.ClientTLS = *clientTLS
+	}
+	return cc
+}
+
+// WithAutoEncrypt returns a copy of cc with AutoEncrypt set.
+func (cc ConsulConfig) WithAutoEncrypt() ConsulConfig {
+	cc.AutoEncrypt = true
+	return cc
+}
+
 func (cc ConsulConfig) Args() []string {
 	args := []string{"agent",
 		fmt.Sprintf("-data-dir=%s", cc.Common.DataDir),
@@ -159,7 +228,6 @@ func (cc ConsulConfig) Env() []string {
 
 func (cc ConsulConfig) Files() map[string]string {
 	tlsCfg := map[string]interface{}{
-		"verify_incoming_rpc":    true,
 		"verify_outgoing":        true,
 		"verify_server_hostname": true,
 	}
@@ -168,6 +236,9 @@ func (cc ConsulConfig) Files() map[string]string {
 	if cc.Common.TLS.Cert != "" {
 		files["consul.pem"] = cc.Common.TLS.Cert
 		tlsCfg["cert_file"] = "consul.pem"
+		// Without a cert of our own, e.g. a client agent given only the
+		// CA, we can't verify incoming connections.
+		tlsCfg["verify_incoming_rpc"] = true
 	}
 	if cc.Common.TLS.PrivateKey != "" {
 		files["consul-key.pem"] = cc.Common.TLS.PrivateKey
@@ -177,6 +248,20 @@ func (cc ConsulConfig) Files() map[string]string {
 		files["ca.pem"] = cc.Common.TLS.CA
 		tlsCfg["ca_file"] = "ca.pem"
 	}
+	if cc.Common.ClientTLS.Cert != "" {
+		// Consul only needs the CA to verify clients; client.pem is there
+		// for the harness's Endpoint, and for consul CLI users.
+		files["client.pem"] = cc.Common.ClientTLS.Cert
+		files["client-key.pem"] = cc.Common.ClientTLS.PrivateKey
+		tlsCfg["verify_incoming_https"] = true
+	}
+	if cc.AutoEncrypt {
+		if cc.Server {
+			tlsCfg["auto_encrypt"] = map[string]interface{}{"allow_tls": true}
+		} else {
+			tlsCfg["auto_encrypt"] = map[string]interface{}{"tls": true}
+		}
+	}
 
 	if len(files) > 0 {
 		tlsCfgBytes, err := jsonutil.EncodeJSON(tlsCfg)
@@ -196,9 +281,30 @@ performance {
   raft_multiplier = 1
 }
 `
+	if cc.Server {
+		files["connect.hcl"] = `
+connect {
+  enabled = true
+}
+`
+	}
+	if cc.Server && cc.Autopilot != nil {
+		files["autopilot.hcl"] = cc.Autopilot.hcl()
+	}
 	return files
 }
 
+func (ap AutopilotConfig) hcl() string {
+	s := fmt.Sprintf("autopilot {\n  cleanup_dead_servers = %v\n", ap.CleanupDeadServers)
+	if ap.LastContactThreshold != 0 {
+		s += fmt.Sprintf("  last_contact_threshold = \"%s\"\n", ap.LastContactThreshold)
+	}
+	if ap.ServerStabilizationTime != 0 {
+		s += fmt.Sprintf("  server_stabilization_time = \"%s\"\n", ap.ServerStabilizationTime)
+	}
+	return s + "}\n"
+}
+
 func HarnessToConfig(r runner.Harness) (*consulapi.Config, error) {
 	apicfg, err := r.Endpoint("http", true)
 	if err != nil {
@@ -220,10 +326,24 @@ func HarnessToAPI(r runner.Harness) (*consulapi.Client, error) {
 	return apiConfigToClient(apicfg)
 }
 
+// HarnessToAPIWithClientTLS is like HarnessToAPI, except the client presents
+// the given certificate files, e.g. for an agent started with
+// verify_incoming_https by something other than WithClientTLS.
+func HarnessToAPIWithClientTLS(r runner.Harness, certFile, keyFile string) (*consulapi.Client, error) {
+	apicfg, err := r.Endpoint("http", true)
+	if err != nil {
+		return nil, err
+	}
+	apicfg.ClientCertFile, apicfg.ClientKeyFile = certFile, keyFile
+	return apiConfigToClient(apicfg)
+}
+
 func apiConfigToClient(a *runner.APIConfig) (*consulapi.Client, error) {
 	cfg := consulapi.DefaultConfig()
 	cfg.Address = a.Address.String()
 	cfg.TLSConfig.CAFile = a.CAFile
+	cfg.TLSConfig.CertFile = a.ClientCertFile
+	cfg.TLSConfig.KeyFile = a.ClientKeyFile
 	return consulapi.NewClient(cfg)
 }
 
@@ -247,6 +367,41 @@ func LeadersHealthy(ctx context.Context, servers []runner.Harness, expectedPeers
 	return runner.LeaderPeerAPIsHealthy(ctx, apis, expectedPeers)
 }
 
+// ConsulAutopilotHealthy waits until any of the servers reports autopilot
+// healthy, returning the last error seen if ctx expires first.  The health
+// endpoint is served by the leader, which only reports healthy when all peers
+// pass the autopilot health checks.  The error is a *runner.NodeError, which
+// wraps runner.ErrUnhealthyAutopilot if the server responded.
+func ConsulAutopilotHealthy(ctx context.Context, servers []runner.Harness) error {
+	var clients []*consulapi.Client
+	for _, server := range servers {
+		client, err := HarnessToAPI(server)
+		if err != nil {
+			return errors.Wrap(err, "cannot create Consul client from harness")
+		}
+		clients = append(clients, client)
+	}
+
+	var err error
+	for ctx.Err() == nil {
+		for i, client := range clients {
+			health, herr := client.Operator().AutopilotServerHealth((&consulapi.QueryOptions{}).WithContext(ctx))
+			if herr == nil && health.Healthy {
+				return nil
+			}
+			if herr == nil {
+				herr = fmt.Errorf("%w, failure tolerance=%d", runner.ErrUnhealthyAutopilot, health.FailureTolerance)
+			}
+			err = &runner.NodeError{Node: i, Err: herr}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
 var ServerScrapeConfig = prometheus.ScrapeConfig{
 	JobName:     "consul",
 	Params:      url.Values{"format": []string{"prometheus"}},
@@ -0,0 +1,106 @@
+// Package dns provides helpers for querying the DNS interface of a Consul
+// agent, for use in service discovery tests.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// HarnessToAddr returns the host:port of the DNS interface of the Consul
+// agent running in h.
+func HarnessToAddr(h runner.Harness, local bool) (string, error) {
+	apicfg, err := h.Endpoint(consul.PortNames.DNS, local)
+	if err != nil {
+		return "", err
+	}
+	return apicfg.Address.Host, nil
+}
+
+// ServiceName returns the fully qualified Consul DNS name of service, with an
+// optional tag prefix.
+func ServiceName(service, tag string) string {
+	if tag != "" {
+		return fmt.Sprintf("%s.%s.service.consul.", tag, service)
+	}
+	return fmt.Sprintf("%s.service.consul.", service)
+}
+
+func query(ctx context.Context, addr, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	c := new(dns.Client)
+	if deadline, ok := ctx.Deadline(); ok {
+		c.Timeout = time.Until(deadline)
+	}
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("query for %s returned %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return append(resp.Answer, resp.Extra...), nil
+}
+
+// LookupSRV returns the SRV records for name obtained from the DNS server at
+// addr.
+func LookupSRV(ctx context.Context, addr, name string) ([]*dns.SRV, error) {
+	rrs, err := query(ctx, addr, name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*dns.SRV
+	for _, rr := range rrs {
+		if srv, ok := rr.(*dns.SRV); ok {
+			ret = append(ret, srv)
+		}
+	}
+	return ret, nil
+}
+
+// LookupA returns the IPv4 addresses for name obtained from the DNS server at
+// addr.
+func LookupA(ctx context.Context, addr, name string) ([]net.IP, error) {
+	rrs, err := query(ctx, addr, name, dns.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			ret = append(ret, a.A)
+		}
+	}
+	return ret, nil
+}
+
+// ServiceResolvable waits until service has at least count instances
+// resolvable via SRV lookups against the DNS server at addr.  It returns an
+// error if ctx expires first.
+func ServiceResolvable(ctx context.Context, addr, service string, count int) error {
+	name := ServiceName(service, "")
+	var err error
+	var srvs []*dns.SRV
+	for ctx.Err() == nil {
+		srvs, err = LookupSRV(ctx, addr, name)
+		if err == nil && len(srvs) >= count {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	var targets []string
+	for _, srv := range srvs {
+		targets = append(targets, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	}
+	return fmt.Errorf("service %s not resolvable, found [%s], last error: %v",
+		service, strings.Join(targets, ", "), err)
+}
@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// GatewayKind is the kind of gateway to run with "consul connect envoy".
+type GatewayKind string
+
+const (
+	MeshGateway        GatewayKind = "mesh"
+	IngressGateway     GatewayKind = "ingress"
+	TerminatingGateway GatewayKind = "terminating"
+)
+
+type GatewayPorts struct {
+	Gateway int
+	Admin   int
+}
+
+var GatewayPortNames = struct {
+	Gateway string
+	Admin   string
+}{
+	"gateway",
+	"envoy-admin",
+}
+
+func DefGatewayPorts() GatewayPorts {
+	return GatewayPorts{
+		Gateway: 8443,
+		Admin:   19000,
+	}
+}
+
+func (c GatewayPorts) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "consul-gateway",
+		NameOrder: []string{
+			GatewayPortNames.Gateway,
+			GatewayPortNames.Admin,
+		},
+		ByName: map[string]yurt.Port{
+			GatewayPortNames.Gateway: {Number: c.Gateway, Type: yurt.TCPOnly},
+			GatewayPortNames.Admin:   {Number: c.Admin, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// GatewayConfig describes how to run a Connect gateway, i.e. an Envoy proxy
+// launched and registered by "consul connect envoy -gateway=...".
+type GatewayConfig struct {
+	Common runner.Config
+	Kind   GatewayKind
+	// Service is the name the gateway is registered as.
+	Service string
+	// HTTPAddr and GRPCAddr give the host:port of the local Consul agent's
+	// HTTP(S) and gRPC listeners.
+	HTTPAddr string
+	GRPCAddr string
+	// EnvoyBinary is the path to the envoy binary.  If empty, envoy must be
+	// found in $PATH.
+	EnvoyBinary string
+}
+
+var _ runner.Command = GatewayConfig{}
+
+func NewGatewayConfig(kind GatewayKind, service, httpAddr, grpcAddr, envoyBinary string) GatewayConfig {
+	return GatewayConfig{
+		Kind:        kind,
+		Service:     service,
+		HTTPAddr:    httpAddr,
+		GRPCAddr:    grpcAddr,
+		EnvoyBinary: envoyBinary,
+		Common: runner.Config{
+			Ports: DefGatewayPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (gc GatewayConfig) Config() runner.Config {
+	return gc.Common
+}
+
+func (gc GatewayConfig) Name() string {
+	return "consul"
+}
+
+func (gc GatewayConfig) WithConfig(cfg runner.Config) runner.Command {
+	gc.Common = cfg
+	return gc
+}
+
+func (gc GatewayConfig) Args() []string {
+	bindIP := "127.0.0.1"
+	if gc.Common.NetworkConfig.Network != nil {
+		bindIP = "0.0.0.0"
+	}
+	ports := gc.Common.Ports.ByName
+	scheme := "http"
+	if gc.Common.TLS.CA != "" {
+		scheme = "https"
+	}
+
+	args := []string{"connect", "envoy",
+		"-gateway=" + string(gc.Kind),
+		"-register",
+		"-service=" + gc.Service,
+		fmt.Sprintf("-address=%s:%d", bindIP, ports[GatewayPortNames.Gateway].Number),
+		fmt.Sprintf("-admin-bind=%s:%d", bindIP, ports[GatewayPortNames.Admin].Number),
+		fmt.Sprintf("-http-addr=%s://%s", scheme, gc.HTTPAddr),
+		fmt.Sprintf("-grpc-addr=%s://%s", scheme, gc.GRPCAddr),
+	}
+	if gc.Common.TLS.CA != "" {
+		args = append(args, "-ca-file="+filepath.Join(gc.Common.ConfigDir, "ca.pem"))
+	}
+	if gc.EnvoyBinary != "" {
+		args = append(args, "-envoy-binary="+gc.EnvoyBinary)
+	}
+	return args
+}
+
+func (gc GatewayConfig) Env() []string {
+	return nil
+}
+
+func (gc GatewayConfig) Files() map[string]string {
+	files := map[string]string{}
+	if gc.Common.TLS.CA != "" {
+		files["ca.pem"] = gc.Common.TLS.CA
+	}
+	return files
+}
@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+var ProxyPortNames = struct {
+	Public string
+}{
+	"proxy-public",
+}
+
+// ProxyPorts returns the port of the proxy's public listener, i.e. the one
+// accepting mTLS connections from other services in the mesh.
+func ProxyPorts(public int) yurt.Ports {
+	return yurt.Ports{
+		Kind:      "consul-proxy",
+		NameOrder: []string{ProxyPortNames.Public},
+		ByName: map[string]yurt.Port{
+			ProxyPortNames.Public: {Number: public, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// ProxyConfig describes how to run Consul's built-in Connect proxy, as the
+// sidecar of Service.  Unlike GatewayConfig it needs no envoy binary, which
+// makes it the cheapest way to get a real sidecar in tests.
+type ProxyConfig struct {
+	Common runner.Config
+	// Service is the name of the service the proxy fronts; its leaf cert is
+	// obtained from the local agent for this name.
+	Service string
+	// ServiceAddr is the host:port that inbound connections are forwarded to.
+	ServiceAddr string
+	// HTTPAddr gives the host:port of the local Consul agent's HTTP(S)
+	// listener.
+	HTTPAddr string
+}
+
+var _ runner.Command = ProxyConfig{}
+
+func NewProxyConfig(service, serviceAddr, httpAddr string) ProxyConfig {
+	return ProxyConfig{
+		Service:     service,
+		ServiceAddr: serviceAddr,
+		HTTPAddr:    httpAddr,
+		Common: runner.Config{
+			Ports: ProxyPorts(21000),
+		},
+	}
+}
+
+func (pc ProxyConfig) Config() runner.Config {
+	return pc.Common
+}
+
+func (pc ProxyConfig) Name() string {
+	return "consul"
+}
+
+func (pc ProxyConfig) WithConfig(cfg runner.Config) runner.Command {
+	pc.Common = cfg
+	return pc
+}
+
+func (pc ProxyConfig) Args() []string {
+	bindIP := "127.0.0.1"
+	if pc.Common.NetworkConfig.Network != nil {
+		bindIP = "0.0.0.0"
+	}
+	scheme := "http"
+	if pc.Common.TLS.CA != "" {
+		scheme = "https"
+	}
+
+	args := []string{"connect", "proxy",
+		"-service=" + pc.Service,
+		"-service-addr=" + pc.ServiceAddr,
+		fmt.Sprintf("-listen=%s:%d", bindIP, pc.Common.Ports.ByName[ProxyPortNames.Public].Number),
+		fmt.Sprintf("-http-addr=%s://%s", scheme, pc.HTTPAddr),
+	}
+	if pc.Common.TLS.CA != "" {
+		args = append(args, "-ca-file="+filepath.Join(pc.Common.ConfigDir, "ca.pem"))
+	}
+	return args
+}
+
+func (pc ProxyConfig) Env() []string {
+	return nil
+}
+
+func (pc ProxyConfig) Files() map[string]string {
+	files := map[string]string{}
+	if pc.Common.TLS.CA != "" {
+		files["ca.pem"] = pc.Common.TLS.CA
+	}
+	return files
+}
@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/docker/docker/api/types"
+	dockerapi "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// BuildImage builds the image described by dockerfile, a path relative to
+// dir, using dir as the build context, and tags it as tag.  buildArgs are
+// passed as the values of ARG instructions.
+func BuildImage(ctx context.Context, cli *dockerapi.Client, dir, dockerfile, tag string, buildArgs map[string]string) error {
+	buildCtx, err := archive.TarWithOptions(dir, &archive.TarOptions{})
+	if err != nil {
+		return fmt.Errorf("error creating build context from %s: %w", dir, err)
+	}
+	defer buildCtx.Close()
+
+	args := map[string]*string{}
+	for k, v := range buildArgs {
+		v := v
+		args[k] = &v
+	}
+	resp, err := cli.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
+		Dockerfile:  dockerfile,
+		Tags:        []string{tag},
+		BuildArgs:   args,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return fmt.Errorf("error building %s: %w", tag, err)
+	}
+	defer resp.Body.Close()
+	// Build errors are reported in the stream rather than by ImageBuild.
+	if err := jsonmessage.DisplayJSONMessagesStream(resp.Body, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("error building %s: %w", tag, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	dockerapi "github.com/docker/docker/client"
+)
+
+// Removed lists the resources removed by Cleanup, by name.
+type Removed struct {
+	Containers []string
+	Networks   []string
+	Volumes    []string
+}
+
+// Cleanup removes resources left behind by yurt runs that didn't clean up
+// after themselves: stopped containers labeled yurt, and networks labeled
+// yurt that no container is attached to, and volumes labeled yurt that no
+// container uses, in all cases only if they were created more than olderThan
+// ago.  Running containers are left alone, so it's safe to run while other
+// yurt envs are in use.
+func Cleanup(ctx context.Context, cli *dockerapi.Client, olderThan time.Duration) (*Removed, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var removed Removed
+
+	conts, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", "yurt"),
+			filters.Arg("status", "created"),
+			filters.Arg("status", "exited"),
+			filters.Arg("status", "dead"),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conts {
+		if time.Unix(c.Created, 0).After(cutoff) {
+			continue
+		}
+		err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return &removed, err
+		}
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = c.Names[0][1:]
+		}
+		removed.Containers = append(removed.Containers, name)
+	}
+
+	nets, err := cli.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", "yurt")),
+	})
+	if err != nil {
+		return &removed, err
+	}
+	for _, n := range nets {
+		if n.Created.After(cutoff) {
+			continue
+		}
+		// The list doesn't include attached containers, so inspect.
+		netRes, err := cli.NetworkInspect(ctx, n.ID, types.NetworkInspectOptions{})
+		if err != nil {
+			return &removed, err
+		}
+		if len(netRes.Containers) > 0 {
+			continue
+		}
+		if err := cli.NetworkRemove(ctx, n.ID); err != nil {
+			return &removed, err
+		}
+		removed.Networks = append(removed.Networks, n.Name)
+	}
+
+	// Dangling volumes are those no container, running or not, refers to,
+	// so this must come after removing the containers.
+	vols, err := cli.VolumeList(ctx, filters.NewArgs(
+		filters.Arg("label", "yurt"),
+		filters.Arg("dangling", "true"),
+	))
+	if err != nil {
+		return &removed, err
+	}
+	for _, v := range vols.Volumes {
+		// Drivers needn't report when volumes were created, in which case
+		// they're assumed to be old enough.
+		if created, err := time.Parse(time.RFC3339, v.CreatedAt); err == nil && created.After(cutoff) {
+			continue
+		}
+		if err := cli.VolumeRemove(ctx, v.Name, false); err != nil {
+			return &removed, err
+		}
+		removed.Volumes = append(removed.Volumes, v.Name)
+	}
+	return &removed, nil
+}
@@ -0,0 +1,201 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	dockerapi "github.com/docker/docker/client"
+	"gopkg.in/yaml.v2"
+)
+
+// CopyLabelPrefix prefixes the labels Start puts on containers to record
+// what was copied into them: the label CopyLabelPrefix+to has the value from,
+// for each entry of RunOptions.CopyFromTo.
+const CopyLabelPrefix = "yurt.copy."
+
+type composeFile struct {
+	Version  string                    `yaml:"version"`
+	Services map[string]composeService `yaml:"services"`
+	Networks map[string]composeNetwork `yaml:"networks,omitempty"`
+	Volumes  map[string]composeVolume  `yaml:"volumes,omitempty"`
+}
+
+type composeService struct {
+	Image         string                           `yaml:"image"`
+	ContainerName string                           `yaml:"container_name"`
+	Hostname      string                           `yaml:"hostname,omitempty"`
+	Entrypoint    []string                         `yaml:"entrypoint,omitempty"`
+	Command       []string                         `yaml:"command,omitempty"`
+	Environment   []string                         `yaml:"environment,omitempty"`
+	Labels        map[string]string                `yaml:"labels,omitempty"`
+	Ports         []string                         `yaml:"ports,omitempty"`
+	Volumes       []string                         `yaml:"volumes,omitempty"`
+	Tmpfs         []string                         `yaml:"tmpfs,omitempty"`
+	NetworkMode   string                           `yaml:"network_mode,omitempty"`
+	Networks      map[string]composeServiceNetwork `yaml:"networks,omitempty"`
+	Privileged    bool                             `yaml:"privileged,omitempty"`
+}
+
+type composeServiceNetwork struct {
+	IPv4Address string `yaml:"ipv4_address,omitempty"`
+}
+
+type composeNetwork struct {
+	Name   string       `yaml:"name"`
+	Driver string       `yaml:"driver,omitempty"`
+	IPAM   *composeIPAM `yaml:"ipam,omitempty"`
+}
+
+type composeVolume struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type composeIPAM struct {
+	Config []map[string]string `yaml:"config"`
+}
+
+// ExportCompose writes to w a docker-compose file that recreates the yurt
+// containers attached to the network netName: their images, commands,
+// environment, static IPs, published ports, and the network itself.  Files
+// yurt copied into the containers become bind mounts of the host paths they
+// were copied from, so the host's work dir must still exist to use it.  Data
+// dirs mounted as tmpfs or docker volumes are mounted the same way; the
+// volumes are reused if they still exist, keeping their data.
+func ExportCompose(ctx context.Context, cli *dockerapi.Client, netName string, w io.Writer) error {
+	conts, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", "yurt"),
+			filters.Arg("network", netName),
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	cf := composeFile{
+		// 2.x rather than 3.x because it supports static IPs without swarm.
+		Version:  "2.4",
+		Services: map[string]composeService{},
+	}
+	netRes, err := cli.NetworkInspect(ctx, netName, types.NetworkInspectOptions{})
+	if err != nil {
+		return err
+	}
+	cn := composeNetwork{Name: netRes.Name, Driver: netRes.Driver}
+	if len(netRes.IPAM.Config) > 0 {
+		cn.IPAM = &composeIPAM{}
+		for _, c := range netRes.IPAM.Config {
+			cn.IPAM.Config = append(cn.IPAM.Config, map[string]string{"subnet": c.Subnet})
+		}
+	}
+	cf.Networks = map[string]composeNetwork{netName: cn}
+
+	for _, c := range conts {
+		svc, volumes, err := composeServiceFor(ctx, cli, c.ID, netName)
+		if err != nil {
+			return err
+		}
+		cf.Services[svc.ContainerName] = *svc
+		for name, vol := range volumes {
+			if cf.Volumes == nil {
+				cf.Volumes = map[string]composeVolume{}
+			}
+			cf.Volumes[name] = vol
+		}
+	}
+
+	b, err := yaml.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// composeServiceFor returns the service that recreates container id, along
+// with the named volumes it mounts.
+func composeServiceFor(ctx context.Context, cli *dockerapi.Client, id, netName string) (*composeService, map[string]composeVolume, error) {
+	cont, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := strings.TrimPrefix(cont.Name, "/")
+	svc := &composeService{
+		Image:         cont.Config.Image,
+		ContainerName: name,
+		Hostname:      cont.Config.Hostname,
+		Entrypoint:    cont.Config.Entrypoint,
+		Command:       cont.Config.Cmd,
+		Labels:        map[string]string{},
+		Privileged:    cont.HostConfig.Privileged,
+	}
+
+	// The inspected env includes that of the image, which needn't be repeated.
+	imageEnv := map[string]bool{}
+	if img, _, err := cli.ImageInspectWithRaw(ctx, cont.Image); err == nil && img.Config != nil {
+		for _, e := range img.Config.Env {
+			imageEnv[e] = true
+		}
+	}
+	for _, e := range cont.Config.Env {
+		if !imageEnv[e] {
+			svc.Environment = append(svc.Environment, e)
+		}
+	}
+
+	for k, v := range cont.Config.Labels {
+		if to := strings.TrimPrefix(k, CopyLabelPrefix); to != k {
+			svc.Volumes = append(svc.Volumes, v+":"+to)
+		} else {
+			svc.Labels[k] = v
+		}
+	}
+	volumes := map[string]composeVolume{}
+	for _, m := range cont.HostConfig.Mounts {
+		switch m.Type {
+		case mount.TypeTmpfs:
+			tmpfs := m.Target
+			if m.TmpfsOptions != nil && m.TmpfsOptions.SizeBytes > 0 {
+				tmpfs += fmt.Sprintf(":size=%d", m.TmpfsOptions.SizeBytes)
+			}
+			svc.Tmpfs = append(svc.Tmpfs, tmpfs)
+		case mount.TypeVolume:
+			svc.Volumes = append(svc.Volumes, m.Source+":"+m.Target)
+			vol := composeVolume{Name: m.Source}
+			if m.VolumeOptions != nil {
+				vol.Labels = m.VolumeOptions.Labels
+			}
+			volumes[m.Source] = vol
+		}
+	}
+	sort.Strings(svc.Volumes)
+	sort.Strings(svc.Tmpfs)
+
+	for p := range cont.Config.ExposedPorts {
+		if cont.HostConfig.PublishAllPorts {
+			svc.Ports = append(svc.Ports, string(p))
+		}
+	}
+	sort.Strings(svc.Ports)
+
+	if cont.HostConfig.NetworkMode.IsHost() {
+		svc.NetworkMode = "host"
+	} else if es := cont.NetworkSettings.Networks[netName]; es != nil {
+		var csn composeServiceNetwork
+		if es.IPAMConfig != nil {
+			csn.IPv4Address = es.IPAMConfig.IPv4Address
+		}
+		svc.Networks = map[string]composeServiceNetwork{netName: csn}
+	} else {
+		return nil, nil, fmt.Errorf("container %s isn't attached to network %s", name, netName)
+	}
+	return svc, volumes, nil
+}
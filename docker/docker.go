@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	dockerapi "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
@@ -14,6 +15,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // Create a docker private network or if one already exists with the name netName,
@@ -51,6 +54,8 @@ func createNetwork(ctx context.Context, cli *dockerapi.Client, netName, cidr str
 		CheckDuplicate: true,
 		Driver:         "bridge",
 		Options:        map[string]string{},
+		// So that Cleanup can find it.
+		Labels: map[string]string{"yurt": "true"},
 		IPAM: &network.IPAM{
 			Driver:  "default",
 			Options: map[string]string{},
@@ -110,12 +115,22 @@ type RunOptions struct {
 	IP              string
 	Privileged      bool
 	CopyFromTo      map[string]string
+	// Output receives the container's stdout and stderr, prefixed by
+	// ContainerName.  If nil, os.Stdout is used.
+	Output io.Writer
+	// LogConfig selects the container's log driver; the daemon's default is
+	// used if Type is empty.  Output only works with drivers docker can read
+	// logs back from, like json-file, local, and journald.
+	LogConfig container.LogConfig
+	Mounts    []mount.Mount
 }
 
 func Start(ctx context.Context, client *dockerapi.Client, opts RunOptions) (*types.ContainerJSON, error) {
 	hostConfig := &container.HostConfig{
 		PublishAllPorts: true,
 		AutoRemove:      false,
+		LogConfig:       opts.LogConfig,
+		Mounts:          opts.Mounts,
 		//Privileged: true,
 	}
 
@@ -144,6 +159,17 @@ func Start(ctx context.Context, client *dockerapi.Client, opts RunOptions) (*typ
 
 	cfg := *opts.ContainerConfig
 	cfg.Hostname = opts.ContainerName
+	// Record what's copied in, so that ExportCompose can mount it instead.
+	cfg.Labels = map[string]string{}
+	for k, v := range opts.ContainerConfig.Labels {
+		cfg.Labels[k] = v
+	}
+	for from, to := range opts.CopyFromTo {
+		if abs, err := filepath.Abs(from); err == nil {
+			from = abs
+		}
+		cfg.Labels[CopyLabelPrefix+to] = from
+	}
 	container, err := client.ContainerCreate(ctx, &cfg, hostConfig, networkingConfig, opts.ContainerName)
 	if err != nil {
 		return nil, fmt.Errorf("container create failed: %v", err)
@@ -165,8 +191,12 @@ func Start(ctx context.Context, client *dockerapi.Client, opts RunOptions) (*typ
 	if err != nil {
 		return nil, err
 	}
+	output := opts.Output
+	if output == nil {
+		output = os.Stdout
+	}
 	go func() {
-		err = ContainerLogs(ctx, client, inspect.ID, util.NewLinePrefixer(opts.ContainerName, os.Stdout))
+		err = ContainerLogs(ctx, client, inspect.ID, util.NewLinePrefixer(opts.ContainerName, output))
 		if err != nil {
 			log.Printf("error getting container logs for %s: %v", opts.ContainerName, err)
 		}
@@ -226,3 +256,34 @@ func ContainerLogs(ctx context.Context, cli *dockerapi.Client, id string, writer
 	}
 	return nil
 }
+
+// Exec runs cmd in the running container id, returning its combined stdout
+// and stderr, and an error if it exits with a non-zero status.
+func Exec(ctx context.Context, cli *dockerapi.Client, id string, cmd []string) (string, error) {
+	exec, err := cli.ContainerExecCreate(ctx, id, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+
+	var out strings.Builder
+	if _, err := stdcopy.StdCopy(&out, &out, resp.Reader); err != nil {
+		return "", err
+	}
+	inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return out.String(), err
+	}
+	if inspect.ExitCode != 0 {
+		return out.String(), fmt.Errorf("%v exited with %d: %s", cmd, inspect.ExitCode, out.String())
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,136 @@
+// events lets envs, clusters and CAs report what they're doing in a
+// structured way, so that CLIs and tests can react to it and log it
+// consistently.
+package events
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind identifies what happened.
+type Kind string
+
+const (
+	// NodeStarted is published when an env has started a node's process or
+	// container.
+	NodeStarted Kind = "node-started"
+	// NodeExited is published when a node's process or container exits; Err
+	// is set if it exited with an error.
+	NodeExited Kind = "node-exited"
+	// LeaderElected is published when a cluster's servers agree on a leader.
+	LeaderElected Kind = "leader-elected"
+	// UnsealCompleted is published when a Vault node has been unsealed.
+	UnsealCompleted Kind = "unseal-completed"
+	// CertIssued is published when a CA issues a certificate.
+	CertIssued Kind = "cert-issued"
+)
+
+// Event describes something that happened.  Fields that don't apply to the
+// event's Kind are empty.
+type Event struct {
+	Time    time.Time
+	Kind    Kind
+	Cluster string
+	Node    string
+	// Message gives further details, e.g. the leader's address.
+	Message string
+	Err     error
+}
+
+func (e Event) String() string {
+	parts := []string{string(e.Kind)}
+	if e.Cluster != "" {
+		parts = append(parts, "cluster="+e.Cluster)
+	}
+	if e.Node != "" {
+		parts = append(parts, "node="+e.Node)
+	}
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	}
+	if e.Err != nil {
+		parts = append(parts, fmt.Sprintf("err=%v", e.Err))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Bus delivers published events to subscribers.  A nil *Bus is valid and
+// discards everything published to it, so components can publish without
+// checking whether anyone is listening.
+type Bus struct {
+	l      sync.Mutex
+	nextID int
+	subs   map[int]func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: map[int]func(Event){}}
+}
+
+// Publish delivers ev to all subscribers, setting its Time if it's zero.
+// Callbacks are run synchronously, in no particular order.
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.l.Lock()
+	subs := make([]func(Event), 0, len(b.subs))
+	for _, f := range b.subs {
+		subs = append(subs, f)
+	}
+	b.l.Unlock()
+	for _, f := range subs {
+		f(ev)
+	}
+}
+
+// Subscribe calls f with every event published until the returned func is
+// called.  Since f is called by publishers, it mustn't block for long.
+func (b *Bus) Subscribe(f func(Event)) (unsubscribe func()) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = f
+	return func() {
+		b.l.Lock()
+		defer b.l.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Channel returns a channel receiving the events published until the returned
+// func is called, which also closes the channel.  Up to size events are
+// buffered; if the buffer is full, events are dropped rather than blocking
+// publishers.
+func (b *Bus) Channel(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	var l sync.Mutex
+	closed := false
+	unsubscribe := b.Subscribe(func(ev Event) {
+		l.Lock()
+		defer l.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	return ch, func() {
+		unsubscribe()
+		l.Lock()
+		defer l.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+}
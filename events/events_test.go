@@ -0,0 +1,40 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	var nilBus *Bus
+	nilBus.Publish(Event{Kind: NodeStarted})
+
+	b := NewBus()
+	var got []Event
+	unsubscribe := b.Subscribe(func(ev Event) {
+		got = append(got, ev)
+	})
+	ch, closeCh := b.Channel(1)
+
+	b.Publish(Event{Kind: NodeStarted, Node: "consul-srv-1"})
+	b.Publish(Event{Kind: NodeExited, Node: "consul-srv-1", Err: errors.New("exit status 1")})
+	unsubscribe()
+	b.Publish(Event{Kind: LeaderElected})
+
+	if len(got) != 2 || got[0].Kind != NodeStarted || got[1].Kind != NodeExited {
+		t.Fatalf("unexpected events: %v", got)
+	}
+	if got[0].Time.IsZero() {
+		t.Fatal("expected Time to be set")
+	}
+
+	// The channel's buffer only held the first event; the rest were dropped.
+	closeCh()
+	var fromCh []Event
+	for ev := range ch {
+		fromCh = append(fromCh, ev)
+	}
+	if len(fromCh) != 1 || fromCh[0].Kind != NodeStarted {
+		t.Fatalf("unexpected events from channel: %v", fromCh)
+	}
+}
@@ -0,0 +1,269 @@
+// export tells humans and scripts how to reach the clusters in a yurt
+// environment, by writing the environment variables understood by the
+// Consul, Nomad and Vault CLIs to a sourceable shell file or JSON.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// Endpoints tells API clients how to reach a cluster.  The JSON keys are the
+// lowercased names of the environment variables understood by the
+// Consul, Nomad and Vault CLIs.
+type Endpoints struct {
+	ConsulHTTPAddr   string   `json:"consul_http_addr,omitempty" yaml:"consul_http_addr,omitempty"`
+	ConsulCACert     string   `json:"consul_cacert,omitempty" yaml:"consul_cacert,omitempty"`
+	ConsulClientCert string   `json:"consul_client_cert,omitempty" yaml:"consul_client_cert,omitempty"`
+	ConsulClientKey  string   `json:"consul_client_key,omitempty" yaml:"consul_client_key,omitempty"`
+	NomadAddr        string   `json:"nomad_addr,omitempty" yaml:"nomad_addr,omitempty"`
+	NomadCACert      string   `json:"nomad_cacert,omitempty" yaml:"nomad_cacert,omitempty"`
+	NomadClientCert  string   `json:"nomad_client_cert,omitempty" yaml:"nomad_client_cert,omitempty"`
+	NomadClientKey   string   `json:"nomad_client_key,omitempty" yaml:"nomad_client_key,omitempty"`
+	VaultAddr        string   `json:"vault_addr,omitempty" yaml:"vault_addr,omitempty"`
+	VaultCACert      string   `json:"vault_cacert,omitempty" yaml:"vault_cacert,omitempty"`
+	VaultClientCert  string   `json:"vault_client_cert,omitempty" yaml:"vault_client_cert,omitempty"`
+	VaultClientKey   string   `json:"vault_client_key,omitempty" yaml:"vault_client_key,omitempty"`
+	VaultToken       string   `json:"vault_token,omitempty" yaml:"vault_token,omitempty"`
+	VaultUnsealKeys  []string `json:"vault_unseal_keys,omitempty" yaml:"vault_unseal_keys,omitempty"`
+}
+
+// Environment returns the endpoints as environment variable settings,
+// omitting those that are empty.
+func (e Endpoints) Environment() map[string]string {
+	env := map[string]string{
+		"CONSUL_HTTP_ADDR":   e.ConsulHTTPAddr,
+		"CONSUL_CACERT":      e.ConsulCACert,
+		"CONSUL_CLIENT_CERT": e.ConsulClientCert,
+		"CONSUL_CLIENT_KEY":  e.ConsulClientKey,
+		"NOMAD_ADDR":         e.NomadAddr,
+		"NOMAD_CACERT":       e.NomadCACert,
+		"NOMAD_CLIENT_CERT":  e.NomadClientCert,
+		"NOMAD_CLIENT_KEY":   e.NomadClientKey,
+		"VAULT_ADDR":         e.VaultAddr,
+		"VAULT_CACERT":       e.VaultCACert,
+		"VAULT_CLIENT_CERT":  e.VaultClientCert,
+		"VAULT_CLIENT_KEY":   e.VaultClientKey,
+		"VAULT_TOKEN":        e.VaultToken,
+		"VAULT_UNSEAL_KEYS":  strings.Join(e.VaultUnsealKeys, ","),
+	}
+	for k, v := range env {
+		if v == "" {
+			delete(env, k)
+		}
+	}
+	return env
+}
+
+// Clusters holds the endpoints of clusters, keyed by cluster name.
+type Clusters map[string]*Endpoints
+
+func (c Clusters) get(name string) *Endpoints {
+	if c[name] == nil {
+		c[name] = &Endpoints{}
+	}
+	return c[name]
+}
+
+// AddConsul sets the Consul endpoints of cluster name to those of cc.
+func (c Clusters) AddConsul(name string, cc *cluster.ConsulCluster) error {
+	return c.setConsul(name, cc.Servers()[0])
+}
+
+// AddNomad sets the Nomad endpoints of cluster name to those of nc.
+func (c Clusters) AddNomad(name string, nc *cluster.NomadCluster) error {
+	return c.setNomad(name, nc.Servers()[0])
+}
+
+// AddConsulNomad sets the Consul and Nomad endpoints of cnc's cluster.
+func (c Clusters) AddConsulNomad(cnc *cluster.ConsulNomadCluster) error {
+	if err := c.AddConsul(cnc.Name, cnc.Consul); err != nil {
+		return err
+	}
+	return c.AddNomad(cnc.Name, cnc.Nomad)
+}
+
+// AddVault sets the Vault endpoints of cluster name to those of vc, along
+// with its root token and unseal keys.
+func (c Clusters) AddVault(name string, vc *cluster.VaultCluster) error {
+	if err := c.setVault(name, vc.Servers()[0]); err != nil {
+		return err
+	}
+	ep := c.get(name)
+	ep.VaultToken, ep.VaultUnsealKeys = vc.RootToken(), vc.UnsealKeys()
+	return nil
+}
+
+func (c Clusters) setConsul(name string, h runner.Harness) error {
+	cfg, err := h.Endpoint("http", true)
+	if err != nil {
+		return err
+	}
+	ep := c.get(name)
+	ep.ConsulHTTPAddr, ep.ConsulCACert, ep.ConsulClientCert, ep.ConsulClientKey = apiConfigFields(cfg)
+	return nil
+}
+
+func (c Clusters) setNomad(name string, h runner.Harness) error {
+	cfg, err := h.Endpoint("http", true)
+	if err != nil {
+		return err
+	}
+	ep := c.get(name)
+	ep.NomadAddr, ep.NomadCACert, ep.NomadClientCert, ep.NomadClientKey = apiConfigFields(cfg)
+	return nil
+}
+
+func (c Clusters) setVault(name string, h runner.Harness) error {
+	cfg, err := h.Endpoint("http", true)
+	if err != nil {
+		return err
+	}
+	ep := c.get(name)
+	ep.VaultAddr, ep.VaultCACert, ep.VaultClientCert, ep.VaultClientKey = apiConfigFields(cfg)
+	return nil
+}
+
+func apiConfigFields(cfg *runner.APIConfig) (addr, caFile, certFile, keyFile string) {
+	return cfg.Address.String(), cfg.CAFile, cfg.ClientCertFile, cfg.ClientKeyFile
+}
+
+// serverNode matches the names the cluster package gives server nodes, e.g.
+// "mycluster-consul-srv-3".
+var serverNode = regexp.MustCompile(`^(.+)-(consul|nomad|vault)-srv-\d+$`)
+
+// FromEnv finds the clusters in e from the names of their server nodes, and
+// returns their endpoints.  Vault tokens can't be found this way; use
+// AddVault to include them.
+func FromEnv(e runenv.Env) (Clusters, error) {
+	c := Clusters{}
+	done := map[string]bool{}
+	for _, node := range e.NodeNames() {
+		m := serverNode.FindStringSubmatch(node)
+		if m == nil || done[m[1]+"/"+m[2]] {
+			continue
+		}
+		h, ok := e.Harness(node)
+		if !ok {
+			continue
+		}
+		var err error
+		switch m[2] {
+		case "consul":
+			err = c.setConsul(m[1], h)
+		case "nomad":
+			err = c.setNomad(m[1], h)
+		case "vault":
+			err = c.setVault(m[1], h)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", node, err)
+		}
+		done[m[1]+"/"+m[2]] = true
+	}
+	return c, nil
+}
+
+// Names returns the cluster names, sorted.
+func (c Clusters) Names() []string {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteShell writes the endpoints of the clusters named to w as "export"
+// statements that can be sourced by a shell.  Those of the first cluster
+// named that exists are given as is, so that the CLIs use it, and those of
+// any others are prefixed by their cluster name.  Names of clusters that
+// don't exist are ignored.  If names is empty, all clusters are written, in
+// sorted order.
+func (c Clusters) WriteShell(w io.Writer, names []string) error {
+	return c.writeVars(w, names, "export ", shellQuote)
+}
+
+// WriteDotenv is like WriteShell, but writes the dotenv format, i.e. without
+// the "export " prefixes, and with double-quoted values.
+func (c Clusters) WriteDotenv(w io.Writer, names []string) error {
+	return c.writeVars(w, names, "", strconv.Quote)
+}
+
+func (c Clusters) writeVars(w io.Writer, names []string, export string, quote func(string) string) error {
+	if len(names) == 0 {
+		names = c.Names()
+	}
+	first := true
+	for _, name := range names {
+		ep, ok := c[name]
+		if !ok {
+			continue
+		}
+		// The first cluster that exists gets the unprefixed names, even if
+		// earlier ones were named.
+		prefix := ""
+		if !first {
+			prefix = strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		}
+		first = false
+		env := ep.Environment()
+		var keys []string
+		for k := range env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s%s%s=%s\n", export, prefix, k, quote(env[k])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for use as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// WriteJSON writes the endpoints of all the clusters to w as JSON, keyed by
+// cluster name.
+func (c Clusters) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(struct {
+		Clusters Clusters `json:"clusters"`
+	}{c}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteFiles writes env.sh, as written by WriteShell, and env.json, as
+// written by WriteJSON, to dir.  They're only readable by the owner since
+// tokens and unseal keys are secrets.
+func (c Clusters) WriteFiles(dir string, names []string) error {
+	var sh, js strings.Builder
+	if err := c.WriteShell(&sh, names); err != nil {
+		return err
+	}
+	if err := c.WriteJSON(&js); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "env.sh"), []byte(sh.String()), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "env.json"), []byte(js.String()), 0600)
+}
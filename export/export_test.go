@@ -0,0 +1,168 @@
+package export
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+func testClusters() Clusters {
+	return Clusters{
+		"dc1": {
+			ConsulHTTPAddr: "https://127.0.0.1:8501",
+			ConsulCACert:   "/tmp/ca.pem",
+			VaultAddr:      "http://127.0.0.1:8200",
+			VaultToken:     "it's-a-secret",
+		},
+		"dc-2": {
+			NomadAddr:       "http://127.0.0.1:4646",
+			VaultUnsealKeys: []string{"k1", "k2"},
+		},
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	env := testClusters()["dc-2"].Environment()
+	if len(env) != 2 || env["NOMAD_ADDR"] != "http://127.0.0.1:4646" || env["VAULT_UNSEAL_KEYS"] != "k1,k2" {
+		t.Fatalf("unexpected environment %v", env)
+	}
+}
+
+func TestWriteVars(t *testing.T) {
+	testCases := []struct {
+		name   string
+		names  []string
+		dotenv bool
+		want   string
+	}{
+		{
+			name: "all sorted",
+			want: `export NOMAD_ADDR='http://127.0.0.1:4646'
+export VAULT_UNSEAL_KEYS='k1,k2'
+export DC1_CONSUL_CACERT='/tmp/ca.pem'
+export DC1_CONSUL_HTTP_ADDR='https://127.0.0.1:8501'
+export DC1_VAULT_ADDR='http://127.0.0.1:8200'
+export DC1_VAULT_TOKEN='it'\''s-a-secret'
+`,
+		},
+		{
+			name:  "named first",
+			names: []string{"dc1", "dc-2"},
+			want: `export CONSUL_CACERT='/tmp/ca.pem'
+export CONSUL_HTTP_ADDR='https://127.0.0.1:8501'
+export VAULT_ADDR='http://127.0.0.1:8200'
+export VAULT_TOKEN='it'\''s-a-secret'
+export DC_2_NOMAD_ADDR='http://127.0.0.1:4646'
+export DC_2_VAULT_UNSEAL_KEYS='k1,k2'
+`,
+		},
+		{
+			name:  "first missing",
+			names: []string{"nosuch", "dc-2"},
+			want: `export NOMAD_ADDR='http://127.0.0.1:4646'
+export VAULT_UNSEAL_KEYS='k1,k2'
+`,
+		},
+		{
+			name:   "dotenv",
+			names:  []string{"dc-2"},
+			dotenv: true,
+			want: `NOMAD_ADDR="http://127.0.0.1:4646"
+VAULT_UNSEAL_KEYS="k1,k2"
+`,
+		},
+		{
+			name:  "none",
+			names: []string{"nosuch"},
+			want:  "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sb strings.Builder
+			write := testClusters().WriteShell
+			if tc.dotenv {
+				write = testClusters().WriteDotenv
+			}
+			if err := write(&sb, tc.names); err != nil {
+				t.Fatal(err)
+			}
+			if got := sb.String(); got != tc.want {
+				t.Fatalf("got:\n%s\nexpected:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var sb strings.Builder
+	if err := testClusters().WriteJSON(&sb); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Clusters map[string]map[string]interface{} `json:"clusters"`
+	}
+	if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Clusters["dc1"]["vault_token"] != "it's-a-secret" || got.Clusters["dc-2"]["nomad_addr"] != "http://127.0.0.1:4646" {
+		t.Fatalf("unexpected JSON %s", sb.String())
+	}
+	if _, ok := got.Clusters["dc-2"]["consul_http_addr"]; ok {
+		t.Fatalf("expected empty fields to be omitted, got %s", sb.String())
+	}
+}
+
+// nodeEnv is an env whose harnesses serve their "http" endpoint at the
+// address given.
+type nodeEnv struct {
+	runenv.Env
+	addrs map[string]string
+}
+
+func (e nodeEnv) NodeNames() []string {
+	var names []string
+	for name := range e.addrs {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (e nodeEnv) Harness(name string) (runner.Harness, bool) {
+	addr, ok := e.addrs[name]
+	return addrHarness(addr), ok
+}
+
+type addrHarness string
+
+func (h addrHarness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
+	return &runner.APIConfig{Address: url.URL{Scheme: "http", Host: string(h)}}, nil
+}
+
+func (h addrHarness) Stop() error { return nil }
+func (h addrHarness) Kill()       {}
+func (h addrHarness) Wait() error { return nil }
+
+func TestFromEnv(t *testing.T) {
+	c, err := FromEnv(nodeEnv{addrs: map[string]string{
+		"dc1-consul-srv-1": "127.0.0.1:8500",
+		"dc1-nomad-srv-2":  "127.0.0.1:4646",
+		"dc2-vault-srv-3":  "127.0.0.1:8200",
+		"dc2-consul-cli-4": "127.0.0.1:9500",
+		"prometheus":       "127.0.0.1:9090",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(c.Names(), ","); got != "dc1,dc2" {
+		t.Fatalf("expected clusters dc1,dc2, got %s", got)
+	}
+	if c["dc1"].ConsulHTTPAddr != "http://127.0.0.1:8500" || c["dc1"].NomadAddr != "http://127.0.0.1:4646" ||
+		c["dc2"].VaultAddr != "http://127.0.0.1:8200" || c["dc2"].ConsulHTTPAddr != "" {
+		t.Fatalf("unexpected endpoints %+v %+v", c["dc1"], c["dc2"])
+	}
+}
@@ -0,0 +1,120 @@
+package testhelper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+	"github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// PromQueryRange evaluates query over the window ending now, with a point
+// every step, returning a series per label set.
+func PromQueryRange(ctx context.Context, addr string, query string, window, step time.Duration) (model.Matrix, error) {
+	cli, err := promapi.NewClient(promapi.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	api := v1.NewAPI(cli)
+	now := time.Now()
+	val, _, err := api.QueryRange(ctx, query, v1.Range{Start: now.Add(-window), End: now, Step: step})
+	if err != nil {
+		return nil, fmt.Errorf("range query %q failed: %w", query, err)
+	}
+	matrix, ok := val.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("range query %q did not return a matrix: %v", query, val.Type())
+	}
+	return matrix, nil
+}
+
+// PromAssertAbsent returns an error if metric currently has any samples for
+// job, e.g. to verify that a failure counter was never created.
+func PromAssertAbsent(ctx context.Context, addr string, job string, metric string) error {
+	samples, err := PromQueryVector(ctx, addr, job, metric)
+	if err != nil {
+		return err
+	}
+	if len(samples) != 0 {
+		return fmt.Errorf("expected no samples for metric %q, got %v", metric, samples)
+	}
+	return nil
+}
+
+// PromAssertIncreasing returns an error unless every series of metric for
+// job has at least two points in the last window, never decreases, and ends
+// higher than it started.  Apply it to counters, e.g. consul_raft_apply, to
+// verify that progress is being made.
+func PromAssertIncreasing(ctx context.Context, addr string, job string, metric string, window time.Duration) error {
+	query := fmt.Sprintf(`%s{job="%s"}`, metric, job)
+	// Aim for a point per scrape, assuming the 5s interval MonitoredEnv uses.
+	step := window / 10
+	if step < 5*time.Second {
+		step = 5 * time.Second
+	}
+	matrix, err := PromQueryRange(ctx, addr, query, window, step)
+	if err != nil {
+		return err
+	}
+	if len(matrix) == 0 {
+		return fmt.Errorf("no series for %q", query)
+	}
+	for _, series := range matrix {
+		if len(series.Values) < 2 {
+			return fmt.Errorf("series %s has %d points, need at least 2", series.Metric, len(series.Values))
+		}
+		for i := 1; i < len(series.Values); i++ {
+			if series.Values[i].Value < series.Values[i-1].Value {
+				return fmt.Errorf("series %s decreased from %v to %v at %v", series.Metric,
+					series.Values[i-1].Value, series.Values[i].Value, series.Values[i].Timestamp.Time())
+			}
+		}
+		first, last := series.Values[0], series.Values[len(series.Values)-1]
+		if last.Value <= first.Value {
+			return fmt.Errorf("series %s didn't increase over %v: %v", series.Metric, window, first.Value)
+		}
+	}
+	return nil
+}
+
+// WaitForSamples polls the instant query until it returns at least count
+// samples, backing off from 100ms up to 2s between attempts, and returns
+// the last result.
+func WaitForSamples(ctx context.Context, addr string, query string, count int) (model.Vector, error) {
+	cli, err := promapi.NewClient(promapi.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	api := v1.NewAPI(cli)
+
+	backoff := 100 * time.Millisecond
+	for ctx.Err() == nil {
+		var val model.Value
+		val, _, err = api.Query(ctx, query, time.Now())
+		if err == nil {
+			vect, ok := val.(model.Vector)
+			switch {
+			case !ok:
+				err = fmt.Errorf("query %q did not return a vector: %v", query, val.Type())
+			case len(vect) >= count:
+				return vect, nil
+			default:
+				err = fmt.Errorf("query %q returned %d samples, want %d", query, len(vect), count)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return nil, err
+}
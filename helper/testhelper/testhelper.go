@@ -9,6 +9,7 @@ import (
 	consulapi "github.com/hashicorp/consul/api"
 	nomadapi "github.com/hashicorp/nomad/api"
 	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/nomad"
 	promapi "github.com/prometheus/client_golang/api"
 	"github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
@@ -93,7 +94,7 @@ func PromQueryAlive(ctx context.Context, addr string, job string, metric string,
 }
 
 // TestNomadJobs exercises a Consul/Nomad/Prometheus cluster by registering
-// jobhcl as a Nomad job.
+// jobhcl as a Nomad job, waiting for it to be healthy using nomad.DeployJob.
 func TestNomadJobs(t *testing.T, ctx context.Context, consulCli *consulapi.Client,
 	nomadCli *nomadapi.Client, name, jobhcl string, tester func(ctx context.Context, addr string) error) {
 
@@ -101,14 +102,6 @@ func TestNomadJobs(t *testing.T, ctx context.Context, consulCli *consulapi.Clien
 	if err != nil {
 		t.Fatal(err)
 	}
-	register, _, err := nomadCli.Jobs().Register(job, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if register.Warnings != "" {
-		t.Logf("register warnings: %v", register.Warnings)
-	}
-
 	defer func() {
 		_, _, err := nomadCli.Jobs().Deregister(*job.ID, false, nil)
 		if err != nil {
@@ -133,6 +126,10 @@ func TestNomadJobs(t *testing.T, ctx context.Context, consulCli *consulapi.Clien
 
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
+	if _, err := nomad.DeployJob(ctx, nomadCli, jobhcl); err != nil {
+		t.Fatal(err)
+	}
+
 	var svcaddr string
 	for ctx.Err() == nil {
 		time.Sleep(100 * time.Millisecond)
@@ -179,11 +176,17 @@ func promDockerJobHCL(t *testing.T) string {
 }
 
 func ExecDockerJobHCL(t *testing.T) string {
-	promcmd, err := binaries.Default.Get("prometheus")
+	promcmd, err := binaries.Default.Get("prometheus", "")
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	return RawExecJobHCL(promcmd)
+}
+
+// RawExecJobHCL returns a prometheus job like ExecDockerJobHCL, running the
+// prometheus binary at promcmd on the Nomad client.
+func RawExecJobHCL(promcmd string) string {
 	return fmt.Sprintf(promJobHCL, "", "raw_exec", fmt.Sprintf(`command = "%s"`, promcmd))
 }
 
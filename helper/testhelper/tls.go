@@ -0,0 +1,128 @@
+package testhelper
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ncabatoff/yurt/pki"
+)
+
+// TLSHandshakeWithCRL does a TLS handshake with the server at addr
+// (host:port), verifying its cert using caPEM and rejecting it if it's
+// listed in crlPEM.  It returns the handshake error, if any.
+func TLSHandshakeWithCRL(ctx context.Context, addr, caPEM, crlPEM string) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+		return fmt.Errorf("no CA certs found")
+	}
+	verify, err := pki.VerifyNotRevoked(crlPEM)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	rawConn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		RootCAs:               pool,
+		ServerName:            host,
+		VerifyPeerCertificate: verify,
+	})
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn.Handshake()
+}
+
+// ServerCertRevoked returns nil if a CRL-checking client rejects the cert of
+// the server at addr as revoked, and an error if the handshake succeeds or
+// fails for some other reason.
+func ServerCertRevoked(ctx context.Context, addr, caPEM, crlPEM string) error {
+	err := TLSHandshakeWithCRL(ctx, addr, caPEM, crlPEM)
+	switch {
+	case err == nil:
+		return fmt.Errorf("handshake with %s succeeded, expected cert to be revoked", addr)
+	case strings.Contains(err.Error(), "is revoked"):
+		return nil
+	default:
+		return fmt.Errorf("handshake with %s failed for another reason: %w", addr, err)
+	}
+}
+
+// ConnectHandshake does a mutual TLS handshake with the Connect sidecar
+// public listener at addr (host:port), presenting the leaf cert client, e.g.
+// from ConnectCertificateMaker, and verifying the sidecar's cert against
+// rootsPEM, e.g. the Connect CA roots.  Sidecars are identified by SPIFFE ID
+// rather than hostname, so the server's URI SAN must equal wantURI.  Envoy
+// checks intentions after the handshake, so a successful return doesn't mean
+// the connection is allowed.
+func ConnectHandshake(ctx context.Context, addr string, client *pki.TLSConfigPEM, rootsPEM []string, wantURI string) error {
+	pool := x509.NewCertPool()
+	for _, root := range rootsPEM {
+		if !pool.AppendCertsFromPEM([]byte(root)) {
+			return fmt.Errorf("invalid root cert")
+		}
+	}
+	cert, err := tls.X509KeyPair([]byte(client.Cert+"\n"+client.CA), []byte(client.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	rawConn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Verification is done below, since there's no hostname to check.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			for _, b := range raw {
+				c, err := x509.ParseCertificate(b)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, c)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no server cert")
+			}
+			inter := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				inter.AddCert(c)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: inter,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if err != nil {
+				return err
+			}
+			for _, u := range certs[0].URIs {
+				if u.String() == wantURI {
+					return nil
+				}
+			}
+			return fmt.Errorf("server cert URI SANs %v don't include %s", certs[0].URIs, wantURI)
+		},
+	})
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn.Handshake()
+}
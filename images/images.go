@@ -0,0 +1,167 @@
+// images resolves services to the docker images used to run them, and pulls
+// those images, the docker counterpart to binaries.
+package images
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	dockerapi "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/ncabatoff/yurt"
+)
+
+// Manager provides image references by service name, e.g. "consul".  An
+// empty version means the default image of the service's descriptor.
+type Manager interface {
+	Get(ctx context.Context, service, version string) (string, error)
+}
+
+// PullOptions configure a PullManager.
+type PullOptions struct {
+	// Repos overrides the repository used for a service, e.g.
+	// {"nomad": "myregistry:5000/nomad"}.  Tags are still based on version.
+	Repos map[string]string
+	// Pins maps image references, e.g. "consul:1.11.1", to the digest they
+	// must resolve to, e.g. "sha256:...".  Pinned images are run by digest.
+	Pins map[string]string
+	// Progress receives pull progress.  If nil, progress isn't shown.
+	Progress io.Writer
+}
+
+// PullManager is a Manager that pulls images using the docker API, once per
+// image per manager.  If a pull fails but the image exists locally, e.g.
+// when offline, the local image is used.
+type PullManager struct {
+	l      sync.Mutex
+	api    *dockerapi.Client
+	opts   PullOptions
+	pulled map[string]string
+}
+
+var _ Manager = &PullManager{}
+
+func NewPullManager(api *dockerapi.Client, opts PullOptions) *PullManager {
+	return &PullManager{
+		api:    api,
+		opts:   opts,
+		pulled: make(map[string]string),
+	}
+}
+
+// Reference returns the image reference for version of service, without
+// pulling it.  Versions are given as for binaries, e.g. "2.32.1" rather than
+// prometheus' "v2.32.1" tag; see DockerDescriptor.TagPrefix.
+func (m *PullManager) Reference(service, version string) (string, error) {
+	desc, ok := yurt.LookupService(service)
+	if !ok || desc.Docker == nil {
+		return "", fmt.Errorf("no docker image for service %q", service)
+	}
+	repo, tag := splitTag(desc.Docker.Image)
+	if r, ok := m.opts.Repos[service]; ok {
+		repo = r
+	}
+	if version != "" {
+		tag = version
+		if !strings.HasPrefix(tag, desc.Docker.TagPrefix) {
+			tag = desc.Docker.TagPrefix + tag
+		}
+	}
+	if tag == "" {
+		return repo, nil
+	}
+	return repo + ":" + tag, nil
+}
+
+// splitTag splits an image reference into repository and tag, allowing for
+// registry hosts with ports, e.g. "localhost:5000/consul:1.11.1".
+func splitTag(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
+
+// Get returns the reference to run for version of service, pulling it first
+// if this manager hasn't already.  If the image is pinned, the reference
+// returned names its digest.
+func (m *PullManager) Get(ctx context.Context, service, version string) (string, error) {
+	ref, err := m.Reference(service, version)
+	if err != nil {
+		return "", err
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+	if resolved, ok := m.pulled[ref]; ok {
+		return resolved, nil
+	}
+	resolved, err := m.pull(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	m.pulled[ref] = resolved
+	return resolved, nil
+}
+
+func (m *PullManager) pull(ctx context.Context, ref string) (string, error) {
+	progress := m.opts.Progress
+	if progress == nil {
+		progress = ioutil.Discard
+	}
+	pullErr := func() error {
+		rc, err := m.api.ImagePull(ctx, ref, types.ImagePullOptions{})
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return jsonmessage.DisplayJSONMessagesStream(rc, progress, 0, false, nil)
+	}()
+
+	inspect, _, err := m.api.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		if pullErr != nil {
+			return "", fmt.Errorf("error pulling %s: %w", ref, pullErr)
+		}
+		return "", err
+	}
+	if pullErr != nil {
+		log.Printf("error pulling %s, using local image: %v", ref, pullErr)
+	}
+
+	pin, ok := m.opts.Pins[ref]
+	if !ok {
+		return ref, nil
+	}
+	repo, _ := splitTag(ref)
+	for _, rd := range inspect.RepoDigests {
+		if strings.HasSuffix(rd, "@"+pin) {
+			return repo + "@" + pin, nil
+		}
+	}
+	return "", fmt.Errorf("image %s has digests %v, expected %s", ref, inspect.RepoDigests, pin)
+}
+
+// Prefetch pulls images for services, a map from service name to version
+// ("" for the default), e.g. to avoid pulls counting against test timeouts.
+func (m *PullManager) Prefetch(ctx context.Context, services map[string]string) error {
+	var errs []string
+	for service, version := range services {
+		if _, err := m.Get(ctx, service, version); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", service, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("prefetch failed:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
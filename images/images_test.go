@@ -0,0 +1,161 @@
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	dockerapi "github.com/docker/docker/client"
+	_ "github.com/ncabatoff/yurt/consul"
+	_ "github.com/ncabatoff/yurt/minio"
+	_ "github.com/ncabatoff/yurt/nomad"
+	_ "github.com/ncabatoff/yurt/prometheus"
+)
+
+func TestSplitTag(t *testing.T) {
+	for image, want := range map[string][2]string{
+		"consul:1.11.1":                 {"consul", "1.11.1"},
+		"noenv/nomad":                   {"noenv/nomad", ""},
+		"localhost:5000/vault":          {"localhost:5000/vault", ""},
+		"localhost:5000/vault:1.9.2":    {"localhost:5000/vault", "1.9.2"},
+		"hashicorp/consul-enterprise:1": {"hashicorp/consul-enterprise", "1"},
+	} {
+		repo, tag := splitTag(image)
+		if repo != want[0] || tag != want[1] {
+			t.Errorf("%s: expected %v, got %s %s", image, want, repo, tag)
+		}
+	}
+}
+
+func TestReference(t *testing.T) {
+	m := NewPullManager(nil, PullOptions{Repos: map[string]string{"nomad": "localhost:5000/nomad"}})
+	for _, tc := range []struct {
+		service, version, want string
+	}{
+		{"consul", "", "consul:1.11.1"},
+		{"consul", "1.10.6", "consul:1.10.6"},
+		{"nomad", "1.2.3", "localhost:5000/nomad:1.2.3"},
+		{"prometheus", "2.30.0", "prom/prometheus:v2.30.0"},
+		{"prometheus", "v2.30.0", "prom/prometheus:v2.30.0"},
+		{"minio", "2021-12-10T23-03-39Z", "minio/minio:RELEASE.2021-12-10T23-03-39Z"},
+	} {
+		got, err := m.Reference(tc.service, tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s %q: expected %s, got %s", tc.service, tc.version, tc.want, got)
+		}
+	}
+	if _, err := m.Reference("nosuchservice", ""); err == nil {
+		t.Fatal("expected error for unknown service")
+	}
+}
+
+// fakeDaemon serves the docker API endpoints used by PullManager.  Pulls
+// fail if pullErr is set; images in digests exist locally, with the given
+// repo digests.
+type fakeDaemon struct {
+	l       sync.Mutex
+	pulls   map[string]int
+	pullErr bool
+	digests map[string][]string
+}
+
+func (f *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/images/create"):
+		ref := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		f.pulls[ref]++
+		if f.pullErr {
+			http.Error(w, `{"message": "no network"}`, http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "Pulled"}` + "\n"))
+	case strings.Contains(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+		ref := strings.TrimSuffix(r.URL.Path[strings.Index(r.URL.Path, "/images/")+len("/images/"):], "/json")
+		digests, ok := f.digests[ref]
+		if !ok {
+			http.Error(w, `{"message": "no such image"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:abc", RepoDigests: digests})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeDaemon(t *testing.T, f *fakeDaemon) *dockerapi.Client {
+	f.pulls = map[string]int{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	cli, err := dockerapi.NewClientWithOpts(dockerapi.WithHost("tcp://"+srv.Listener.Addr().String()),
+		dockerapi.WithVersion("1.39"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestGet(t *testing.T) {
+	f := &fakeDaemon{digests: map[string][]string{"consul:1.11.1": nil}}
+	m := NewPullManager(newFakeDaemon(t, f), PullOptions{})
+	for i := 0; i < 2; i++ {
+		ref, err := m.Get(context.Background(), "consul", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != "consul:1.11.1" {
+			t.Fatalf("expected consul:1.11.1, got %s", ref)
+		}
+	}
+	if f.pulls["consul:1.11.1"] != 1 {
+		t.Fatalf("expected one pull, got %d", f.pulls["consul:1.11.1"])
+	}
+
+	if _, err := m.Get(context.Background(), "consul", "1.10.6"); err == nil {
+		t.Fatal("expected error for image that's neither pulled nor local")
+	}
+}
+
+// TestGetOffline verifies that local images are used when pulls fail.
+func TestGetOffline(t *testing.T) {
+	f := &fakeDaemon{pullErr: true, digests: map[string][]string{"consul:1.11.1": nil}}
+	m := NewPullManager(newFakeDaemon(t, f), PullOptions{})
+	ref, err := m.Get(context.Background(), "consul", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "consul:1.11.1" {
+		t.Fatalf("expected consul:1.11.1, got %s", ref)
+	}
+}
+
+func TestGetPinned(t *testing.T) {
+	const digest = "sha256:0123456789abcdef"
+	f := &fakeDaemon{digests: map[string][]string{
+		"consul:1.11.1": {"consul@" + digest},
+		"consul:1.10.6": {"consul@sha256:fedcba9876543210"},
+	}}
+	m := NewPullManager(newFakeDaemon(t, f), PullOptions{Pins: map[string]string{
+		"consul:1.11.1": digest,
+		"consul:1.10.6": digest,
+	}})
+	ref, err := m.Get(context.Background(), "consul", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "consul@"+digest {
+		t.Fatalf("expected pinned reference, got %s", ref)
+	}
+	if _, err := m.Get(context.Background(), "consul", "1.10.6"); err == nil {
+		t.Fatal("expected error for image whose digest doesn't match its pin")
+	}
+}
@@ -0,0 +1,146 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/ncabatoff/yurt/cluster"
+)
+
+// Consul provides workloads that churn the catalog and KV store of a Consul
+// cluster, e.g. to observe anti-entropy and raft under load.
+type Consul struct {
+	// Clients are the agents used.  Service instance i is always registered
+	// with the same agent, so that it can be deregistered from it.
+	Clients []*consulapi.Client
+	// Service is the name of the service whose instances are registered and
+	// queried, default "load".
+	Service string
+	// Instances is the number of distinct service instances, default 100.
+	Instances int
+	// KVPrefix is the prefix of the keys written, default "load/".
+	KVPrefix string
+	// Keys is the number of distinct keys written, default 100.
+	Keys int
+	// ValueSize is the size in bytes of the values written, default 100.
+	ValueSize int
+}
+
+// NewConsul returns a Consul using the agents of the servers of cc.
+func NewConsul(cc *cluster.ConsulCluster) (*Consul, error) {
+	clients, err := cc.ClientAPIs()
+	if err != nil {
+		return nil, err
+	}
+	return &Consul{Clients: clients}, nil
+}
+
+func (c *Consul) client(i int) *consulapi.Client {
+	return c.Clients[i%len(c.Clients)]
+}
+
+func (c *Consul) service() string {
+	if c.Service == "" {
+		return "load"
+	}
+	return c.Service
+}
+
+func (c *Consul) instances() int {
+	if c.Instances <= 0 {
+		return 100
+	}
+	return c.Instances
+}
+
+func (c *Consul) kvPrefix() string {
+	if c.KVPrefix == "" {
+		return "load/"
+	}
+	return c.KVPrefix
+}
+
+func (c *Consul) instanceID(n int) string {
+	return fmt.Sprintf("%s-%d", c.service(), n)
+}
+
+// ServiceChurn returns a workload that registers the service instances in
+// turn, then deregisters them in turn, and so on.
+func (c *Consul) ServiceChurn(cfg Config) Workload {
+	return Workload{
+		Name:   "consul-service-churn",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			n := i % c.instances()
+			agent := c.client(n).Agent()
+			if (i/c.instances())%2 == 1 {
+				return agent.ServiceDeregister(c.instanceID(n))
+			}
+			return agent.ServiceRegister(&consulapi.AgentServiceRegistration{
+				ID:   c.instanceID(n),
+				Name: c.service(),
+				Port: 10000 + n,
+				Tags: []string{"yurt-load"},
+			})
+		},
+	}
+}
+
+// KVWrite returns a workload that writes values to the keys in turn.
+func (c *Consul) KVWrite(cfg Config) Workload {
+	keys := c.Keys
+	if keys <= 0 {
+		keys = 100
+	}
+	size := c.ValueSize
+	if size <= 0 {
+		size = 100
+	}
+	return Workload{
+		Name:   "consul-kv-write",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			pair := &consulapi.KVPair{
+				Key:   fmt.Sprintf("%skey-%d", c.kvPrefix(), i%keys),
+				Value: []byte(strings.Repeat(string(rune('a'+i%26)), size)),
+			}
+			_, err := c.client(i).KV().Put(pair, (&consulapi.WriteOptions{}).WithContext(ctx))
+			return err
+		},
+	}
+}
+
+// CatalogQuery returns a workload that lists the instances of the service
+// from the catalog, alternating between default and stale consistency so
+// that followers as well as the leader answer queries.
+func (c *Consul) CatalogQuery(cfg Config) Workload {
+	return Workload{
+		Name:   "consul-catalog-query",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			opts := &consulapi.QueryOptions{AllowStale: i%2 == 1}
+			_, _, err := c.client(i).Catalog().Service(c.service(), "", opts.WithContext(ctx))
+			return err
+		},
+	}
+}
+
+// Cleanup deregisters all the service instances and deletes the keys
+// written, so that churn from one run doesn't linger into the next.
+func (c *Consul) Cleanup(ctx context.Context) error {
+	if len(c.Clients) == 0 {
+		return fmt.Errorf("no Consul clients")
+	}
+	for n := 0; n < c.instances(); n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Deregistering an instance that isn't registered is an error we
+		// can ignore.
+		_ = c.client(n).Agent().ServiceDeregister(c.instanceID(n))
+	}
+	_, err := c.Clients[0].KV().DeleteTree(c.kvPrefix(), (&consulapi.WriteOptions{}).WithContext(ctx))
+	return err
+}
@@ -0,0 +1,273 @@
+// load drives workloads against yurt clusters at a given rate and
+// concurrency, recording the latency of each operation in Prometheus
+// histograms.  The histograms can be pushed to the Pushgateway of a
+// MonitoredEnv, see runenv.MonitoredEnv.RunPushgateway, so that runs against
+// different versions or configurations can be compared in Prometheus.
+package load
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/yurt/pushgateway"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Config controls how hard a workload is driven.
+type Config struct {
+	// Rate is the number of operations per second to start, across all
+	// workers.  If zero, each worker starts a new operation as soon as its
+	// previous one completes.
+	Rate float64
+	// Concurrency is the number of workers issuing operations, default 1.
+	Concurrency int
+	// Duration is how long to run for.  If zero, the workload runs until
+	// the context given to Runner.Run is done.
+	Duration time.Duration
+}
+
+// interval is the time between operations needed to achieve Rate.
+func (c Config) interval() time.Duration {
+	return time.Duration(float64(time.Second) / c.Rate)
+}
+
+// Workload is an operation to perform repeatedly.
+type Workload struct {
+	// Name identifies the workload in results and metrics, e.g. "kv-read".
+	Name string
+	Config
+	// Op performs the i'th operation of the workload.  It's called
+	// concurrently by the workers.
+	Op func(ctx context.Context, i int) error
+}
+
+// Result summarizes the operations performed by a workload.
+type Result struct {
+	Ops    int
+	Errors int
+	// Latency is the total time taken by the operations.
+	Latency time.Duration
+	// FirstError is the first error returned by an operation, if any.
+	FirstError error
+}
+
+// Mean returns the mean latency of the operations.
+func (r Result) Mean() time.Duration {
+	if r.Ops == 0 {
+		return 0
+	}
+	return r.Latency / time.Duration(r.Ops)
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("ops=%d errors=%d mean=%s", r.Ops, r.Errors, r.Mean())
+}
+
+// DefaultPushInterval is how often metrics are pushed when
+// Runner.PushInterval isn't set.
+const DefaultPushInterval = 10 * time.Second
+
+// Runner runs workloads and records their metrics.
+type Runner struct {
+	// PushAddr is the address of a Pushgateway to push metrics to, e.g.
+	// http://127.0.0.1:9091.  If empty, metrics are only recorded locally,
+	// see Registry.
+	PushAddr string
+	// PushInterval is how often metrics are pushed while running.
+	PushInterval time.Duration
+	// Job and Grouping identify the pushed metrics; Job defaults to
+	// "yurt-load".  Include a label distinguishing the runs to compare in
+	// Grouping, e.g. {"instance": "vault-1.9.2"}.
+	Job      string
+	Grouping map[string]string
+
+	once     sync.Once
+	registry *prometheus.Registry
+	latency  *prometheus.HistogramVec
+}
+
+func (r *Runner) init() {
+	r.once.Do(func() {
+		r.registry = prometheus.NewRegistry()
+		r.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "yurt",
+			Subsystem: "load",
+			Name:      "latency_seconds",
+			Help:      "Latency of load generator operations, by workload and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"workload", "result"})
+		r.registry.MustRegister(r.latency)
+	})
+}
+
+// Registry returns the registry holding the metrics of the workloads run.
+func (r *Runner) Registry() *prometheus.Registry {
+	r.init()
+	return r.registry
+}
+
+// Run runs the workloads concurrently until each has run for its Duration,
+// or until ctx is done, returning their results by name.  Errors returned by
+// operations are counted rather than stopping the workload.  If PushAddr is
+// set, metrics are pushed every PushInterval and once more at the end; only
+// a failure of the final push is returned.
+func (r *Runner) Run(ctx context.Context, workloads ...Workload) (map[string]*Result, error) {
+	r.init()
+	results := make(map[string]*Result, len(workloads))
+	for _, w := range workloads {
+		if _, ok := results[w.Name]; ok {
+			return nil, fmt.Errorf("duplicate workload name %q", w.Name)
+		}
+		if w.Rate > 0 && w.interval() <= 0 {
+			return nil, fmt.Errorf("workload %q rate %g is too high, max is one per nanosecond", w.Name, w.Rate)
+		}
+		results[w.Name] = &Result{}
+	}
+
+	pushCtx, stopPushing := context.WithCancel(ctx)
+	pushDone := make(chan struct{})
+	go func() {
+		defer close(pushDone)
+		r.pushPeriodically(pushCtx)
+	}()
+
+	var wg sync.WaitGroup
+	for _, w := range workloads {
+		wg.Add(1)
+		go func(w Workload, res *Result) {
+			defer wg.Done()
+			r.run(ctx, w, res)
+		}(w, results[w.Name])
+	}
+	wg.Wait()
+	stopPushing()
+	<-pushDone
+
+	if r.PushAddr == "" {
+		return results, nil
+	}
+	// Don't use ctx, which may well be done by now.
+	pctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return results, r.Push(pctx)
+}
+
+func (r *Runner) run(ctx context.Context, w Workload, res *Result) {
+	if w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Duration)
+		defer cancel()
+	}
+
+	// Workers take a token for each operation: with no rate limit, tokens
+	// are always available.
+	tokens := make(chan int)
+	go func() {
+		defer close(tokens)
+		var tick <-chan time.Time
+		if w.Rate > 0 {
+			ticker := time.NewTicker(w.interval())
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; ; i++ {
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case tokens <- i:
+			}
+		}
+	}()
+
+	var l sync.Mutex
+	var wg sync.WaitGroup
+	workers := w.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tokens {
+				start := time.Now()
+				err := w.Op(ctx, i)
+				took := time.Since(start)
+				if err != nil && ctx.Err() != nil {
+					// Interrupted by the end of the run, not a real failure.
+					continue
+				}
+				result := "ok"
+				if err != nil {
+					result = "error"
+				}
+				r.latency.WithLabelValues(w.Name, result).Observe(took.Seconds())
+
+				l.Lock()
+				res.Ops++
+				res.Latency += took
+				if err != nil {
+					res.Errors++
+					if res.FirstError == nil {
+						res.FirstError = err
+					}
+				}
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (r *Runner) pushPeriodically(ctx context.Context) {
+	if r.PushAddr == "" {
+		return
+	}
+	interval := r.PushInterval
+	if interval <= 0 {
+		interval = DefaultPushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Failures are retried at the next interval.
+			_ = r.Push(ctx)
+		}
+	}
+}
+
+// Push pushes the metrics recorded so far to the Pushgateway at PushAddr.
+func (r *Runner) Push(ctx context.Context) error {
+	r.init()
+	mfs, err := r.registry.Gather()
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	enc := expfmt.NewEncoder(&sb, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	job := r.Job
+	if job == "" {
+		job = "yurt-load"
+	}
+	return pushgateway.Push(ctx, r.PushAddr, job, r.Grouping, sb.String())
+}
@@ -0,0 +1,71 @@
+package load
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRunRate verifies that workloads are run at the requested rate, that
+// failed operations are counted, and that latencies are recorded.
+func TestRunRate(t *testing.T) {
+	var r Runner
+	failing := errors.New("odd")
+	results, err := r.Run(context.Background(),
+		Workload{
+			Name:   "limited",
+			Config: Config{Rate: 50, Concurrency: 2, Duration: time.Second},
+			Op: func(ctx context.Context, i int) error {
+				if i%2 == 1 {
+					return failing
+				}
+				return nil
+			},
+		},
+		Workload{
+			Name:   "unlimited",
+			Config: Config{Duration: 100 * time.Millisecond},
+			Op: func(ctx context.Context, i int) error {
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limited := results["limited"]
+	if limited.Ops < 25 || limited.Ops > 55 {
+		t.Fatalf("expected about 50 ops at 50/s for 1s, got %d", limited.Ops)
+	}
+	if limited.Errors < limited.Ops/2-1 || limited.Errors > limited.Ops/2+1 || limited.FirstError != failing {
+		t.Fatalf("expected half the ops to fail, got %v", limited)
+	}
+	if results["unlimited"].Ops <= limited.Ops {
+		t.Fatalf("expected unlimited workload to do more than %d ops, got %v", limited.Ops, results["unlimited"])
+	}
+
+	mfs, err := r.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || len(mfs[0].Metric) != 3 {
+		t.Fatalf("expected histograms for limited ok/error and unlimited ok, got %v", mfs)
+	}
+}
+
+// TestRunRateTooHigh verifies that a rate too high to tick at is rejected
+// rather than making the ticker panic.
+func TestRunRateTooHigh(t *testing.T) {
+	var r Runner
+	_, err := r.Run(context.Background(), Workload{
+		Name:   "fast",
+		Config: Config{Rate: 2e9, Duration: time.Second},
+		Op: func(ctx context.Context, i int) error {
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for rate above 1e9")
+	}
+}
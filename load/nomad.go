@@ -0,0 +1,186 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/ncabatoff/yurt/cluster"
+)
+
+// Nomad provides workloads that churn the jobs of a Nomad cluster, to
+// exercise the schedulers.  Jobs run a shell sleep using the raw_exec driver,
+// which yurt's Nomad clients enable.
+type Nomad struct {
+	// Clients are used in turn by successive operations, e.g. one per server
+	// as returned by cluster.NomadCluster.ClientAPIs.
+	Clients []*nomadapi.Client
+	// JobPrefix prefixes the IDs of the jobs created, default "load-".
+	JobPrefix string
+	// Jobs is the number of distinct batch and service jobs, default 10.
+	Jobs int
+	// MaxCount is the count service jobs are scaled up to, default 3.
+	MaxCount int
+	// Datacenter is where jobs run, default "dc1".
+	Datacenter string
+	// Sleep is the number of seconds that batch job tasks run for, default 5.
+	Sleep int
+}
+
+// NewNomad returns a Nomad using the servers of nc.
+func NewNomad(nc *cluster.NomadCluster) (*Nomad, error) {
+	clients, err := nc.ClientAPIs()
+	if err != nil {
+		return nil, err
+	}
+	return &Nomad{Clients: clients}, nil
+}
+
+func (n *Nomad) client(i int) *nomadapi.Client {
+	return n.Clients[i%len(n.Clients)]
+}
+
+func (n *Nomad) prefix() string {
+	if n.JobPrefix == "" {
+		return "load-"
+	}
+	return n.JobPrefix
+}
+
+func (n *Nomad) jobs() int {
+	if n.Jobs <= 0 {
+		return 10
+	}
+	return n.Jobs
+}
+
+func (n *Nomad) dispatchJobID() string {
+	return n.prefix() + "dispatch"
+}
+
+// job returns a job of the given type, with a single group of count tasks
+// that sleep for sleep seconds, or forever if sleep is zero.
+func (n *Nomad) job(id, typ string, count, sleep int) *nomadapi.Job {
+	dc := n.Datacenter
+	if dc == "" {
+		dc = "dc1"
+	}
+	cmd := "sleep " + strconv.Itoa(sleep)
+	if sleep == 0 {
+		cmd = "while true; do sleep 60; done"
+	}
+	cpu, mem := 20, 16
+	task := nomadapi.NewTask("sleep", "raw_exec").
+		SetConfig("command", "/bin/sh").
+		SetConfig("args", []string{"-c", cmd}).
+		Require(&nomadapi.Resources{CPU: &cpu, MemoryMB: &mem})
+	group := nomadapi.NewTaskGroup("load", count).AddTask(task)
+	job := nomadapi.NewBatchJob(id, id, "global", 50)
+	if typ == nomadapi.JobTypeService {
+		job = nomadapi.NewServiceJob(id, id, "global", 50)
+	}
+	return job.AddDatacenter(dc).AddTaskGroup(group)
+}
+
+func (n *Nomad) sleep() int {
+	if n.Sleep <= 0 {
+		return 5
+	}
+	return n.Sleep
+}
+
+// Setup registers the parameterized job used by the Dispatch workload.
+func (n *Nomad) Setup(ctx context.Context) error {
+	if len(n.Clients) == 0 {
+		return fmt.Errorf("no Nomad clients")
+	}
+	job := n.job(n.dispatchJobID(), nomadapi.JobTypeBatch, 1, n.sleep())
+	job.ParameterizedJob = &nomadapi.ParameterizedJobConfig{MetaOptional: []string{"iteration"}}
+	_, _, err := n.Clients[0].Jobs().Register(job, nil)
+	return err
+}
+
+// BatchSubmit returns a workload that registers the batch jobs in turn,
+// each time as a new version so that it's scheduled again.
+func (n *Nomad) BatchSubmit(cfg Config) Workload {
+	return Workload{
+		Name:   "nomad-batch-submit",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			id := fmt.Sprintf("%sbatch-%d", n.prefix(), i%n.jobs())
+			job := n.job(id, nomadapi.JobTypeBatch, 1, n.sleep()).SetMeta("iteration", strconv.Itoa(i))
+			_, _, err := n.client(i).Jobs().Register(job, nil)
+			return err
+		},
+	}
+}
+
+// ServiceChurn returns a workload that cycles each of the service jobs
+// through being registered with a count of one, scaled up to MaxCount, and
+// stopped.
+func (n *Nomad) ServiceChurn(cfg Config) Workload {
+	maxCount := n.MaxCount
+	if maxCount <= 0 {
+		maxCount = 3
+	}
+	return Workload{
+		Name:   "nomad-service-churn",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			id := fmt.Sprintf("%sservice-%d", n.prefix(), i%n.jobs())
+			jobs := n.client(i).Jobs()
+			switch (i / n.jobs()) % 3 {
+			case 0:
+				_, _, err := jobs.Register(n.job(id, nomadapi.JobTypeService, 1, 0), nil)
+				return err
+			case 1:
+				_, _, err := jobs.Register(n.job(id, nomadapi.JobTypeService, maxCount, 0), nil)
+				return err
+			default:
+				_, _, err := jobs.Deregister(id, true, nil)
+				return err
+			}
+		},
+	}
+}
+
+// Dispatch returns a workload that dispatches the parameterized job created
+// by Setup.
+func (n *Nomad) Dispatch(cfg Config) Workload {
+	return Workload{
+		Name:   "nomad-dispatch",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			meta := map[string]string{"iteration": strconv.Itoa(i)}
+			_, _, err := n.client(i).Jobs().Dispatch(n.dispatchJobID(), meta, nil, nil)
+			return err
+		},
+	}
+}
+
+// Cleanup purges the jobs created by the workloads, including dispatched
+// ones, then garbage collects so that they don't linger into the next run.
+func (n *Nomad) Cleanup(ctx context.Context) error {
+	if len(n.Clients) == 0 {
+		return fmt.Errorf("no Nomad clients")
+	}
+	cli := n.Clients[0]
+	stubs, _, err := cli.Jobs().PrefixList(n.prefix())
+	if err != nil {
+		return err
+	}
+	for _, stub := range stubs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(stub.ID, n.prefix()) {
+			continue
+		}
+		if _, _, err := cli.Jobs().Deregister(stub.ID, true, nil); err != nil {
+			return fmt.Errorf("error purging job %s: %w", stub.ID, err)
+		}
+	}
+	return cli.System().GarbageCollect()
+}
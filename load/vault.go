@@ -0,0 +1,231 @@
+package load
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/cluster"
+)
+
+// Vault provides workloads that exercise a Vault cluster.
+type Vault struct {
+	// Clients are used in turn by successive operations, e.g. one per node
+	// as returned by cluster.VaultCluster.Clients.  They must have a token
+	// able to use the mounts below and to create tokens.
+	Clients []*vaultapi.Client
+	// KVMount is the path of the KV version 1 mount used, default "load-kv".
+	KVMount string
+	// TransitMount is the path of the transit mount used, default
+	// "load-transit".
+	TransitMount string
+	// Keys is the number of distinct KV keys written and read, default 100.
+	Keys int
+	// ValueSize is the size in bytes of the values written, default 100.
+	ValueSize int
+	// TokenTTL is the TTL of the tokens created, default "5m"; they're short
+	// lived so that they don't accumulate.
+	TokenTTL string
+}
+
+// transitKey is the name of the transit key used for encryption.
+const transitKey = "load"
+
+// NewVault returns a Vault using the root token to talk to each node of vc.
+func NewVault(vc *cluster.VaultCluster) (*Vault, error) {
+	clients, err := vc.Clients()
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{Clients: clients}, nil
+}
+
+func (v *Vault) client(i int) *vaultapi.Client {
+	return v.Clients[i%len(v.Clients)]
+}
+
+// writeWithContext is like Logical().Write, but honours ctx, which the
+// vault/api version we use doesn't support for logical requests.
+func writeWithContext(ctx context.Context, cli *vaultapi.Client, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	req := cli.NewRequest("PUT", "/v1/"+path)
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	return doWithContext(ctx, cli, req)
+}
+
+// readWithContext is like Logical().Read, returning a nil secret if path
+// doesn't exist, but honours ctx.
+func readWithContext(ctx context.Context, cli *vaultapi.Client, path string) (*vaultapi.Secret, error) {
+	return doWithContext(ctx, cli, cli.NewRequest("GET", "/v1/"+path))
+}
+
+func doWithContext(ctx context.Context, cli *vaultapi.Client, req *vaultapi.Request) (*vaultapi.Secret, error) {
+	resp, err := cli.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && req.Method == "GET" {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	return vaultapi.ParseSecret(resp.Body)
+}
+
+func (v *Vault) kvMount() string {
+	if v.KVMount == "" {
+		return "load-kv"
+	}
+	return v.KVMount
+}
+
+func (v *Vault) transitMount() string {
+	if v.TransitMount == "" {
+		return "load-transit"
+	}
+	return v.TransitMount
+}
+
+func (v *Vault) keys() int {
+	if v.Keys <= 0 {
+		return 100
+	}
+	return v.Keys
+}
+
+func (v *Vault) key(i int) string {
+	return fmt.Sprintf("%s/key-%d", v.kvMount(), i%v.keys())
+}
+
+// Setup creates the mounts and transit key used by the workloads, if they
+// don't exist already, and writes every KV key so that reads succeed.
+func (v *Vault) Setup(ctx context.Context) error {
+	if len(v.Clients) == 0 {
+		return fmt.Errorf("no Vault clients")
+	}
+	cli := v.Clients[0]
+	mounts, err := cli.Sys().ListMounts()
+	if err != nil {
+		return err
+	}
+	for path, input := range map[string]*vaultapi.MountInput{
+		v.kvMount():      {Type: "kv", Options: map[string]string{"version": "1"}},
+		v.transitMount(): {Type: "transit"},
+	} {
+		if _, ok := mounts[strings.Trim(path, "/")+"/"]; ok {
+			continue
+		}
+		if err := cli.Sys().Mount(path, input); err != nil {
+			return fmt.Errorf("error mounting %s: %w", path, err)
+		}
+	}
+	if _, err := cli.Logical().Write(v.transitMount()+"/keys/"+transitKey, nil); err != nil {
+		return fmt.Errorf("error creating transit key: %w", err)
+	}
+
+	write := v.KVWrite(Config{}).Op
+	for i := 0; i < v.keys(); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := write(ctx, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Vault) value() (string, error) {
+	size := v.ValueSize
+	if size <= 0 {
+		size = 100
+	}
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b)[:size], nil
+}
+
+// KVWrite returns a workload that writes random values to the KV keys in
+// turn.
+func (v *Vault) KVWrite(cfg Config) Workload {
+	return Workload{
+		Name:   "vault-kv-write",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			val, err := v.value()
+			if err != nil {
+				return err
+			}
+			_, err = writeWithContext(ctx, v.client(i), v.key(i), map[string]interface{}{"value": val})
+			return err
+		},
+	}
+}
+
+// KVRead returns a workload that reads the KV keys in turn.
+func (v *Vault) KVRead(cfg Config) Workload {
+	return Workload{
+		Name:   "vault-kv-read",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			secret, err := readWithContext(ctx, v.client(i), v.key(i))
+			if err != nil {
+				return err
+			}
+			if secret == nil {
+				return fmt.Errorf("%s not found", v.key(i))
+			}
+			return nil
+		},
+	}
+}
+
+// TransitEncrypt returns a workload that encrypts random values using the
+// transit key.
+func (v *Vault) TransitEncrypt(cfg Config) Workload {
+	path := v.transitMount() + "/encrypt/" + transitKey
+	return Workload{
+		Name:   "vault-transit-encrypt",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			val, err := v.value()
+			if err != nil {
+				return err
+			}
+			plaintext := base64.StdEncoding.EncodeToString([]byte(val))
+			_, err = writeWithContext(ctx, v.client(i), path, map[string]interface{}{"plaintext": plaintext})
+			return err
+		},
+	}
+}
+
+// TokenCreate returns a workload that creates tokens with the default
+// policy.
+func (v *Vault) TokenCreate(cfg Config) Workload {
+	ttl := v.TokenTTL
+	if ttl == "" {
+		ttl = "5m"
+	}
+	return Workload{
+		Name:   "vault-token-create",
+		Config: cfg,
+		Op: func(ctx context.Context, i int) error {
+			_, err := writeWithContext(ctx, v.client(i), "auth/token/create", map[string]interface{}{
+				"policies": []string{"default"},
+				"ttl":      ttl,
+			})
+			return err
+		},
+	}
+}
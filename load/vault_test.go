@@ -0,0 +1,72 @@
+package load
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// TestVaultKV verifies that the KV workloads write and read back values,
+// and that a missing key is an error.
+func TestVaultKV(t *testing.T) {
+	var l sync.Mutex
+	kv := map[string]json.RawMessage{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		defer l.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			kv[r.URL.Path] = b
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			data, ok := kv[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		}
+	}))
+	defer srv.Close()
+
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = srv.URL
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Vault{Clients: []*vaultapi.Client{cli}, Keys: 2}
+	ctx := context.Background()
+
+	read := v.KVRead(Config{}).Op
+	if err := read(ctx, 0); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected missing key to be not found, got %v", err)
+	}
+	write := v.KVWrite(Config{}).Op
+	for i := 0; i < 2; i++ {
+		if err := write(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+		if err := read(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := v.KVWrite(Config{}).Op(cctx, 0); err == nil {
+		t.Fatal("expected write with cancelled context to fail")
+	}
+}
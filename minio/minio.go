@@ -0,0 +1,240 @@
+package minio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type Ports struct {
+	HTTP    int
+	Console int
+}
+
+var PortNames = struct {
+	HTTP    string
+	Console string
+}{
+	"http",
+	"console",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP:    9000,
+		Console: 9001,
+	}
+}
+
+// RunnerPorts uses Kind "minio", which is also the name of the scrape job in
+// ScrapeConfig, so that a MonitoredEnv picks up MinIO targets.
+func (c Ports) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "minio",
+		NameOrder: []string{
+			PortNames.HTTP,
+			PortNames.Console,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP:    {Number: c.HTTP, Type: yurt.TCPOnly},
+			PortNames.Console: {Number: c.Console, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// Descriptor describes MinIO for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "minio",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/minio/v2/metrics/cluster"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/minio/health/live"},
+		{Port: PortNames.HTTP, Path: "/minio/health/ready"},
+	},
+	// The image's entrypoint prefixes the args with the minio command, so
+	// that they're the same as when running the binary.  MinIO doesn't use
+	// a config dir, but yurt expects one.
+	Docker: &yurt.DockerDescriptor{
+		Image:      "minio/minio:RELEASE.2022-01-08T03-11-54Z",
+		ConfigDir:  "/minio/config",
+		DataDir:    "/data",
+		LogDir:     "/minio/logs",
+		Entrypoint: []string{"/usr/bin/docker-entrypoint.sh"},
+		TagPrefix:  "RELEASE.",
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "AccessKey", Type: "string", Description: "root user"},
+		{Name: "SecretKey", Type: "string", Description: "root password"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// ScrapeConfig is the Prometheus job used to scrape MinIO.  Config makes the
+// metrics endpoint public, so no bearer token is needed.
+var ScrapeConfig = prometheus.ScrapeConfig{
+	JobName:     "minio",
+	MetricsPath: "/minio/v2/metrics/cluster",
+}
+
+// Config describes how to run a single-drive MinIO server, providing an S3
+// compatible object store, e.g. for Thanos to upload blocks to.
+type Config struct {
+	Common runner.Config
+	// AccessKey and SecretKey are the root credentials.
+	AccessKey string
+	SecretKey string
+}
+
+func (c Config) Config() runner.Config {
+	return c.Common
+}
+
+func (c Config) Name() string {
+	return "minio"
+}
+
+func NewConfig(accessKey, secretKey string) Config {
+	return Config{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (c Config) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func (c Config) Args() []string {
+	addr := "127.0.0.1"
+	if c.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	return []string{"server", c.Common.DataDir,
+		fmt.Sprintf("--address=%s:%d", addr, c.Common.Ports.ByName[PortNames.HTTP].Number),
+		fmt.Sprintf("--console-address=%s:%d", addr, c.Common.Ports.ByName[PortNames.Console].Number),
+	}
+}
+
+func (c Config) Env() []string {
+	return []string{
+		"MINIO_ROOT_USER=" + c.AccessKey,
+		"MINIO_ROOT_PASSWORD=" + c.SecretKey,
+		"MINIO_PROMETHEUS_AUTH_TYPE=public",
+	}
+}
+
+func (c Config) Files() map[string]string {
+	return nil
+}
+
+// HealthCheck waits until the MinIO server at addr, e.g.
+// http://127.0.0.1:9000, is ready to serve requests.
+func HealthCheck(ctx context.Context, addr string) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, addr+"/minio/health/ready", nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("ready status %d", resp.StatusCode)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Client returns an S3 client for the MinIO server at addr.
+func Client(addr, accessKey, secretKey string) (*s3.S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(addr),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// MakeBucket creates the named bucket on the MinIO server at addr.
+func MakeBucket(ctx context.Context, addr, accessKey, secretKey, bucket string) error {
+	cli, err := Client(addr, accessKey, secretKey)
+	if err != nil {
+		return err
+	}
+	_, err = cli.CreateBucketWithContext(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return fmt.Errorf("error creating bucket %q: %w", bucket, err)
+	}
+	return nil
+}
+
+// ListObjects returns the keys of the objects in bucket, e.g. so that tests
+// can verify that Thanos has uploaded blocks.
+func ListObjects(ctx context.Context, addr, accessKey, secretKey, bucket string) ([]string, error) {
+	cli, err := Client(addr, accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = cli.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)},
+		func(page *s3.ListObjectsV2Output, _ bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// PutObject writes body to key in bucket, e.g. an artifact for a Nomad job
+// to fetch.
+func PutObject(ctx context.Context, addr, accessKey, secretKey, bucket, key string, body []byte) error {
+	cli, err := Client(addr, accessKey, secretKey)
+	if err != nil {
+		return err
+	}
+	_, err = cli.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return fmt.Errorf("error putting %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
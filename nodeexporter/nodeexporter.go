@@ -0,0 +1,105 @@
+package nodeexporter
+
+import (
+	"fmt"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type Ports struct {
+	HTTP int
+}
+
+var PortNames = struct {
+	HTTP string
+}{
+	"http",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP: 9100,
+	}
+}
+
+// RunnerPorts uses Kind "node", which is also the name of the scrape job in
+// ScrapeConfig, so that a MonitoredEnv picks up node_exporter targets.
+func (c Ports) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "node",
+		NameOrder: []string{
+			PortNames.HTTP,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// Descriptor describes node_exporter for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "node_exporter",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"agent"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/metrics"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// ScrapeConfig is the Prometheus job used to scrape node_exporter.
+var ScrapeConfig = prometheus.ScrapeConfig{
+	JobName: "node",
+}
+
+// Config describes how to run node_exporter, which exports host-level
+// metrics (CPU, memory, disk, network) of the machine it runs on.
+type Config struct {
+	Common runner.Config
+}
+
+func (c Config) Config() runner.Config {
+	return c.Common
+}
+
+func (c Config) Name() string {
+	return "node_exporter"
+}
+
+func NewConfig() Config {
+	return Config{
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (c Config) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func (c Config) Args() []string {
+	port := c.Common.Ports.ByName[PortNames.HTTP].Number
+	addr := "127.0.0.1"
+	if c.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	return []string{
+		fmt.Sprintf("--web.listen-address=%s:%d", addr, port),
+	}
+}
+
+func (c Config) Env() []string {
+	return nil
+}
+
+func (c Config) Files() map[string]string {
+	return nil
+}
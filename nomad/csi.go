@@ -0,0 +1,102 @@
+package nomad
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// CSIHostpathJobHCL returns a Nomad job which runs the CSI hostpath driver as
+// a monolith plugin with the given plugin ID.  Clients need the docker driver
+// configured to allow privileged containers.  The hostpath driver is only
+// suitable for testing: volumes live on the client running the plugin.
+func CSIHostpathJobHCL(pluginID string) string {
+	return fmt.Sprintf(`
+job "%[1]s" {
+  datacenters = ["dc1"]
+  type = "system"
+  group "csi" {
+    task "plugin" {
+      driver = "docker"
+      config {
+        image = "k8s.gcr.io/sig-storage/hostpathplugin:v1.7.3"
+        args = [
+          "--drivername=csi-hostpath",
+          "--v=5",
+          "--endpoint=unix://csi/csi.sock",
+          "--nodeid=node-${node.unique.name}",
+        ]
+        privileged = true
+      }
+      csi_plugin {
+        id = "%[1]s"
+        type = "monolith"
+        mount_dir = "/csi"
+      }
+      resources {
+        cpu = 100
+        memory = 128
+      }
+    }
+  }
+}
+`, pluginID)
+}
+
+// RegisterJobHCL parses and registers jobhcl, returning the job ID.  Unlike
+// Jobs().ParseHCL and Jobs().Register, this doesn't round-trip the job through
+// the client library's Job struct, so stanzas the library doesn't know about,
+// such as csi_plugin, are preserved.
+func RegisterJobHCL(cli *nomadapi.Client, jobhcl string) (string, error) {
+	var job map[string]interface{}
+	_, err := cli.Raw().Write("/v1/jobs/parse", &nomadapi.JobsParseRequest{
+		JobHCL:       jobhcl,
+		Canonicalize: true,
+	}, &job, nil)
+	if err != nil {
+		return "", fmt.Errorf("error parsing job: %w", err)
+	}
+
+	_, err = cli.Raw().Write("/v1/jobs", map[string]interface{}{"Job": job}, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("error registering job: %w", err)
+	}
+	id, _ := job["ID"].(string)
+	return id, nil
+}
+
+// csiPlugin is the subset of the CSI plugin API response we use.
+type csiPlugin struct {
+	ID                 string
+	ControllersHealthy int
+	NodesHealthy       int
+}
+
+// CSIPluginHealthy waits until the CSI plugin with the given ID reports at
+// least nodes healthy node plugins.
+func CSIPluginHealthy(ctx context.Context, cli *nomadapi.Client, pluginID string, nodes int) error {
+	var err error
+	for ctx.Err() == nil {
+		var plugin csiPlugin
+		_, err = cli.Raw().Query("/v1/plugin/csi/"+pluginID, &plugin, nil)
+		if err == nil {
+			if plugin.NodesHealthy >= nodes {
+				return nil
+			}
+			err = fmt.Errorf("plugin %s has %d healthy nodes, want %d", pluginID, plugin.NodesHealthy, nodes)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for CSI plugin: %w", err)
+}
+
+// DeployCSIPlugin registers jobhcl, which must define a CSI plugin with the
+// given ID, then waits until nodes instances of the plugin are healthy.
+func DeployCSIPlugin(ctx context.Context, cli *nomadapi.Client, jobhcl, pluginID string, nodes int) error {
+	if _, err := RegisterJobHCL(cli, jobhcl); err != nil {
+		return err
+	}
+	return CSIPluginHealthy(ctx, cli, pluginID, nodes)
+}
@@ -0,0 +1,187 @@
+package nomad
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+// AllocAddr is a labelled network address of a running allocation.
+type AllocAddr struct {
+	AllocID string
+	// Task is empty for group-level networks.
+	Task    string
+	Label   string
+	Address string
+}
+
+// DeployJob registers the job defined by jobhcl and waits until it's healthy:
+// if the registration creates a deployment, until the deployment succeeds,
+// otherwise until all the allocations created are running.  If the job fails
+// to place or become healthy the task events of its allocations are logged
+// and an error is returned.  On success the addresses of the job's running
+// allocations are returned.
+func DeployJob(ctx context.Context, cli *nomadapi.Client, jobhcl string) ([]AllocAddr, error) {
+	job, err := cli.Jobs().ParseHCL(jobhcl, true)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing job: %w", err)
+	}
+	resp, _, err := cli.Jobs().Register(job, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error registering job: %w", err)
+	}
+	if resp.Warnings != "" {
+		log.Printf("job %s register warnings: %s", *job.ID, resp.Warnings)
+	}
+
+	eval, err := waitEval(ctx, cli, resp.EvalID)
+	if err != nil {
+		return nil, err
+	}
+
+	if eval.DeploymentID != "" {
+		err = waitDeployment(ctx, cli, eval.DeploymentID)
+	} else {
+		err = waitAllocsRunning(ctx, cli, eval.ID)
+	}
+	if err != nil {
+		logTaskEvents(cli, *job.ID)
+		return nil, err
+	}
+
+	allocs, _, err := cli.Jobs().Allocations(*job.ID, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []AllocAddr
+	for _, stub := range allocs {
+		if stub.ClientStatus != nomadapi.AllocClientStatusRunning {
+			continue
+		}
+		alloc, _, err := cli.Allocations().Info(stub.ID, nil)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, allocAddrs(alloc)...)
+	}
+	return addrs, nil
+}
+
+func waitEval(ctx context.Context, cli *nomadapi.Client, evalID string) (*nomadapi.Evaluation, error) {
+	var err error
+	for ctx.Err() == nil {
+		var eval *nomadapi.Evaluation
+		eval, _, err = cli.Evaluations().Info(evalID, nil)
+		if err == nil {
+			switch eval.Status {
+			case "complete":
+				if len(eval.FailedTGAllocs) > 0 {
+					var groups []string
+					for tg := range eval.FailedTGAllocs {
+						groups = append(groups, tg)
+					}
+					sort.Strings(groups)
+					return nil, fmt.Errorf("evaluation %s failed to place groups %v", evalID, groups)
+				}
+				return eval, nil
+			case "failed", "canceled":
+				return nil, fmt.Errorf("evaluation %s %s: %s", evalID, eval.Status, eval.StatusDescription)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for evaluation %s, last error: %v", evalID, err)
+}
+
+func waitDeployment(ctx context.Context, cli *nomadapi.Client, deploymentID string) error {
+	var err error
+	for ctx.Err() == nil {
+		var d *nomadapi.Deployment
+		d, _, err = cli.Deployments().Info(deploymentID, nil)
+		if err == nil {
+			switch d.Status {
+			case "successful":
+				return nil
+			case "failed", "cancelled":
+				return fmt.Errorf("deployment %s %s: %s", deploymentID, d.Status, d.StatusDescription)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for deployment %s, last error: %v", deploymentID, err)
+}
+
+func waitAllocsRunning(ctx context.Context, cli *nomadapi.Client, evalID string) error {
+	var err error
+	for ctx.Err() == nil {
+		var allocs []*nomadapi.AllocationListStub
+		allocs, _, err = cli.Evaluations().Allocations(evalID, nil)
+		if err == nil {
+			running := 0
+			for _, alloc := range allocs {
+				switch alloc.ClientStatus {
+				case nomadapi.AllocClientStatusRunning, nomadapi.AllocClientStatusComplete:
+					running++
+				case nomadapi.AllocClientStatusFailed, nomadapi.AllocClientStatusLost:
+					return fmt.Errorf("allocation %s is %s", alloc.ID, alloc.ClientStatus)
+				}
+			}
+			if running == len(allocs) {
+				return nil
+			}
+			err = fmt.Errorf("%d of %d allocations running", running, len(allocs))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for allocations of evaluation %s: %v", evalID, err)
+}
+
+// logTaskEvents logs the task events of all of the job's allocations, which
+// is normally the quickest way to see why a job isn't healthy.
+func logTaskEvents(cli *nomadapi.Client, jobID string) {
+	allocs, _, err := cli.Jobs().Allocations(jobID, false, nil)
+	if err != nil {
+		log.Printf("error listing allocations of job %s: %v", jobID, err)
+		return
+	}
+	for _, alloc := range allocs {
+		for task, state := range alloc.TaskStates {
+			for _, ev := range state.Events {
+				log.Printf("alloc %s task %s: %s %s: %s", alloc.ID[:8], task,
+					time.Unix(0, ev.Time).Format(time.RFC3339), ev.Type, ev.DisplayMessage)
+			}
+		}
+	}
+}
+
+func allocAddrs(alloc *nomadapi.Allocation) []AllocAddr {
+	if alloc.AllocatedResources == nil {
+		return nil
+	}
+	var addrs []AllocAddr
+	add := func(task string, networks []*nomadapi.NetworkResource) {
+		for _, nw := range networks {
+			for _, ports := range [][]nomadapi.Port{nw.ReservedPorts, nw.DynamicPorts} {
+				for _, port := range ports {
+					addrs = append(addrs, AllocAddr{
+						AllocID: alloc.ID,
+						Task:    task,
+						Label:   port.Label,
+						Address: net.JoinHostPort(nw.IP, strconv.Itoa(port.Value)),
+					})
+				}
+			}
+		}
+	}
+	add("", alloc.AllocatedResources.Shared.Networks)
+	for task, res := range alloc.AllocatedResources.Tasks {
+		add(task, res.Networks)
+	}
+	return addrs
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 
 	nomadapi "github.com/hashicorp/nomad/api"
@@ -55,6 +56,35 @@ func (c Ports) RunnerPorts() yurt.Ports {
 	}
 }
 
+// Descriptor describes Nomad for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "nomad",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server", "client"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/v1/metrics", Params: url.Values{"format": []string{"prometheus"}}},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/v1/agent/health"},
+	},
+	Docker: &yurt.DockerDescriptor{
+		Image:     "noenv/nomad:0.10.3",
+		ConfigDir: "/nomad/config",
+		DataDir:   "/nomad/data",
+		LogDir:    "/nomad/logs",
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "BootstrapExpect", Type: "int", Description: "number of servers to wait for, 0 for clients"},
+		{Name: "ConsulAddr", Type: "string", Description: "host:port of the local Consul agent"},
+		{Name: "ConsulDNSAddr", Type: "string", Description: "host:port of the Consul DNS interface, published in client meta"},
+		{Name: "HostVolumes", Type: "[]HostVolume", Description: "host volumes exposed by clients"},
+		{Name: "DockerPlugin", Type: "*DockerPluginConfig", Description: "docker driver settings for clients"},
+		{Name: "Vault", Type: "*VaultConfig", Description: "Vault integration using workload identity"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
 type NomadConfig struct {
 	Common runner.Config
 	// BootstrapExpect is how many servers to wait for when bootstrapping;
@@ -62,6 +92,50 @@ type NomadConfig struct {
 	BootstrapExpect int
 	// ConsulAddr is the address of the (normally local) consul agent, format is Host:Port
 	ConsulAddr string
+	// ConsulDNSAddr is the address of the DNS interface of the consul agent,
+	// format is Host:Port.  If set on a client, it's published in the client's
+	// node meta as consul_dns_addr, consul_dns_ip and consul_dns_port, so that
+	// jobs can use it, e.g. via ${meta.consul_dns_ip} in a network dns block.
+	ConsulDNSAddr string
+	// HostVolumes are exposed by clients for use by jobs.
+	HostVolumes []HostVolume
+	// DockerPlugin, if given, configures the docker driver on clients.
+	DockerPlugin *DockerPluginConfig
+	// Vault, if given, enables the Vault integration using workload identity.
+	Vault *VaultConfig
+	// ConsulHTTP means the Consul agent at ConsulAddr serves plain HTTP even
+	// though we use TLS, e.g. a client agent given only the CA.
+	ConsulHTTP bool
+}
+
+// VaultConfig configures the Vault integration using workload identity
+// rather than static Vault tokens, which requires Nomad 1.7+.  Servers sign
+// a workload identity for Vault with the given audience, and clients exchange
+// it for a Vault token using the JWT auth method at JWTAuthPath, see
+// vault.ConfigureNomadWorkloadIdentity.
+type VaultConfig struct {
+	// Address is the URL of the Vault API.
+	Address string
+	// CA is the PEM CA certificate used to verify Vault, if it uses TLS.
+	CA string
+	// JWTAuthPath is the mount path of the JWT auth method, e.g. "jwt-nomad".
+	JWTAuthPath string
+	// Audience is the aud claim of the workload identities, e.g. "vault.io".
+	Audience string
+}
+
+// HostVolume is a client host_volume stanza.
+type HostVolume struct {
+	Name     string
+	Path     string
+	ReadOnly bool
+}
+
+// DockerPluginConfig holds the docker driver options we care about, e.g. CSI
+// plugins need privileged containers.
+type DockerPluginConfig struct {
+	AllowPrivileged bool
+	VolumesEnabled  bool
 }
 
 func NewConfig(bootstrapExpect int, consulAddr string, tls *pki.TLSConfigPEM) NomadConfig {
@@ -92,6 +166,44 @@ func (nc NomadConfig) WithConfig(cfg runner.Config) runner.Command {
 	return nc
 }
 
+// WithClientTLS returns a copy of nc that sets verify_https_client, so that
+// the HTTP API, and thus the nomad CLI and UI, only accept clients presenting a
+// certificate signed by our CA.  RPC between agents verifies certs regardless
+// once TLS is enabled.
+func (nc NomadConfig) WithClientTLS(clientTLS *pki.TLSConfigPEM) NomadConfig {
+	if clientTLS != nil {
+		nc.Common.ClientTLS = *clientTLS
+	}
+	return nc
+}
+
+// WithConsulDNS returns a copy of nc with ConsulDNSAddr set to addr, or an
+// error if addr isn't of the form Host:Port.  An empty addr is allowed.
+func (nc NomadConfig) WithConsulDNS(addr string) (NomadConfig, error) {
+	if addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nc, fmt.Errorf("invalid Consul DNS address %q: %w", addr, err)
+		}
+	}
+	nc.ConsulDNSAddr = addr
+	return nc, nil
+}
+
+func (nc NomadConfig) WithHostVolumes(vols []HostVolume) NomadConfig {
+	nc.HostVolumes = vols
+	return nc
+}
+
+func (nc NomadConfig) WithDockerPlugin(dp *DockerPluginConfig) NomadConfig {
+	nc.DockerPlugin = dp
+	return nc
+}
+
+func (nc NomadConfig) WithVault(v *VaultConfig) NomadConfig {
+	nc.Vault = v
+	return nc
+}
+
 func (nc NomadConfig) Args() []string {
 	args := []string{"agent"}
 	if nc.BootstrapExpect > 0 {
@@ -143,7 +255,7 @@ func (nc NomadConfig) Files() map[string]string {
 	allcfg := map[string]interface{}{
 		"tls": tlsCfg,
 		"consul": map[string]interface{}{
-			"ssl":     true,
+			"ssl":     !nc.ConsulHTTP,
 			"ca_file": "ca.pem",
 		},
 	}
@@ -161,6 +273,13 @@ func (nc NomadConfig) Files() map[string]string {
 		files["ca.pem"] = nc.Common.TLS.CA
 		tlsCfg["ca_file"] = "ca.pem"
 	}
+	if nc.Common.ClientTLS.Cert != "" {
+		// Nomad agents talk to each other over RPC, not HTTPS, so they never
+		// present client.pem; it's only there for the harness's Endpoint.
+		files["client.pem"] = nc.Common.ClientTLS.Cert
+		files["client-key.pem"] = nc.Common.ClientTLS.PrivateKey
+		tlsCfg["verify_https_client"] = true
+	}
 	if len(files) > 0 {
 		tlsCfgBytes, err := jsonutil.EncodeJSON(allcfg)
 		if err != nil {
@@ -204,6 +323,10 @@ disable_update_check = true
 
 	files["common.hcl"] = common
 
+	if nc.Vault != nil {
+		files["vault.hcl"] = nc.vaultConfig(files)
+	}
+
 	if nc.BootstrapExpect == 0 {
 		// Disable Java so I don't get popups on my MacOS machine about installing it.
 		files["client.hcl"] = `
@@ -218,10 +341,61 @@ plugin "raw_exec" {
   }
 }
 `
+		if nc.ConsulDNSAddr != "" {
+			// WithConsulDNS validates the address; if it was set directly and
+			// isn't valid, publish it as is, without the parts.
+			meta := fmt.Sprintf("    consul_dns_addr = %q\n", nc.ConsulDNSAddr)
+			if host, port, err := net.SplitHostPort(nc.ConsulDNSAddr); err == nil {
+				meta += fmt.Sprintf("    consul_dns_ip = %q\n    consul_dns_port = %q\n", host, port)
+			}
+			files["consul-dns.hcl"] = "\nclient {\n  meta {\n" + meta + "  }\n}\n"
+		}
+		if len(nc.HostVolumes) > 0 {
+			var vols string
+			for _, vol := range nc.HostVolumes {
+				vols += fmt.Sprintf(`
+  host_volume "%s" {
+    path = "%s"
+    read_only = %v
+  }
+`, vol.Name, vol.Path, vol.ReadOnly)
+			}
+			files["host-volumes.hcl"] = "client {" + vols + "}\n"
+		}
+		if nc.DockerPlugin != nil {
+			files["docker.hcl"] = fmt.Sprintf(`
+plugin "docker" {
+  config {
+    allow_privileged = %v
+    volumes {
+      enabled = %v
+    }
+  }
+}
+`, nc.DockerPlugin.AllowPrivileged, nc.DockerPlugin.VolumesEnabled)
+		}
 	}
 	return files
 }
 
+func (nc NomadConfig) vaultConfig(files map[string]string) string {
+	v := fmt.Sprintf("vault {\n  enabled = true\n  address = \"%s\"\n", nc.Vault.Address)
+	if nc.Vault.CA != "" {
+		files["vault-ca.pem"] = nc.Vault.CA
+		v += "  ca_file = \"vault-ca.pem\"\n"
+	}
+	if nc.BootstrapExpect > 0 {
+		v += fmt.Sprintf(`  default_identity {
+    aud = ["%s"]
+    ttl = "1h"
+  }
+`, nc.Vault.Audience)
+	} else {
+		v += fmt.Sprintf("  jwt_auth_backend_path = \"%s\"\n", nc.Vault.JWTAuthPath)
+	}
+	return v + "}\n"
+}
+
 func HarnessToAPI(r runner.Harness) (*nomadapi.Client, error) {
 	apicfg, err := r.Endpoint("http", true)
 	if err != nil {
@@ -230,10 +404,24 @@ func HarnessToAPI(r runner.Harness) (*nomadapi.Client, error) {
 	return apiConfigToClient(apicfg)
 }
 
+// HarnessToAPIWithClientTLS is like HarnessToAPI, except the client presents
+// the given certificate files, e.g. for an agent whose tls stanza sets
+// verify_https_client but which wasn't configured using WithClientTLS.
+func HarnessToAPIWithClientTLS(r runner.Harness, certFile, keyFile string) (*nomadapi.Client, error) {
+	apicfg, err := r.Endpoint("http", true)
+	if err != nil {
+		return nil, err
+	}
+	apicfg.ClientCertFile, apicfg.ClientKeyFile = certFile, keyFile
+	return apiConfigToClient(apicfg)
+}
+
 func apiConfigToClient(a *runner.APIConfig) (*nomadapi.Client, error) {
 	cfg := nomadapi.DefaultConfig()
 	cfg.Address = a.Address.String()
 	cfg.TLSConfig.CACert = a.CAFile
+	cfg.TLSConfig.ClientCert = a.ClientCertFile
+	cfg.TLSConfig.ClientKey = a.ClientKeyFile
 	return nomadapi.NewClient(cfg)
 }
 
@@ -0,0 +1,245 @@
+package nomadautoscaler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type Ports struct {
+	HTTP int
+}
+
+var PortNames = struct {
+	HTTP string
+}{
+	"http",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP: 8080,
+	}
+}
+
+func (c Ports) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "nomad-autoscaler",
+		NameOrder: []string{
+			PortNames.HTTP,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// Descriptor describes the Nomad Autoscaler for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "nomad-autoscaler",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"agent"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/v1/metrics", Params: url.Values{"format": []string{"prometheus"}}},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/v1/health"},
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "NomadAddr", Type: "string", Description: "URL of the Nomad API"},
+		{Name: "PrometheusAddr", Type: "string", Description: "URL of the Prometheus API used by the prometheus APM plugin"},
+		{Name: "EvaluationInterval", Type: "time.Duration", Description: "default policy evaluation interval"},
+		{Name: "Cooldown", Type: "time.Duration", Description: "default policy cooldown"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// Config describes how to run a single Nomad Autoscaler agent.  Scaling
+// policies are read from the scaling blocks of the jobs registered in Nomad;
+// the "prometheus" APM plugin is configured to query PrometheusAddr, so
+// policies can use source = "prometheus".
+type Config struct {
+	Common runner.Config
+	// NomadAddr is the URL of the Nomad API, e.g. https://127.0.0.1:4646.
+	NomadAddr string
+	// PrometheusAddr is the URL of the Prometheus API, e.g.
+	// http://127.0.0.1:9090, typically that of MonitoredEnv.PromAddr.
+	PrometheusAddr string
+	// EvaluationInterval and Cooldown are the policy defaults; zero means
+	// use the autoscaler's own defaults, which are too slow for most tests.
+	EvaluationInterval time.Duration
+	Cooldown           time.Duration
+}
+
+func (c Config) Config() runner.Config {
+	return c.Common
+}
+
+func (c Config) Name() string {
+	return "nomad-autoscaler"
+}
+
+func NewConfig(nomadAddr, promAddr string, tls *pki.TLSConfigPEM) Config {
+	var t pki.TLSConfigPEM
+	if tls != nil {
+		t = *tls
+	}
+	return Config{
+		NomadAddr:      nomadAddr,
+		PrometheusAddr: promAddr,
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+			TLS:   t,
+		},
+	}
+}
+
+func (c Config) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+// WithIntervals returns a copy of c using the given policy defaults.
+func (c Config) WithIntervals(evaluation, cooldown time.Duration) Config {
+	c.EvaluationInterval, c.Cooldown = evaluation, cooldown
+	return c
+}
+
+func (c Config) Args() []string {
+	return []string{"agent",
+		fmt.Sprintf("-config=%s/autoscaler.hcl", c.Common.ConfigDir),
+	}
+}
+
+func (c Config) Env() []string {
+	return nil
+}
+
+func (c Config) Files() map[string]string {
+	files := map[string]string{}
+
+	addr := "127.0.0.1"
+	if c.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	cfg := fmt.Sprintf(`
+http {
+  bind_address = "%s"
+  bind_port = %d
+}
+`, addr, c.Common.Ports.ByName[PortNames.HTTP].Number)
+
+	if c.Common.LogDir != "" {
+		cfg += fmt.Sprintf("log_file = \"%s/\"\n", c.Common.LogDir)
+	}
+
+	nomadCfg := fmt.Sprintf("  address = \"%s\"\n", c.NomadAddr)
+	if c.Common.TLS.CA != "" {
+		files["ca.pem"] = c.Common.TLS.CA
+		nomadCfg += fmt.Sprintf("  ca_cert = \"%s/ca.pem\"\n", c.Common.ConfigDir)
+	}
+	cfg += "nomad {\n" + nomadCfg + "}\n"
+
+	if c.PrometheusAddr != "" {
+		cfg += fmt.Sprintf(`
+apm "prometheus" {
+  driver = "prometheus"
+  config = {
+    address = "%s"
+  }
+}
+`, c.PrometheusAddr)
+	}
+
+	var policy string
+	if c.EvaluationInterval != 0 {
+		policy += fmt.Sprintf("  default_evaluation_interval = \"%s\"\n", c.EvaluationInterval)
+	}
+	if c.Cooldown != 0 {
+		policy += fmt.Sprintf("  default_cooldown = \"%s\"\n", c.Cooldown)
+	}
+	if policy != "" {
+		cfg += "policy {\n" + policy + "}\n"
+	}
+
+	files["autoscaler.hcl"] = cfg
+	return files
+}
+
+// HealthCheck waits until the autoscaler at addr (e.g. http://127.0.0.1:8080)
+// reports itself healthy, returning the last error seen if ctx expires first.
+func HealthCheck(ctx context.Context, addr string) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/health", nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("health status %d", resp.StatusCode)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// WaitGroupCount waits until the job's task group has the given count and
+// that many allocations running, as happens after the autoscaler acts on a
+// horizontal scaling policy.
+func WaitGroupCount(ctx context.Context, cli *nomadapi.Client, jobID, group string, count int) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var job *nomadapi.Job
+		job, _, err = cli.Jobs().Info(jobID, nil)
+		if err != nil {
+			continue
+		}
+		var tg *nomadapi.TaskGroup
+		for _, g := range job.TaskGroups {
+			if g.Name != nil && *g.Name == group {
+				tg = g
+			}
+		}
+		if tg == nil {
+			return fmt.Errorf("job %s has no group %s", jobID, group)
+		}
+		if tg.Count == nil || *tg.Count != count {
+			err = fmt.Errorf("group count is %v, want %d", tg.Count, count)
+			continue
+		}
+		var summary *nomadapi.JobSummary
+		summary, _, err = cli.Jobs().Summary(jobID, nil)
+		if err != nil {
+			continue
+		}
+		if s := summary.Summary[group]; s.Running != count {
+			err = fmt.Errorf("running=%d, want %d", s.Running, count)
+			continue
+		}
+		return nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
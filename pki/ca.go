@@ -5,13 +5,23 @@ import (
 	"fmt"
 	"github.com/hashicorp/go-uuid"
 	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/events"
 	"github.com/ncabatoff/yurt/util"
 	"strings"
+	"sync"
 )
 
 type CertificateAuthority struct {
 	path string
 	cli  *vaultapi.Client
+
+	l sync.Mutex
+	// roles are the names of the roles created on demand by role().
+	roles map[string]bool
+
+	// Events, if non-nil, receives a CertIssued event for each certificate
+	// issued.
+	Events *events.Bus
 }
 
 func NewExternalCertificateAuthority(vaultAddr, vaultToken string) (*CertificateAuthority, error) {
@@ -29,19 +39,27 @@ func NewCertificateAuthority(cli *vaultapi.Client) (*CertificateAuthority, error
 	if err != nil {
 		return nil, err
 	}
+	return createCertificateAuthority(cli, u)
+}
 
-	if err := createRootCA(cli, u); err != nil {
+func createCertificateAuthority(cli *vaultapi.Client, path string) (*CertificateAuthority, error) {
+	if err := createRootCA(cli, path); err != nil {
 		return nil, err
 	}
 
-	if err := createIntermediateCA(cli, u); err != nil {
+	if err := createIntermediateCA(cli, path); err != nil {
 		return nil, err
 	}
 
+	return newCertificateAuthority(cli, path), nil
+}
+
+func newCertificateAuthority(cli *vaultapi.Client, path string) *CertificateAuthority {
 	return &CertificateAuthority{
-		path: u,
-		cli:  cli,
-	}, nil
+		path:  path,
+		cli:   cli,
+		roles: map[string]bool{},
+	}
 }
 
 func createRootCA(cli *vaultapi.Client, pfx string) error {
@@ -108,57 +126,149 @@ func createIntermediateCA(cli *vaultapi.Client, pfx string) error {
 		return err
 	}
 
-	resp, err = cli.Logical().Write(intPath+"/roles/consul-server", map[string]interface{}{
-		"allowed_domains":  "server.dc1.consul",
-		"allow_subdomains": "true",
-		"allow_localhost":  "true",
-		"allow_any_name":   "true",
-		"allow_ip_sans":    "true",
-		"max_ttl":          "720h",
-	})
-	if err != nil {
-		return err
+	return writeRoles(cli, intPath)
+}
+
+func writeRoles(cli *vaultapi.Client, intPath string) error {
+	for role, params := range roles {
+		if _, err := cli.Logical().Write(intPath+"/roles/"+role, params); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// roles are the PKI roles created in the intermediate, by name.
+var roles = map[string]map[string]interface{}{
+	"consul-server": serverRole("server.dc1.consul"),
+	"nomad-server":  serverRole("server.global.nomad"),
+	"vault-server":  serverRole("server.dc1.vault"),
+	"consul-client": clientRole("client.dc1.consul"),
+	"nomad-client":  clientRole("client.global.nomad"),
+	"vault-client":  clientRole("client.dc1.vault"),
+	"connect-leaf":  connectLeafRole(),
+}
 
-	resp, err = cli.Logical().Write(intPath+"/roles/nomad-server", map[string]interface{}{
-		"allowed_domains":  "server.global.nomad",
+func serverRole(domain string) map[string]interface{} {
+	return map[string]interface{}{
+		"allowed_domains":  domain,
 		"allow_subdomains": "true",
 		"allow_localhost":  "true",
 		"allow_any_name":   "true",
 		"allow_ip_sans":    "true",
 		"max_ttl":          "720h",
-	})
-	if err != nil {
-		return err
 	}
+}
 
-	resp, err = cli.Logical().Write(intPath+"/roles/vault-server", map[string]interface{}{
-		"allowed_domains":  "server.dc1.vault",
+func clientRole(domain string) map[string]interface{} {
+	return map[string]interface{}{
+		"allowed_domains":  domain,
 		"allow_subdomains": "true",
-		"allow_localhost":  "true",
 		"allow_any_name":   "true",
-		"allow_ip_sans":    "true",
+		"server_flag":      "false",
+		"client_flag":      "true",
 		"max_ttl":          "720h",
-	})
-	if err != nil {
-		return err
 	}
-	return nil
+}
+
+// IssueOptions customize the certificates issued by the *WithOptions methods.
+// Zero values mean use the defaults of the plain methods.
+type IssueOptions struct {
+	// KeyType is "rsa" (the default) or "ec".
+	KeyType string
+	// KeyBits defaults to 2048 for rsa and 256 for ec.
+	KeyBits int
+	// TTL of the cert, e.g. "30s".
+	TTL string
+	// MaxTTL caps TTL, default 720h.
+	MaxTTL string
+	// AltNames are DNS SANs, in addition to localhost for server certs.
+	AltNames []string
+	// IPSANs are IP SANs, in addition to 127.0.0.1 for server certs.
+	IPSANs []string
+	// URISANs are URI SANs, e.g. SPIFFE IDs.  Only roles that allow them,
+	// like the one used by ConnectLeafTLS, will accept them.
+	URISANs []string
+}
+
+// role returns the name of a role that issues certs like base does, but
+// with opts' key type, key bits and max TTL, creating it if needed.
+func (ca *CertificateAuthority) role(base string, opts IssueOptions) (string, error) {
+	if opts.KeyType == "" && opts.KeyBits == 0 && opts.MaxTTL == "" {
+		return base, nil
+	}
+	params := map[string]interface{}{}
+	for k, v := range roles[base] {
+		params[k] = v
+	}
+	name := base
+	if opts.KeyType != "" {
+		params["key_type"] = opts.KeyType
+		name += "-" + opts.KeyType
+	}
+	if opts.KeyBits != 0 {
+		params["key_bits"] = opts.KeyBits
+		name += fmt.Sprintf("-%d", opts.KeyBits)
+	}
+	if opts.MaxTTL != "" {
+		params["max_ttl"] = opts.MaxTTL
+		name += "-" + opts.MaxTTL
+	}
+
+	ca.l.Lock()
+	defer ca.l.Unlock()
+	if ca.roles[name] {
+		return name, nil
+	}
+	if _, err := ca.cli.Logical().Write(ca.path+"-pki-int/roles/"+name, params); err != nil {
+		return "", fmt.Errorf("error creating role %s: %w", name, err)
+	}
+	ca.roles[name] = true
+	return name, nil
 }
 
 func (ca *CertificateAuthority) serverTLS(ctx context.Context, role, cn, ip, ttl string) (*TLSConfigPEM, error) {
-	switch ip {
-	case "":
-		ip = "127.0.0.1"
-	default:
-		ip += ",127.0.0.1"
+	var ips []string
+	if ip != "" {
+		ips = append(ips, ip)
 	}
-	secret, err := ca.cli.Logical().Write(ca.path+"-pki-int/issue/"+role, map[string]interface{}{
-		"common_name": cn,
-		"alt_names":   "localhost",
-		"ip_sans":     ip,
-		"ttl":         ttl,
+	return ca.serverTLSWithOptions(ctx, role, cn, IssueOptions{TTL: ttl, IPSANs: ips})
+}
+
+func (ca *CertificateAuthority) serverTLSWithOptions(ctx context.Context, role, cn string, opts IssueOptions) (*TLSConfigPEM, error) {
+	return ca.issue(ctx, role, cn, IssueOptions{
+		KeyType:  opts.KeyType,
+		KeyBits:  opts.KeyBits,
+		TTL:      opts.TTL,
+		MaxTTL:   opts.MaxTTL,
+		AltNames: append([]string{"localhost"}, opts.AltNames...),
+		IPSANs:   append(append([]string{}, opts.IPSANs...), "127.0.0.1"),
 	})
+}
+
+func (ca *CertificateAuthority) clientTLS(ctx context.Context, role, cn, ttl string) (*TLSConfigPEM, error) {
+	return ca.issue(ctx, role, cn, IssueOptions{TTL: ttl})
+}
+
+func (ca *CertificateAuthority) issue(ctx context.Context, baseRole, cn string, opts IssueOptions) (*TLSConfigPEM, error) {
+	role, err := ca.role(baseRole, opts)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"common_name": cn,
+		"ttl":         opts.TTL,
+	}
+	if len(opts.AltNames) > 0 {
+		data["alt_names"] = strings.Join(opts.AltNames, ",")
+	}
+	if len(opts.IPSANs) > 0 {
+		data["ip_sans"] = strings.Join(opts.IPSANs, ",")
+	}
+	if len(opts.URISANs) > 0 {
+		data["uri_sans"] = strings.Join(opts.URISANs, ",")
+	}
+	secret, err := ca.cli.Logical().Write(ca.path+"-pki-int/issue/"+role, data)
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +278,19 @@ func (ca *CertificateAuthority) serverTLS(ctx context.Context, role, cn, ip, ttl
 		cacert += c.(string) + "\n"
 	}
 
-	return &TLSConfigPEM{
+	tls := &TLSConfigPEM{
 		CA:         cacert,
 		Cert:       secret.Data["certificate"].(string),
 		PrivateKey: secret.Data["private_key"].(string),
-	}, nil
+	}
+	if ca.Events != nil {
+		msg := "cn=" + cn
+		if serial, err := tls.Serial(); err == nil {
+			msg += " serial=" + serial
+		}
+		ca.Events.Publish(events.Event{Kind: events.CertIssued, Message: msg})
+	}
+	return tls, nil
 }
 
 func (ca *CertificateAuthority) ConsulServerTLS(ctx context.Context, ip, ttl string) (*TLSConfigPEM, error) {
@@ -186,3 +304,69 @@ func (ca *CertificateAuthority) NomadServerTLS(ctx context.Context, ip, ttl stri
 func (ca *CertificateAuthority) VaultServerTLS(ctx context.Context, ip, ttl string) (*TLSConfigPEM, error) {
 	return ca.serverTLS(ctx, "vault-server", "server.dc1.vault", ip, ttl)
 }
+
+// ServerTLSWithOptions returns a server cert for product, one of "consul",
+// "nomad", or "vault", with the key type, TTLs and SANs given by opts.  Like
+// the product specific methods, the cert is valid for localhost and
+// 127.0.0.1 in addition to opts' SANs.
+func (ca *CertificateAuthority) ServerTLSWithOptions(ctx context.Context, product string, opts IssueOptions) (*TLSConfigPEM, error) {
+	role := product + "-server"
+	params, ok := roles[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown product %q", product)
+	}
+	return ca.serverTLSWithOptions(ctx, role, params["allowed_domains"].(string), opts)
+}
+
+// ConsulClientTLS returns a certificate usable for client authentication
+// against a Consul HTTPS listener that verifies incoming connections.
+func (ca *CertificateAuthority) ConsulClientTLS(ctx context.Context, ttl string) (*TLSConfigPEM, error) {
+	return ca.clientTLS(ctx, "consul-client", "client.dc1.consul", ttl)
+}
+
+// NomadClientTLS returns a certificate usable for client authentication
+// against a Nomad HTTPS listener that verifies incoming connections.  It's
+// not suitable for Nomad client agents, which need a server-capable cert.
+func (ca *CertificateAuthority) NomadClientTLS(ctx context.Context, ttl string) (*TLSConfigPEM, error) {
+	return ca.clientTLS(ctx, "nomad-client", "client.global.nomad", ttl)
+}
+
+// VaultClientTLS returns a certificate usable for client authentication
+// against a Vault listener that requires client certificates.
+func (ca *CertificateAuthority) VaultClientTLS(ctx context.Context, ttl string) (*TLSConfigPEM, error) {
+	return ca.clientTLS(ctx, "vault-client", "client.dc1.vault", ttl)
+}
+
+// ClientTLSWithOptions returns a client authentication cert for product,
+// one of "consul", "nomad", or "vault", with the key type, TTLs and SANs
+// given by opts.
+func (ca *CertificateAuthority) ClientTLSWithOptions(ctx context.Context, product string, opts IssueOptions) (*TLSConfigPEM, error) {
+	role := product + "-client"
+	params, ok := roles[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown product %q", product)
+	}
+	return ca.issue(ctx, role, params["allowed_domains"].(string), opts)
+}
+
+// ConnectVaultCAConfig holds the settings needed by Consul Connect's Vault CA
+// provider.
+type ConnectVaultCAConfig struct {
+	Address             string
+	Token               string
+	RootPKIPath         string
+	IntermediatePKIPath string
+}
+
+// ConnectVaultCAConfig returns the settings needed to make Consul Connect's
+// Vault CA provider use ca's root, so that mesh certificates chain up to the
+// same root as the certificates issued by ca.  Consul will mount and manage
+// its own intermediate using the same token ca uses.
+func (ca *CertificateAuthority) ConnectVaultCAConfig() ConnectVaultCAConfig {
+	return ConnectVaultCAConfig{
+		Address:             ca.cli.Address(),
+		Token:               ca.cli.Token(),
+		RootPKIPath:         ca.path + "-pki-root",
+		IntermediatePKIPath: ca.path + "-pki-connect-int",
+	}
+}
@@ -0,0 +1,105 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CRLFile is the name of the file WriteCRL writes to each dir.
+const CRLFile = "crl.pem"
+
+// Revoke revokes the certificate with the given serial, e.g. as returned by
+// TLSConfigPEM.Serial, and rebuilds the CRL.  Only certs issued by ca using
+// the *ServerTLS and *ClientTLS methods can be revoked.
+func (ca *CertificateAuthority) Revoke(ctx context.Context, serial string) error {
+	err := ca.writeRaw(ctx, ca.path+"-pki-int/revoke", map[string]interface{}{
+		"serial_number": serial,
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking %s: %w", serial, err)
+	}
+	return nil
+}
+
+// CRL returns the PEM encoded certificate revocation list of the CA that
+// issues ca's certs.
+func (ca *CertificateAuthority) CRL(ctx context.Context) (string, error) {
+	return ca.readRaw(ctx, ca.path+"-pki-int/crl/pem")
+}
+
+// WriteCRL fetches the current CRL and writes it to CRLFile in each of
+// dirs.  It's a client-side helper: neither Consul, Nomad nor Vault are
+// configured to read the file, so it's only honored by clients that check
+// it themselves, e.g. using VerifyNotRevoked.
+func (ca *CertificateAuthority) WriteCRL(ctx context.Context, dirs ...string) error {
+	crl, err := ca.CRL(ctx)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, CRLFile), []byte(crl), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyNotRevoked returns a func suitable for tls.Config's
+// VerifyPeerCertificate, which rejects peers whose certificate, or any
+// certificate in its chain, is listed in the PEM encoded CRL.  The CRL is
+// only trusted if it's signed by a CA in the verified chain, and only
+// applies to the certs that CA issued; peers whose chain doesn't include
+// the CRL's issuer are rejected.  The stock Go TLS stack, used by Consul,
+// Nomad and Vault, doesn't check CRLs itself.
+func VerifyNotRevoked(crlPEM string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	crl, err := x509.ParseCRL([]byte(crlPEM))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CRL: %w", err)
+	}
+	revoked := map[string]bool{}
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		revoked[rc.SerialNumber.String()] = true
+	}
+	var crlIssuer pkix.Name
+	crlIssuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			var issuer *x509.Certificate
+			var sigErr error
+			for _, cert := range chain {
+				if cert.Subject.String() != crlIssuer.String() {
+					continue
+				}
+				if sigErr = cert.CheckCRLSignature(crl); sigErr == nil {
+					issuer = cert
+					break
+				}
+			}
+			switch {
+			case issuer == nil && sigErr != nil:
+				return fmt.Errorf("CRL issuer %s in the verified chain didn't sign it: %w", crlIssuer, sigErr)
+			case issuer == nil:
+				return fmt.Errorf("CRL issuer %s isn't in the verified chain", crlIssuer)
+			}
+			for _, cert := range chain {
+				if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+					continue
+				}
+				if revoked[cert.SerialNumber.String()] {
+					return fmt.Errorf("certificate %s (%s) is revoked", FormatSerial(cert), cert.Subject)
+				}
+			}
+		}
+		return nil
+	}, nil
+}
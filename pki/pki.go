@@ -1,7 +1,37 @@
 package pki
 
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
 type TLSConfigPEM struct {
 	CA         string
 	Cert       string
 	PrivateKey string
 }
+
+// Serial returns the serial number of t's certificate in the form Vault uses,
+// e.g. "1f:0a:...", as needed by CertificateAuthority.Revoke.
+func (t TLSConfigPEM) Serial() (string, error) {
+	block, _ := pem.Decode([]byte(t.Cert))
+	if block == nil {
+		return "", fmt.Errorf("no PEM data found in cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return FormatSerial(cert), nil
+}
+
+// FormatSerial returns the serial number of cert in the form Vault uses.
+func FormatSerial(cert *x509.Certificate) string {
+	var parts []string
+	for _, b := range cert.SerialNumber.Bytes() {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
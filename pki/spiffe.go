@@ -0,0 +1,71 @@
+package pki
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SPIFFEID identifies a Connect service the way Consul does in the URI SAN
+// of its leaf certificates.
+type SPIFFEID struct {
+	// TrustDomain is the cluster's trust domain, e.g. as returned by the
+	// Connect CA roots API: "<cluster id>.consul".
+	TrustDomain string
+	// Namespace defaults to "default".
+	Namespace  string
+	Datacenter string
+	Service    string
+}
+
+// URI returns the SPIFFE ID in URI form, e.g.
+// spiffe://1234abcd-....consul/ns/default/dc/dc1/svc/web.
+func (id SPIFFEID) URI() string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/dc/%s/svc/%s", id.TrustDomain, id.namespace(), id.Datacenter, id.Service)
+}
+
+// CommonName returns the CN Consul would use in a leaf cert for id.  Like
+// Consul, it truncates the trust domain to keep within the 64 character CN
+// limit.
+func (id SPIFFEID) CommonName() string {
+	td := strings.TrimSuffix(id.TrustDomain, ".consul")
+	if len(td) > 8 {
+		td = td[:8]
+	}
+	return fmt.Sprintf("%s.svc.%s.%s.consul", id.Service, id.namespace(), td)
+}
+
+func (id SPIFFEID) namespace() string {
+	if id.Namespace == "" {
+		return "default"
+	}
+	return id.Namespace
+}
+
+func connectLeafRole() map[string]interface{} {
+	return map[string]interface{}{
+		"allow_any_name":   "true",
+		"allowed_uri_sans": "spiffe://*",
+		"require_cn":       "false",
+		"key_type":         "ec",
+		"key_bits":         256,
+		"server_flag":      "true",
+		"client_flag":      "true",
+		"max_ttl":          "72h",
+	}
+}
+
+// ConnectLeafTLS returns a cert like those Consul Connect issues to sidecar
+// proxies, i.e. an ECDSA cert usable for both client and server auth whose
+// URI SAN is id's SPIFFE ID.  If Connect uses ca's root, e.g. after
+// ConsulCluster.SetVaultConnectCA, sidecars will accept it as coming from
+// id's service.
+func (ca *CertificateAuthority) ConnectLeafTLS(ctx context.Context, id SPIFFEID, ttl string) (*TLSConfigPEM, error) {
+	if id.TrustDomain == "" || id.Datacenter == "" || id.Service == "" {
+		return nil, fmt.Errorf("SPIFFE ID requires trust domain, datacenter and service: %+v", id)
+	}
+	return ca.issue(ctx, "connect-leaf", id.CommonName(), IssueOptions{
+		TTL:     ttl,
+		URISANs: []string{id.URI()},
+	})
+}
@@ -0,0 +1,189 @@
+package pki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// CAState is what another process needs to reuse a CertificateAuthority's
+// PKI mounts instead of creating new ones.
+type CAState struct {
+	// Path is the prefix of the mounts, i.e. they're <Path>-pki-root and
+	// <Path>-pki-int.
+	Path string `json:"path"`
+	// CAChain is the PEM chain of the intermediate CA.  It's used on load to
+	// detect mounts that have since been recreated with different keys.
+	CAChain string `json:"ca_chain"`
+}
+
+// Path returns the prefix of the PKI mounts used by ca.
+func (ca *CertificateAuthority) Path() string {
+	return ca.path
+}
+
+// CAChain returns the PEM chain of the CA that issues ca's certs.
+func (ca *CertificateAuthority) CAChain(ctx context.Context) (string, error) {
+	return ca.readRaw(ctx, ca.path+"-pki-int/ca_chain")
+}
+
+// State returns the state needed to reuse ca, e.g. with
+// ReuseCertificateAuthority.
+func (ca *CertificateAuthority) State(ctx context.Context) (*CAState, error) {
+	chain, err := ca.CAChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &CAState{Path: ca.path, CAChain: chain}, nil
+}
+
+// Save writes ca's state to file as JSON, for use by
+// LoadCertificateAuthority.
+func (ca *CertificateAuthority) Save(ctx context.Context, file string) error {
+	state, err := ca.State(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0600)
+}
+
+// LoadCertificateAuthority returns a CertificateAuthority using the PKI
+// mounts described by the state in file, as written by Save.  It fails if
+// the mounts no longer exist or now hold a different CA.
+func LoadCertificateAuthority(ctx context.Context, cli *vaultapi.Client, file string) (*CertificateAuthority, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var state CAState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing CA state in %s: %w", file, err)
+	}
+	ca, err := ReuseCertificateAuthority(ctx, cli, state.Path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ca.CAChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if chain != state.CAChain {
+		return nil, fmt.Errorf("CA chain at %s doesn't match the one in %s", state.Path, file)
+	}
+	return ca, nil
+}
+
+// ReuseCertificateAuthority returns a CertificateAuthority using the
+// existing PKI mounts with prefix path, e.g. as created by another process
+// using NewCertificateAuthority or OpenCertificateAuthority.  The roles are
+// rewritten, so mounts created by older versions gain any new ones.
+func ReuseCertificateAuthority(ctx context.Context, cli *vaultapi.Client, path string) (*CertificateAuthority, error) {
+	ok, err := mountsExist(ctx, cli, path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no PKI mounts found with prefix %s", path)
+	}
+	if err := writeRoles(cli, path+"-pki-int"); err != nil {
+		return nil, err
+	}
+	return newCertificateAuthority(cli, path), nil
+}
+
+// OpenCertificateAuthority is like ReuseCertificateAuthority if the PKI
+// mounts with prefix path exist, otherwise it creates them like
+// NewCertificateAuthority does.  Use a fixed path to share one CA between
+// parallel tests or successive runs.  When several callers race to create
+// the mounts, the losers wait, until ctx is done, for the winner to finish
+// setting up the intermediate CA.
+func OpenCertificateAuthority(ctx context.Context, cli *vaultapi.Client, path string) (*CertificateAuthority, error) {
+	ok, err := mountsExist(ctx, cli, path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		ca, err := createCertificateAuthority(cli, path)
+		if err == nil || !strings.Contains(err.Error(), "path is already in use") {
+			return ca, err
+		}
+	}
+	if err := waitForCAChain(ctx, cli, path); err != nil {
+		return nil, err
+	}
+	return ReuseCertificateAuthority(ctx, cli, path)
+}
+
+// waitForCAChain returns once the intermediate mount with prefix path has a
+// signed CA, since the mounts exist before their creator has generated one.
+func waitForCAChain(ctx context.Context, cli *vaultapi.Client, path string) error {
+	ca := newCertificateAuthority(cli, path)
+	for {
+		chain, err := ca.CAChain(ctx)
+		if err == nil && chain != "" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for CA at %s, last error: %v", path, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func mountsExist(ctx context.Context, cli *vaultapi.Client, path string) (bool, error) {
+	req := cli.NewRequest("GET", "/v1/sys/mounts")
+	resp, err := cli.RawRequestWithContext(ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("error listing mounts: %w", err)
+	}
+	defer resp.Body.Close()
+	secret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil || secret == nil {
+		return false, fmt.Errorf("error parsing mounts: %v", err)
+	}
+	_, root := secret.Data[path+"-pki-root/"]
+	_, intermediate := secret.Data[path+"-pki-int/"]
+	return root && intermediate, nil
+}
+
+func (ca *CertificateAuthority) readRaw(ctx context.Context, path string) (string, error) {
+	req := ca.cli.NewRequest("GET", "/v1/"+path)
+	resp, err := ca.cli.RawRequestWithContext(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d reading %s: %s", resp.StatusCode, path, b)
+	}
+	return string(b), nil
+}
+
+// writeRaw does a PUT of data to path, for callers that don't need the
+// response.  Unlike Logical().Write, it honors ctx.
+func (ca *CertificateAuthority) writeRaw(ctx context.Context, path string, data map[string]interface{}) error {
+	req := ca.cli.NewRequest("PUT", "/v1/"+path)
+	if err := req.SetJSONBody(data); err != nil {
+		return err
+	}
+	resp, err := ca.cli.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
+	"sort"
 	"time"
 
 	"github.com/ncabatoff/yurt"
@@ -46,10 +49,95 @@ func (c Ports) RunnerPorts() yurt.Ports {
 	}
 }
 
+// Descriptor describes Prometheus for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "prometheus",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/metrics"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/-/healthy"},
+		{Port: PortNames.HTTP, Path: "/-/ready"},
+	},
+	// The image's entrypoint is the prometheus binary, but it sets flags of
+	// its own in CMD, which our args replace.
+	Docker: &yurt.DockerDescriptor{
+		Image:      "prom/prometheus:v2.32.1",
+		ConfigDir:  "/prometheus/config",
+		DataDir:    "/prometheus/data",
+		LogDir:     "/prometheus/logs",
+		Entrypoint: []string{"/bin/prometheus"},
+		TagPrefix:  "v",
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "Jobs", Type: "map[string]ScrapeConfig", Description: "scrape configs by job name"},
+		{Name: "Rules", Type: "[]RuleGroup", Description: "recording and alerting rule groups"},
+		{Name: "RemoteWrite", Type: "[]RemoteWriteConfig", Description: "remote_write targets"},
+		{Name: "Storage", Type: "StorageConfig", Description: "TSDB retention time and size"},
+		{Name: "EnableLifecycle", Type: "bool", Description: "allow config reloads via HTTP"},
+		{Name: "ExternalLabels", Type: "map[string]string", Description: "labels added to series sent elsewhere"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
 // Config describes how to run a single Prometheus instance.
 type Config struct {
 	Common runner.Config
 	Jobs   map[string]ScrapeConfig
+	// Rules are written to rules.yml, which is referenced by rule_files.
+	Rules []RuleGroup
+	// RemoteWrite targets receive a copy of all samples scraped.
+	RemoteWrite []RemoteWriteConfig
+	// Storage controls how long samples are retained.
+	Storage StorageConfig
+	// EnableLifecycle allows config reloads (see Reload) and shutdown via
+	// HTTP.
+	EnableLifecycle bool
+	// ExternalLabels are added to all series and alerts sent elsewhere,
+	// e.g. via RemoteWrite.
+	ExternalLabels map[string]string
+}
+
+// StorageConfig limits TSDB retention.  Zero values mean use the Prometheus
+// defaults.
+type StorageConfig struct {
+	RetentionTime time.Duration
+	// RetentionSize is the maximum size of storage blocks, e.g. "512MB".
+	RetentionSize string
+	// BlockDuration, if non-zero, is used as both the min and max duration
+	// of TSDB blocks, disabling local compaction.  This is needed by the
+	// Thanos sidecar to upload blocks; short durations make for quick tests.
+	BlockDuration time.Duration
+}
+
+// RemoteWriteConfig describes a remote_write target, e.g. a Thanos receiver.
+type RemoteWriteConfig struct {
+	URL           string
+	Name          string
+	RemoteTimeout time.Duration
+	// BasicAuth is optional.  The password is written to a file rather than
+	// being included in prometheus.yml.
+	BasicAuth *BasicAuth
+	// TLS is optional; CA is used to verify the target, and Cert and
+	// PrivateKey, if given, are presented to it.
+	TLS *pki.TLSConfigPEM
+}
+
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// remoteWrite is the prometheus.yml form of RemoteWriteConfig.
+type remoteWrite struct {
+	URL           string            `yaml:"url"`
+	Name          string            `yaml:"name,omitempty"`
+	RemoteTimeout time.Duration     `yaml:"remote_timeout,omitempty"`
+	BasicAuth     *config.BasicAuth `yaml:"basic_auth,omitempty"`
+	TLSConfig     *config.TLSConfig `yaml:"tls_config,omitempty"`
 }
 
 func (cc Config) Config() runner.Config {
@@ -83,6 +171,37 @@ func (cc Config) WithConfig(cfg runner.Config) runner.Command {
 	return cc
 }
 
+// WithRemoteWrite returns a copy of cc that forwards samples to the given
+// targets.
+func (cc Config) WithRemoteWrite(targets []RemoteWriteConfig) Config {
+	cc.RemoteWrite = targets
+	return cc
+}
+
+// WithStorage returns a copy of cc using the given retention settings.
+func (cc Config) WithStorage(storage StorageConfig) Config {
+	cc.Storage = storage
+	return cc
+}
+
+// WithLifecycle returns a copy of cc with the lifecycle API enabled.
+func (cc Config) WithLifecycle() Config {
+	cc.EnableLifecycle = true
+	return cc
+}
+
+// WithExternalLabels returns a copy of cc using the given external labels.
+func (cc Config) WithExternalLabels(labels map[string]string) Config {
+	cc.ExternalLabels = labels
+	return cc
+}
+
+// WithRules returns a copy of cc that loads the given rule groups.
+func (cc Config) WithRules(groups []RuleGroup) Config {
+	cc.Rules = groups
+	return cc
+}
+
 func (cc Config) Args() []string {
 	args := []string{
 		fmt.Sprintf("--storage.tsdb.path=%s", cc.Common.DataDir),
@@ -94,6 +213,20 @@ func (cc Config) Args() []string {
 		addr = "0.0.0.0"
 	}
 	args = append(args, fmt.Sprintf("--web.listen-address=%s:%d", addr, port))
+	if cc.Storage.RetentionTime != 0 {
+		args = append(args, fmt.Sprintf("--storage.tsdb.retention.time=%s", model.Duration(cc.Storage.RetentionTime)))
+	}
+	if cc.Storage.RetentionSize != "" {
+		args = append(args, fmt.Sprintf("--storage.tsdb.retention.size=%s", cc.Storage.RetentionSize))
+	}
+	if cc.Storage.BlockDuration != 0 {
+		d := model.Duration(cc.Storage.BlockDuration)
+		args = append(args, fmt.Sprintf("--storage.tsdb.min-block-duration=%s", d),
+			fmt.Sprintf("--storage.tsdb.max-block-duration=%s", d))
+	}
+	if cc.EnableLifecycle {
+		args = append(args, "--web.enable-lifecycle")
+	}
 
 	return args
 }
@@ -184,12 +317,48 @@ type ScrapeConfig struct {
 }
 
 type GlobalConfig struct {
-	ScrapeInterval time.Duration `yaml:"scrape_interval,omitempty"`
+	ScrapeInterval     time.Duration     `yaml:"scrape_interval,omitempty"`
+	EvaluationInterval time.Duration     `yaml:"evaluation_interval,omitempty"`
+	ExternalLabels     map[string]string `yaml:"external_labels,omitempty"`
 }
 
 type PrometheusConfig struct {
 	Global        *GlobalConfig  `yaml:"global,omitempty"`
+	RuleFiles     []string       `yaml:"rule_files,omitempty"`
 	ScrapeConfigs []ScrapeConfig `yaml:"scrape_configs"`
+	RemoteWrite   []remoteWrite  `yaml:"remote_write,omitempty"`
+}
+
+// RuleGroup is a group of recording and/or alerting rules.
+type RuleGroup struct {
+	Name     string        `yaml:"name"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Rules    []Rule        `yaml:"rules"`
+}
+
+// Rule is a recording rule if Record is set, otherwise an alerting rule.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         time.Duration     `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// TargetDownRules alerts when any scrape target is down.
+var TargetDownRules = RuleGroup{
+	Name: "yurt-targets",
+	Rules: []Rule{
+		{
+			Alert: "TargetDown",
+			Expr:  "up == 0",
+			For:   30 * time.Second,
+			Annotations: map[string]string{
+				"summary": "{{ $labels.job }} target {{ $labels.instance }} is down",
+			},
+		},
+	},
 }
 
 func (cc Config) Files() map[string]string {
@@ -213,9 +382,17 @@ func (cc Config) Files() map[string]string {
 	p := PrometheusConfig{
 		Global: &GlobalConfig{
 			ScrapeInterval: 5 * time.Second,
+			ExternalLabels: cc.ExternalLabels,
 		},
 	}
-	for name, job := range cc.Jobs {
+	// Sort jobs so that the config doesn't change from one render to the next.
+	var names []string
+	for name := range cc.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		job := cc.Jobs[name]
 		if cc.Common.TLS.CA != "" {
 			job.HTTPClientConfig.TLSConfig = config.TLSConfig{
 				CAFile: cc.Common.TLS.CA,
@@ -233,6 +410,18 @@ func (cc Config) Files() map[string]string {
 		}
 		p.ScrapeConfigs = append(p.ScrapeConfigs, job)
 	}
+	for i, target := range cc.RemoteWrite {
+		p.RemoteWrite = append(p.RemoteWrite, target.render(files, fmt.Sprintf("remote-write-%d", i)))
+	}
+	if len(cc.Rules) > 0 {
+		b, err := yaml.Marshal(map[string][]RuleGroup{"groups": cc.Rules})
+		if err != nil {
+			log.Fatal(err)
+		}
+		files["rules.yml"] = string(b)
+		p.RuleFiles = []string{"rules.yml"}
+		p.Global.EvaluationInterval = 5 * time.Second
+	}
 	b, err := yaml.Marshal(p)
 	if err != nil {
 		log.Fatal(err)
@@ -241,6 +430,56 @@ func (cc Config) Files() map[string]string {
 	return files
 }
 
+// render returns the prometheus.yml form of rw, adding any files it needs
+// to files, named using prefix.
+func (rw RemoteWriteConfig) render(files map[string]string, prefix string) remoteWrite {
+	ret := remoteWrite{
+		URL:           rw.URL,
+		Name:          rw.Name,
+		RemoteTimeout: rw.RemoteTimeout,
+	}
+	if rw.BasicAuth != nil {
+		files[prefix+".password"] = rw.BasicAuth.Password
+		ret.BasicAuth = &config.BasicAuth{
+			Username:     rw.BasicAuth.Username,
+			PasswordFile: prefix + ".password",
+		}
+	}
+	if rw.TLS != nil {
+		ret.TLSConfig = &config.TLSConfig{}
+		if rw.TLS.CA != "" {
+			files[prefix+"-ca.pem"] = rw.TLS.CA
+			ret.TLSConfig.CAFile = prefix + "-ca.pem"
+		}
+		if rw.TLS.Cert != "" {
+			files[prefix+".pem"] = rw.TLS.Cert
+			files[prefix+"-key.pem"] = rw.TLS.PrivateKey
+			ret.TLSConfig.CertFile = prefix + ".pem"
+			ret.TLSConfig.KeyFile = prefix + "-key.pem"
+		}
+	}
+	return ret
+}
+
+// Reload makes the Prometheus server at promAddr reread its config files,
+// which requires that it was started with EnableLifecycle.
+func Reload(ctx context.Context, promAddr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, promAddr+"/-/reload", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("reload status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
 func HealthCheck(ctx context.Context, promAddr string) error {
 	var err error
 	var cli promapi.Client
@@ -267,3 +506,70 @@ func HealthCheck(ctx context.Context, promAddr string) error {
 	}
 	return err
 }
+
+// RulesHealthy waits until at least count rules are loaded and all of them
+// evaluate without error, returning the last error seen if ctx expires first.
+func RulesHealthy(ctx context.Context, promAddr string, count int) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var rules promv1.RulesResult
+		rules, err = rulesAPI(ctx, promAddr)
+		if err != nil {
+			continue
+		}
+		var loaded int
+		for _, group := range rules.Groups {
+			for _, rule := range group.Rules {
+				loaded++
+				switch r := rule.(type) {
+				case promv1.RecordingRule:
+					if r.Health != promv1.RuleHealthGood {
+						err = fmt.Errorf("rule %s health=%s: %s", r.Name, r.Health, r.LastError)
+					}
+				case promv1.AlertingRule:
+					if r.Health != promv1.RuleHealthGood {
+						err = fmt.Errorf("rule %s health=%s: %s", r.Name, r.Health, r.LastError)
+					}
+				}
+			}
+		}
+		if err == nil && loaded < count {
+			err = fmt.Errorf("%d rules loaded, want %d", loaded, count)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func rulesAPI(ctx context.Context, promAddr string) (promv1.RulesResult, error) {
+	cli, err := promapi.NewClient(promapi.Config{Address: promAddr})
+	if err != nil {
+		return promv1.RulesResult{}, err
+	}
+	return promv1.NewAPI(cli).Rules(ctx)
+}
+
+// FiringAlerts returns the names of the alerts that are currently firing.
+func FiringAlerts(ctx context.Context, promAddr string) ([]string, error) {
+	cli, err := promapi.NewClient(promapi.Config{Address: promAddr})
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := promv1.NewAPI(cli).Alerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, alert := range alerts.Alerts {
+		if alert.State == promv1.AlertStateFiring {
+			names = append(names, string(alert.Labels[model.AlertNameLabel]))
+		}
+	}
+	return names, nil
+}
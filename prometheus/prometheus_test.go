@@ -83,3 +83,113 @@ scrape_configs:
 		t.Fatal(d)
 	}
 }
+
+func TestRuleSerialization(t *testing.T) {
+	c := NewConfig(nil, nil).WithRules([]RuleGroup{
+		{
+			Name: "example",
+			Rules: []Rule{
+				{Record: "job:up:sum", Expr: "sum by (job) (up)"},
+				{Alert: "Down", Expr: "up == 0", For: 30 * time.Second, Labels: map[string]string{"severity": "page"}},
+			},
+		},
+	})
+	files := c.Files()
+
+	expected := `groups:
+- name: example
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+  - alert: Down
+    expr: up == 0
+    for: 30s
+    labels:
+      severity: page
+`
+	if d := cmp.Diff(expected, files["rules.yml"]); len(d) > 0 {
+		t.Fatal(d)
+	}
+
+	expected = `global:
+  scrape_interval: 5s
+  evaluation_interval: 5s
+rule_files:
+- rules.yml
+scrape_configs:
+- job_name: prometheus
+  file_sd_configs:
+  - files:
+    - prometheus.*.json
+    refresh_interval: 1s
+`
+	if d := cmp.Diff(expected, files["prometheus.yml"]); len(d) > 0 {
+		t.Fatal(d)
+	}
+}
+
+func TestRemoteWriteSerialization(t *testing.T) {
+	c := NewConfig(nil, nil).WithRemoteWrite([]RemoteWriteConfig{
+		{
+			URL:       "https://example.com/api/v1/push",
+			BasicAuth: &BasicAuth{Username: "user", Password: "secret"},
+		},
+	})
+	files := c.Files()
+	if files["remote-write-0.password"] != "secret" {
+		t.Fatalf("password file not written: %v", files)
+	}
+
+	expected := `global:
+  scrape_interval: 5s
+scrape_configs:
+- job_name: prometheus
+  file_sd_configs:
+  - files:
+    - prometheus.*.json
+    refresh_interval: 1s
+remote_write:
+- url: https://example.com/api/v1/push
+  basic_auth:
+    username: user
+    password_file: remote-write-0.password
+`
+	if d := cmp.Diff(expected, files["prometheus.yml"]); len(d) > 0 {
+		t.Fatal(d)
+	}
+}
+
+func TestStorageAndLifecycle(t *testing.T) {
+	c := NewConfig(nil, nil).
+		WithStorage(StorageConfig{RetentionTime: 2 * time.Hour, RetentionSize: "512MB"}).
+		WithExternalLabels(map[string]string{"env": "test"}).
+		WithLifecycle()
+	c.Common.DataDir, c.Common.ConfigDir = "/data", "/config"
+
+	expectedArgs := []string{
+		"--storage.tsdb.path=/data",
+		"--config.file=/config/prometheus.yml",
+		"--web.listen-address=127.0.0.1:9090",
+		"--storage.tsdb.retention.time=2h",
+		"--storage.tsdb.retention.size=512MB",
+		"--web.enable-lifecycle",
+	}
+	if d := cmp.Diff(expectedArgs, c.Args()); len(d) > 0 {
+		t.Fatal(d)
+	}
+
+	expected := `global:
+  scrape_interval: 5s
+  external_labels:
+    env: test
+scrape_configs:
+- job_name: prometheus
+  file_sd_configs:
+  - files:
+    - prometheus.*.json
+    refresh_interval: 1s
+`
+	if d := cmp.Diff(expected, c.Files()["prometheus.yml"]); len(d) > 0 {
+		t.Fatal(d)
+	}
+}
@@ -0,0 +1,181 @@
+package pushgateway
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type Ports struct {
+	HTTP int
+}
+
+var PortNames = struct {
+	HTTP string
+}{
+	"http",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP: 9091,
+	}
+}
+
+// RunnerPorts uses Kind "pushgateway", which is also the name of the scrape
+// job in ScrapeConfig, so that a MonitoredEnv picks up Pushgateway targets.
+func (c Ports) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "pushgateway",
+		NameOrder: []string{
+			PortNames.HTTP,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// Descriptor describes the Pushgateway for the yurt service registry.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "pushgateway",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/metrics"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/-/healthy"},
+		{Port: PortNames.HTTP, Path: "/-/ready"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// ScrapeConfig is the Prometheus job used to scrape the Pushgateway.  Labels
+// are honored so that pushed metrics keep their job and instance labels,
+// rather than getting those of the Pushgateway.
+var ScrapeConfig = prometheus.ScrapeConfig{
+	JobName:     "pushgateway",
+	HonorLabels: true,
+}
+
+// Config describes how to run a Pushgateway, which holds metrics pushed by
+// short-lived processes such as Nomad batch jobs until Prometheus scrapes
+// them.
+type Config struct {
+	Common runner.Config
+}
+
+func (c Config) Config() runner.Config {
+	return c.Common
+}
+
+func (c Config) Name() string {
+	return "pushgateway"
+}
+
+func NewConfig() Config {
+	return Config{
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (c Config) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func (c Config) Args() []string {
+	port := c.Common.Ports.ByName[PortNames.HTTP].Number
+	addr := "127.0.0.1"
+	if c.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	return []string{
+		fmt.Sprintf("--web.listen-address=%s:%d", addr, port),
+	}
+}
+
+func (c Config) Env() []string {
+	return nil
+}
+
+func (c Config) Files() map[string]string {
+	return nil
+}
+
+// HealthCheck waits until the Pushgateway at addr, e.g.
+// http://127.0.0.1:9091, is ready to accept pushes.
+func HealthCheck(ctx context.Context, addr string) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, addr+"/-/ready", nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("ready status %d", resp.StatusCode)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// PushURL returns the URL to push metrics for job to, grouped by the given
+// labels, e.g. so that a batch job can do
+//
+//	curl --data-binary @metrics.txt <url>
+func PushURL(addr, job string, grouping map[string]string) string {
+	path := []string{"metrics", "job", url.PathEscape(job)}
+	var names []string
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path = append(path, url.PathEscape(name), url.PathEscape(grouping[name]))
+	}
+	return addr + "/" + strings.Join(path, "/")
+}
+
+// Push replaces the metrics of the group given by job and grouping with
+// metrics, which are in the Prometheus text exposition format.
+func Push(ctx context.Context, addr, job string, grouping map[string]string, metrics string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, PushURL(addr, job, grouping), strings.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push to %s: status %d: %s", req.URL, resp.StatusCode, body)
+	}
+	return nil
+}
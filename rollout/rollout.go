@@ -0,0 +1,186 @@
+// Package rollout restarts the hosts of a yurt-run fleet one at a time,
+// waiting for the Consul and Nomad clusters to be healthy between hosts.
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/nomad"
+	"github.com/ncabatoff/yurt/runner"
+	"gopkg.in/yaml.v2"
+)
+
+// Host is a machine running yurt-run.
+type Host struct {
+	Name string `yaml:"name"`
+	// IP is the address the Consul and Nomad agents listen on.
+	IP string `yaml:"ip"`
+	// RestartCommand is run locally to restart (and possibly upgrade) yurt-run
+	// on the host, e.g. ["ssh", "host1", "sudo systemctl restart yurt-run"].
+	RestartCommand []string `yaml:"restart_command"`
+}
+
+// TLS gives the files needed to talk to agents whose HTTP APIs use TLS, as
+// when yurt-run is run with -tls.
+type TLS struct {
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate to present, needed
+	// only if the agents verify incoming HTTPS connections.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+}
+
+// Inventory describes a yurt-run fleet.
+type Inventory struct {
+	// ConsulServerIPs must match what the hosts' yurt-run was configured with.
+	ConsulServerIPs []string `yaml:"consul_server_ips"`
+	Hosts           []Host   `yaml:"hosts"`
+	// TLS, if given, makes us use HTTPS to talk to the agents.
+	TLS *TLS `yaml:"tls,omitempty"`
+}
+
+func LoadInventory(path string) (*Inventory, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inventory: %w", err)
+	}
+
+	var inv Inventory
+	if err := yaml.Unmarshal(contents, &inv); err != nil {
+		return nil, fmt.Errorf("error parsing inventory: %w", err)
+	}
+	return &inv, nil
+}
+
+// DefaultHealthTimeout is used when Options.HealthTimeout isn't set.
+const DefaultHealthTimeout = 5 * time.Minute
+
+type Options struct {
+	// HealthTimeout bounds how long to wait for the clusters to become healthy
+	// after restarting each host, default DefaultHealthTimeout.
+	HealthTimeout time.Duration
+	// Restart restarts yurt-run on host.  If nil, host.RestartCommand is run.
+	Restart func(ctx context.Context, host Host) error
+}
+
+// Run restarts each host in turn.  Before each restart, and after the last, the
+// clusters must be healthy; if they aren't within HealthTimeout, Run stops and
+// returns an error without touching the remaining hosts.
+func Run(ctx context.Context, inv Inventory, opts Options) error {
+	restart := opts.Restart
+	if restart == nil {
+		restart = runRestartCommand
+	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = DefaultHealthTimeout
+	}
+
+	if err := waitHealthy(ctx, inv, nil, opts.HealthTimeout); err != nil {
+		return fmt.Errorf("fleet not healthy before starting rollout: %w", err)
+	}
+	for i, host := range inv.Hosts {
+		log.Printf("restarting host %d/%d: %s", i+1, len(inv.Hosts), host.Name)
+		if err := restart(ctx, host); err != nil {
+			return fmt.Errorf("error restarting %s: %w", host.Name, err)
+		}
+		if err := waitHealthy(ctx, inv, &host, opts.HealthTimeout); err != nil {
+			return fmt.Errorf("fleet not healthy after restarting %s: %w", host.Name, err)
+		}
+	}
+	return nil
+}
+
+func runRestartCommand(ctx context.Context, host Host) error {
+	if len(host.RestartCommand) == 0 {
+		return fmt.Errorf("no restart_command given")
+	}
+	cmd := exec.CommandContext(ctx, host.RestartCommand[0], host.RestartCommand[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// waitHealthy waits until the Consul and Nomad servers agree on a leader and
+// have all the expected peers, and if host is given, until its agents respond.
+func waitHealthy(ctx context.Context, inv Inventory, host *Host, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var consulAPIs, nomadAPIs []runner.LeaderPeersAPI
+	var consulPeers, nomadPeers []string
+	for _, ip := range inv.ConsulServerIPs {
+		cc, nc, err := clients(ip, inv.TLS)
+		if err != nil {
+			return err
+		}
+		consulAPIs = append(consulAPIs, cc.Status())
+		nomadAPIs = append(nomadAPIs, nc.Status())
+		consulPeers = append(consulPeers, fmt.Sprintf("%s:%d", ip, consul.DefPorts().Server))
+		nomadPeers = append(nomadPeers, fmt.Sprintf("%s:%d", ip, nomad.DefPorts().RPC))
+	}
+
+	if err := runner.LeaderPeerAPIsHealthy(ctx, consulAPIs, consulPeers); err != nil {
+		return fmt.Errorf("consul: %w", err)
+	}
+	if err := runner.LeaderPeerAPIsHealthy(ctx, nomadAPIs, nomadPeers); err != nil {
+		return fmt.Errorf("nomad: %w", err)
+	}
+	if host == nil {
+		return nil
+	}
+
+	cc, nc, err := clients(host.IP, inv.TLS)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		_, err = cc.Agent().Self()
+		if err == nil {
+			_, err = nc.Agent().Self()
+		}
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("agents on %s not responding: %w", host.Name, err)
+}
+
+// clients returns API clients for the agents at ip.  With TLS, the agents'
+// certificates are verified against the CA, which works because yurt-run
+// issues them for the agent's IP.
+func clients(ip string, tls *TLS) (*consulapi.Client, *nomadapi.Client, error) {
+	ccfg := consulapi.DefaultNonPooledConfig()
+	ccfg.Address = fmt.Sprintf("%s:%d", ip, consul.DefPorts().HTTP)
+	ncfg := nomadapi.DefaultConfig()
+	ncfg.Address = fmt.Sprintf("http://%s:%d", ip, nomad.DefPorts().HTTP)
+	if tls != nil {
+		ccfg.Scheme = "https"
+		ccfg.TLSConfig.CAFile = tls.CAFile
+		ccfg.TLSConfig.CertFile = tls.CertFile
+		ccfg.TLSConfig.KeyFile = tls.KeyFile
+		ncfg.Address = fmt.Sprintf("https://%s:%d", ip, nomad.DefPorts().HTTP)
+		ncfg.TLSConfig.CACert = tls.CAFile
+		ncfg.TLSConfig.ClientCert = tls.CertFile
+		ncfg.TLSConfig.ClientKey = tls.KeyFile
+	}
+
+	cc, err := consulapi.NewClient(ccfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	nc, err := nomadapi.NewClient(ncfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cc, nc, nil
+}
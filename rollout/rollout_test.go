@@ -0,0 +1,140 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt/consul"
+	"github.com/ncabatoff/yurt/nomad"
+)
+
+// fakeAgent serves the status and agent endpoints used by waitHealthy on
+// port of 127.0.0.1, as if it were a server whose raft address is raftAddr
+// in a single node cluster.  The test is skipped if the port is in use.
+func fakeAgent(t *testing.T, port int, raftAddr string, useTLS bool) *httptest.Server {
+	t.Helper()
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Skipf("can't listen on agent port: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp interface{}
+		switch r.URL.Path {
+		case "/v1/status/leader":
+			resp = raftAddr
+		case "/v1/status/peers":
+			resp = []string{raftAddr}
+		case "/v1/agent/self":
+			resp = map[string]interface{}{}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func fakeFleet(t *testing.T, useTLS bool) Inventory {
+	consulSrv := fakeAgent(t, consul.DefPorts().HTTP, fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().Server), useTLS)
+	fakeAgent(t, nomad.DefPorts().HTTP, fmt.Sprintf("127.0.0.1:%d", nomad.DefPorts().RPC), useTLS)
+	inv := Inventory{
+		ConsulServerIPs: []string{"127.0.0.1"},
+		Hosts:           []Host{{Name: "a", IP: "127.0.0.1"}, {Name: "b", IP: "127.0.0.1"}},
+	}
+	if useTLS {
+		// Both servers use the same httptest certificate.
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: consulSrv.Certificate().Raw})
+		if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+			t.Fatal(err)
+		}
+		inv.TLS = &TLS{CAFile: caFile}
+	}
+	return inv
+}
+
+func testRun(t *testing.T, useTLS bool) {
+	inv := fakeFleet(t, useTLS)
+	var restarted []string
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// No HealthTimeout: the default must apply rather than an expired one.
+	err := Run(ctx, inv, Options{
+		Restart: func(ctx context.Context, host Host) error {
+			restarted = append(restarted, host.Name)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted) != 2 || restarted[0] != "a" || restarted[1] != "b" {
+		t.Fatalf("expected hosts a and b to be restarted in order, got %v", restarted)
+	}
+}
+
+func TestRun(t *testing.T) {
+	testRun(t, false)
+}
+
+func TestRunTLS(t *testing.T) {
+	testRun(t, true)
+}
+
+// TestRunUnhealthy verifies that no host is restarted when the fleet isn't
+// healthy to begin with.
+func TestRunUnhealthy(t *testing.T) {
+	inv := fakeFleet(t, false)
+	inv.ConsulServerIPs = append(inv.ConsulServerIPs, "127.0.0.1")
+	err := Run(context.Background(), inv, Options{
+		HealthTimeout: 500 * time.Millisecond,
+		Restart: func(ctx context.Context, host Host) error {
+			t.Fatalf("unexpected restart of %s", host.Name)
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error from unhealthy fleet")
+	}
+}
+
+func TestLoadInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.yaml")
+	contents := `
+consul_server_ips: [10.0.0.1]
+hosts:
+- name: host1
+  ip: 10.0.0.1
+  restart_command: [ssh, host1, sudo systemctl restart yurt-run]
+tls:
+  ca_file: ca.pem
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Hosts) != 1 || len(inv.Hosts[0].RestartCommand) != 3 || inv.TLS == nil || inv.TLS.CAFile != "ca.pem" {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+}
@@ -0,0 +1,169 @@
+package runenv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/ncabatoff/yurt/vault"
+)
+
+// CAService provides a Vault-backed CA to be shared by many clusters or
+// tests in a process, rather than each of them running a Vault of its own
+// just to mint certificates.  The single node Vault behind the CA is only
+// started by the first call to Acquire, and is stopped once every Acquire
+// has been matched by a call to Release.
+type CAService struct {
+	// Env is where the Vault node runs.  If nil, an ExecEnv in a temp dir is
+	// created for it, and removed on teardown.
+	Env Env
+	// FirstPort is the first port used by the ExecEnv created if Env is nil.
+	FirstPort int
+
+	l    sync.Mutex
+	refs int
+	ca   *pki.CertificateAuthority
+	cli  *vaultapi.Client
+	stop func()
+}
+
+// SharedCA is the CAService used by test packages, running in its own
+// ExecEnv.
+var SharedCA = &CAService{FirstPort: 30000}
+
+// Acquire returns the CA, creating it if this is the first reference.  Each
+// successful call must be matched by a call to Release.  ctx only bounds the
+// creation of the CA; once created it lives until the last Release.
+func (s *CAService) Acquire(ctx context.Context) (*pki.CertificateAuthority, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.refs == 0 {
+		if err := s.start(ctx); err != nil {
+			return nil, err
+		}
+	}
+	s.refs++
+	return s.ca, nil
+}
+
+// Client returns a root token client of the Vault behind the CA, or nil if
+// the CA hasn't been acquired.
+func (s *CAService) Client() *vaultapi.Client {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.cli
+}
+
+// Release drops a reference obtained by Acquire, stopping the Vault behind
+// the CA if it was the last one.
+func (s *CAService) Release() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.refs == 0 {
+		return
+	}
+	s.refs--
+	if s.refs == 0 {
+		s.stop()
+		s.ca, s.cli, s.stop = nil, nil, nil
+	}
+}
+
+func (s *CAService) start(ctx context.Context) (err error) {
+	e := s.Env
+	var cleanup []func()
+	teardown := func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			teardown()
+		}
+	}()
+
+	if e == nil {
+		workDir, err := ioutil.TempDir("", "yurt-ca")
+		if err != nil {
+			return err
+		}
+		cleanup = append(cleanup, func() { _ = os.RemoveAll(workDir) })
+
+		// The env outlives ctx, which only bounds creation.
+		ectx, cancel := context.WithCancel(context.Background())
+		ee, err := NewExecEnv(ectx, "yurt-ca", workDir, s.FirstPort, binaries.Default)
+		if err != nil {
+			cancel()
+			return err
+		}
+		cleanup = append(cleanup, func() {
+			cancel()
+			_ = ee.Group.Wait()
+		})
+		e = ee
+	}
+
+	h, cli, err := startCAVault(ctx, e)
+	if h != nil {
+		cleanup = append(cleanup, func() { _ = h.Stop() })
+	}
+	if err != nil {
+		return fmt.Errorf("error starting vault for CA: %w", err)
+	}
+
+	ca, err := pki.NewCertificateAuthority(cli)
+	if err != nil {
+		return err
+	}
+	ca.Events = EventBus(e)
+
+	s.ca, s.cli, s.stop = ca, cli, teardown
+	return nil
+}
+
+// startCAVault runs an initialized and unsealed single node Vault in e,
+// returning its harness, which is non-nil if it was started even if an error
+// occurred afterwards, and a root token client.
+func startCAVault(ctx context.Context, e Env) (runner.Harness, *vaultapi.Client, error) {
+	node, err := e.AllocNode("yurt-ca-vault-srv", vault.DefPorts().RunnerPorts())
+	if err != nil {
+		return nil, nil, err
+	}
+	joinAddr, err := node.Address(vault.PortNames.HTTP)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The node must outlive ctx, which only bounds waiting for it to be ready.
+	h, err := e.Run(e.Context(), vault.NewRaftConfig([]string{joinAddr}, nil, 0), node)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.Go(h.Wait)
+
+	cli, err := vault.HarnessToAPI(h)
+	if err != nil {
+		return h, nil, err
+	}
+	if _, err := vault.Status(ctx, cli); err != nil {
+		return h, nil, err
+	}
+	rootToken, keys, err := vault.Initialize(ctx, cli, nil)
+	if err != nil {
+		return h, nil, err
+	}
+	if err := vault.Unseal(ctx, cli, keys[0], false); err != nil {
+		return h, nil, err
+	}
+	cli.SetToken(rootToken)
+	if err := vault.LeadersHealthy(ctx, []runner.Harness{h}); err != nil {
+		return h, nil, err
+	}
+	return h, cli, nil
+}
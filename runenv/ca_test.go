@@ -0,0 +1,58 @@
+package runenv
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestCAServiceRefCount verifies that the Vault behind a CAService is
+// started by the first Acquire, shared by later ones, and stopped by the
+// last Release, after which it can be acquired anew.
+func TestCAServiceRefCount(t *testing.T) {
+	s := &CAService{FirstPort: 31000}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ca1, err := s.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+	ca2, err := s.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca1 != ca2 {
+		t.Fatal("expected the second Acquire to share the first's CA")
+	}
+	cli := s.Client()
+	if cli == nil {
+		t.Fatal("expected a client once acquired")
+	}
+
+	// The CA must outlive the ctx passed to Acquire.
+	cancel()
+	s.Release()
+	if _, err := ca1.ConsulServerTLS(context.Background(), "127.0.0.1", "1h"); err != nil {
+		t.Fatalf("expected the CA to work with a reference left: %v", err)
+	}
+
+	s.Release()
+	if s.Client() != nil {
+		t.Fatal("expected no client after the last Release")
+	}
+	if _, err := cli.Sys().Health(); err == nil {
+		t.Fatal("expected Vault to be stopped after the last Release")
+	}
+	// Extra releases are ignored.
+	s.Release()
+
+	ca3, err := s.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca3 == ca1 {
+		t.Fatal("expected a new CA after the last Release")
+	}
+}
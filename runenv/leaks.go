@@ -0,0 +1,204 @@
+package runenv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Leaks describes what an env left behind once it was done, other than the
+// nodes it was asked to keep.
+type Leaks struct {
+	// Processes lists exec nodes whose process is still running.
+	Processes []string
+	// Containers lists yurt containers still running on a docker env's
+	// network.
+	Containers []string
+	// Goroutines holds the stacks of goroutines started since the env was
+	// created that are still running.
+	Goroutines []string
+}
+
+func (l Leaks) Empty() bool {
+	return len(l.Processes)+len(l.Containers)+len(l.Goroutines) == 0
+}
+
+func (l Leaks) String() string {
+	var sb strings.Builder
+	if len(l.Processes) > 0 {
+		fmt.Fprintf(&sb, "leaked processes: %s\n", strings.Join(l.Processes, ", "))
+	}
+	if len(l.Containers) > 0 {
+		fmt.Fprintf(&sb, "leaked containers: %s\n", strings.Join(l.Containers, ", "))
+	}
+	if len(l.Goroutines) > 0 {
+		fmt.Fprintf(&sb, "leaked %d goroutine(s):\n\n%s\n", len(l.Goroutines), strings.Join(l.Goroutines, "\n\n"))
+	}
+	return sb.String()
+}
+
+// leakFinder is implemented by envs that can find the resources they leaked.
+type leakFinder interface {
+	findLeaks(ctx context.Context) (Leaks, error)
+}
+
+// findLeaks returns the processes of nodes that weren't kept that are still
+// running.
+func (b *BaseEnv) findLeaks(ctx context.Context) (Leaks, error) {
+	var leaks Leaks
+	for _, name := range b.NodeNames() {
+		if b.registry.isKept(name) {
+			continue
+		}
+		h, ok := b.Harness(name)
+		if !ok {
+			continue
+		}
+		p, ok := h.(interface{ Pid() int })
+		if !ok {
+			continue
+		}
+		if pid := p.Pid(); processAlive(pid) {
+			leaks.Processes = append(leaks.Processes, fmt.Sprintf("%s (pid %d)", name, pid))
+		}
+	}
+	return leaks, nil
+}
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// findLeaks returns the running containers on the env's network that weren't
+// kept.
+func (d *DockerEnv) findLeaks(ctx context.Context) (Leaks, error) {
+	var leaks Leaks
+	conts, err := d.DockerAPI.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", "yurt"),
+			filters.Arg("network", d.NetConf.DockerNetName),
+		),
+	})
+	if err != nil {
+		return leaks, err
+	}
+	for _, c := range conts {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if !d.registry.isKept(name) {
+			leaks.Containers = append(leaks.Containers, name)
+		}
+	}
+	return leaks, nil
+}
+
+// goroutineIDs returns the IDs of the running goroutines, mapped to their
+// stacks.
+func goroutineIDs() map[int]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	ids := map[int]string{}
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		// Each stack starts with a line like "goroutine 7 [running]:".
+		fields := strings.Fields(string(g))
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[1]); err == nil {
+			ids[id] = string(g)
+		}
+	}
+	return ids
+}
+
+// ignoredGoroutines match the stacks of goroutines that outlive envs
+// legitimately, e.g. those of idle pooled HTTP connections.
+var ignoredGoroutines = []string{
+	"net/http.(*persistConn)",
+	"net/http.(*Transport).dialConnFor",
+	"runenv.goroutineIDs",
+	"testing.(*T).Run",
+	"testing.tRunner",
+	"os/signal.signal_recv",
+}
+
+// leakedGoroutines returns the stacks of the goroutines running that aren't
+// in baseline and aren't ignored.
+func leakedGoroutines(baseline map[int]string) []string {
+	var leaked []int
+	current := goroutineIDs()
+outer:
+	for id, stack := range current {
+		if _, ok := baseline[id]; ok {
+			continue
+		}
+		for _, ign := range ignoredGoroutines {
+			if strings.Contains(stack, ign) {
+				continue outer
+			}
+		}
+		leaked = append(leaked, id)
+	}
+	sort.Ints(leaked)
+	var stacks []string
+	for _, id := range leaked {
+		stacks = append(stacks, current[id])
+	}
+	return stacks
+}
+
+// CheckLeaks looks for what e left behind, other than the nodes it was asked
+// to keep, along with any goroutines started since baseline was taken using
+// GoroutineBaseline.  It should be called once e's group has finished.
+// Since cleanup is partly asynchronous, it keeps looking for up to grace
+// before reporting leaks.
+func CheckLeaks(e Env, baseline map[int]string, grace time.Duration) (Leaks, error) {
+	lf, ok := e.(leakFinder)
+	deadline := time.Now().Add(grace)
+	for {
+		var leaks Leaks
+		if ok {
+			var err error
+			leaks, err = lf.findLeaks(context.Background())
+			if err != nil {
+				return leaks, err
+			}
+		}
+		if baseline != nil {
+			leaks.Goroutines = leakedGoroutines(baseline)
+		}
+		if leaks.Empty() || time.Now().After(deadline) {
+			return leaks, nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// GoroutineBaseline records the running goroutines, for CheckLeaks.
+func GoroutineBaseline() map[int]string {
+	return goroutineIDs()
+}
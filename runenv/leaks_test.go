@@ -0,0 +1,133 @@
+package runenv
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+func TestGoroutineIDs(t *testing.T) {
+	ids := goroutineIDs()
+	found := false
+	for _, stack := range ids {
+		if strings.Contains(stack, "TestGoroutineIDs") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected our own goroutine among %d", len(ids))
+	}
+}
+
+func TestLeakedGoroutines(t *testing.T) {
+	baseline := GoroutineBaseline()
+	if leaked := leakedGoroutines(baseline); len(leaked) != 0 {
+		t.Fatalf("expected no leaks yet, got %v", leaked)
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		<-done
+		close(exited)
+	}()
+	leaked := leakedGoroutines(baseline)
+	if len(leaked) != 1 || !strings.Contains(leaked[0], "TestLeakedGoroutines") {
+		t.Fatalf("expected the goroutine started to be leaked, got %v", leaked)
+	}
+
+	close(done)
+	<-exited
+	leaks, err := CheckLeaks(nil, baseline, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaks.Empty() {
+		t.Fatalf("expected no leaks once the goroutine exited, got %s", leaks)
+	}
+}
+
+// pidHarness is a harness for a process started outside of the env.
+type pidHarness struct {
+	cmd *exec.Cmd
+}
+
+var _ runner.Harness = pidHarness{}
+
+func (h pidHarness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
+	return nil, nil
+}
+
+func (h pidHarness) Stop() error {
+	h.Kill()
+	return nil
+}
+
+func (h pidHarness) Kill() {
+	_ = h.cmd.Process.Kill()
+}
+
+func (h pidHarness) Wait() error {
+	return nil
+}
+
+func (h pidHarness) Pid() int {
+	return h.cmd.Process.Pid
+}
+
+func startPid(t *testing.T, b *BaseEnv, name string) pidHarness {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can't run sleep: %v", err)
+	}
+	// Reap it, lest it linger as a zombie that still looks alive.
+	go func() { _ = cmd.Wait() }()
+	h := pidHarness{cmd}
+	t.Cleanup(h.Kill)
+	b.registry.addHarness(yurt.Node{Name: name}, h)
+	return h
+}
+
+func TestCheckLeaksProcesses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := NewExecEnv(ctx, t.Name(), t.TempDir(), 18000, binaries.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaked := startPid(t, &e.BaseEnv, "consul-srv-1")
+	startPid(t, &e.BaseEnv, "consul-srv-2")
+	e.registry.addKept("consul-srv-2")
+
+	leaks, err := CheckLeaks(e, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks.Processes) != 1 || !strings.HasPrefix(leaks.Processes[0], "consul-srv-1 ") {
+		t.Fatalf("expected consul-srv-1 to be leaked and consul-srv-2 kept, got %s", leaks)
+	}
+	if !strings.Contains(leaks.String(), "leaked processes: consul-srv-1") {
+		t.Fatalf("unexpected report %q", leaks)
+	}
+
+	// CheckLeaks allows for processes that take a while to exit.
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		leaked.Kill()
+	}()
+	leaks, err = CheckLeaks(e, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaks.Empty() {
+		t.Fatalf("expected no leaks once the process exited, got %s", leaks)
+	}
+}
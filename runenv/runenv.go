@@ -4,11 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,13 +22,22 @@ import (
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/ncabatoff/yurt"
 	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/blackboxexporter"
+	"github.com/ncabatoff/yurt/chaos"
 	"github.com/ncabatoff/yurt/consul"
 	"github.com/ncabatoff/yurt/docker"
+	"github.com/ncabatoff/yurt/events"
+	"github.com/ncabatoff/yurt/images"
+	"github.com/ncabatoff/yurt/minio"
+	"github.com/ncabatoff/yurt/nodeexporter"
 	"github.com/ncabatoff/yurt/nomad"
 	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/pushgateway"
 	"github.com/ncabatoff/yurt/runner"
 	dockerrunner "github.com/ncabatoff/yurt/runner/docker"
 	"github.com/ncabatoff/yurt/runner/exec"
+	"github.com/ncabatoff/yurt/thanos"
+	"github.com/ncabatoff/yurt/util"
 	"github.com/ncabatoff/yurt/vault"
 	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
@@ -41,6 +55,13 @@ type Env interface {
 	AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error)
 	Context() context.Context
 	Go(f func() error)
+	// Node returns the node allocated with the given name, if any.
+	Node(name string) (yurt.Node, bool)
+	// Harness returns the harness most recently started for the named node,
+	// if any.
+	Harness(name string) (runner.Harness, bool)
+	// NodeNames returns the names of all the nodes allocated, sorted.
+	NodeNames() []string
 }
 
 type BaseEnv struct {
@@ -51,12 +72,162 @@ type BaseEnv struct {
 	// The env terminates as soon as Ctx is done or a member of the group returns
 	// an error.
 	*errgroup.Group
+	// Events, if non-nil, receives events about the nodes started.
+	Events   *events.Bus
+	registry *nodeRegistry
 }
 
 func (b *BaseEnv) Context() context.Context {
 	return b.Ctx
 }
 
+func (b *BaseEnv) EventBus() *events.Bus {
+	return b.Events
+}
+
+// EventBus returns the bus e publishes events to, or nil if there's none;
+// publishing to a nil bus does nothing.
+func EventBus(e Env) *events.Bus {
+	if eb, ok := e.(interface{ EventBus() *events.Bus }); ok {
+		return eb.EventBus()
+	}
+	return nil
+}
+
+// watch publishes a NodeStarted event for the node started as h, and unless
+// it's kept, a NodeExited event once it exits.
+func (b *BaseEnv) watch(node yurt.Node, h runner.Harness, keep bool) {
+	if b.Events == nil {
+		return
+	}
+	b.Events.Publish(events.Event{Kind: events.NodeStarted, Node: node.Name, Message: "host=" + node.Host})
+	if keep {
+		return
+	}
+	go func() {
+		err := h.Wait()
+		b.Events.Publish(events.Event{Kind: events.NodeExited, Node: node.Name, Err: err})
+	}()
+}
+
+// nodeRegistry tracks the nodes and harnesses created by an env by name.
+type nodeRegistry struct {
+	l         sync.Mutex
+	nodes     map[string]yurt.Node
+	harnesses map[string]runner.Harness
+	// keep lists the services whose nodes should be left running once the
+	// env is done, and kept the names of the nodes started that way.
+	keep []string
+	kept []string
+	// cleanups are run once the env is done, before its workdir is removed.
+	cleanups []func()
+}
+
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{
+		nodes:     map[string]yurt.Node{},
+		harnesses: map[string]runner.Harness{},
+	}
+}
+
+func (r *nodeRegistry) addCleanup(f func()) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.cleanups = append(r.cleanups, f)
+}
+
+func (r *nodeRegistry) addNode(node yurt.Node) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.nodes[node.Name] = node
+}
+
+func (r *nodeRegistry) addHarness(node yurt.Node, h runner.Harness) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if _, ok := r.nodes[node.Name]; !ok {
+		r.nodes[node.Name] = node
+	}
+	r.harnesses[node.Name] = h
+}
+
+// keeps returns true if the node named name matches one of the services
+// passed to Keep.
+func (r *nodeRegistry) keeps(name string) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, k := range r.keep {
+		if k == "*" || name == k || strings.HasPrefix(name, k+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *nodeRegistry) addKept(name string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.kept = append(r.kept, name)
+}
+
+func (r *nodeRegistry) isKept(name string) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, k := range r.kept {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep selects services that shouldn't be stopped when the env is done, e.g.
+// so that they can be inspected after a test.  Each entry is either a node
+// name like "consul-srv-1", or a node base name like "consul-srv", matching
+// all nodes allocated with it, or "*" to keep every node.  Only nodes started
+// after the call are kept.
+// If any nodes are kept, WorkDir isn't removed either.
+func (b *BaseEnv) Keep(services ...string) {
+	b.registry.l.Lock()
+	defer b.registry.l.Unlock()
+	b.registry.keep = append(b.registry.keep, services...)
+}
+
+// Kept returns the names of the nodes that were started so as to keep running
+// once the env is done.
+func (b *BaseEnv) Kept() []string {
+	b.registry.l.Lock()
+	defer b.registry.l.Unlock()
+	kept := append([]string(nil), b.registry.kept...)
+	sort.Strings(kept)
+	return kept
+}
+
+func (b *BaseEnv) Node(name string) (yurt.Node, bool) {
+	b.registry.l.Lock()
+	defer b.registry.l.Unlock()
+	node, ok := b.registry.nodes[name]
+	return node, ok
+}
+
+func (b *BaseEnv) Harness(name string) (runner.Harness, bool) {
+	b.registry.l.Lock()
+	defer b.registry.l.Unlock()
+	h, ok := b.registry.harnesses[name]
+	return h, ok
+}
+
+func (b *BaseEnv) NodeNames() []string {
+	b.registry.l.Lock()
+	defer b.registry.l.Unlock()
+	var names []string
+	for name := range b.registry.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func NewBaseEnv(ctx context.Context, workDir string) (*BaseEnv, error) {
 	if workDir == "" {
 		tmpDir, err := ioutil.TempDir("", "yurt-env")
@@ -71,16 +242,29 @@ func NewBaseEnv(ctx context.Context, workDir string) (*BaseEnv, error) {
 		return nil, err
 	}
 	g, ctx := errgroup.WithContext(ctx)
+	registry := newNodeRegistry()
 	g.Go(func() error {
 		<-ctx.Done()
+		registry.l.Lock()
+		kept := len(registry.kept)
+		cleanups := registry.cleanups
+		registry.l.Unlock()
+		if kept > 0 {
+			// Kept nodes still need their config and data.
+			return nil
+		}
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
 		// TODO add retries to handle slow exiters
 		_ = os.RemoveAll(absDir)
 		return nil
 	})
 	return &BaseEnv{
-		WorkDir: absDir,
-		Ctx:     ctx,
-		Group:   g,
+		WorkDir:  absDir,
+		Ctx:      ctx,
+		Group:    g,
+		registry: registry,
 	}, nil
 }
 
@@ -90,6 +274,61 @@ type ExecEnv struct {
 	nodes      *atomic.Int32
 	binmgr     binaries.Manager
 	LogToFiles bool
+	// Versions overrides the binary version used to run commands, keyed by
+	// command name, e.g. {"consul": "1.10.6"}.  A version requested using
+	// runner.WithVersion, e.g. by a VersionedEnv, takes precedence.
+	Versions map[string]string
+	// Output, if set, returns where the output of cmd run on node goes when
+	// it isn't logged to a file, see exec.ExecRunner.Output.
+	Output func(cmd runner.Command, node yurt.Node) io.Writer
+	// DataDirLimits limits the size of the data dirs of nodes whose names
+	// match its keys, path.Match patterns such as "*-consul-srv-1", to the
+	// number of bytes given, using chaos.LimitDir.  This requires root; see
+	// chaos.FillDataDir for provoking out-of-disk errors.
+	DataDirLimits map[string]int64
+	diskLimits    *diskLimits
+}
+
+// diskLimits tracks the data dirs limited by an ExecEnv, so that nodes
+// restarted in the same dir don't get limited twice.
+type diskLimits struct {
+	l      sync.Mutex
+	limits map[string]*chaos.DiskLimit
+}
+
+// dataDirLimit returns the limit in limits matching nodeName, or 0 if none.
+func dataDirLimit(limits map[string]int64, nodeName string) int64 {
+	for pattern, limit := range limits {
+		if ok, _ := path.Match(pattern, nodeName); ok {
+			return limit
+		}
+	}
+	return 0
+}
+
+// limitDataDir limits dir to size bytes unless it's been done already,
+// releasing the limit once the env is done, unless it has kept nodes.
+func (e ExecEnv) limitDataDir(dir string, size int64) error {
+	if e.diskLimits == nil {
+		return fmt.Errorf("DataDirLimits requires an ExecEnv created by NewExecEnv")
+	}
+	e.diskLimits.l.Lock()
+	defer e.diskLimits.l.Unlock()
+	if _, ok := e.diskLimits.limits[dir]; ok {
+		return nil
+	}
+	limit, err := chaos.LimitDir(dir, size)
+	if err != nil {
+		return err
+	}
+	e.diskLimits.limits[dir] = limit
+	// Release it before the workdir is removed, since the image is in there.
+	e.registry.addCleanup(func() {
+		if err := limit.Release(); err != nil {
+			log.Printf("error releasing data dir limit: %v", err)
+		}
+	})
+	return nil
 }
 
 var _ Env = &ExecEnv{}
@@ -104,68 +343,166 @@ func NewExecEnv(ctx context.Context, name, workDir string, firstPort int, binmgr
 		firstPort: atomic.NewInt32(int32(firstPort)),
 		nodes:     atomic.NewInt32(0),
 		binmgr:    binmgr,
+		diskLimits: &diskLimits{
+			limits: map[string]*chaos.DiskLimit{},
+		},
 	}, nil
 }
 
 func (e ExecEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
 	name := fmt.Sprintf("%s-%d", baseName, e.nodes.Add(1))
 	lastPort := e.firstPort.Add(int32(len(ports.NameOrder)))
-	return yurt.Node{
+	node := yurt.Node{
 		Name:  name,
 		Host:  "127.0.0.1",
 		Ports: ports.Sequential(int(lastPort) - len(ports.NameOrder)),
-	}, nil
+	}
+	e.registry.addNode(node)
+	return node, nil
+}
+
+// DumpStacks sends SIGQUIT to every running process started by the env,
+// writing the resulting Go stack dumps to dir/<node name>.stacks.  Processes
+// exit after dumping their stacks, so kept nodes (see Keep) are skipped.
+// Note that dir shouldn't be within WorkDir, since that gets removed when the
+// env is done.
+func (e ExecEnv) DumpStacks(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for _, name := range e.NodeNames() {
+		name := name
+		h, ok := e.Harness(name)
+		if !ok || e.registry.isKept(name) {
+			continue
+		}
+		eh, ok := h.(*exec.Harness)
+		if !ok {
+			continue
+		}
+		g.Go(func() error {
+			f, err := os.Create(filepath.Join(dir, name+".stacks"))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := eh.DumpStacks(f, 10*time.Second); err != nil {
+				return fmt.Errorf("error dumping stacks of %s: %w", name, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// ExecRunnerConfig returns the config an ExecEnv with the given workDir
+// would use to run cmd on node.
+func ExecRunnerConfig(workDir string, cmd runner.Command, node yurt.Node) runner.Config {
+	return runner.Config{
+		NodeName:  node.Name,
+		ConfigDir: filepath.Join(workDir, node.Name, "config"),
+		DataDir:   filepath.Join(workDir, node.Name, "data"),
+		LogDir:    filepath.Join(workDir, node.Name, "log"),
+		Ports:     node.Ports,
+		TLS:       cmd.Config().TLS,
+		ClientTLS: cmd.Config().ClientTLS,
+	}
 }
 
 func (e ExecEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
-	binPath, err := e.binmgr.Get(cmd.Name())
+	version := e.Versions[cmd.Name()]
+	if vc, ok := cmd.(runner.VersionedCommand); ok && vc.Version() != "" {
+		version = vc.Version()
+	}
+	binPath, err := e.binmgr.Get(cmd.Name(), version)
 	if err != nil {
 		return nil, err
 	}
 
+	if limit := dataDirLimit(e.DataDirLimits, node.Name); limit > 0 {
+		if err := e.limitDataDir(filepath.Join(e.WorkDir, node.Name, "data"), limit); err != nil {
+			return nil, fmt.Errorf("error limiting data dir of %s: %w", node.Name, err)
+		}
+	}
+
+	keep := e.registry.keeps(node.Name)
 	logDir := filepath.Join(e.WorkDir, node.Name, "log")
 	logName := ""
-	if e.LogToFiles {
+	if e.LogToFiles || keep {
 		logName = filepath.Join(logDir, fmt.Sprintf("%s-stdout.txt", time.Now().Format(time.RFC3339)))
 	}
 
-	r, err := exec.NewExecRunner(binPath, cmd, runner.Config{
-		NodeName:  node.Name,
-		ConfigDir: filepath.Join(e.WorkDir, node.Name, "config"),
-		DataDir:   filepath.Join(e.WorkDir, node.Name, "data"),
-		LogDir:    logDir,
-		Ports:     node.Ports,
-		TLS:       cmd.Config().TLS,
-	})
+	r, err := exec.NewExecRunner(binPath, cmd, ExecRunnerConfig(e.WorkDir, cmd, node))
 	if err != nil {
 		return nil, err
 	}
-	h, err := r.Start(ctx, logName)
+	if e.Output != nil {
+		r.Output = e.Output(cmd, node)
+	}
+	var h *exec.Harness
+	if keep {
+		h, err = r.StartDetached(ctx, logName)
+	} else {
+		h, err = r.Start(ctx, logName)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error starting server: %w", err)
 	}
+	if keep {
+		e.registry.addKept(node.Name)
+	}
+	e.registry.addHarness(node, h)
+	e.watch(node, h, keep)
 	return h, nil
 }
 
 type DockerEnv struct {
 	BaseEnv
-	BinMgr    binaries.Manager
+	BinMgr binaries.Manager
+	// Images resolves and pulls the images commands are run with.
+	Images    images.Manager
 	DockerAPI *dockerapi.Client
 	NetConf   yurt.NetworkConfig
 	baseCIDR  net.IPNet
 	curIPOct  *atomic.Int32
 	nodes     *atomic.Int32
+	// Versions overrides the image version used to run commands, keyed by
+	// command name, like ExecEnv.Versions.
+	Versions map[string]string
+	// LogConfig is the log driver config of the containers run.  It defaults
+	// to json-file logs rotated at 10MB, keeping 3 files, so that
+	// long-running envs don't fill the disk; nil means the daemon's default.
+	LogConfig *runner.LogConfig
+
+	// DataMount selects what's mounted at containers' data dirs: "tmpfs",
+	// "volume" for a docker volume per node, or "" to copy in a dir from
+	// WorkDir.  Volumes outlive their containers; see RemoveVolumes.
+	DataMount string
+	// DataDirLimits limits the size of the data dirs of nodes whose names
+	// match its keys, path.Match patterns like ExecEnv.DataDirLimits, by
+	// mounting a tmpfs of the number of bytes given, regardless of DataMount.
+	DataDirLimits map[string]int64
+
+	l sync.Mutex
+	// built maps command names to images created by BuildImage.
+	built map[string]string
+	// volumes are the names of the docker volumes created for data dirs.
+	volumes []string
 }
 
 func (d *DockerEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
 	name := fmt.Sprintf("%s-%d", baseName, d.nodes.Add(1))
 	i4 := sockaddr.ToIPv4Addr(d.NetConf.Network).NetIP().To4()
 	i4[3] = byte(d.curIPOct.Add(1))
-	return yurt.Node{
+	node := yurt.Node{
 		Name:  name,
 		Ports: ports.Sequential(17000),
 		Host:  i4.String(),
-	}, nil
+	}
+	d.registry.addNode(node)
+	return node, nil
 }
 
 func NewDockerEnv(ctx context.Context, binMgr binaries.Manager, name, workDir, cidr string) (*DockerEnv, error) {
@@ -201,41 +538,58 @@ func NewDockerEnv(ctx context.Context, binMgr binaries.Manager, name, workDir, c
 			Network:       sa,
 		},
 		DockerAPI: cli,
+		Images:    images.NewPullManager(cli, images.PullOptions{}),
 		nodes:     atomic.NewInt32(0),
 		curIPOct:  atomic.NewInt32(1),
+		LogConfig: &runner.LogConfig{
+			Driver:  "json-file",
+			Options: map[string]string{"max-size": "10m", "max-file": "3"},
+		},
 	}, nil
 }
 
 func (d *DockerEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
-	var image, cfg, data, logs string
-	switch cmd.Name() {
-	case "consul":
-		image = "consul:1.11.1"
-		cfg = "/consul/config"
-		data = "/consul/data"
-		logs = "/consul/logs"
-	case "nomad":
-		image = "noenv/nomad:0.10.3"
-		cfg = "/nomad/config"
-		data = "/nomad/data"
-		logs = "/nomad/logs"
-	case "vault":
-		image = "vault:1.9.2"
-		cfg = "/vault/config"
-		data = "/vault/file"
-		logs = "/vault/logs"
-	default:
+	desc, ok := yurt.LookupService(cmd.Name())
+	if !ok || desc.Docker == nil {
 		return nil, fmt.Errorf("unknown config %q", cmd.Name())
 	}
+	version := d.Versions[cmd.Name()]
+	if vc, ok := cmd.(runner.VersionedCommand); ok && vc.Version() != "" {
+		version = vc.Version()
+	}
+	d.l.Lock()
+	image, ok := d.built[cmd.Name()]
+	d.l.Unlock()
+	var err error
+	if !ok {
+		image, err = d.Images.Get(ctx, cmd.Name(), version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg, data, logs := desc.Docker.ConfigDir, desc.Docker.DataDir, desc.Docker.LogDir
 	var binary string
 	// Use a local vault while we wait to get our fixes merged
 	if d.BinMgr != nil && cmd.Name() == "vault" {
-		var err error
-		binary, err = d.BinMgr.GetOSArch(cmd.Name(), "linux", "arm64", "")
+		binary, err = d.BinMgr.GetOSArch(cmd.Name(), "linux", "arm64", version)
 		if err != nil {
 			return nil, err
 		}
 	}
+	var dataMount *runner.DataMount
+	limit := dataDirLimit(d.DataDirLimits, node.Name)
+	switch {
+	case limit > 0:
+		dataMount = &runner.DataMount{Type: "tmpfs", SizeBytes: limit}
+	case d.DataMount == "":
+	case d.DataMount == "volume":
+		dataMount = &runner.DataMount{Type: "volume", Name: dockerName(node.Name + "-data")}
+		d.l.Lock()
+		d.volumes = append(d.volumes, dataMount.Name)
+		d.l.Unlock()
+	default:
+		dataMount = &runner.DataMount{Type: d.DataMount}
+	}
 	nodeDir := filepath.Join(d.WorkDir, node.Name)
 	r, err := dockerrunner.NewDockerRunner(binary, nodeDir, d.DockerAPI, image, node.Host, cmd, runner.Config{
 		NodeName:      node.Name,
@@ -245,39 +599,243 @@ func (d *DockerEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node)
 		LogDir:        logs,
 		Ports:         node.Ports,
 		TLS:           cmd.Config().TLS,
+		ClientTLS:     cmd.Config().ClientTLS,
+		LogConfig:     d.LogConfig,
+		DataMount:     dataMount,
 	})
 	if err != nil {
 		return nil, err
 	}
-	h, err := r.Start(ctx)
+	r.Entrypoint = desc.Docker.Entrypoint
+	keep := d.registry.keeps(node.Name)
+	start := r.Start
+	if keep {
+		start = r.StartDetached
+	}
+	h, err := start(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error starting server: %w", err)
 	}
+	if keep {
+		d.registry.addKept(node.Name)
+	}
+	d.registry.addHarness(node, h)
+	d.watch(node, h, keep)
 	return h, nil
 }
 
 var _ Env = &DockerEnv{}
 
-func NewDockerTestEnv(t *testing.T, timeout time.Duration) (*DockerEnv, func()) {
+// BuildImage builds an image for commands named service from dockerfile,
+// which is given the build arg BASE, the image the env would otherwise run
+// service with, e.g.
+//
+//	ARG BASE
+//	FROM $BASE
+//	COPY prometheus /bin/prometheus
+//
+// The build context contains files, a map from file name to the host path to
+// copy it from.  Commands named service that are run afterwards use the
+// image, which is returned.
+func (d *DockerEnv) BuildImage(ctx context.Context, service, dockerfile string, files map[string]string) (string, error) {
+	base, err := d.Images.Get(ctx, service, d.Versions[service])
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(d.WorkDir, "images", service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		return "", err
+	}
+	for name, from := range files {
+		to := filepath.Join(dir, name)
+		if err := util.CopyFile(to, from); err != nil {
+			return "", err
+		}
+		// Preserve executability, which COPY does too.
+		if fi, err := os.Stat(from); err == nil {
+			if err := os.Chmod(to, fi.Mode()); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	tag := dockerName(d.NetConf.DockerNetName + "-" + service)
+	if err := docker.BuildImage(ctx, d.DockerAPI, dir, "Dockerfile", tag, map[string]string{"BASE": base}); err != nil {
+		return "", err
+	}
+
+	d.l.Lock()
+	defer d.l.Unlock()
+	if d.built == nil {
+		d.built = map[string]string{}
+	}
+	d.built[service] = tag
+	return tag, nil
+}
+
+// dockerName returns a name for a docker image or volume based on s, which
+// may contain characters docker doesn't allow in them, e.g. the slashes of
+// subtest names.  Image names must be lowercase too.
+func dockerName(s string) string {
+	return "yurt-" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(s))
+}
+
+// RemoveVolumes removes the data volumes created by the env.  Their
+// containers must have been removed first, so it retries for a while to
+// allow for containers still being removed after the env is done.
+func (d *DockerEnv) RemoveVolumes(ctx context.Context, timeout time.Duration) error {
+	d.l.Lock()
+	volumes := d.volumes
+	d.volumes = nil
+	d.l.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, name := range volumes {
+		for {
+			err := d.DockerAPI.VolumeRemove(ctx, name, true)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("error removing volume %s: %w", name, err)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Volumes returns the names of the data volumes created by the env.
+func (d *DockerEnv) Volumes() []string {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return append([]string(nil), d.volumes...)
+}
+
+// ExportCompose writes a docker-compose file recreating the env's containers
+// and network to w, see docker.ExportCompose.
+func (d *DockerEnv) ExportCompose(w io.Writer) error {
+	return docker.ExportCompose(d.Context(), d.DockerAPI, d.NetConf.DockerNetName, w)
+}
+
+// KeepEnvVar names the environment variable that selects services for test
+// envs to keep running after cleanup, as a comma-separated list of the form
+// accepted by BaseEnv.Keep.
+const KeepEnvVar = "YURT_KEEP"
+
+// DataMountEnvVar names the environment variable that sets the DataMount of
+// docker test envs.
+const DataMountEnvVar = "YURT_DOCKER_DATA_MOUNT"
+
+// KeepVolumesEnvVar names the environment variable that, if set to anything
+// but "" or "0", makes docker test envs keep their data volumes after
+// cleanup.  They're always kept if the test failed, so they can be inspected.
+const KeepVolumesEnvVar = "YURT_KEEP_VOLUMES"
+
+type testEnvOptions struct {
+	keep        []string
+	failOnLeaks bool
+}
+
+// TestEnvOption customizes the envs created by the New*TestEnv funcs.
+type TestEnvOption func(*testEnvOptions)
+
+// KeepServices makes the test env keep the given services running after
+// cleanup, in addition to any selected using KeepEnvVar.  See BaseEnv.Keep.
+func KeepServices(services ...string) TestEnvOption {
+	return func(o *testEnvOptions) {
+		o.keep = append(o.keep, services...)
+	}
+}
+
+// FailOnLeaks makes the test fail if the env leaves processes, containers or
+// goroutines behind once it's cleaned up, rather than just logging them.
+func FailOnLeaks() TestEnvOption {
+	return func(o *testEnvOptions) {
+		o.failOnLeaks = true
+	}
+}
+
+func newTestEnvOptions(opts []TestEnvOption) testEnvOptions {
+	var o testEnvOptions
+	for _, s := range strings.Split(os.Getenv(KeepEnvVar), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			o.keep = append(o.keep, s)
+		}
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// logKept tells the user about any nodes left running by a test env.
+func logKept(t *testing.T, b *BaseEnv) {
+	if kept := b.Kept(); len(kept) > 0 {
+		t.Logf("left running: %s; files are in %s", strings.Join(kept, ", "), b.WorkDir)
+	}
+}
+
+// reportLeaks tells the user about anything e left behind, see CheckLeaks.
+func reportLeaks(t *testing.T, e Env, baseline map[int]string, o testEnvOptions) {
+	leaks, err := CheckLeaks(e, baseline, 5*time.Second)
+	if err != nil {
+		t.Logf("error checking for leaks: %v", err)
+	}
+	if leaks.Empty() {
+		return
+	}
+	if o.failOnLeaks {
+		t.Error(leaks.String())
+	} else {
+		t.Log(leaks.String())
+	}
+}
+
+func NewDockerTestEnv(t *testing.T, timeout time.Duration, opts ...TestEnvOption) (*DockerEnv, func()) {
 	t.Helper()
+	baseline := GoroutineBaseline()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 
 	e, err := NewDockerEnv(ctx, binaries.Default, t.Name(), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	o := newTestEnvOptions(opts)
+	e.Keep(o.keep...)
+	e.DataMount = os.Getenv(DataMountEnvVar)
 	return e, func() {
 		cancel()
 		err := e.Group.Wait()
 		if err != nil {
 			t.Log(err)
 		}
+		logKept(t, &e.BaseEnv)
+		reportLeaks(t, e, baseline, o)
+		if volumes := e.Volumes(); len(volumes) > 0 {
+			if keep := os.Getenv(KeepVolumesEnvVar); t.Failed() || (keep != "" && keep != "0") {
+				t.Logf("kept volumes: %s", strings.Join(volumes, ", "))
+				return
+			}
+			if err := e.RemoveVolumes(context.Background(), 10*time.Second); err != nil {
+				t.Log(err)
+			}
+		}
 	}
 }
 
-func NewMonitoredExecTestEnv(t *testing.T, timeout time.Duration) (*MonitoredEnv, func()) {
+func NewMonitoredExecTestEnv(t *testing.T, timeout time.Duration, opts ...TestEnvOption) (*MonitoredEnv, func()) {
 	t.Helper()
-	e, cleanup := NewExecTestEnv(t, timeout)
+	e, cleanup := NewExecTestEnv(t, timeout, opts...)
 	m, err := NewMonitoredEnv(e, e)
 	if err != nil {
 		t.Fatal(err)
@@ -285,8 +843,9 @@ func NewMonitoredExecTestEnv(t *testing.T, timeout time.Duration) (*MonitoredEnv
 	return m, cleanup
 }
 
-func NewExecTestEnv(t *testing.T, timeout time.Duration) (*ExecEnv, func()) {
+func NewExecTestEnv(t *testing.T, timeout time.Duration, opts ...TestEnvOption) (*ExecEnv, func()) {
 	t.Helper()
+	baseline := GoroutineBaseline()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 
 	//e, err := NewExecEnv(ctx, t.Name(), "", 18000, binaries.EnvPathManager{})
@@ -294,12 +853,26 @@ func NewExecTestEnv(t *testing.T, timeout time.Duration) (*ExecEnv, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	o := newTestEnvOptions(opts)
+	e.Keep(o.keep...)
 	return e, func() {
+		if t.Failed() {
+			dir, err := ioutil.TempDir("", "yurt-stacks")
+			if err == nil {
+				err = e.DumpStacks(dir)
+				t.Logf("stack dumps written to %s", dir)
+			}
+			if err != nil {
+				t.Log(err)
+			}
+		}
 		cancel()
 		err := e.Group.Wait()
 		if err != nil {
 			t.Log(err)
 		}
+		logKept(t, &e.BaseEnv)
+		reportLeaks(t, e, baseline, o)
 	}
 }
 
@@ -313,17 +886,80 @@ type MonitoredEnv struct {
 	parent        Env
 	promConfigDir string
 	promAddr      *runner.APIConfig
+	promHarness   runner.Harness
 	targetAddrs   targetAddrsByKind
+
+	// promConfig is what Prometheus was last (re)loaded with.
+	promLock   sync.Mutex
+	promConfig prometheus.Config
+
+	// storeAddr is the gRPC address of the Thanos sidecar, if any.
+	storeAddr string
+
+	// probe is true when blackbox_exporter probes the services' health
+	// endpoints.
+	probe bool
+
+	reloadOnTargetChange bool
+}
+
+// MonitoredEnvOptions customize the Prometheus server of a MonitoredEnv.
+type MonitoredEnvOptions struct {
+	// Storage sets TSDB retention, default is that of Prometheus.
+	Storage prometheus.StorageConfig
+	// ExternalLabels are added to series sent elsewhere, e.g. so that
+	// series federated or remote written from many envs can be told apart.
+	ExternalLabels map[string]string
+	// Thanos runs a Thanos sidecar next to Prometheus, exposing its data
+	// via the store API, see StoreAddr and NewGlobalQuery.  Since Thanos
+	// requires them, ExternalLabels default to {"monitor": <node name>}.
+	Thanos bool
+	// ObjStore, if given, is where the sidecar uploads blocks, e.g. as
+	// returned by RunMinio.  It implies Thanos.  Storage.BlockDuration
+	// should be set, otherwise it'll be hours before anything is uploaded.
+	ObjStore *thanos.ObjStoreConfig
+	// ReloadOnTargetChange reloads Prometheus whenever targets are removed
+	// because their node exited.  Prometheus normally notices changes to
+	// the target files by itself, but only every 5m on filesystems without
+	// change notifications.
+	ReloadOnTargetChange bool
+	// NodeExporter runs node_exporter in ex, so that host metrics accompany
+	// those of the services.
+	NodeExporter bool
+	// Blackbox runs blackbox_exporter in ex, and probes the health endpoints
+	// of the probedServices run in the env.
+	Blackbox bool
 }
 
+// targetAddrsByKind tracks the targets written to the file SD files in the
+// Prometheus config dir.
 type targetAddrsByKind struct {
-	lock  sync.Mutex
-	addrs map[string][]string
+	lock sync.Mutex
+	// addrs maps a node kind or probe job to its targets, by node name.
+	addrs map[string]map[string]string
+	// allocated maps node names to their kind and metrics target, so that
+	// a node's targets can be restored when it's run again after exiting.
+	allocated map[string]kindTarget
+	// harnesses maps node names to the harness last run for them, so that
+	// when a replaced node's previous harness exits we leave it be.
+	harnesses map[string]runner.Harness
+}
+
+type kindTarget struct {
+	kind, addr string
 }
 
 var _ Env = &MonitoredEnv{}
 
 func NewMonitoredEnv(parent, ex Env) (*MonitoredEnv, error) {
+	return NewMonitoredEnvWithOptions(parent, ex, MonitoredEnvOptions{})
+}
+
+// NewMonitoredEnvWithOptions creates an env that runs commands using parent,
+// monitoring them using a Prometheus server run using ex.  The server has
+// its lifecycle API enabled, so that scrape jobs can be added using
+// AddScrapeJob without restarting it.
+func NewMonitoredEnvWithOptions(parent, ex Env, opts MonitoredEnvOptions) (*MonitoredEnv, error) {
 	promNode, _ := ex.AllocNode("prometheus", prometheus.DefPorts().RunnerPorts())
 	//consulClientNode := ex.AllocNode("consul", consul.DefPorts().RunnerPorts())
 	// TODO trying to get the address before the client is running will be an
@@ -334,75 +970,367 @@ func NewMonitoredEnv(parent, ex Env) (*MonitoredEnv, error) {
 	//}
 	//ssc := consul.ServiceScrapeConfig
 	//ssc.ConsulServiceDiscoveryConfigs[0].Server = consulClientAddr
-	p := prometheus.NewConfig(map[string]prometheus.ScrapeConfig{
+	jobs := map[string]prometheus.ScrapeConfig{
 		"consul": consul.ServerScrapeConfig,
 		//"consul-services": ssc,
 		//"nomad-clients": nomad.ClientScrapeConfig,
-		"nomad": nomad.ServerScrapeConfig,
-		"vault": vault.ServerScrapeConfig,
-	}, nil)
+		"nomad":       nomad.ServerScrapeConfig,
+		"vault":       vault.ServerScrapeConfig,
+		"pushgateway": pushgateway.ScrapeConfig,
+		"minio":       minio.ScrapeConfig,
+	}
+	if opts.NodeExporter {
+		jobs["node"] = nodeexporter.ScrapeConfig
+	}
+	var bbNode yurt.Node
+	if opts.Blackbox {
+		var err error
+		bbNode, err = ex.AllocNode("blackbox", blackboxexporter.DefPorts().RunnerPorts())
+		if err != nil {
+			return nil, err
+		}
+		bbAddr, err := bbNode.Address(blackboxexporter.PortNames.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range probedServices {
+			job := probeJob(name)
+			jobs[job] = blackboxexporter.ProbeScrapeConfig(job, blackboxexporter.ModuleHTTP2xx, bbAddr)
+		}
+	}
+	if opts.ObjStore != nil {
+		opts.Thanos = true
+	}
+	if opts.Thanos && len(opts.ExternalLabels) == 0 {
+		opts.ExternalLabels = map[string]string{"monitor": promNode.Name}
+	}
+	p := prometheus.NewConfig(jobs, nil).
+		WithStorage(opts.Storage).
+		WithExternalLabels(opts.ExternalLabels).
+		WithLifecycle()
 	h, err := ex.Run(parent.Context(), p, promNode)
 	if err != nil {
 		return nil, err
 	}
 	ex.Go(h.Wait)
+	// Nothing else would stop what we've started if we fail part way.
+	started := []runner.Harness{h}
+	fail := func(err error) (*MonitoredEnv, error) {
+		for _, h := range started {
+			h.Kill()
+		}
+		return nil, err
+	}
 
 	apiConf, err := h.Endpoint(prometheus.PortNames.HTTP, true)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
-	return &MonitoredEnv{
+	m := &MonitoredEnv{
 		exec:          ex,
 		parent:        parent,
 		promConfigDir: h.(*exec.Harness).Config.ConfigDir,
+		promHarness:   h,
 		promAddr:      apiConf,
 		targetAddrs: targetAddrsByKind{
-			addrs: map[string][]string{},
+			addrs:     map[string]map[string]string{},
+			allocated: map[string]kindTarget{},
+			harnesses: map[string]runner.Harness{},
 		},
-	}, nil
+		promConfig:           p,
+		probe:                opts.Blackbox,
+		reloadOnTargetChange: opts.ReloadOnTargetChange,
+	}
+
+	if opts.NodeExporter {
+		// All exec nodes share the host, so a single node_exporter suffices.
+		neh, err := m.runNodeExporter(parent.Context())
+		if err != nil {
+			return fail(err)
+		}
+		started = append(started, neh)
+	}
+
+	if opts.Blackbox {
+		bbh, err := ex.Run(parent.Context(), blackboxexporter.NewConfig(), bbNode)
+		if err != nil {
+			return fail(err)
+		}
+		ex.Go(bbh.Wait)
+		started = append(started, bbh)
+	}
+
+	if opts.Thanos {
+		if err := m.runSidecar(parent.Context(), h.(*exec.Harness).Config.DataDir, opts.ObjStore); err != nil {
+			return fail(err)
+		}
+	}
+
+	return m, nil
+}
+
+// runNodeExporter runs node_exporter in the exec env, adding it to the
+// targets of the "node" job.
+func (e *MonitoredEnv) runNodeExporter(ctx context.Context) (runner.Harness, error) {
+	ports := nodeexporter.DefPorts().RunnerPorts()
+	node, err := e.exec.AllocNode("node-exporter", ports)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := node.Address(nodeexporter.PortNames.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	h, err := e.exec.Run(ctx, nodeexporter.NewConfig(), node)
+	if err != nil {
+		return nil, err
+	}
+	e.exec.Go(h.Wait)
+
+	e.targetAddrs.lock.Lock()
+	defer e.targetAddrs.lock.Unlock()
+	e.setTarget(ports.Kind, node.Name, addr)
+	if err := e.writeTargets(ports.Kind); err != nil {
+		h.Kill()
+		return nil, err
+	}
+	return h, nil
+}
+
+// probedServices are the services whose API endpoints a MonitoredEnv probes
+// using blackbox_exporter, measuring availability and latency from outside.
+var probedServices = []string{"consul", "nomad", "vault"}
+
+func probeJob(service string) string {
+	return "probe-" + service
 }
 
 func (e *MonitoredEnv) PromAddr() *runner.APIConfig {
 	return e.promAddr
 }
 
-func (e *MonitoredEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
-	return e.parent.Run(ctx, cmd, node)
+// AddScrapeJob adds job to the Prometheus config and reloads it.  As with
+// the builtin jobs, targets are read from files in the Prometheus config dir
+// named "<job name>.*.json", unless job uses another discovery mechanism.
+func (e *MonitoredEnv) AddScrapeJob(ctx context.Context, job prometheus.ScrapeConfig) error {
+	e.promLock.Lock()
+	defer e.promLock.Unlock()
+
+	cfg := e.promConfig
+	cfg.Jobs = make(map[string]prometheus.ScrapeConfig, len(e.promConfig.Jobs)+1)
+	for name, j := range e.promConfig.Jobs {
+		cfg.Jobs[name] = j
+	}
+	cfg.Jobs[job.JobName] = job
+
+	dest := filepath.Join(e.promConfigDir, "prometheus.yml")
+	if err := ioutil.WriteFile(dest, []byte(cfg.Files()["prometheus.yml"]), 0644); err != nil {
+		return err
+	}
+	if err := prometheus.Reload(ctx, e.promAddr.Address.String()); err != nil {
+		return fmt.Errorf("error reloading prometheus config: %w", err)
+	}
+	e.promConfig = cfg
+	return nil
 }
 
-func (e *MonitoredEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
-	node, _ := e.parent.AllocNode(baseName, ports)
-	addr, _ := node.Address("http")
-	targets := []string{addr}
+// RunPushgateway starts a Pushgateway scraped by the env's Prometheus server,
+// returning its harness and address, e.g. http://127.0.0.1:9091, for
+// batch jobs to push their metrics to.
+func (e *MonitoredEnv) RunPushgateway(ctx context.Context) (runner.Harness, string, error) {
+	node, err := e.AllocNode("pushgateway", pushgateway.DefPorts().RunnerPorts())
+	if err != nil {
+		return nil, "", err
+	}
+	h, err := e.exec.Run(ctx, pushgateway.NewConfig(), node)
+	if err != nil {
+		return nil, "", err
+	}
+	apiConf, err := h.Endpoint(pushgateway.PortNames.HTTP, true)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := apiConf.Address.String()
+	if err := pushgateway.HealthCheck(ctx, addr); err != nil {
+		h.Kill()
+		return nil, "", err
+	}
+	return h, addr, nil
+}
+
+// PromHarness returns the harness of the Prometheus server.
+func (e *MonitoredEnv) PromHarness() runner.Harness {
+	return e.promHarness
+}
+
+// Run starts cmd as node using the parent env.  The node's targets are
+// removed from the Prometheus target files once it exits, and restored if
+// it's run again, e.g. when a node is replaced.
+func (e *MonitoredEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
+	h, err := e.parent.Run(ctx, cmd, node)
+	if err != nil {
+		return nil, err
+	}
 
 	e.targetAddrs.lock.Lock()
-	defer e.targetAddrs.lock.Unlock()
+	e.targetAddrs.harnesses[node.Name] = h
+	var restored []string
+	if kt, ok := e.targetAddrs.allocated[node.Name]; ok {
+		if _, ok := e.targetAddrs.addrs[kt.kind][node.Name]; !ok {
+			e.setTarget(kt.kind, node.Name, kt.addr)
+			restored = append(restored, kt.kind)
+		}
+	}
+	err = e.writeTargets(restored...)
+	e.targetAddrs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	for _, target := range e.targetAddrs.addrs[ports.Kind] {
-		targets = append(targets, target)
+	if err := e.addProbeTarget(cmd, node); err != nil {
+		return nil, err
 	}
+	go e.removeTargetsOnExit(node.Name, h)
+	return h, nil
+}
 
-	localTargets := []map[string]interface{}{
-		map[string]interface{}{
-			"targets": targets,
-		},
+// removeTargetsOnExit waits for h to exit, then removes all of node's
+// targets, unless node has been run again in the meantime.
+func (e *MonitoredEnv) removeTargetsOnExit(node string, h runner.Harness) {
+	_ = h.Wait()
+	if e.parent.Context().Err() != nil {
+		// Everything's shutting down, including Prometheus.
+		return
 	}
 
-	tbytes, err := json.Marshal(localTargets)
+	e.targetAddrs.lock.Lock()
+	if e.targetAddrs.harnesses[node] != h {
+		e.targetAddrs.lock.Unlock()
+		return
+	}
+	delete(e.targetAddrs.harnesses, node)
+	var changed []string
+	for kind, targets := range e.targetAddrs.addrs {
+		if _, ok := targets[node]; ok {
+			delete(targets, node)
+			changed = append(changed, kind)
+		}
+	}
+	err := e.writeTargets(changed...)
+	e.targetAddrs.lock.Unlock()
 	if err != nil {
-		return yurt.Node{}, err
+		log.Printf("error removing targets of %s: %v", node, err)
+		return
+	}
+
+	if e.reloadOnTargetChange && len(changed) > 0 {
+		e.promLock.Lock()
+		defer e.promLock.Unlock()
+		if err := prometheus.Reload(e.parent.Context(), e.promAddr.Address.String()); err != nil {
+			log.Printf("error reloading prometheus after removing targets of %s: %v", node, err)
+		}
+	}
+}
+
+// setTarget records addr as the target of node for kind, which is a node
+// kind or probe job.  The caller must hold targetAddrs.lock.
+func (e *MonitoredEnv) setTarget(kind, node, addr string) {
+	targets := e.targetAddrs.addrs[kind]
+	if targets == nil {
+		targets = map[string]string{}
+		e.targetAddrs.addrs[kind] = targets
+	}
+	targets[node] = addr
+}
+
+// writeTargets rewrites the target files of the given kinds.  The caller must
+// hold targetAddrs.lock.
+func (e *MonitoredEnv) writeTargets(kinds ...string) error {
+	for _, kind := range kinds {
+		targets := []string{}
+		for _, addr := range e.targetAddrs.addrs[kind] {
+			targets = append(targets, addr)
+		}
+		sort.Strings(targets)
+		localTargets := []map[string]interface{}{
+			{
+				"targets": targets,
+			},
+		}
+
+		// Kinds of the form "consul.1.10.6", as created by VersionedEnv, get
+		// their own targets file, with a version label to tell them apart.
+		if i := strings.Index(kind, "."); i > 0 {
+			localTargets[0]["labels"] = map[string]string{"version": kind[i+1:]}
+		}
+
+		tbytes, err := json.Marshal(localTargets)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(e.promConfigDir, kind+".servers.json")
+		if err := ioutil.WriteFile(dest, tbytes, 0644); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	dest := filepath.Join(e.promConfigDir, ports.Kind+".servers.json")
-	err = ioutil.WriteFile(dest, tbytes, 0644)
+// addProbeTarget adds the health endpoint of node to the probe job of its
+// service, if it's one of probedServices and probing is enabled.
+func (e *MonitoredEnv) addProbeTarget(cmd runner.Command, node yurt.Node) error {
+	if !e.probe {
+		return nil
+	}
+	desc, ok := yurt.LookupService(cmd.Name())
+	if !ok || len(desc.Health) == 0 {
+		return nil
+	}
+	job := ""
+	for _, name := range probedServices {
+		if name == desc.Name {
+			job = probeJob(name)
+		}
+	}
+	if job == "" {
+		return nil
+	}
+
+	scheme := "http"
+	if cmd.Config().TLS.Cert != "" {
+		scheme = "https"
+	}
+	target, err := blackboxexporter.ProbeTarget(node, scheme, desc.Health[0])
 	if err != nil {
+		return err
+	}
+
+	e.targetAddrs.lock.Lock()
+	defer e.targetAddrs.lock.Unlock()
+	e.setTarget(job, node.Name, target)
+	return e.writeTargets(job)
+}
+
+func (e *MonitoredEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
+	node, _ := e.parent.AllocNode(baseName, ports)
+	addr, _ := node.Address("http")
+
+	e.targetAddrs.lock.Lock()
+	defer e.targetAddrs.lock.Unlock()
+
+	e.targetAddrs.allocated[node.Name] = kindTarget{kind: ports.Kind, addr: addr}
+	e.setTarget(ports.Kind, node.Name, addr)
+	if err := e.writeTargets(ports.Kind); err != nil {
 		return yurt.Node{}, err
 	}
-	e.targetAddrs.addrs[ports.Kind] = targets
 	return node, nil
 }
 
+func (e *MonitoredEnv) EventBus() *events.Bus {
+	return EventBus(e.parent)
+}
+
 func (e *MonitoredEnv) Context() context.Context {
 	return e.parent.Context()
 }
@@ -410,3 +1338,15 @@ func (e *MonitoredEnv) Context() context.Context {
 func (e *MonitoredEnv) Go(f func() error) {
 	e.parent.Go(f)
 }
+
+func (e *MonitoredEnv) Node(name string) (yurt.Node, bool) {
+	return e.parent.Node(name)
+}
+
+func (e *MonitoredEnv) Harness(name string) (runner.Harness, bool) {
+	return e.parent.Harness(name)
+}
+
+func (e *MonitoredEnv) NodeNames() []string {
+	return e.parent.NodeNames()
+}
@@ -2,26 +2,35 @@ package runenv
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ncabatoff/yurt"
 	"github.com/ncabatoff/yurt/consul"
 	"github.com/ncabatoff/yurt/helper/testhelper"
+	"github.com/ncabatoff/yurt/minio"
 	"github.com/ncabatoff/yurt/nomad"
 	"github.com/ncabatoff/yurt/prometheus"
+	"github.com/ncabatoff/yurt/pushgateway"
 	"github.com/ncabatoff/yurt/runner"
 	"github.com/ncabatoff/yurt/vault"
 )
 
 func TestConsulExec(t *testing.T) {
-	e, cleanup := NewExecTestEnv(t, 10*time.Second)
+	e, cleanup := NewExecTestEnv(t, 10*time.Second, FailOnLeaks())
 	defer cleanup()
 
 	e.Go(runConsulServer(t, e).Wait)
 }
 
 func TestConsulExecClient(t *testing.T) {
-	e, cleanup := NewExecTestEnv(t, 10*time.Second)
+	e, cleanup := NewExecTestEnv(t, 10*time.Second, FailOnLeaks())
 	defer cleanup()
 	consulHarness := runConsulServer(t, e)
 	e.Go(consulHarness.Wait)
@@ -263,7 +272,7 @@ func TestMonitoredConsulExec(t *testing.T) {
 	e, cleanup := NewExecTestEnv(t, 15*time.Second)
 	defer cleanup()
 
-	m, err := NewMonitoredEnv(e, e)
+	m, err := NewMonitoredEnvWithOptions(e, e, MonitoredEnvOptions{NodeExporter: true, Blackbox: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -275,6 +284,148 @@ func TestMonitoredConsulExec(t *testing.T) {
 	testhelper.UntilPass(t, ctx, func() error {
 		return testhelper.PromQueryAlive(ctx, m.promAddr.Address.String(), "consul", "consul_raft_apply", 1)
 	})
+	testhelper.UntilPass(t, ctx, func() error {
+		return testhelper.PromQueryAlive(ctx, m.promAddr.Address.String(), "node", "node_load1", 1)
+	})
+	testhelper.UntilPass(t, ctx, func() error {
+		return testhelper.PromQueryAlive(ctx, m.promAddr.Address.String(), "probe-consul", "probe_success", 1)
+	})
+}
+
+// readTargets returns the target groups in the file_sd targets file of kind.
+func readTargets(t *testing.T, m *MonitoredEnv, kind string) []map[string]interface{} {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(m.promConfigDir, kind+".servers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []map[string]interface{}
+	if err := json.Unmarshal(b, &groups); err != nil {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+// TestWriteTargetsVersionLabel verifies that the targets of kinds created by
+// VersionedEnv get a version label, and those of other kinds don't.
+func TestWriteTargetsVersionLabel(t *testing.T) {
+	m := &MonitoredEnv{promConfigDir: t.TempDir()}
+	m.targetAddrs.addrs = map[string]map[string]string{
+		"consul":        {"a": "127.0.0.1:8500"},
+		"consul.1.10.6": {"b": "127.0.0.1:9500"},
+	}
+	if err := m.writeTargets("consul", "consul.1.10.6"); err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := readTargets(t, m, "consul"); len(groups) != 1 || groups[0]["labels"] != nil {
+		t.Fatalf("expected one unlabelled target group, got %v", groups)
+	}
+	groups := readTargets(t, m, "consul.1.10.6")
+	if len(groups) != 1 {
+		t.Fatalf("expected one target group, got %v", groups)
+	}
+	labels, _ := groups[0]["labels"].(map[string]interface{})
+	if labels["version"] != "1.10.6" {
+		t.Fatalf("expected version label 1.10.6, got %v", groups[0])
+	}
+}
+
+// targetsEnv is a parent env for MonitoredEnv whose nodes are all given
+// the same address, and whose harnesses run until released.
+type targetsEnv struct {
+	Env
+	ctx context.Context
+}
+
+func (e targetsEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
+	return yurt.Node{Name: baseName + "-1", Host: "127.0.0.1", Ports: ports}, nil
+}
+
+func (e targetsEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
+	return &blockingHarness{done: make(chan struct{})}, nil
+}
+
+func (e targetsEnv) Context() context.Context {
+	return e.ctx
+}
+
+type blockingHarness struct {
+	runner.Harness
+	done chan struct{}
+}
+
+func (h *blockingHarness) Wait() error {
+	<-h.done
+	return nil
+}
+
+// TestMonitoredEnvTargets verifies that a node's target is removed once it
+// exits, restored when it's run again, and left alone when a harness that
+// was replaced exits.
+func TestMonitoredEnvTargets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &MonitoredEnv{
+		parent:        targetsEnv{ctx: ctx},
+		promConfigDir: t.TempDir(),
+		targetAddrs: targetAddrsByKind{
+			addrs:     map[string]map[string]string{},
+			allocated: map[string]kindTarget{},
+			harnesses: map[string]runner.Harness{},
+		},
+	}
+	targets := func() []interface{} {
+		groups := readTargets(t, m, "consul")
+		if len(groups) != 1 {
+			t.Fatalf("expected one target group, got %v", groups)
+		}
+		return groups[0]["targets"].([]interface{})
+	}
+	waitTargets := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(targets()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d targets, got %v", want, targets())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ports := consul.DefPorts().RunnerPorts()
+	node, err := m.AllocNode("consul-srv", ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := consul.NewConfig(true, nil, nil)
+	run := func() *blockingHarness {
+		t.Helper()
+		h, err := m.Run(ctx, cmd, node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.(*blockingHarness)
+	}
+
+	h := run()
+	waitTargets(1)
+	close(h.done)
+	waitTargets(0)
+
+	h = run()
+	waitTargets(1)
+	if got := targets()[0]; got != fmt.Sprintf("127.0.0.1:%d", consul.DefPorts().HTTP) {
+		t.Fatalf("expected restored target to be the node's http address, got %v", got)
+	}
+
+	// The node is replaced, then its old harness exits.
+	replacement := run()
+	close(h.done)
+	time.Sleep(100 * time.Millisecond)
+	waitTargets(1)
+	close(replacement.done)
+	waitTargets(0)
 }
 
 func TestMonitoredVaultExec(t *testing.T) {
@@ -318,3 +469,172 @@ func TestMonitoredNomadExec(t *testing.T) {
 		return testhelper.PromQueryAlive(ctx, m.promAddr.Address.String(), "nomad", "nomad_raft_apply", 1)
 	})
 }
+
+func TestMonitoredPushgatewayExec(t *testing.T) {
+	e, cleanup := NewExecTestEnv(t, 15*time.Second)
+	defer cleanup()
+
+	m, err := NewMonitoredEnv(e, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, addr, err := m.RunPushgateway(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Go(h.Wait)
+
+	err = pushgateway.Push(ctx, addr, "batch", map[string]string{"instance": "batch-1"},
+		"# TYPE yurt_batch_completed gauge\nyurt_batch_completed 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pushed metrics keep their job label, rather than getting that of the
+	// Pushgateway target, so query them directly.
+	testhelper.UntilPass(t, ctx, func() error {
+		samples, err := testhelper.PromQueryVector(ctx, m.promAddr.Address.String(), "batch", "yurt_batch_completed")
+		if err != nil {
+			return err
+		}
+		if len(samples) != 1 || samples[0] != 1 {
+			return fmt.Errorf("expected one sample with value 1, got %v", samples)
+		}
+		return nil
+	})
+}
+
+// TestMinioDocker verifies that MinIO runs in a docker env, and that objects
+// put in its bucket can be listed back.
+func TestMinioDocker(t *testing.T) {
+	e, cleanup := NewDockerTestEnv(t, 30*time.Second)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	const access, secret, bucket = "yurtaccess", "yurtsecret", "artifacts"
+	mh, _, err := RunMinio(ctx, e, access, secret, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(mh.Wait)
+
+	apiConf, err := mh.Endpoint(minio.PortNames.HTTP, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := apiConf.Address.String()
+	for _, key := range []string{"a.txt", "dir/b.txt"} {
+		if err := minio.PutObject(ctx, addr, access, secret, bucket, key, []byte("hello "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := minio.ListObjects(ctx, addr, access, secret, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a.txt,dir/b.txt" {
+		t.Fatalf("expected the objects put to be listed, got %v", keys)
+	}
+}
+
+func TestThanosGlobalQueryExec(t *testing.T) {
+	e, cleanup := NewExecTestEnv(t, 30*time.Second)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	mh, objStore, err := RunMinio(ctx, e, "yurtaccess", "yurtsecret", "thanos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(mh.Wait)
+
+	var envs []*MonitoredEnv
+	for i := 0; i < 2; i++ {
+		m, err := NewMonitoredEnvWithOptions(e, e, MonitoredEnvOptions{ObjStore: objStore})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envs = append(envs, m)
+	}
+
+	qh, qAddr, err := NewGlobalQuery(ctx, e, envs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Go(qh.Wait)
+
+	// Each Prometheus scrapes itself; the querier should see both, told
+	// apart by their external labels.
+	testhelper.UntilPass(t, ctx, func() error {
+		samples, err := testhelper.PromQueryVector(ctx, qAddr.Address.String(), "prometheus", "up")
+		if err != nil {
+			return err
+		}
+		if len(samples) != 2 {
+			return fmt.Errorf("expected 2 samples, got %v", samples)
+		}
+		return nil
+	})
+}
+
+func TestDataDirLimit(t *testing.T) {
+	limits := map[string]int64{
+		"*-consul-srv-1": 1 << 20,
+		"c2-vault-*":     2 << 20,
+	}
+	for name, expected := range map[string]int64{
+		"c1-consul-srv-1": 1 << 20,
+		"c1-consul-srv-2": 0,
+		"c2-vault-3":      2 << 20,
+		"c1-vault-1":      0,
+	} {
+		if got := dataDirLimit(limits, name); got != expected {
+			t.Errorf("%s: expected limit %d, got %d", name, expected, got)
+		}
+	}
+	if got := dataDirLimit(nil, "c1-consul-srv-1"); got != 0 {
+		t.Errorf("expected no limit without limits, got %d", got)
+	}
+}
+
+// TestLimitDataDir verifies that an ExecEnv limits a data dir only once, and
+// releases the limit when the env is done.
+func TestLimitDataDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := NewExecEnv(ctx, t.Name(), t.TempDir(), 32000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(e.WorkDir, "c1-consul-srv-1", "data")
+	if err := e.limitDataDir(dir, 4<<20); err != nil {
+		t.Skipf("can't limit data dir: %v", err)
+	}
+	if err := e.limitDataDir(dir, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.diskLimits.limits) != 1 {
+		t.Fatalf("expected one limit, got %v", e.diskLimits.limits)
+	}
+	image := e.diskLimits.limits[dir].Image
+
+	cancel()
+	if err := e.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatalf("expected limit to be released once the env is done, got %v", err)
+	}
+	// Which it must be before the workdir is removed, lest the mount stop it.
+	if _, err := os.Stat(e.WorkDir); !os.IsNotExist(err) {
+		t.Fatalf("expected workdir to be removed once the env is done, got %v", err)
+	}
+
+	if err := (ExecEnv{}).limitDataDir(dir, 4<<20); err == nil {
+		t.Fatal("expected error limiting data dir of env not created by NewExecEnv")
+	}
+}
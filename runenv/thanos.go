@@ -0,0 +1,110 @@
+package runenv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ncabatoff/yurt/minio"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/ncabatoff/yurt/thanos"
+)
+
+// runSidecar starts a Thanos sidecar for the env's Prometheus server, whose
+// TSDB lives in promDataDir.
+func (e *MonitoredEnv) runSidecar(ctx context.Context, promDataDir string, objStore *thanos.ObjStoreConfig) error {
+	node, err := e.exec.AllocNode("thanos-sidecar", thanos.DefPorts().SidecarPorts())
+	if err != nil {
+		return err
+	}
+	cmd := thanos.NewSidecarConfig(e.promAddr.Address.String(), promDataDir, objStore)
+	h, err := e.exec.Run(ctx, cmd, node)
+	if err != nil {
+		return err
+	}
+	e.exec.Go(h.Wait)
+
+	apiConf, err := h.Endpoint(thanos.PortNames.HTTP, true)
+	if err != nil {
+		return err
+	}
+	if err := thanos.HealthCheck(ctx, apiConf.Address.String()); err != nil {
+		return fmt.Errorf("thanos sidecar not ready: %w", err)
+	}
+	e.storeAddr, err = node.Address(thanos.PortNames.GRPC)
+	return err
+}
+
+// StoreAddr returns the gRPC address of the env's Thanos sidecar, if it was
+// created with MonitoredEnvOptions.Thanos.
+func (e *MonitoredEnv) StoreAddr() (string, bool) {
+	return e.storeAddr, e.storeAddr != ""
+}
+
+// NewGlobalQuery runs a Thanos querier in e over the Prometheus servers of
+// the given envs, which must have been created with
+// MonitoredEnvOptions.Thanos, e.g. one per datacenter.  The returned config
+// gives the address of its Prometheus compatible query API.
+func NewGlobalQuery(ctx context.Context, e Env, envs ...*MonitoredEnv) (runner.Harness, *runner.APIConfig, error) {
+	var stores []string
+	for _, m := range envs {
+		addr, ok := m.StoreAddr()
+		if !ok {
+			return nil, nil, fmt.Errorf("env with prometheus %s has no thanos sidecar", m.promAddr.Address.String())
+		}
+		stores = append(stores, addr)
+	}
+
+	node, err := e.AllocNode("thanos-query", thanos.DefPorts().QueryPorts())
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := e.Run(ctx, thanos.NewQueryConfig(stores), node)
+	if err != nil {
+		return nil, nil, err
+	}
+	apiConf, err := h.Endpoint(thanos.PortNames.HTTP, true)
+	if err != nil {
+		h.Kill()
+		return nil, nil, err
+	}
+	if err := thanos.HealthCheck(ctx, apiConf.Address.String()); err != nil {
+		h.Kill()
+		return nil, nil, fmt.Errorf("thanos query not ready: %w", err)
+	}
+	return h, apiConf, nil
+}
+
+// RunMinio starts a MinIO server in e with the given root credentials and
+// creates bucket in it, returning the harness and the object store config
+// a Thanos sidecar needs to upload blocks to the bucket.
+func RunMinio(ctx context.Context, e Env, accessKey, secretKey, bucket string) (runner.Harness, *thanos.ObjStoreConfig, error) {
+	node, err := e.AllocNode("minio", minio.DefPorts().RunnerPorts())
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := e.Run(ctx, minio.NewConfig(accessKey, secretKey), node)
+	if err != nil {
+		return nil, nil, err
+	}
+	apiConf, err := h.Endpoint(minio.PortNames.HTTP, true)
+	if err != nil {
+		h.Kill()
+		return nil, nil, err
+	}
+	addr := apiConf.Address.String()
+	if err := minio.HealthCheck(ctx, addr); err != nil {
+		h.Kill()
+		return nil, nil, fmt.Errorf("minio not ready: %w", err)
+	}
+	if err := minio.MakeBucket(ctx, addr, accessKey, secretKey, bucket); err != nil {
+		h.Kill()
+		return nil, nil, err
+	}
+	return h, &thanos.ObjStoreConfig{
+		Bucket:    bucket,
+		Endpoint:  apiConf.Address.Host,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Insecure:  true,
+	}, nil
+}
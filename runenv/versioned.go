@@ -0,0 +1,72 @@
+package runenv
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/events"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// VersionedEnv wraps an Env so that commands for Product are run using
+// Version instead of the default version of the binary.  Nodes allocated for
+// Product get a port kind of "<product>.<version>", so that a MonitoredEnv
+// parent scrapes them with a version label, keeping them distinct from other
+// versions of the same product running side by side.  ExecEnv and DockerEnv
+// support running specific versions.
+type VersionedEnv struct {
+	Env
+	Product string
+	Version string
+}
+
+var _ Env = &VersionedEnv{}
+
+func NewVersionedEnv(parent Env, product, version string) *VersionedEnv {
+	return &VersionedEnv{
+		Env:     parent,
+		Product: product,
+		Version: version,
+	}
+}
+
+// NameSuffix returns a version-derived suffix suitable for node and cluster
+// names, e.g. "1-10-6".
+func (e *VersionedEnv) NameSuffix() string {
+	return strings.ReplaceAll(e.Version, ".", "-")
+}
+
+func (e *VersionedEnv) AllocNode(baseName string, ports yurt.Ports) (yurt.Node, error) {
+	if ports.Kind == e.Product {
+		ports.Kind += "." + e.Version
+	}
+	return e.Env.AllocNode(baseName, ports)
+}
+
+func (e *VersionedEnv) Run(ctx context.Context, cmd runner.Command, node yurt.Node) (runner.Harness, error) {
+	if cmd.Name() == e.Product {
+		cmd = runner.WithVersion(cmd, e.Version)
+	}
+	return e.Env.Run(ctx, cmd, node)
+}
+
+func (e *VersionedEnv) EventBus() *events.Bus {
+	return EventBus(e.Env)
+}
+
+// WithVersions returns e wrapped in a VersionedEnv for each product in
+// versions, a map from product to version, e.g. {"consul": "1.10.6"}.  It
+// returns e itself if versions is empty.
+func WithVersions(e Env, versions map[string]string) Env {
+	var products []string
+	for product := range versions {
+		products = append(products, product)
+	}
+	sort.Strings(products)
+	for _, product := range products {
+		e = NewVersionedEnv(e, product, versions[product])
+	}
+	return e
+}
@@ -6,10 +6,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/hashicorp/vault/sdk/helper/certutil"
@@ -25,7 +27,10 @@ type DockerRunner struct {
 	Image     string
 	IP        string
 	DockerAPI *client.Client
-	binary    string
+	// Entrypoint, if set, replaces the default entrypoint, which suits the
+	// HashiCorp images.
+	Entrypoint []string
+	binary     string
 }
 
 type harness struct {
@@ -34,6 +39,16 @@ type harness struct {
 	dockerAPI *client.Client
 	ip        string
 	config    runner.Config
+	// detach, if non-nil, makes Wait return once it's closed, even though
+	// the container may still be running.
+	detach <-chan struct{}
+	// exited is closed once the container has stopped running, at which
+	// point exitErr holds the result for Wait.  We start waiting as soon as
+	// the container is started, since once it's removed there's nothing left
+	// to wait on.
+	exited   chan struct{}
+	exitErr  error
+	stopOnce sync.Once
 }
 
 var _ runner.Harness = &harness{}
@@ -65,6 +80,18 @@ func (d *DockerRunner) Command() runner.Command {
 	return d.command
 }
 
+// StartDetached is like Start, except the container isn't removed when ctx
+// is done; instead, Wait returns without waiting for it.  Stop and Kill still
+// remove the container.
+func (d *DockerRunner) StartDetached(ctx context.Context) (*harness, error) {
+	h, err := d.Start(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	h.detach = ctx.Done()
+	return h, nil
+}
+
 // Start a new docker container based on the runner config.  Any existing container
 // with the same name will be removed first.  Return IP of new container or error.
 func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
@@ -92,9 +119,30 @@ func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
 	adjConfig := d.config
 	cfgDir := filepath.Join(d.NodeDir, "config")
 	copyFromTo := map[string]string{
-		cfgDir:                           adjConfig.ConfigDir,
-		filepath.Join(d.NodeDir, "data"): adjConfig.DataDir,
-		filepath.Join(d.NodeDir, "log"):  adjConfig.LogDir,
+		cfgDir:                          adjConfig.ConfigDir,
+		filepath.Join(d.NodeDir, "log"): adjConfig.LogDir,
+	}
+	var mounts []mount.Mount
+	switch dm := adjConfig.DataMount; {
+	case dm == nil:
+		copyFromTo[filepath.Join(d.NodeDir, "data")] = adjConfig.DataDir
+	case dm.Type == "tmpfs":
+		m := mount.Mount{Type: mount.TypeTmpfs, Target: adjConfig.DataDir}
+		if dm.SizeBytes > 0 {
+			m.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: dm.SizeBytes}
+		}
+		mounts = append(mounts, m)
+	case dm.Type == "volume":
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: dm.Name,
+			Target: adjConfig.DataDir,
+			VolumeOptions: &mount.VolumeOptions{
+				Labels: map[string]string{"yurt": "true"},
+			},
+		})
+	default:
+		return nil, fmt.Errorf("invalid data mount type %q", dm.Type)
 	}
 	for from := range copyFromTo {
 		if err := os.MkdirAll(from, 0777); err != nil {
@@ -126,6 +174,10 @@ func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
 		// tries to bind to the same listener address twice, then fails.
 		args = append(args[:1], args[2:]...)
 	}
+	entrypoint := d.Entrypoint
+	if len(entrypoint) == 0 {
+		entrypoint = []string{"/bin/sh", "-x", "/usr/local/bin/docker-entrypoint.sh"}
+	}
 	contConfig := container.Config{
 		Image: d.Image,
 		Cmd:   args,
@@ -135,7 +187,11 @@ func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
 		},
 		//WorkingDir:   adjConfig.ConfigDir,
 		ExposedPorts: portset,
-		Entrypoint:   []string{"/bin/sh", "-x", "/usr/local/bin/docker-entrypoint.sh"},
+		Entrypoint:   entrypoint,
+	}
+	var logConfig container.LogConfig
+	if lc := d.config.LogConfig; lc != nil {
+		logConfig = container.LogConfig{Type: lc.Driver, Config: lc.Options}
 	}
 	cont, err := docker.Start(ctx, d.DockerAPI, docker.RunOptions{
 		NetName:         adjConfig.NetworkConfig.DockerNetName,
@@ -143,6 +199,8 @@ func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
 		CopyFromTo:      copyFromTo,
 		ContainerName:   d.config.NodeName,
 		IP:              d.IP,
+		LogConfig:       logConfig,
+		Mounts:          mounts,
 	})
 	id := ""
 	if cont != nil {
@@ -160,13 +218,19 @@ func (d *DockerRunner) Start(ctx context.Context) (*harness, error) {
 		cancel()
 		return nil, err
 	}
-	return &harness{
+	h := &harness{
 		cancel:    cancel,
 		config:    d.config,
 		container: cont,
 		dockerAPI: d.DockerAPI,
 		ip:        ip,
-	}, nil
+		exited:    make(chan struct{}),
+	}
+	go func() {
+		h.exitErr = docker.Wait(d.DockerAPI, cont.ID)
+		close(h.exited)
+	}()
+	return h, nil
 }
 
 func (d *harness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
@@ -199,17 +263,47 @@ func (d *harness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
 			apiConfig.CAFile = filepath.Join(d.config.ConfigDir, "ca.pem")
 		}
 	}
+	if len(d.config.ClientTLS.Cert) > 0 {
+		apiConfig.ClientCertFile = filepath.Join(d.config.ConfigDir, "client.pem")
+		apiConfig.ClientKeyFile = filepath.Join(d.config.ConfigDir, "client-key.pem")
+	}
 
 	return &apiConfig, nil
 }
 
+// ContainerID returns the ID of the container started for the node.
+func (d *harness) ContainerID() string {
+	return d.container.ID
+}
+
+// DataDir returns the path of the node's data dir within the container.
+func (d *harness) DataDir() string {
+	return d.config.DataDir
+}
+
 func (d *harness) Wait() error {
-	return docker.Wait(d.dockerAPI, d.container.ID)
+	select {
+	case <-d.exited:
+		return d.exitErr
+	case <-d.detach:
+		return nil
+	}
 }
 
+// Stop stops the container, which docker does by sending SIGTERM, then
+// SIGKILL if it's still running after the config's StopGrace.  Once the
+// container has exited it's removed.
 func (d *harness) Stop() error {
-	d.cancel()
-	return nil
+	var err error
+	d.stopOnce.Do(func() {
+		grace := d.config.StopGraceOrDefault()
+		err = d.dockerAPI.ContainerStop(context.Background(), d.container.ID, &grace)
+		if err == nil {
+			<-d.exited
+		}
+		d.cancel()
+	})
+	return err
 }
 
 func (d *harness) Kill() {
@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoLeader means none of the nodes queried knew of a leader.
+	ErrNoLeader = errors.New("no leader")
+	// ErrUnhealthyAutopilot means autopilot reported the cluster unhealthy.
+	ErrUnhealthyAutopilot = errors.New("autopilot reports unhealthy")
+)
+
+// ErrMultipleLeaders means the nodes queried disagreed about the leader.
+type ErrMultipleLeaders struct {
+	Leaders []string
+}
+
+func (e *ErrMultipleLeaders) Error() string {
+	return fmt.Sprintf("multiple leaders: %v", e.Leaders)
+}
+
+// ErrPeerMismatch means a node reported different raft peers than expected.
+type ErrPeerMismatch struct {
+	Want []string
+	Got  []string
+}
+
+func (e *ErrPeerMismatch) Error() string {
+	return fmt.Sprintf("expected peers %v, got %v", e.Want, e.Got)
+}
+
+// NodeError gives the node a health check failure was seen on, as an index
+// into the APIs or servers checked.  Use errors.Is or errors.As to find the
+// cause.
+type NodeError struct {
+	Node int
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node %d: %v", e.Node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
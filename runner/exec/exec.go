@@ -3,11 +3,13 @@ package exec
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,12 +21,51 @@ type ExecRunner struct {
 	command runner.Command
 	config  runner.Config
 	BinPath string
+	// Output, if non-nil, receives the process's stdout and stderr when
+	// they aren't written to a log file, instead of them going to os.Stdout
+	// prefixed by the node name.
+	Output io.Writer
 }
 
 type Harness struct {
 	cancel func()
 	Config runner.Config
 	cmd    *exec.Cmd
+	stderr *tapWriter
+	exit   *exitState
+	// detach, if non-nil, makes Wait return once it's closed, even though
+	// the process may still be running.
+	detach   <-chan struct{}
+	stopOnce *sync.Once
+}
+
+// exitState lets Wait be called any number of times, and lets us know when
+// the process has exited without calling cmd.Wait ourselves.
+type exitState struct {
+	done chan struct{}
+	err  error
+}
+
+// tapWriter writes to w, and additionally to tap when one is set.
+type tapWriter struct {
+	l   sync.Mutex
+	w   io.Writer
+	tap io.Writer
+}
+
+func (t *tapWriter) Write(p []byte) (int, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.tap != nil {
+		_, _ = t.tap.Write(p)
+	}
+	return t.w.Write(p)
+}
+
+func (t *tapWriter) setTap(tap io.Writer) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.tap = tap
 }
 
 var _ runner.Harness = &Harness{}
@@ -37,8 +78,23 @@ func NewExecRunner(binPath string, command runner.Command, config runner.Config)
 	}, nil
 }
 
-// Start launches the process
+// Start launches the process, which is killed when ctx is done.
 func (e *ExecRunner) Start(ctx context.Context, logname string) (*Harness, error) {
+	return e.start(ctx, logname, false)
+}
+
+// StartDetached launches a process that isn't killed when ctx is done, nor
+// when we exit; once ctx is done, Wait returns without waiting for it.  Its
+// output is written directly to logname, which is required, so that it
+// doesn't depend on us to copy it.  Stop and Kill still work as usual.
+func (e *ExecRunner) StartDetached(ctx context.Context, logname string) (*Harness, error) {
+	if logname == "" {
+		return nil, fmt.Errorf("detached processes must log to a file")
+	}
+	return e.start(ctx, logname, true)
+}
+
+func (e *ExecRunner) start(ctx context.Context, logname string, detached bool) (*Harness, error) {
 	for _, dir := range []string{e.config.DataDir, e.config.LogDir} {
 		if dir != "" {
 			if err := os.MkdirAll(dir, 0755); err != nil {
@@ -61,6 +117,11 @@ func (e *ExecRunner) Start(ctx context.Context, logname string) (*Harness, error
 			return nil, err
 		}
 	}
+	var detach <-chan struct{}
+	if detached {
+		detach = ctx.Done()
+		ctx = context.Background()
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	cmd := exec.CommandContext(ctx, e.BinPath, command.Args()...)
 	cmd.Env = command.Env()
@@ -71,14 +132,30 @@ func (e *ExecRunner) Start(ctx context.Context, logname string) (*Harness, error
 		log.Println(cmd)
 	}
 
-	cmd.Stdout = util.NewLinePrefixer(e.config.NodeName, output)
-	cmd.Stderr = util.NewLinePrefixer(e.config.NodeName, output)
+	var stdout, stderrOut io.Writer = util.NewLinePrefixer(e.config.NodeName, output), util.NewLinePrefixer(e.config.NodeName, output)
+	if e.Output != nil && logname == "" {
+		stdout, stderrOut = e.Output, e.Output
+	}
+	stderr := &tapWriter{w: stderrOut}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if detached {
+		// Passing the file itself means the child inherits it, rather than
+		// writing to a pipe that goes away when we exit.
+		cmd.Stdout, cmd.Stderr = output, output
+	}
 
 	if err := cmd.Start(); err != nil {
 		cancel()
 		return nil, err
 	}
 
+	exit := &exitState{done: make(chan struct{})}
+	go func() {
+		exit.err = cmd.Wait()
+		close(exit.done)
+	}()
+
 	return &Harness{
 		Config: command.Config(),
 		cancel: func() {
@@ -86,7 +163,11 @@ func (e *ExecRunner) Start(ctx context.Context, logname string) (*Harness, error
 			//debug.PrintStack()
 			cancel()
 		},
-		cmd: cmd,
+		cmd:      cmd,
+		stderr:   stderr,
+		exit:     exit,
+		detach:   detach,
+		stopOnce: &sync.Once{},
 	}, nil
 }
 
@@ -103,6 +184,10 @@ func (h Harness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
 		}
 		apiConfig.CAFile = filepath.Join(h.Config.ConfigDir, "ca.pem")
 	}
+	if len(h.Config.ClientTLS.Cert) > 0 {
+		apiConfig.ClientCertFile = filepath.Join(h.Config.ConfigDir, "client.pem")
+		apiConfig.ClientKeyFile = filepath.Join(h.Config.ConfigDir, "client-key.pem")
+	}
 	apiConfig.Address.Scheme = name
 	apiConfig.Address.Host = fmt.Sprintf("%s:%d", "127.0.0.1", port.Number)
 
@@ -110,20 +195,86 @@ func (h Harness) Endpoint(name string, local bool) (*runner.APIConfig, error) {
 }
 
 func (h Harness) Wait() error {
-	err := h.cmd.Wait()
+	select {
+	case <-h.exit.done:
+	case <-h.detach:
+		return nil
+	}
+	err := h.exit.err
 	if err != nil && strings.Contains(err.Error(), "signal: killed") {
 		return nil
 	}
 	return err
 }
 
+// DumpStacks sends SIGQUIT to the process, which for a Go program means
+// writing the stacks of all goroutines to stderr and exiting.  The stderr
+// output produced until the process exits, or timeout expires, is copied to w.
+// The process isn't expected to survive this.
+func (h Harness) DumpStacks(w io.Writer, timeout time.Duration) error {
+	select {
+	case <-h.exit.done:
+		return fmt.Errorf("process has already exited")
+	default:
+	}
+
+	h.stderr.setTap(w)
+	defer h.stderr.setTap(nil)
+	if err := h.cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+		return err
+	}
+
+	select {
+	case <-h.exit.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for process to exit after SIGQUIT")
+	}
+}
+
+// Reload sends SIGHUP to the process, which Consul, Nomad and Vault take as
+// a request to reload their config files, including TLS certificates.
+func (h Harness) Reload() error {
+	select {
+	case <-h.exit.done:
+		return fmt.Errorf("process has already exited")
+	default:
+	}
+	return h.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+// DataDir returns the path of the node's data dir.
+func (h Harness) DataDir() string {
+	return h.Config.DataDir
+}
+
+// Pid returns the process ID of the running process.
+func (h Harness) Pid() int {
+	return h.cmd.Process.Pid
+}
+
 func (h Harness) Kill() {
 	h.cancel()
 }
 
+// Stop sends SIGTERM to the process and waits for it to exit, sending
+// SIGKILL if it hasn't done so within the config's StopGrace.
 func (h Harness) Stop() error {
-	h.cmd.Process.Signal(syscall.SIGTERM)
-	time.Sleep(3 * time.Second)
-	h.cancel()
+	h.stopOnce.Do(func() {
+		select {
+		case <-h.exit.done:
+			return
+		default:
+		}
+		_ = h.cmd.Process.Signal(syscall.SIGTERM)
+		grace := h.Config.StopGraceOrDefault()
+		select {
+		case <-h.exit.done:
+		case <-time.After(grace):
+			log.Printf("%s still running %s after SIGTERM, killing it", h.Config.NodeName, grace)
+		}
+		h.cancel()
+		<-h.exit.done
+	})
 	return nil
 }
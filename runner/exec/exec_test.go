@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type shCommand struct {
+	script string
+	config runner.Config
+}
+
+func (c shCommand) Name() string             { return "sh" }
+func (c shCommand) Args() []string           { return []string{"-c", c.script} }
+func (c shCommand) Env() []string            { return nil }
+func (c shCommand) Files() map[string]string { return nil }
+func (c shCommand) Config() runner.Config    { return c.config }
+func (c shCommand) WithConfig(cfg runner.Config) runner.Command {
+	c.config = cfg
+	return c
+}
+
+// TestStopKillsAfterGrace verifies that Stop kills a process ignoring SIGTERM
+// once the grace period is up, that it can be called repeatedly, and that
+// Wait gives the same result to concurrent callers.
+func TestStopKillsAfterGrace(t *testing.T) {
+	cfg := runner.Config{
+		ConfigDir: t.TempDir(),
+		NodeName:  t.Name(),
+		StopGrace: 200 * time.Millisecond,
+	}
+	r, err := NewExecRunner("/bin/sh", shCommand{script: `trap "" TERM; sleep 30`}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := r.Start(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("Stop took %s", took)
+	}
+	if err := h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = h.Wait()
+		}(i)
+	}
+	wg.Wait()
+	for i := range errs {
+		if errs[i] != errs[0] {
+			t.Fatalf("Wait results differ: %v", errs)
+		}
+	}
+}
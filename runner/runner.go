@@ -3,6 +3,7 @@ package runner
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/url"
 	"reflect"
 	"sort"
@@ -30,7 +31,37 @@ type (
 		// may not be an addressable name, depending on NetworkConfig.
 		NodeName string
 		TLS      pki.TLSConfigPEM
-		Ports    yurt.Ports
+		// ClientTLS is optional.  If given, the service should require API
+		// clients to present a certificate, and this is the one to use.
+		ClientTLS pki.TLSConfigPEM
+		Ports     yurt.Ports
+		// LogConfig, only used by docker runners, selects the log driver for
+		// the container.  The docker daemon's default is used if it's nil.
+		LogConfig *LogConfig
+		// DataMount, only used by docker runners, mounts something at DataDir
+		// rather than copying in a dir from the host.
+		DataMount *DataMount
+		// StopGrace is how long Stop waits for the process to exit after asking
+		// it to, before killing it.  DefaultStopGrace is used if it's zero.
+		StopGrace time.Duration
+	}
+
+	// LogConfig selects a docker log driver and its options, e.g. driver
+	// "json-file" with options {"max-size": "10m", "max-file": "3"} to rotate
+	// logs, or "journald".
+	LogConfig struct {
+		Driver  string
+		Options map[string]string
+	}
+
+	// DataMount describes what to mount at a container's data dir.  Type is
+	// "tmpfs", for data that needn't outlive the container, or "volume", for
+	// a docker volume named Name, which is created if need be.  SizeBytes, if
+	// non-zero, limits the size of a tmpfs, e.g. to test running out of disk.
+	DataMount struct {
+		Type      string
+		Name      string
+		SizeBytes int64
 	}
 
 	// Command describes how to run and interact with a process that starts
@@ -54,6 +85,10 @@ type (
 	APIConfig struct {
 		Address url.URL
 		CAFile  string
+		// ClientCertFile and ClientKeyFile are only needed when the service
+		// requires clients to authenticate using TLS certificates.
+		ClientCertFile string
+		ClientKeyFile  string
 	}
 
 	Harness interface {
@@ -63,8 +98,14 @@ type (
 		// on the execution model, i.e. whether port forwarding is being used
 		// to bridge the local and execution networks.
 		Endpoint(name string, local bool) (*APIConfig, error)
+		// Stop asks the process to exit, and returns once it has, killing
+		// it if it hasn't exited within the config's StopGrace.  Calling
+		// Stop again, or after the process has exited, does nothing.
 		Stop() error
 		Kill()
+		// Wait returns once the process has exited, with an error if it
+		// exited abnormally.  It may be called any number of times, from
+		// any number of goroutines, and always returns the same result.
 		Wait() error
 	}
 
@@ -86,33 +127,58 @@ type (
 	}
 )
 
+// DefaultStopGrace is the StopGrace used when Config doesn't give one.
+const DefaultStopGrace = 10 * time.Second
+
+// StopGraceOrDefault returns StopGrace, or DefaultStopGrace if it's zero.
+func (c Config) StopGraceOrDefault() time.Duration {
+	if c.StopGrace == 0 {
+		return DefaultStopGrace
+	}
+	return c.StopGrace
+}
+
+// LeaderPeerAPIsHealthyNow returns nil if all the apis agree on the leader,
+// and all report expectedPeers, which must be sorted.  Otherwise the error
+// is ErrNoLeader, an *ErrMultipleLeaders, or a *NodeError wrapping either an
+// *ErrPeerMismatch or the error returned by an api.
 func LeaderPeerAPIsHealthyNow(apis []LeaderPeersAPI, expectedPeers []string) error {
-	var errs []error
-	var peers []string
 	var leaders = make(map[string]struct{})
 
-	for _, api := range apis {
+	for i, api := range apis {
 		leader, err := api.Leader()
 		if err != nil {
-			errs = append(errs, err)
-			break
+			return &NodeError{Node: i, Err: err}
 		}
 		if leader != "" {
 			leaders[leader] = struct{}{}
 		}
-		peers, err = api.Peers()
+		peers, err := api.Peers()
 		if err != nil {
-			errs = append(errs, err)
-			break
+			return &NodeError{Node: i, Err: err}
+		}
+		sort.Strings(peers)
+		if !reflect.DeepEqual(peers, expectedPeers) {
+			return &NodeError{Node: i, Err: &ErrPeerMismatch{Want: expectedPeers, Got: peers}}
 		}
 	}
-	sort.Strings(peers)
-	if len(errs) == 0 && len(leaders) == 1 && reflect.DeepEqual(peers, expectedPeers) {
+	return checkLeaders(leaders)
+}
+
+// checkLeaders returns an error unless there's exactly one leader.
+func checkLeaders(leaders map[string]struct{}) error {
+	switch len(leaders) {
+	case 0:
+		return ErrNoLeader
+	case 1:
 		return nil
 	}
-
-	return fmt.Errorf("expected no errs, 1 leader, peers=%v, got %v, %v, %v", expectedPeers,
-		errs, leaders, peers)
+	var names []string
+	for leader := range leaders {
+		names = append(names, leader)
+	}
+	sort.Strings(names)
+	return &ErrMultipleLeaders{Leaders: names}
 }
 
 func LeaderPeerAPIsHealthy(ctx context.Context, apis []LeaderPeersAPI, expectedPeers []string) error {
@@ -145,25 +211,84 @@ func LeaderAPIsHealthy(ctx context.Context, apis []LeaderAPI) error {
 	return err
 }
 
+// WaitClosed polls until h no longer accepts connections on any of the named
+// endpoints, e.g. because it has been stopped, or until ctx is done.
+func WaitClosed(ctx context.Context, h Harness, names ...string) error {
+	var addrs []string
+	for _, name := range names {
+		cfg, err := h.Endpoint(name, true)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, cfg.Address.Host)
+	}
+
+	for ctx.Err() == nil {
+		var open []string
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				conn.Close()
+				open = append(open, addr)
+			}
+		}
+		if len(open) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("still listening on %v: %w", open, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return ctx.Err()
+}
+
+// LeaderAPIsHealthyNow returns the leader if all the apis agree on it.
+// Otherwise the error is as for LeaderPeerAPIsHealthyNow.
 func LeaderAPIsHealthyNow(apis []LeaderAPI) (string, error) {
-	var errs []error
 	var leaders = make(map[string]struct{})
 
-	for _, api := range apis {
+	for i, api := range apis {
 		leader, err := api.Leader()
 		if err != nil {
-			errs = append(errs, err)
-			break
+			return "", &NodeError{Node: i, Err: err}
 		}
 		if leader != "" {
 			leaders[leader] = struct{}{}
 		}
 	}
-	if len(errs) == 0 && len(leaders) == 1 {
-		for leader := range leaders {
-			return leader, nil
-		}
+	if err := checkLeaders(leaders); err != nil {
+		return "", err
+	}
+	for leader := range leaders {
+		return leader, nil
 	}
+	return "", ErrNoLeader
+}
+
+// VersionedCommand is a Command that must be run using a specific version of
+// its binary, rather than the default one.
+type VersionedCommand interface {
+	Command
+	Version() string
+}
+
+type versionedCommand struct {
+	Command
+	version string
+}
+
+func (v versionedCommand) Version() string {
+	return v.version
+}
+
+func (v versionedCommand) WithConfig(cfg Config) Command {
+	return versionedCommand{v.Command.WithConfig(cfg), v.version}
+}
 
-	return "", fmt.Errorf("expected no errs, 1 leader got %v, %v", errs, leaders)
+// WithVersion returns cmd wrapped so that it's run using the given version of
+// its binary, by envs that support that.
+func WithVersion(cmd Command, version string) VersionedCommand {
+	return versionedCommand{cmd, version}
 }
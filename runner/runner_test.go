@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeLeaderPeers struct {
+	leader string
+	peers  []string
+	err    error
+}
+
+func (f fakeLeaderPeers) Leader() (string, error) {
+	return f.leader, f.err
+}
+
+func (f fakeLeaderPeers) Peers() ([]string, error) {
+	return append([]string(nil), f.peers...), nil
+}
+
+func TestLeaderPeerAPIsHealthyNowErrors(t *testing.T) {
+	peers := []string{"a", "b"}
+	errDown := errors.New("connection refused")
+
+	err := LeaderPeerAPIsHealthyNow([]LeaderPeersAPI{
+		fakeLeaderPeers{leader: "a", peers: []string{"b", "a"}},
+		fakeLeaderPeers{leader: "a", peers: peers},
+	}, peers)
+	if err != nil {
+		t.Fatalf("expected healthy, got %v", err)
+	}
+
+	err = LeaderPeerAPIsHealthyNow([]LeaderPeersAPI{
+		fakeLeaderPeers{peers: peers},
+		fakeLeaderPeers{peers: peers},
+	}, peers)
+	if !errors.Is(err, ErrNoLeader) {
+		t.Fatalf("expected ErrNoLeader, got %v", err)
+	}
+
+	err = LeaderPeerAPIsHealthyNow([]LeaderPeersAPI{
+		fakeLeaderPeers{leader: "a", peers: peers},
+		fakeLeaderPeers{leader: "b", peers: peers},
+	}, peers)
+	var multi *ErrMultipleLeaders
+	if !errors.As(err, &multi) || len(multi.Leaders) != 2 {
+		t.Fatalf("expected ErrMultipleLeaders, got %v", err)
+	}
+
+	err = LeaderPeerAPIsHealthyNow([]LeaderPeersAPI{
+		fakeLeaderPeers{leader: "a", peers: peers},
+		fakeLeaderPeers{leader: "a", peers: []string{"a"}},
+	}, peers)
+	var mismatch *ErrPeerMismatch
+	var nodeErr *NodeError
+	if !errors.As(err, &mismatch) || !errors.As(err, &nodeErr) || nodeErr.Node != 1 {
+		t.Fatalf("expected ErrPeerMismatch on node 1, got %v", err)
+	}
+
+	err = LeaderPeerAPIsHealthyNow([]LeaderPeersAPI{
+		fakeLeaderPeers{err: errDown},
+	}, peers)
+	if !errors.Is(err, errDown) || !errors.As(err, &nodeErr) || nodeErr.Node != 0 {
+		t.Fatalf("expected wrapped API error on node 0, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package yurt
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// ServiceDescriptor is a machine-readable description of a kind of service
+// that yurt knows how to run, e.g. Consul or Vault.  Each service package
+// registers its descriptor, so that code needing to treat services
+// generically can look them up by name instead of hard-coding them.
+type ServiceDescriptor struct {
+	// Name is the command name, i.e. what runner.Command.Name returns and
+	// the binary that gets run.
+	Name string
+	// Ports are the default ports.
+	Ports Ports
+	// Roles are the roles a node of this service can play, e.g. server.
+	Roles []string
+	// Metrics describes where Prometheus metrics are exposed, if anywhere.
+	Metrics *Endpoint
+	// Health lists endpoints that return 200 when a node is healthy.
+	Health []Endpoint
+	// Docker describes how to run the service in a container, if supported.
+	Docker *DockerDescriptor
+	// ConfigSchema lists the service-specific settings of its Config.
+	ConfigSchema []ConfigField
+}
+
+// Endpoint is an HTTP path served on a named port.
+type Endpoint struct {
+	Port   string
+	Path   string
+	Params url.Values
+}
+
+// DockerDescriptor gives the image and in-container paths used by DockerEnv.
+type DockerDescriptor struct {
+	Image     string
+	ConfigDir string
+	DataDir   string
+	LogDir    string
+	// Entrypoint, if set, replaces the entrypoint used to run the command's
+	// args, which by default is the docker-entrypoint.sh script of the
+	// HashiCorp images.
+	Entrypoint []string
+	// TagPrefix is prepended to versions to get image tags, for images not
+	// tagged with the bare version, e.g. "v" for prom/prometheus.
+	TagPrefix string
+}
+
+// ConfigField describes a single setting of a service Config.
+type ConfigField struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+var services = struct {
+	sync.Mutex
+	byName map[string]ServiceDescriptor
+}{
+	byName: map[string]ServiceDescriptor{},
+}
+
+// RegisterService adds d to the registry; it panics if a service with the
+// same name is already registered.  It's meant to be called from init.
+func RegisterService(d ServiceDescriptor) {
+	services.Lock()
+	defer services.Unlock()
+	if _, ok := services.byName[d.Name]; ok {
+		panic(fmt.Sprintf("service %q registered twice", d.Name))
+	}
+	services.byName[d.Name] = d
+}
+
+// LookupService returns the descriptor of the named service.
+func LookupService(name string) (ServiceDescriptor, bool) {
+	services.Lock()
+	defer services.Unlock()
+	d, ok := services.byName[name]
+	return d, ok
+}
+
+// Services returns the descriptors of all registered services, sorted by name.
+func Services() []ServiceDescriptor {
+	services.Lock()
+	defer services.Unlock()
+	var ret []ServiceDescriptor
+	for _, d := range services.byName {
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
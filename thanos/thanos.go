@@ -0,0 +1,261 @@
+package thanos
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/runner"
+	"gopkg.in/yaml.v2"
+)
+
+type Ports struct {
+	HTTP int
+	GRPC int
+}
+
+var PortNames = struct {
+	HTTP string
+	GRPC string
+}{
+	"http",
+	"grpc",
+}
+
+func DefPorts() Ports {
+	return Ports{
+		HTTP: 10902,
+		GRPC: 10901,
+	}
+}
+
+func (c Ports) runnerPorts(kind string) yurt.Ports {
+	return yurt.Ports{
+		Kind: kind,
+		NameOrder: []string{
+			PortNames.HTTP,
+			PortNames.GRPC,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+			PortNames.GRPC: {Number: c.GRPC, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// SidecarPorts returns the ports of a sidecar, with Kind "thanos-sidecar".
+func (c Ports) SidecarPorts() yurt.Ports {
+	return c.runnerPorts("thanos-sidecar")
+}
+
+// QueryPorts returns the ports of a querier, with Kind "thanos-query".
+func (c Ports) QueryPorts() yurt.Ports {
+	return c.runnerPorts("thanos-query")
+}
+
+// Descriptor describes Thanos for the yurt service registry.  Both roles
+// are run using the same binary.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "thanos",
+	Ports:   DefPorts().SidecarPorts(),
+	Roles:   []string{"sidecar", "query"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/metrics"},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/-/healthy"},
+		{Port: PortNames.HTTP, Path: "/-/ready"},
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "PrometheusAddr", Type: "string", Description: "sidecar: URL of the Prometheus API"},
+		{Name: "PrometheusDataDir", Type: "string", Description: "sidecar: TSDB dir of Prometheus"},
+		{Name: "ObjStore", Type: "*ObjStoreConfig", Description: "sidecar: bucket to upload blocks to"},
+		{Name: "Stores", Type: "[]string", Description: "query: gRPC addresses of the store APIs to query"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
+// ObjStoreConfig describes an S3 compatible bucket, e.g. one in a MinIO
+// server run using the minio package.
+type ObjStoreConfig struct {
+	Bucket string
+	// Endpoint is host:port, without a scheme.
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	// Insecure means use http rather than https.
+	Insecure bool
+}
+
+func (o ObjStoreConfig) yaml() string {
+	type s3Config struct {
+		Bucket    string `yaml:"bucket"`
+		Endpoint  string `yaml:"endpoint"`
+		AccessKey string `yaml:"access_key"`
+		SecretKey string `yaml:"secret_key"`
+		Insecure  bool   `yaml:"insecure"`
+	}
+	b, err := yaml.Marshal(struct {
+		Type   string   `yaml:"type"`
+		Config s3Config `yaml:"config"`
+	}{
+		Type:   "S3",
+		Config: s3Config(o),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// SidecarConfig describes how to run a Thanos sidecar next to a Prometheus
+// server, exposing its data via the store API, and optionally uploading its
+// blocks to an object store.  Prometheus must have external labels that
+// identify it uniquely.
+type SidecarConfig struct {
+	Common runner.Config
+	// PrometheusAddr is the URL of the Prometheus API.
+	PrometheusAddr string
+	// PrometheusDataDir is the TSDB path of Prometheus, i.e. its DataDir.
+	PrometheusDataDir string
+	// ObjStore is optional.  If given, Prometheus should be run with a
+	// StorageConfig.BlockDuration.
+	ObjStore *ObjStoreConfig
+}
+
+func (c SidecarConfig) Config() runner.Config {
+	return c.Common
+}
+
+func (c SidecarConfig) Name() string {
+	return "thanos"
+}
+
+func NewSidecarConfig(promAddr, promDataDir string, objStore *ObjStoreConfig) SidecarConfig {
+	return SidecarConfig{
+		PrometheusAddr:    promAddr,
+		PrometheusDataDir: promDataDir,
+		ObjStore:          objStore,
+		Common: runner.Config{
+			Ports: DefPorts().SidecarPorts(),
+		},
+	}
+}
+
+func (c SidecarConfig) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func listenArgs(cfg runner.Config) []string {
+	addr := "127.0.0.1"
+	if cfg.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	return []string{
+		fmt.Sprintf("--http-address=%s:%d", addr, cfg.Ports.ByName[PortNames.HTTP].Number),
+		fmt.Sprintf("--grpc-address=%s:%d", addr, cfg.Ports.ByName[PortNames.GRPC].Number),
+	}
+}
+
+func (c SidecarConfig) Args() []string {
+	args := append([]string{"sidecar",
+		fmt.Sprintf("--tsdb.path=%s", c.PrometheusDataDir),
+		fmt.Sprintf("--prometheus.url=%s", c.PrometheusAddr),
+	}, listenArgs(c.Common)...)
+	if c.ObjStore != nil {
+		args = append(args, fmt.Sprintf("--objstore.config-file=%s/objstore.yml", c.Common.ConfigDir))
+	}
+	return args
+}
+
+func (c SidecarConfig) Env() []string {
+	return nil
+}
+
+func (c SidecarConfig) Files() map[string]string {
+	if c.ObjStore == nil {
+		return nil
+	}
+	return map[string]string{
+		"objstore.yml": c.ObjStore.yaml(),
+	}
+}
+
+// QueryConfig describes how to run a Thanos querier, which exposes a
+// Prometheus compatible query API over all the store APIs it's given, e.g.
+// those of several sidecars.
+type QueryConfig struct {
+	Common runner.Config
+	// Stores are the host:port gRPC addresses of the store APIs to query.
+	Stores []string
+}
+
+func (c QueryConfig) Config() runner.Config {
+	return c.Common
+}
+
+func (c QueryConfig) Name() string {
+	return "thanos"
+}
+
+func NewQueryConfig(stores []string) QueryConfig {
+	return QueryConfig{
+		Stores: stores,
+		Common: runner.Config{
+			Ports: DefPorts().QueryPorts(),
+		},
+	}
+}
+
+func (c QueryConfig) WithConfig(cfg runner.Config) runner.Command {
+	c.Common = cfg
+	return c
+}
+
+func (c QueryConfig) Args() []string {
+	args := append([]string{"query"}, listenArgs(c.Common)...)
+	for _, store := range c.Stores {
+		args = append(args, "--store="+store)
+	}
+	return args
+}
+
+func (c QueryConfig) Env() []string {
+	return nil
+}
+
+func (c QueryConfig) Files() map[string]string {
+	return nil
+}
+
+// HealthCheck waits until the Thanos component at addr, e.g.
+// http://127.0.0.1:10902, is ready.
+func HealthCheck(ctx context.Context, addr string) error {
+	var err error
+	for ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, addr+"/-/ready", nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("ready status %d", resp.StatusCode)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
@@ -3,6 +3,8 @@ package yurt
 import (
 	"context"
 	"fmt"
+	"net"
+
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/ncabatoff/yurt/pki"
 )
@@ -17,6 +19,31 @@ type CertificateMaker interface {
 	MakeCertificate(ctx context.Context, hostname, ip string) (*pki.TLSConfigPEM, error)
 }
 
+// CertificateMakers maps service kinds, e.g. "consul", "nomad" or "vault",
+// to the CertificateMaker used to issue certificates to nodes of that kind.
+// This is how custom cert issuance, e.g. using step-ca or cert-manager, gets
+// plugged in per service.
+type CertificateMakers map[string]CertificateMaker
+
+// MakeCertificate returns a certificate for node using the maker for kind,
+// or nil if there is none.  The node name is given as the hostname, and the
+// node host as the IP if it is one.
+func (c CertificateMakers) MakeCertificate(ctx context.Context, kind string, node Node) (*pki.TLSConfigPEM, error) {
+	maker := c[kind]
+	if maker == nil {
+		return nil, nil
+	}
+	var ip string
+	if net.ParseIP(node.Host) != nil {
+		ip = node.Host
+	}
+	tls, err := maker.MakeCertificate(ctx, node.Name, ip)
+	if err != nil {
+		return nil, fmt.Errorf("error making %s certificate for %s: %w", kind, node.Name, err)
+	}
+	return tls, nil
+}
+
 // A Node describes a service instance, typically a member or future member of a
 // cluster.  The Node may not yet exist.  Multiple nodes of different types may
 // map to the same host, e.g. a host might run both Consul and Nomad, and may
@@ -0,0 +1,154 @@
+package vault
+
+import (
+	"fmt"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+type AgentPorts struct {
+	HTTP int
+}
+
+func DefAgentPorts() AgentPorts {
+	return AgentPorts{
+		HTTP: 8100,
+	}
+}
+
+func (c AgentPorts) RunnerPorts() yurt.Ports {
+	return yurt.Ports{
+		Kind: "vault-agent",
+		NameOrder: []string{
+			PortNames.HTTP,
+		},
+		ByName: map[string]yurt.Port{
+			PortNames.HTTP: {Number: c.HTTP, Type: yurt.TCPOnly},
+		},
+	}
+}
+
+// AgentConfig describes how to run Vault Agent as a caching API proxy in
+// front of a Vault server.  The agent listens without TLS, so HarnessToAPI
+// on its harness yields a plain HTTP client whose requests go through the
+// agent's cache.  Clients supply their own tokens, unless AppRole is given,
+// in which case requests without a token use the agent's auto-auth token.
+type AgentConfig struct {
+	Common runner.Config
+	// VaultAddr is the URL of the Vault server to proxy.
+	VaultAddr string
+	// AppRole, if given, configures approle auto-auth.
+	AppRole *AgentAppRole
+}
+
+// AgentAppRole holds the approle credentials used for auto-auth.
+type AgentAppRole struct {
+	RoleID   string
+	SecretID string
+}
+
+func (ac AgentConfig) Config() runner.Config {
+	return ac.Common
+}
+
+func (ac AgentConfig) Name() string {
+	return "vault"
+}
+
+// NewAgentConfig returns a config for an agent proxying vaultAddr.  Only the
+// CA of tls is used, to verify the server; the agent's own listener doesn't
+// use TLS.
+func NewAgentConfig(vaultAddr string, tls *pki.TLSConfigPEM) AgentConfig {
+	var t pki.TLSConfigPEM
+	if tls != nil {
+		t.CA = tls.CA
+	}
+	return AgentConfig{
+		VaultAddr: vaultAddr,
+		Common: runner.Config{
+			Ports: DefAgentPorts().RunnerPorts(),
+			TLS:   t,
+		},
+	}
+}
+
+// WithClientTLS returns a copy of ac that presents the given certificate to
+// the server, as needed when the server requires client certificates.
+func (ac AgentConfig) WithClientTLS(clientTLS *pki.TLSConfigPEM) AgentConfig {
+	if clientTLS != nil {
+		ac.Common.ClientTLS = *clientTLS
+	}
+	return ac
+}
+
+func (ac AgentConfig) WithAppRole(appRole *AgentAppRole) AgentConfig {
+	ac.AppRole = appRole
+	return ac
+}
+
+func (ac AgentConfig) WithConfig(cfg runner.Config) runner.Command {
+	ac.Common = cfg
+	return ac
+}
+
+func (ac AgentConfig) Args() []string {
+	return []string{"agent", fmt.Sprintf("-config=%s/agent.hcl", ac.Common.ConfigDir)}
+}
+
+func (ac AgentConfig) Env() []string {
+	return nil
+}
+
+func (ac AgentConfig) Files() map[string]string {
+	files := map[string]string{}
+	dir := ac.Common.ConfigDir
+
+	server := fmt.Sprintf("  address = \"%s\"\n", ac.VaultAddr)
+	if ac.Common.TLS.CA != "" {
+		files["ca.pem"] = ac.Common.TLS.CA
+		server += fmt.Sprintf("  ca_cert = \"%s/ca.pem\"\n", dir)
+	}
+	if ac.Common.ClientTLS.Cert != "" {
+		files["client.pem"] = ac.Common.ClientTLS.Cert
+		files["client-key.pem"] = ac.Common.ClientTLS.PrivateKey
+		server += fmt.Sprintf("  client_cert = \"%s/client.pem\"\n  client_key = \"%s/client-key.pem\"\n", dir, dir)
+	}
+
+	addr := "127.0.0.1"
+	if ac.Common.NetworkConfig.Network != nil {
+		addr = "0.0.0.0"
+	}
+	config := fmt.Sprintf(`
+pid_file = "%s/agent.pid"
+vault {
+%s}
+cache {
+  use_auto_auth_token = %v
+}
+listener "tcp" {
+  address = "%s:%d"
+  tls_disable = true
+}
+`, ac.Common.DataDir, server, ac.AppRole != nil, addr, ac.Common.Ports.ByName[PortNames.HTTP].Number)
+
+	if ac.AppRole != nil {
+		files["role-id"] = ac.AppRole.RoleID
+		files["secret-id"] = ac.AppRole.SecretID
+		config += fmt.Sprintf(`
+auto_auth {
+  method "approle" {
+    config = {
+      role_id_file_path = "%s/role-id"
+      secret_id_file_path = "%s/secret-id"
+      remove_secret_id_file_after_reading = false
+    }
+  }
+}
+`, dir, dir)
+	}
+
+	files["agent.hcl"] = config
+	return files
+}
@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// Autopilot upgrade statuses reported by Vault Enterprise.
+const (
+	UpgradeStatusIdle               = "idle"
+	UpgradeStatusAwaitNewVoters     = "await-new-voters"
+	UpgradeStatusPromoting          = "promoting"
+	UpgradeStatusDemoting           = "demoting"
+	UpgradeStatusLeaderTransfer     = "leader-transfer"
+	UpgradeStatusAwaitNewServers    = "await-new-servers"
+	UpgradeStatusAwaitServerRemoval = "await-server-removal"
+	UpgradeStatusDisabled           = "disabled"
+)
+
+// EnterpriseAutopilotState holds the parts of the autopilot state that are
+// only reported by Vault Enterprise, and aren't exposed by our vault/api.
+type EnterpriseAutopilotState struct {
+	Leader          string                    `json:"leader"`
+	Voters          []string                  `json:"voters"`
+	RedundancyZones map[string]RedundancyZone `json:"redundancy_zones"`
+	UpgradeInfo     *UpgradeInfo              `json:"upgrade_info"`
+}
+
+type RedundancyZone struct {
+	Servers          []string `json:"servers"`
+	Voters           []string `json:"voters"`
+	FailureTolerance int      `json:"failure_tolerance"`
+}
+
+type UpgradeInfo struct {
+	Status                 string   `json:"status"`
+	TargetVersion          string   `json:"target_version"`
+	TargetVersionVoters    []string `json:"target_version_voters"`
+	TargetVersionNonVoters []string `json:"target_version_non_voters"`
+	OtherVersionVoters     []string `json:"other_version_voters"`
+	OtherVersionNonVoters  []string `json:"other_version_non_voters"`
+	RedundancyZones        map[string]struct {
+		TargetVersionVoters []string `json:"target_version_voters"`
+		OtherVersionVoters  []string `json:"other_version_voters"`
+	} `json:"redundancy_zones"`
+}
+
+// ReadEnterpriseAutopilotState returns the Enterprise parts of the autopilot
+// state, which are empty when talking to an OSS server.
+func ReadEnterpriseAutopilotState(cli *vaultapi.Client) (*EnterpriseAutopilotState, error) {
+	secret, err := cli.Logical().Read("sys/storage/raft/autopilot/state")
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no autopilot state returned")
+	}
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return nil, err
+	}
+	var state EnterpriseAutopilotState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SetUpgradeMigration enables or disables autopilot automated upgrades.
+func SetUpgradeMigration(cli *vaultapi.Client, enabled bool) error {
+	_, err := cli.Logical().Write("sys/storage/raft/autopilot/configuration", map[string]interface{}{
+		"disable_upgrade_migration": !enabled,
+	})
+	return err
+}
+
+// AutopilotUpgraded waits until autopilot reports that the automated upgrade
+// to targetVersion has completed: all voters run the target version, and
+// autopilot is waiting for the old servers to be removed.
+func AutopilotUpgraded(ctx context.Context, servers []runner.Harness, token, targetVersion string) error {
+	return AnyVault(ctx, servers, func(client *vaultapi.Client) error {
+		client.SetToken(token)
+		state, err := ReadEnterpriseAutopilotState(client)
+		if err != nil {
+			return err
+		}
+		info := state.UpgradeInfo
+		switch {
+		case info == nil:
+			return fmt.Errorf("no upgrade info, not an enterprise server?")
+		case info.TargetVersion != targetVersion:
+			return fmt.Errorf("upgrade target version is %q", info.TargetVersion)
+		case info.Status != UpgradeStatusAwaitServerRemoval && info.Status != UpgradeStatusIdle:
+			return fmt.Errorf("upgrade status is %q", info.Status)
+		case len(info.OtherVersionVoters) > 0:
+			return fmt.Errorf("old version voters remain: %v", info.OtherVersionVoters)
+		}
+		return nil
+	})
+}
+
+// RedundancyZonesHealthy waits until every zone has exactly one voter and
+// the given number of servers in total.
+func RedundancyZonesHealthy(ctx context.Context, servers []runner.Harness, token string, zoneServers map[string]int) error {
+	return AnyVault(ctx, servers, func(client *vaultapi.Client) error {
+		client.SetToken(token)
+		state, err := ReadEnterpriseAutopilotState(client)
+		if err != nil {
+			return err
+		}
+		for name, count := range zoneServers {
+			zone, ok := state.RedundancyZones[name]
+			switch {
+			case !ok:
+				return fmt.Errorf("zone %s not reported", name)
+			case len(zone.Servers) != count:
+				return fmt.Errorf("zone %s has servers %v, want %d", name, zone.Servers, count)
+			case len(zone.Voters) != 1:
+				return fmt.Errorf("zone %s has voters %v, want 1", name, zone.Voters)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,258 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// Profile describes what Bootstrap should create in a Vault cluster.
+type Profile struct {
+	// Mounts maps mount path to secrets engine type.  As well as the usual
+	// engine types, "kv-v2" may be used to get a version 2 KV mount.
+	// PKI mounts get a root CA and a role named "default" allowing any name;
+	// transit mounts get a key named "default".
+	Mounts map[string]string
+	// Policies maps policy name to policy HCL.
+	Policies map[string]string
+	// AppRoles maps AppRole role name to the policies of the tokens issued
+	// when logging in with it.  If non-empty the approle auth method is enabled.
+	AppRoles map[string][]string
+	// Secrets are written to KV v2 mounts.
+	Secrets []KVSecret
+}
+
+// KVSecret is a secret to be written to a KV v2 mount.
+type KVSecret struct {
+	Mount string
+	Path  string
+	Data  map[string]interface{}
+}
+
+// AppRoleCreds are the credentials needed to log in using an AppRole role.
+type AppRoleCreds struct {
+	RoleID   string
+	SecretID string
+}
+
+// BootstrapResult describes what Bootstrap created that isn't known in advance.
+type BootstrapResult struct {
+	// AppRoles maps AppRole role name to its credentials.
+	AppRoles map[string]AppRoleCreds
+}
+
+// DefaultProfile returns a profile with one each of the commonly used secrets
+// engines, a read-only policy for the sample secrets, and an AppRole role
+// using that policy.
+func DefaultProfile() Profile {
+	return Profile{
+		Mounts: map[string]string{
+			"secret":  "kv-v2",
+			"pki":     "pki",
+			"transit": "transit",
+		},
+		Policies: map[string]string{
+			"app-read": `
+path "secret/data/app/*" {
+  capabilities = ["read"]
+}
+
+path "transit/encrypt/default" {
+  capabilities = ["update"]
+}
+
+path "transit/decrypt/default" {
+  capabilities = ["update"]
+}
+
+path "pki/issue/default" {
+  capabilities = ["update"]
+}
+`,
+		},
+		AppRoles: map[string][]string{
+			"app": {"app-read"},
+		},
+		Secrets: []KVSecret{
+			{
+				Mount: "secret",
+				Path:  "app/config",
+				Data: map[string]interface{}{
+					"username": "app",
+					"password": "correct-horse-battery-staple",
+				},
+			},
+		},
+	}
+}
+
+// Bootstrap creates the mounts, policies, roles and secrets described by
+// profile using cli, which must have a sufficiently privileged token, e.g. root.
+// Things that already exist are updated rather than treated as errors, so it's
+// safe to bootstrap a cluster that was bootstrapped in a previous run.
+func Bootstrap(ctx context.Context, cli *vaultapi.Client, profile Profile) (*BootstrapResult, error) {
+	for path, typ := range profile.Mounts {
+		if err := ensureMount(cli, path, typ); err != nil {
+			return nil, err
+		}
+		if err := setupMount(ctx, cli, path, typ); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, policy := range profile.Policies {
+		if err := cli.Sys().PutPolicy(name, policy); err != nil {
+			return nil, fmt.Errorf("error writing policy %s: %w", name, err)
+		}
+	}
+
+	result := &BootstrapResult{
+		AppRoles: map[string]AppRoleCreds{},
+	}
+	if len(profile.AppRoles) > 0 {
+		if err := ensureAuth(cli, "approle", "approle"); err != nil {
+			return nil, err
+		}
+	}
+	for name, policies := range profile.AppRoles {
+		creds, err := createAppRole(cli, name, policies)
+		if err != nil {
+			return nil, err
+		}
+		result.AppRoles[name] = *creds
+	}
+
+	for _, secret := range profile.Secrets {
+		path := fmt.Sprintf("%s/data/%s", secret.Mount, secret.Path)
+		data := map[string]interface{}{"data": secret.Data}
+		if err := writeWithRetry(ctx, cli, path, data); err != nil {
+			return nil, fmt.Errorf("error writing secret %s: %w", path, err)
+		}
+	}
+
+	return result, nil
+}
+
+func ensureMount(cli *vaultapi.Client, path, typ string) error {
+	input := &vaultapi.MountInput{
+		Type: typ,
+	}
+	if typ == "kv-v2" {
+		input.Type = "kv"
+		input.Options = map[string]string{"version": "2"}
+	}
+	if typ == "pki" {
+		input.Config.MaxLeaseTTL = "87600h"
+	}
+
+	err := cli.Sys().Mount(path, input)
+	if err == nil {
+		return nil
+	}
+	// If we get an error mounting, see if it's already mounted.
+	mounts, listerr := cli.Sys().ListMounts()
+	if listerr != nil {
+		return err
+	}
+	if mount, ok := mounts[strings.TrimSuffix(path, "/")+"/"]; ok && mount.Type == input.Type {
+		return nil
+	}
+	return fmt.Errorf("error mounting %s at %s: %w", typ, path, err)
+}
+
+func ensureAuth(cli *vaultapi.Client, path, typ string) error {
+	err := cli.Sys().EnableAuthWithOptions(path, &vaultapi.EnableAuthOptions{
+		Type: typ,
+	})
+	if err == nil {
+		return nil
+	}
+	auths, listerr := cli.Sys().ListAuth()
+	if listerr != nil {
+		return err
+	}
+	if auth, ok := auths[strings.TrimSuffix(path, "/")+"/"]; ok && auth.Type == typ {
+		return nil
+	}
+	return fmt.Errorf("error enabling auth %s at %s: %w", typ, path, err)
+}
+
+func setupMount(ctx context.Context, cli *vaultapi.Client, path, typ string) error {
+	switch typ {
+	case "pki":
+		resp, err := cli.Logical().Read(path + "/cert/ca")
+		if err != nil {
+			return err
+		}
+		if resp == nil || resp.Data["certificate"] == "" {
+			_, err = cli.Logical().Write(path+"/root/generate/internal", map[string]interface{}{
+				"common_name": "example.com",
+				"ttl":         "87600h",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = cli.Logical().Write(path+"/roles/default", map[string]interface{}{
+			"allow_any_name": "true",
+			"allow_ip_sans":  "true",
+			"max_ttl":        "720h",
+		})
+		return err
+	case "transit":
+		return writeWithRetry(ctx, cli, path+"/keys/default", nil)
+	}
+	return nil
+}
+
+func createAppRole(cli *vaultapi.Client, name string, policies []string) (*AppRoleCreds, error) {
+	_, err := cli.Logical().Write("auth/approle/role/"+name, map[string]interface{}{
+		"token_policies": policies,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating approle %s: %w", name, err)
+	}
+
+	resp, err := cli.Logical().Read("auth/approle/role/" + name + "/role-id")
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Data == nil {
+		return nil, fmt.Errorf("no role-id returned for approle %s", name)
+	}
+	roleID, _ := resp.Data["role_id"].(string)
+
+	resp, err = cli.Logical().Write("auth/approle/role/"+name+"/secret-id", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Data == nil {
+		return nil, fmt.Errorf("no secret-id returned for approle %s", name)
+	}
+	secretID, _ := resp.Data["secret_id"].(string)
+
+	return &AppRoleCreds{
+		RoleID:   roleID,
+		SecretID: secretID,
+	}, nil
+}
+
+// writeWithRetry is needed because newly created mounts aren't always
+// immediately usable, e.g. KV v2 mounts go through an upgrade step.
+func writeWithRetry(ctx context.Context, cli *vaultapi.Client, path string, data map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var err error
+	for ctx.Err() == nil {
+		_, err = cli.Logical().Write(path, data)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
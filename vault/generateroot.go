@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// defaultOTPLength is the length of the OTPs used by Vault versions before
+// 1.10, which don't report it or generate one themselves.
+const defaultOTPLength = 26
+
+// GenerateRoot creates a new root token using the unseal keys given, e.g. on
+// a performance secondary, whose token store isn't shared with its primary.
+// Any generate-root attempt already in progress is cancelled.
+func GenerateRoot(ctx context.Context, cli *vaultapi.Client, unsealKeys []string) (string, error) {
+	sys := cli.Sys()
+	status, err := sys.GenerateRootStatus()
+	if err != nil {
+		return "", fmt.Errorf("error getting generate-root status: %w", err)
+	}
+	if status.Started {
+		if err := sys.GenerateRootCancel(); err != nil {
+			return "", fmt.Errorf("error cancelling generate-root attempt: %w", err)
+		}
+	}
+
+	// Vault 1.10 and later generate the OTP, earlier versions need us to.
+	otp := ""
+	status, err = sys.GenerateRootInit("", "")
+	if err == nil && status.OTP != "" {
+		otp = status.OTP
+	} else {
+		if err == nil {
+			_ = sys.GenerateRootCancel()
+		}
+		length := defaultOTPLength
+		if status != nil && status.OTPLength > 0 {
+			length = status.OTPLength
+		}
+		otp, err = randomOTP(length)
+		if err != nil {
+			return "", err
+		}
+		status, err = sys.GenerateRootInit(otp, "")
+		if err != nil {
+			return "", fmt.Errorf("error starting generate-root: %w", err)
+		}
+	}
+
+	for _, key := range unsealKeys {
+		if err := ctx.Err(); err != nil {
+			_ = sys.GenerateRootCancel()
+			return "", err
+		}
+		status, err = sys.GenerateRootUpdate(key, status.Nonce)
+		if err != nil {
+			return "", fmt.Errorf("error providing unseal key to generate-root: %w", err)
+		}
+		if status.Complete {
+			break
+		}
+	}
+	if !status.Complete {
+		_ = sys.GenerateRootCancel()
+		return "", fmt.Errorf("generate-root incomplete after %d unseal keys, %d required", status.Progress, status.Required)
+	}
+
+	encoded := status.EncodedToken
+	if encoded == "" {
+		encoded = status.EncodedRootToken
+	}
+	return decodeRootToken(encoded, otp)
+}
+
+// decodeRootToken recovers the token generate-root encoded using otp.
+func decodeRootToken(encoded, otp string) (string, error) {
+	b, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error decoding root token: %w", err)
+	}
+	if len(b) != len(otp) {
+		return "", fmt.Errorf("encoded root token length %d doesn't match OTP length %d", len(b), len(otp))
+	}
+	token := make([]byte, len(b))
+	for i := range b {
+		token[i] = b[i] ^ otp[i]
+	}
+	return string(token), nil
+}
+
+const otpChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomOTP returns a random base62 string of the given length, the form of
+// OTP Vault expects.
+func randomOTP(length int) (string, error) {
+	otp := make([]byte, length)
+	for i := range otp {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(otpChars))))
+		if err != nil {
+			return "", err
+		}
+		otp[i] = otpChars[n.Int64()]
+	}
+	return string(otp), nil
+}
@@ -0,0 +1,89 @@
+package vault
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ncabatoff/yurt/runner"
+)
+
+// MigrateConfig describes how to run "vault operator migrate" to copy the
+// storage of a Consul-backed Vault cluster to Integrated Storage (raft).
+// Vault must not be running against the source storage during migration.
+// The command should be run as the node that will become the first raft
+// node, so that the raft data is written to that node's data dir.
+type MigrateConfig struct {
+	Common runner.Config
+	// ConsulAddr gives the host:port of the Consul agent to read from.
+	ConsulAddr string
+	// ConsulPath gives the Consul KV prefix where Vault stored its data.
+	ConsulPath string
+	// ClusterAddr is the host:port of the destination raft node's cluster
+	// listener.
+	ClusterAddr string
+}
+
+var _ runner.Command = MigrateConfig{}
+
+func NewMigrateConfig(consulAddr, consulPath, clusterAddr string) MigrateConfig {
+	return MigrateConfig{
+		ConsulAddr:  consulAddr,
+		ConsulPath:  consulPath,
+		ClusterAddr: clusterAddr,
+		Common: runner.Config{
+			Ports: DefPorts().RunnerPorts(),
+		},
+	}
+}
+
+func (mc MigrateConfig) Config() runner.Config {
+	return mc.Common
+}
+
+func (mc MigrateConfig) Name() string {
+	return "vault"
+}
+
+func (mc MigrateConfig) WithConfig(cfg runner.Config) runner.Command {
+	mc.Common = cfg
+	return mc
+}
+
+// Args uses a config file with a .conf suffix, so that it won't be picked up
+// by a Vault server which uses the same config dir.
+func (mc MigrateConfig) Args() []string {
+	return []string{"operator", "migrate", "-config=" + filepath.Join(mc.Common.ConfigDir, "migrate.conf")}
+}
+
+func (mc MigrateConfig) Env() []string {
+	return nil
+}
+
+func (mc MigrateConfig) Files() map[string]string {
+	files := map[string]string{}
+	if mc.Common.TLS.Cert != "" {
+		files["vault.pem"] = mc.Common.TLS.Cert
+		files["vault-key.pem"] = mc.Common.TLS.PrivateKey
+	}
+	if mc.Common.TLS.CA != "" {
+		files["ca.pem"] = mc.Common.TLS.CA
+	}
+
+	source := VaultConfig{
+		Common:     mc.Common,
+		ConsulAddr: mc.ConsulAddr,
+		ConsulPath: mc.ConsulPath,
+	}.consulConfig()
+	source = strings.Replace(source, `storage "consul"`, `storage_source "consul"`, 1)
+
+	files["migrate.conf"] = fmt.Sprintf(`%s
+storage_destination "raft" {
+  path = "%s"
+  node_id = "%s"
+}
+
+cluster_addr = "https://%s"
+`, source, mc.Common.DataDir, mc.Common.NodeName, mc.ClusterAddr)
+	return files
+}
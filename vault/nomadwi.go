@@ -0,0 +1,77 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// NomadWorkloadIdentity describes how Vault should trust the workload
+// identities signed by Nomad servers.
+type NomadWorkloadIdentity struct {
+	// AuthPath is where to mount the JWT auth method, e.g. "jwt-nomad".
+	AuthPath string
+	// JWKSURL is where Nomad publishes its signing keys, normally
+	// <nomad api>/.well-known/jwks.json.
+	JWKSURL string
+	// JWKSCA is the PEM CA needed to verify JWKSURL, if it uses TLS.
+	JWKSCA string
+	// Audience must match the aud claim Nomad puts in the identities.
+	Audience string
+	// Role is the name of the default role, whose tokens get Policies.
+	Role     string
+	Policies []string
+}
+
+// DefaultNomadWorkloadIdentity returns the settings recommended by the Nomad
+// docs, given the Nomad API URL.
+func DefaultNomadWorkloadIdentity(nomadAddr string) NomadWorkloadIdentity {
+	return NomadWorkloadIdentity{
+		AuthPath: "jwt-nomad",
+		JWKSURL:  nomadAddr + "/.well-known/jwks.json",
+		Audience: "vault.io",
+		Role:     "nomad-workloads",
+		Policies: []string{"nomad-workloads"},
+	}
+}
+
+// ConfigureNomadWorkloadIdentity enables and configures the JWT auth method
+// so that Nomad workloads can log in using their workload identity, with
+// a default role mapping the job's identity claims into token metadata.
+func ConfigureNomadWorkloadIdentity(ctx context.Context, cli *vaultapi.Client, wi NomadWorkloadIdentity) error {
+	if err := ensureAuth(cli, wi.AuthPath, "jwt"); err != nil {
+		return err
+	}
+
+	cfg := map[string]interface{}{
+		"jwks_url":           wi.JWKSURL,
+		"jwt_supported_algs": []string{"RS256", "EdDSA"},
+		"default_role":       wi.Role,
+	}
+	if wi.JWKSCA != "" {
+		cfg["jwks_ca_pem"] = wi.JWKSCA
+	}
+	if err := writeWithRetry(ctx, cli, "auth/"+wi.AuthPath+"/config", cfg); err != nil {
+		return fmt.Errorf("error configuring %s: %w", wi.AuthPath, err)
+	}
+
+	_, err := cli.Logical().Write("auth/"+wi.AuthPath+"/role/"+wi.Role, map[string]interface{}{
+		"role_type":               "jwt",
+		"bound_audiences":         []string{wi.Audience},
+		"user_claim":              "/nomad_job_id",
+		"user_claim_json_pointer": true,
+		"claim_mappings": map[string]string{
+			"nomad_namespace": "nomad_namespace",
+			"nomad_job_id":    "nomad_job_id",
+			"nomad_task":      "nomad_task",
+		},
+		"token_type":     "service",
+		"token_policies": wi.Policies,
+		"token_period":   "30m",
+	})
+	if err != nil {
+		return fmt.Errorf("error creating role %s: %w", wi.Role, err)
+	}
+	return nil
+}
@@ -3,9 +3,14 @@ package vault
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -53,6 +58,40 @@ func (c Ports) RunnerPorts() yurt.Ports {
 	}
 }
 
+// Descriptor describes Vault for the yurt service registry.  The agent role
+// is run using AgentConfig, with AgentPorts.
+var Descriptor = yurt.ServiceDescriptor{
+	Name:    "vault",
+	Ports:   DefPorts().RunnerPorts(),
+	Roles:   []string{"server", "agent"},
+	Metrics: &yurt.Endpoint{Port: PortNames.HTTP, Path: "/v1/sys/metrics", Params: url.Values{"format": []string{"prometheus"}}},
+	Health: []yurt.Endpoint{
+		{Port: PortNames.HTTP, Path: "/v1/sys/health", Params: url.Values{"standbyok": []string{"true"}, "perfstandbyok": []string{"true"}}},
+	},
+	Docker: &yurt.DockerDescriptor{
+		Image:     "vault:1.9.2",
+		ConfigDir: "/vault/config",
+		DataDir:   "/vault/file",
+		LogDir:    "/vault/logs",
+	},
+	ConfigSchema: []yurt.ConfigField{
+		{Name: "JoinAddrs", Type: "[]string", Description: "API addresses of the raft peers to join"},
+		{Name: "ConsulAddr", Type: "string", Description: "host:port of the Consul agent, for storage"},
+		{Name: "ConsulPath", Type: "string", Description: "Consul KV prefix used for storage"},
+		{Name: "ServiceRegistrationAddr", Type: "string", Description: "host:port of the Consul agent to register with"},
+		{Name: "ServiceRegistrationTLS", Type: "bool", Description: "register with the Consul agent over HTTPS"},
+		{Name: "Seal", Type: "*Seal", Description: "auto-unseal seal"},
+		{Name: "OldSeal", Type: "*Seal", Description: "seal being migrated away from"},
+		{Name: "RaftPerfMultiplier", Type: "int", Description: "raft performance_multiplier"},
+		{Name: "RedundancyZone", Type: "string", Description: "enterprise autopilot redundancy zone"},
+		{Name: "UpgradeVersion", Type: "string", Description: "enterprise autopilot upgrade version"},
+	},
+}
+
+func init() {
+	yurt.RegisterService(Descriptor)
+}
+
 type Seal struct {
 	Type   string
 	Config map[string]string
@@ -71,6 +110,13 @@ type VaultConfig struct {
 	// ConsulPath gives the Consul KV prefix where Vault will store its data.
 	// Only needed for Consul storage.
 	ConsulPath string
+	// ServiceRegistrationAddr gives the host:port of a Consul agent to
+	// register the vault service with, e.g. when using raft storage.
+	ServiceRegistrationAddr string
+	// ServiceRegistrationTLS makes service registration use HTTPS, verifying
+	// the agent's cert against the CA in Common.TLS.  Set it when the agent
+	// serves its API over HTTPS only, as Consul does once it has a cert.
+	ServiceRegistrationTLS bool
 	// Seal is used for non-Shamir seals, i.e. AutoUnseal.
 	Seal *Seal
 	// OldSeal is used in seal migration scenarios. When migrating away from
@@ -79,6 +125,10 @@ type VaultConfig struct {
 	// completed successfully on all nodes, the old seal stanza should be removed.
 	OldSeal            *Seal
 	RaftPerfMultiplier int
+	// RedundancyZone and UpgradeVersion are Vault Enterprise raft autopilot
+	// settings; UpgradeVersion defaults to the version of the binary.
+	RedundancyZone string
+	UpgradeVersion string
 }
 
 func (vc VaultConfig) Config() runner.Config {
@@ -104,6 +154,16 @@ func NewRaftConfig(joinAddrs []string, tls *pki.TLSConfigPEM, raftPerfMultiplier
 	}
 }
 
+// WithClientTLS returns a copy of vc whose listener sets
+// tls_require_and_verify_client_cert.  Since that applies to everything on the
+// API port, raft retry_join uses the given cert too.
+func (vc VaultConfig) WithClientTLS(clientTLS *pki.TLSConfigPEM) VaultConfig {
+	if clientTLS != nil {
+		vc.Common.ClientTLS = *clientTLS
+	}
+	return vc
+}
+
 func NewConsulConfig(consulAddr, consulPath string, tls *pki.TLSConfigPEM) VaultConfig {
 	var t pki.TLSConfigPEM
 	if tls != nil {
@@ -139,6 +199,11 @@ func (vc VaultConfig) raftConfig() string {
 		scheme = "https"
 		ca = `leader_ca_cert_file = "ca.pem"`
 	}
+	if len(vc.Common.ClientTLS.Cert) > 0 {
+		ca += `
+    leader_client_cert_file = "client.pem"
+    leader_client_key_file = "client-key.pem"`
+	}
 	if len(vc.JoinAddrs) > 1 {
 		for _, j := range vc.JoinAddrs {
 			retryJoin += fmt.Sprintf(`
@@ -153,14 +218,21 @@ func (vc VaultConfig) raftConfig() string {
 	if vc.RaftPerfMultiplier > 0 {
 		perfMultiplier = vc.RaftPerfMultiplier
 	}
+	var autopilot string
+	if vc.RedundancyZone != "" {
+		autopilot += fmt.Sprintf("\n  autopilot_redundancy_zone = \"%s\"", vc.RedundancyZone)
+	}
+	if vc.UpgradeVersion != "" {
+		autopilot += fmt.Sprintf("\n  autopilot_upgrade_version = \"%s\"", vc.UpgradeVersion)
+	}
 	return fmt.Sprintf(`
 storage "raft" {
   path = "%s"
   node_id = "%s"
-  performance_multiplier = "%d"
+  performance_multiplier = "%d"%s
   %s
 }
-`, vc.Common.DataDir, vc.Common.NodeName, perfMultiplier, retryJoin)
+`, vc.Common.DataDir, vc.Common.NodeName, perfMultiplier, autopilot, retryJoin)
 }
 
 func (vc VaultConfig) consulConfig() string {
@@ -207,6 +279,14 @@ func (vc VaultConfig) Files() map[string]string {
 		tlsConfig += `  tls_client_ca_file = "ca.pem"
 `
 	}
+	clientCerts := "tls_disable_client_certs = true"
+	if vc.Common.ClientTLS.Cert != "" {
+		// Besides API clients, raftConfig's retry_join stanzas present
+		// client.pem when joining the leader.
+		files["client.pem"] = vc.Common.ClientTLS.Cert
+		files["client-key.pem"] = vc.Common.ClientTLS.PrivateKey
+		clientCerts = "tls_require_and_verify_client_cert = true"
+	}
 
 	listenerAddr := fmt.Sprintf("%s:%d", network, vc.Common.Ports.ByName[PortNames.HTTP].Number)
 	apiAddr := fmt.Sprintf("%s://%s", scheme, listenerAddr)
@@ -230,14 +310,14 @@ listener "tcp" {
 %s
 EOF
   tls_disable = %v
-  tls_disable_client_certs = true
+  %s
 %s
 }
 telemetry {
   disable_hostname = true
   prometheus_retention_time = "10m"
 }
-`, apiAddr, clusterAddr, listenerAddr, vc.Common.TLS.Cert == "", tlsConfig)
+`, apiAddr, clusterAddr, listenerAddr, vc.Common.TLS.Cert == "", clientCerts, tlsConfig)
 
 	if vc.ConsulAddr != "" {
 		config += vc.consulConfig()
@@ -245,6 +325,23 @@ telemetry {
 		config += vc.raftConfig()
 	}
 
+	if vc.ServiceRegistrationAddr != "" {
+		var tls string
+		if vc.ServiceRegistrationTLS {
+			tls = `
+  scheme = "https"`
+			if vc.Common.TLS.CA != "" {
+				tls += `
+  tls_ca_file = "ca.pem"`
+			}
+		}
+		config += fmt.Sprintf(`
+service_registration "consul" {
+  address = "%s"%s
+}
+`, vc.ServiceRegistrationAddr, tls)
+	}
+
 	if vc.Seal != nil {
 		var kvals []string
 		for k, v := range vc.Seal.Config {
@@ -282,12 +379,26 @@ func HarnessToAPI(r runner.Harness) (*vaultapi.Client, error) {
 	return apiConfigToClient(apicfg)
 }
 
+// HarnessToAPIWithClientTLS is like HarnessToAPI, except the client presents
+// the given certificate files, e.g. for a vault whose listener was made to
+// require client certs other than via WithClientTLS.
+func HarnessToAPIWithClientTLS(r runner.Harness, certFile, keyFile string) (*vaultapi.Client, error) {
+	apicfg, err := r.Endpoint("http", true)
+	if err != nil {
+		return nil, err
+	}
+	apicfg.ClientCertFile, apicfg.ClientKeyFile = certFile, keyFile
+	return apiConfigToClient(apicfg)
+}
+
 func apiConfigToClient(a *runner.APIConfig) (*vaultapi.Client, error) {
 	cfg := vaultapi.DefaultConfig()
 	cfg.MinRetryWait = 50 * time.Millisecond
 	cfg.Address = a.Address.String()
 	err := cfg.ConfigureTLS(&vaultapi.TLSConfig{
-		CACert: a.CAFile,
+		CACert:     a.CAFile,
+		ClientCert: a.ClientCertFile,
+		ClientKey:  a.ClientKeyFile,
 	})
 	if err != nil {
 		return nil, err
@@ -297,6 +408,16 @@ func apiConfigToClient(a *runner.APIConfig) (*vaultapi.Client, error) {
 
 type leaderShim struct {
 	client *vaultapi.Client
+	// members are the servers of the cluster, for Peers to check when
+	// sys/ha-status isn't available.
+	members []haMember
+}
+
+// haMember is a server of an HA cluster, along with its cluster address as
+// it appears in the peers.
+type haMember struct {
+	client      *vaultapi.Client
+	clusterAddr string
 }
 
 var _ runner.LeaderPeersAPI = leaderShim{}
@@ -309,19 +430,100 @@ func (l leaderShim) Leader() (string, error) {
 	return resp.LeaderAddress, nil
 }
 
-// TODO this only works for raft
+// Peers returns the cluster addresses (host:port) of the servers in the
+// cluster.  With raft storage these are the raft peers.  Otherwise, e.g. with
+// Consul storage, they're the nodes taking part in HA according to
+// sys/ha-status, which standbys join by checking in with the active node.
+// Before Vault 1.10 there's no sys/ha-status, so instead they're the members
+// that are unsealed and agree with this node about which is active.
 func (l leaderShim) Peers() ([]string, error) {
+	status, err := l.client.Sys().SealStatus()
+	if err != nil {
+		return nil, err
+	}
+	if status.StorageType == "raft" {
+		return l.raftPeers()
+	}
+	return l.haPeers()
+}
+
+func (l leaderShim) raftPeers() ([]string, error) {
 	resp, err := l.client.Logical().Read("sys/storage/raft/configuration")
 	if err != nil {
 		return nil, err
 	}
+	if resp == nil {
+		return nil, fmt.Errorf("empty response reading raft configuration")
+	}
 
+	config, _ := resp.Data["config"].(map[string]interface{})
+	servers, _ := config["servers"].([]interface{})
 	var peers []string
-	serverMap := resp.Data["config"].(map[string]interface{})["servers"].(map[string]interface{})
-	for _, serverIface := range serverMap {
-		server := serverIface.(map[string]interface{})
-		addr := server["address"].(string)
-		peers = append(peers, addr)
+	for _, serverIface := range servers {
+		server, _ := serverIface.(map[string]interface{})
+		if addr, ok := server["address"].(string); ok {
+			peers = append(peers, addr)
+		}
+	}
+	return peers, nil
+}
+
+func (l leaderShim) haPeers() ([]string, error) {
+	leader, err := l.client.Sys().Leader()
+	if err != nil {
+		return nil, err
+	}
+	if !leader.HAEnabled {
+		return nil, fmt.Errorf("%s: HA is not enabled", l.client.Address())
+	}
+
+	resp, err := l.client.Logical().Read("sys/ha-status")
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		// Read turns the 404 for an unsupported path into a nil response.
+		return l.memberPeers(leader.LeaderClusterAddress)
+	}
+
+	nodes, _ := resp.Data["nodes"].([]interface{})
+	var peers []string
+	for _, nodeIface := range nodes {
+		node, _ := nodeIface.(map[string]interface{})
+		addr, ok := node["cluster_address"].(string)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, u.Host)
+	}
+	return peers, nil
+}
+
+// memberPeers returns the cluster addresses of the members that are unsealed
+// and report leaderClusterAddr as that of the active node.
+func (l leaderShim) memberPeers(leaderClusterAddr string) ([]string, error) {
+	if len(l.members) == 0 {
+		return nil, fmt.Errorf("%s: no sys/ha-status, and no members to check instead", l.client.Address())
+	}
+	if leaderClusterAddr == "" {
+		return nil, fmt.Errorf("%s: no active node", l.client.Address())
+	}
+	var peers []string
+	for _, m := range l.members {
+		// Members that are down or sealed just aren't peers.
+		health, err := m.client.Sys().Health()
+		if err != nil || health.Sealed {
+			continue
+		}
+		leader, err := m.client.Sys().Leader()
+		if err != nil || leader.LeaderClusterAddress != leaderClusterAddr {
+			continue
+		}
+		peers = append(peers, m.clusterAddr)
 	}
 	return peers, nil
 }
@@ -346,6 +548,33 @@ func LeadersHealthy(ctx context.Context, servers []runner.Harness) error {
 	return runner.LeaderAPIsHealthy(ctx, apis)
 }
 
+// LeaderPeersHealthy polls until all the servers agree on the leader and
+// report all of them as peers, see leaderShim.Peers.  This works for Consul
+// storage as well as raft.  token must be allowed to read the peers.
+func LeaderPeersHealthy(ctx context.Context, servers []runner.Harness, token string) error {
+	var members []haMember
+	var expectedPeers []string
+	for _, server := range servers {
+		api, err := HarnessToAPI(server)
+		if err != nil {
+			return err
+		}
+		api.SetToken(token)
+		cfg, err := server.Endpoint(PortNames.Cluster, false)
+		if err != nil {
+			return err
+		}
+		members = append(members, haMember{client: api, clusterAddr: cfg.Address.Host})
+		expectedPeers = append(expectedPeers, cfg.Address.Host)
+	}
+	var apis []runner.LeaderPeersAPI
+	for _, m := range members {
+		apis = append(apis, leaderShim{client: m.client, members: members})
+	}
+	sort.Strings(expectedPeers)
+	return runner.LeaderPeerAPIsHealthy(ctx, apis, expectedPeers)
+}
+
 func Leader(servers []runner.Harness) (string, error) {
 	apis, err := vaultLeaderAPIs(servers)
 	if err != nil {
@@ -374,10 +603,72 @@ func RaftAutopilotHealthy(ctx context.Context, servers []runner.Harness, token s
 			log.Printf("got healthy apstate from %s: %s", client.Address(), buf.String())
 			return nil
 		}
-		return fmt.Errorf("unhealthy")
+		return fmt.Errorf("%s: %w", client.Address(), runner.ErrUnhealthyAutopilot)
 	})
 }
 
+// RaftAutopilotStable is like RaftAutopilotHealthy, but also requires that
+// autopilot knows of exactly voters servers, all of which have become voters,
+// i.e. any newly joined servers have made it through server stabilization.
+func RaftAutopilotStable(ctx context.Context, servers []runner.Harness, token string, voters int) error {
+	return AnyVault(ctx, servers, func(client *vaultapi.Client) error {
+		client.SetToken(token)
+		state, err := client.Sys().RaftAutopilotState()
+		if err != nil {
+			return err
+		}
+		if state == nil || !state.Healthy {
+			return fmt.Errorf("%s: %w", client.Address(), runner.ErrUnhealthyAutopilot)
+		}
+		if len(state.Servers) != voters {
+			return fmt.Errorf("%s: autopilot reports %d servers, expected %d: %w",
+				client.Address(), len(state.Servers), voters, runner.ErrUnhealthyAutopilot)
+		}
+		for name, server := range state.Servers {
+			if server.Status != "voter" && server.Status != "leader" {
+				return fmt.Errorf("%s: server %s has status %q: %w",
+					client.Address(), name, server.Status, runner.ErrUnhealthyAutopilot)
+			}
+		}
+		return nil
+	})
+}
+
+// SealMigrated polls sys/seal-status on all the servers until none of them
+// report a seal migration in progress, and all of them report sealType, e.g.
+// "shamir" or "transit".
+func SealMigrated(ctx context.Context, servers []runner.Harness, sealType string) error {
+	var clients []*vaultapi.Client
+	for _, server := range servers {
+		client, err := HarnessToAPI(server)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, client)
+	}
+
+	var err error
+	for ctx.Err() == nil {
+		err = nil
+		for _, client := range clients {
+			var resp *vaultapi.SealStatusResponse
+			resp, err = client.Sys().SealStatus()
+			if err == nil && (resp.Migration || resp.Type != sealType) {
+				err = fmt.Errorf("%s: seal type %q migration=%v, expected seal type %q",
+					client.Address(), resp.Type, resp.Migration, sealType)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("seal migration not completed, last error: %v", err)
+}
+
 // AnyVault returns nil if f returns a non-nil result for any of the given servers.
 // Errors will be retried with a short constant delay so long as ctx.Err() returns nil.
 func AnyVault(ctx context.Context, servers []runner.Harness, f func(*vaultapi.Client) error) error {
@@ -396,7 +687,7 @@ func AnyVault(ctx context.Context, servers []runner.Harness, f func(*vaultapi.Cl
 			return err
 		}
 		wg.Add(1)
-		go func(client *vaultapi.Client) {
+		go func(i int, client *vaultapi.Client) {
 			defer wg.Done()
 			for ctx.Err() == nil {
 				errs[i] = f(client)
@@ -406,7 +697,7 @@ func AnyVault(ctx context.Context, servers []runner.Harness, f func(*vaultapi.Cl
 				}
 				time.Sleep(100 * time.Millisecond)
 			}
-		}(client)
+		}(i, client)
 	}
 	wg.Wait()
 
@@ -543,3 +834,36 @@ var ServerScrapeConfig = prometheus.ScrapeConfig{
 	Params:      url.Values{"format": []string{"prometheus"}},
 	MetricsPath: "/v1/sys/metrics",
 }
+
+// InitState is the result of initializing a Vault cluster, as needed to
+// unseal and use it later.
+type InitState struct {
+	RootToken  string   `json:"root_token"`
+	UnsealKeys []string `json:"unseal_keys"`
+}
+
+// SaveInitState writes state to path, readable only by the current user.
+func SaveInitState(path string, state InitState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// LoadInitState reads a state previously written by SaveInitState.  If path
+// doesn't exist the error will satisfy os.IsNotExist.
+func LoadInitState(path string) (*InitState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state InitState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing vault init state %s: %w", path, err)
+	}
+	return &state, nil
+}
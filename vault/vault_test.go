@@ -0,0 +1,229 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/pki"
+)
+
+func TestServiceRegistrationConfig(t *testing.T) {
+	tls := &pki.TLSConfigPEM{Cert: "cert", PrivateKey: "key", CA: "ca"}
+	for _, tc := range []struct {
+		name     string
+		useTLS   bool
+		want     []string
+		dontWant []string
+	}{
+		{"http", false, []string{`address = "127.0.0.1:8500"`}, []string{"scheme", "tls_ca_file"}},
+		{"https", true, []string{`address = "127.0.0.1:8500"`, `scheme = "https"`, `tls_ca_file = "ca.pem"`}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vc := NewRaftConfig(nil, tls, 0)
+			vc.Common.Ports = DefPorts().RunnerPorts()
+			vc.ServiceRegistrationAddr = "127.0.0.1:8500"
+			vc.ServiceRegistrationTLS = tc.useTLS
+			hcl := vc.Files()["vault.hcl"]
+			i := strings.Index(hcl, `service_registration "consul"`)
+			if i < 0 {
+				t.Fatalf("no service_registration stanza in:\n%s", hcl)
+			}
+			stanza := hcl[i:]
+			stanza = stanza[:strings.Index(stanza, "}")+1]
+			for _, w := range tc.want {
+				if !strings.Contains(stanza, w) {
+					t.Errorf("expected %q in:\n%s", w, stanza)
+				}
+			}
+			for _, w := range tc.dontWant {
+				if strings.Contains(stanza, w) {
+					t.Errorf("didn't expect %q in:\n%s", w, stanza)
+				}
+			}
+		})
+	}
+}
+
+// fakeHAVault serves the endpoints used by leaderShim.Peers as a node of a
+// Consul storage cluster whose active node has cluster address leader.  If
+// haStatus is nil, it behaves like Vault before 1.10, which lacks
+// sys/ha-status.
+func fakeHAVault(t *testing.T, sealed bool, leader string, haStatus []string) *vaultapi.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp interface{}
+		switch r.URL.Path {
+		case "/v1/sys/seal-status":
+			resp = map[string]interface{}{"sealed": sealed, "storage_type": "consul"}
+		case "/v1/sys/health":
+			resp = map[string]interface{}{"sealed": sealed}
+		case "/v1/sys/leader":
+			resp = map[string]interface{}{"ha_enabled": true, "leader_cluster_address": leader}
+		case "/v1/sys/ha-status":
+			if haStatus == nil {
+				w.WriteHeader(http.StatusNotFound)
+				resp = map[string]interface{}{"errors": []string{"unsupported path"}}
+				break
+			}
+			var nodes []map[string]interface{}
+			for _, addr := range haStatus {
+				nodes = append(nodes, map[string]interface{}{"cluster_address": "https://" + addr})
+			}
+			resp = map[string]interface{}{"data": map[string]interface{}{"nodes": nodes}}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = srv.URL
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestHAPeers(t *testing.T) {
+	const leader = "https://10.0.0.1:8201"
+	peers := func(l leaderShim) []string {
+		t.Helper()
+		got, err := l.Peers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	all := []string{"10.0.0.1:8201", "10.0.0.2:8201"}
+	if got := peers(leaderShim{client: fakeHAVault(t, false, leader, all)}); !reflect.DeepEqual(got, all) {
+		t.Fatalf("expected peers from sys/ha-status %v, got %v", all, got)
+	}
+
+	// Before 1.10: the members that are unsealed and agree on the leader.
+	members := []haMember{
+		{fakeHAVault(t, false, leader, nil), "10.0.0.1:8201"},
+		{fakeHAVault(t, false, leader, nil), "10.0.0.2:8201"},
+		{fakeHAVault(t, true, leader, nil), "10.0.0.3:8201"},
+		{fakeHAVault(t, false, "https://10.0.0.4:8201", nil), "10.0.0.4:8201"},
+	}
+	if got := peers(leaderShim{client: members[0].client, members: members}); !reflect.DeepEqual(got, all) {
+		t.Fatalf("expected peers from members %v, got %v", all, got)
+	}
+	if _, err := (leaderShim{client: members[0].client}).Peers(); err == nil {
+		t.Fatal("expected error without sys/ha-status or members")
+	}
+}
+
+// fakeGenerateRoot serves generate-root, requiring the keys given, and
+// encoding token with the OTP as Vault does.  If legacy is true, it behaves
+// like Vault before 1.10, which requires the client to provide the OTP.
+func fakeGenerateRoot(t *testing.T, legacy bool, token string, keys []string) *vaultapi.Client {
+	t.Helper()
+	var otp, nonce string
+	var progress int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		status := map[string]interface{}{"otp_length": len(token), "required": len(keys)}
+		switch r.URL.Path + " " + r.Method {
+		case "/v1/sys/generate-root/attempt GET":
+		case "/v1/sys/generate-root/attempt DELETE":
+			otp, nonce, progress = "", "", 0
+		case "/v1/sys/generate-root/attempt PUT":
+			switch {
+			case req["otp"] == "" && legacy:
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"otp or pgp_key required"}})
+				return
+			case req["otp"] == "":
+				otp = strings.Repeat("x", len(token))
+				status["otp"] = otp
+			default:
+				otp = req["otp"]
+			}
+			nonce = "n1"
+			status["started"], status["nonce"] = true, nonce
+		case "/v1/sys/generate-root/update PUT":
+			if req["nonce"] != nonce || req["key"] != keys[progress] {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"bad key or nonce"}})
+				return
+			}
+			progress++
+			status["started"], status["nonce"], status["progress"] = true, nonce, progress
+			if progress == len(keys) {
+				encoded := make([]byte, len(token))
+				for i := range encoded {
+					encoded[i] = token[i] ^ otp[i]
+				}
+				status["complete"] = true
+				status["encoded_token"] = base64.RawStdEncoding.EncodeToString(encoded)
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	}))
+	t.Cleanup(srv.Close)
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = srv.URL
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestGenerateRoot(t *testing.T) {
+	const token = "s.abcdefghijklmnopqrstuvwx"
+	keys := []string{"k1", "k2", "k3"}
+	ctx := context.Background()
+	for _, legacy := range []bool{false, true} {
+		got, err := GenerateRoot(ctx, fakeGenerateRoot(t, legacy, token, keys), keys)
+		if err != nil {
+			t.Fatalf("legacy=%v: %v", legacy, err)
+		}
+		if got != token {
+			t.Fatalf("legacy=%v: expected token %q, got %q", legacy, token, got)
+		}
+	}
+
+	if _, err := GenerateRoot(ctx, fakeGenerateRoot(t, false, token, keys), keys[:2]); err == nil {
+		t.Fatal("expected error generating root with too few keys")
+	}
+}
+
+func TestCreateAppRoleMissing(t *testing.T) {
+	// The role is created, but its role-id can't be found.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+	}))
+	defer srv.Close()
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = srv.URL
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createAppRole(cli, "app", []string{"app"}); err == nil || !strings.Contains(err.Error(), "no role-id") {
+		t.Fatalf("expected missing role-id error, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+// Package yurtapi is the stable entry point for code outside this module.
+// The packages it wraps, e.g. runenv and cluster, change shape as yurt
+// evolves; yurtapi only changes in backwards-compatible ways within a major
+// version, as given by APIVersion and the matching git tag.  Consumers are
+// encouraged to import it as yurt:
+//
+//	import yurt "github.com/ncabatoff/yurt/yurtapi"
+//
+//	e, err := yurt.NewEnv(ctx, yurt.EnvOptions{Name: "test"})
+//	cc, err := yurt.NewConsulCluster(ctx, e, yurt.ConsulClusterOptions{
+//		ClusterOptions: yurt.ClusterOptions{Name: "c1", NodeCount: 3},
+//	})
+//
+// The compatibility promise covers the functions and the types defined here,
+// such as EnvOptions and ConsulClusterOptions, which are translated to the
+// options of the underlying packages.  The remaining types, e.g. Env and
+// ConsulCluster, are aliases, so that values can be passed to the underlying
+// packages when something isn't (yet) exposed here; their methods are those
+// of the underlying packages and aren't covered.
+package yurtapi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ncabatoff/yurt"
+	"github.com/ncabatoff/yurt/binaries"
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/pki"
+	"github.com/ncabatoff/yurt/runenv"
+	"github.com/ncabatoff/yurt/runner"
+	"github.com/ncabatoff/yurt/util"
+)
+
+// APIVersion is the semantic version of this package's API.  Releases of the
+// module are tagged with it.
+const APIVersion = "v0.1.0"
+
+type (
+	Env                  = runenv.Env
+	Node                 = yurt.Node
+	Ports                = yurt.Ports
+	Harness              = runner.Harness
+	Command              = runner.Command
+	APIConfig            = runner.APIConfig
+	CertificateAuthority = pki.CertificateAuthority
+	TLSConfigPEM         = pki.TLSConfigPEM
+	BinaryManager        = binaries.Manager
+
+	ConsulCluster      = cluster.ConsulCluster
+	NomadCluster       = cluster.NomadCluster
+	VaultCluster       = cluster.VaultCluster
+	ConsulNomadCluster = cluster.ConsulNomadCluster
+)
+
+// ClusterOptions are common to all the kinds of cluster.
+type ClusterOptions struct {
+	Name      string
+	NodeCount int
+	// CA, if given, is used to create certificates; otherwise the cluster
+	// won't use TLS.
+	CA *CertificateAuthority
+	// MutualTLS makes the servers require API clients to present a
+	// certificate issued by CA.
+	MutualTLS bool
+	// Versions gives the versions to run by product, e.g. {"consul":
+	// "1.10.6"}; by default the env's versions are used.
+	Versions map[string]string
+}
+
+// ConsulClusterOptions configure NewConsulCluster.
+type ConsulClusterOptions struct {
+	ClusterOptions
+}
+
+func (o ConsulClusterOptions) internal() cluster.ConsulClusterOptions {
+	return cluster.ConsulClusterOptions{
+		Name:      o.Name,
+		NodeCount: o.NodeCount,
+		CA:        o.CA,
+		MutualTLS: o.MutualTLS,
+		Versions:  o.Versions,
+	}
+}
+
+// NomadClusterOptions configure NewNomadCluster.
+type NomadClusterOptions struct {
+	ClusterOptions
+	// Consul is the cluster whose client agents the Nomad servers use.
+	Consul *ConsulCluster
+}
+
+func (o NomadClusterOptions) internal() cluster.NomadClusterOptions {
+	return cluster.NomadClusterOptions{
+		Name:      o.Name,
+		NodeCount: o.NodeCount,
+		CA:        o.CA,
+		MutualTLS: o.MutualTLS,
+		Versions:  o.Versions,
+		Consul:    o.Consul,
+	}
+}
+
+// VaultClusterOptions configure NewVaultCluster.
+type VaultClusterOptions struct {
+	ClusterOptions
+	// ConsulAddrs are the addresses of the Consul agents to use for storage,
+	// one per node.  If empty, Integrated Storage (raft) is used.
+	ConsulAddrs []string
+	// StateFile, if given, is where the root token and unseal keys are kept,
+	// so that a cluster initialized by a previous run can be resumed.
+	StateFile string
+}
+
+func (o VaultClusterOptions) internal() cluster.VaultClusterOptions {
+	return cluster.VaultClusterOptions{
+		Name:        o.Name,
+		NodeCount:   o.NodeCount,
+		CA:          o.CA,
+		MutualTLS:   o.MutualTLS,
+		Versions:    o.Versions,
+		ConsulAddrs: o.ConsulAddrs,
+		StateFile:   o.StateFile,
+	}
+}
+
+// EnvKind selects how an env runs processes.
+type EnvKind string
+
+const (
+	// EnvExec runs processes directly on the local host.
+	EnvExec EnvKind = "exec"
+	// EnvDocker runs processes in docker containers.
+	EnvDocker EnvKind = "docker"
+)
+
+// EnvOptions configure NewEnv.  Only Name is required.
+type EnvOptions struct {
+	// Kind defaults to EnvExec.
+	Kind EnvKind
+	Name string
+	// WorkDir is where files get created; a temp dir is used if empty.
+	// Unless services are kept running, it's removed when the env is done.
+	WorkDir string
+	// FirstPort is the first port to allocate for EnvExec, default 23000.
+	FirstPort int
+	// CIDR is the network to create for EnvDocker; a random /24 in 10/8 is
+	// used if empty.
+	CIDR string
+	// Binaries fetches the binaries to run, default binaries.Default.
+	Binaries BinaryManager
+	// Monitored adds a Prometheus server scraping everything run in the env.
+	Monitored bool
+	// Keep lists services to leave running once ctx is done, see
+	// runenv.BaseEnv.Keep.
+	Keep []string
+	// Versions overrides binary versions by product for EnvExec, e.g.
+	// {"consul": "1.10.6"}, see runenv.ExecEnv.Versions.
+	Versions map[string]string
+}
+
+// NewEnv creates an env whose lifecycle is controlled by ctx: once it's
+// done, everything run in the env is stopped.
+func NewEnv(ctx context.Context, opts EnvOptions) (Env, error) {
+	if opts.Binaries == nil {
+		opts.Binaries = binaries.Default
+	}
+	if opts.FirstPort == 0 {
+		opts.FirstPort = 23000
+	}
+
+	var e Env
+	var ee *runenv.ExecEnv
+	switch opts.Kind {
+	case EnvExec, "":
+		var err error
+		ee, err = runenv.NewExecEnv(ctx, opts.Name, opts.WorkDir, opts.FirstPort, opts.Binaries)
+		if err != nil {
+			return nil, err
+		}
+		ee.Keep(opts.Keep...)
+		ee.Versions = opts.Versions
+		e = ee
+	case EnvDocker:
+		de, err := runenv.NewDockerEnv(ctx, opts.Binaries, opts.Name, opts.WorkDir, opts.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		de.Keep(opts.Keep...)
+		e = de
+	default:
+		return nil, fmt.Errorf("invalid env kind %q", opts.Kind)
+	}
+
+	if !opts.Monitored {
+		return e, nil
+	}
+	if ee == nil {
+		// Prometheus always runs locally.
+		var err error
+		ee, err = runenv.NewExecEnv(ctx, opts.Name+"-monitor", "", opts.FirstPort, opts.Binaries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runenv.NewMonitoredEnv(e, ee)
+}
+
+// PromAddr returns the address of the Prometheus server of e, if e was
+// created with Monitored set.
+func PromAddr(e Env) (*APIConfig, bool) {
+	m, ok := e.(*runenv.MonitoredEnv)
+	if !ok {
+		return nil, false
+	}
+	return m.PromAddr(), true
+}
+
+// NewConsulCluster starts a Consul cluster of opts.NodeCount servers in e.
+func NewConsulCluster(ctx context.Context, e Env, opts ConsulClusterOptions) (*ConsulCluster, error) {
+	return cluster.NewConsulClusterWithOptions(ctx, e, opts.internal())
+}
+
+// NewNomadCluster starts a Nomad cluster of opts.NodeCount servers in e,
+// using the Consul cluster opts.Consul.
+func NewNomadCluster(ctx context.Context, e Env, opts NomadClusterOptions) (*NomadCluster, error) {
+	return cluster.NewNomadClusterWithOptions(ctx, e, opts.internal())
+}
+
+// NewVaultCluster starts a Vault cluster of opts.NodeCount servers in e.
+func NewVaultCluster(ctx context.Context, e Env, opts VaultClusterOptions) (*VaultCluster, error) {
+	return cluster.NewVaultClusterWithOptions(ctx, e, opts.internal())
+}
+
+// NewConsulNomadCluster starts a Consul cluster and a Nomad cluster using
+// it, each with nodeCount servers.  ca may be nil, in which case TLS isn't
+// used.
+func NewConsulNomadCluster(ctx context.Context, e Env, ca *CertificateAuthority, name string, nodeCount int) (*ConsulNomadCluster, error) {
+	return cluster.NewConsulNomadCluster(ctx, e, ca, name, nodeCount)
+}
+
+// NewCertificateAuthority creates a CA backed by the Vault server at
+// vaultAddr, e.g. one of a VaultCluster created without TLS.
+func NewCertificateAuthority(vaultAddr, vaultToken string) (*CertificateAuthority, error) {
+	return pki.NewExternalCertificateAuthority(vaultAddr, vaultToken)
+}
+
+// OpenCertificateAuthority is like NewCertificateAuthority, but reuses the
+// PKI mounts with prefix path if they exist, so that repeated or parallel
+// runs against the same Vault can share one CA.
+func OpenCertificateAuthority(ctx context.Context, vaultAddr, vaultToken, path string) (*CertificateAuthority, error) {
+	cli, err := util.MakeVaultClient(vaultAddr, vaultToken)
+	if err != nil {
+		return nil, err
+	}
+	return pki.OpenCertificateAuthority(ctx, cli, path)
+}
@@ -0,0 +1,63 @@
+package yurtapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ncabatoff/yurt/cluster"
+	"github.com/ncabatoff/yurt/runenv"
+)
+
+// TestOptionsInternal verifies that our options are carried over to the
+// options of package cluster.
+func TestOptionsInternal(t *testing.T) {
+	common := ClusterOptions{
+		Name:      "c1",
+		NodeCount: 3,
+		MutualTLS: true,
+		Versions:  map[string]string{"consul": "1.10.6"},
+	}
+
+	got := ConsulClusterOptions{ClusterOptions: common}.internal()
+	want := cluster.ConsulClusterOptions{Name: "c1", NodeCount: 3, MutualTLS: true, Versions: common.Versions}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("consul options (-want +got):\n%s", diff)
+	}
+
+	consul := &ConsulCluster{}
+	nomad := NomadClusterOptions{ClusterOptions: common, Consul: consul}.internal()
+	if nomad.Name != "c1" || nomad.NodeCount != 3 || !nomad.MutualTLS || nomad.Consul != consul || nomad.Versions["consul"] != "1.10.6" {
+		t.Fatalf("unexpected nomad options %+v", nomad)
+	}
+
+	vault := VaultClusterOptions{ClusterOptions: common, ConsulAddrs: []string{"a:8500"}, StateFile: "state.json"}.internal()
+	if vault.Name != "c1" || vault.NodeCount != 3 || !vault.MutualTLS || len(vault.ConsulAddrs) != 1 || vault.StateFile != "state.json" {
+		t.Fatalf("unexpected vault options %+v", vault)
+	}
+}
+
+func TestNewEnv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := NewEnv(ctx, EnvOptions{Kind: "ssh", Name: t.Name()}); err == nil {
+		t.Fatal("expected error for invalid env kind")
+	}
+
+	versions := map[string]string{"consul": "1.10.6"}
+	e, err := NewEnv(ctx, EnvOptions{Name: t.Name(), WorkDir: t.TempDir(), Versions: versions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ee, ok := e.(*runenv.ExecEnv)
+	if !ok {
+		t.Fatalf("expected an ExecEnv by default, got %T", e)
+	}
+	if ee.Versions["consul"] != "1.10.6" {
+		t.Fatalf("expected versions to be set, got %v", ee.Versions)
+	}
+	if _, ok := PromAddr(e); ok {
+		t.Fatal("expected no Prometheus in an unmonitored env")
+	}
+}
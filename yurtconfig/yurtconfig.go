@@ -0,0 +1,239 @@
+// yurtconfig describes named yurt environments in a file, much like
+// kubeconfig does for Kubernetes clusters, so that tools can target any of
+// several environments running at once.  Each context gives the endpoints
+// and credentials of the clusters in one environment; one of them may be
+// selected as current.
+package yurtconfig
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/ncabatoff/yurt/export"
+	"gopkg.in/yaml.v2"
+)
+
+// PathEnvVar names the environment variable that overrides DefaultPath.
+const PathEnvVar = "YURTCONFIG"
+
+// Config is the contents of a yurtconfig file.
+type Config struct {
+	// CurrentContext names the context used when none is given.
+	CurrentContext string    `yaml:"current_context,omitempty"`
+	Contexts       []Context `yaml:"contexts"`
+}
+
+// Context describes one yurt environment.
+type Context struct {
+	Name string `yaml:"name"`
+	// WorkDir is the work dir of the environment, if it has one, e.g. for
+	// passing to "yurt-cluster stop".
+	WorkDir string `yaml:"workdir,omitempty"`
+	// DefaultCluster names the cluster whose endpoints are exported without
+	// a prefix.  If empty, the first cluster in sorted order is used.
+	DefaultCluster string          `yaml:"default_cluster,omitempty"`
+	Clusters       export.Clusters `yaml:"clusters"`
+}
+
+// DefaultPath returns $YURTCONFIG if set, otherwise ~/.yurt/config.
+func DefaultPath() string {
+	if p := os.Getenv(PathEnvVar); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".yurt", "config")
+}
+
+// Load reads the config at path.  A missing file yields an empty config.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes c to path, creating its dir if need be.  The file is only
+// readable by the owner since it holds tokens and unseal keys.
+func (c *Config) Save(path string) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Names returns the names of the contexts, sorted.
+func (c *Config) Names() []string {
+	var names []string
+	for _, ctx := range c.Contexts {
+		names = append(names, ctx.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select returns the context named name, or the current context if name is
+// empty.
+func (c *Config) Select(name string) (*Context, error) {
+	if name == "" {
+		name = c.CurrentContext
+		if name == "" {
+			return nil, fmt.Errorf("no context given and no current context set")
+		}
+	}
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == name {
+			return &c.Contexts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no context named %q", name)
+}
+
+// Set adds ctx, replacing any context with the same name.
+func (c *Config) Set(ctx Context) {
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == ctx.Name {
+			c.Contexts[i] = ctx
+			return
+		}
+	}
+	c.Contexts = append(c.Contexts, ctx)
+}
+
+// Remove deletes the context named name, returning false if there wasn't
+// one.  If it was the current context, no context is current afterwards.
+func (c *Config) Remove(name string) bool {
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == name {
+			c.Contexts = append(c.Contexts[:i], c.Contexts[i+1:]...)
+			if c.CurrentContext == name {
+				c.CurrentContext = ""
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// clusterNames returns the names of the clusters, with the default first.
+func (ctx *Context) clusterNames() []string {
+	names := []string{}
+	if _, ok := ctx.Clusters[ctx.DefaultCluster]; ok {
+		names = append(names, ctx.DefaultCluster)
+	}
+	for _, name := range ctx.Clusters.Names() {
+		if name != ctx.DefaultCluster {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// WriteExports writes shell commands that set the environment variables the
+// Consul, Nomad and Vault CLIs use to talk to the default cluster, and
+// prefixed variables for the other clusters, see export.Clusters.WriteShell.
+func (ctx *Context) WriteExports(w io.Writer) error {
+	return ctx.Clusters.WriteShell(w, ctx.clusterNames())
+}
+
+// Endpoints returns the endpoints of the named cluster, or of the default
+// one if cluster is empty.
+func (ctx *Context) Endpoints(cluster string) (*export.Endpoints, error) {
+	if cluster == "" {
+		names := ctx.clusterNames()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("context %s has no clusters", ctx.Name)
+		}
+		cluster = names[0]
+	}
+	ep, ok := ctx.Clusters[cluster]
+	if !ok {
+		return nil, fmt.Errorf("context %s has no cluster named %q", ctx.Name, cluster)
+	}
+	return ep, nil
+}
+
+// ConsulClient returns a client of the Consul servers of the named cluster,
+// or of the default one if cluster is empty.
+func (ctx *Context) ConsulClient(cluster string) (*consulapi.Client, error) {
+	ep, err := ctx.Endpoints(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if ep.ConsulHTTPAddr == "" {
+		return nil, fmt.Errorf("cluster has no Consul servers")
+	}
+	cfg := consulapi.DefaultConfig()
+	cfg.Address = ep.ConsulHTTPAddr
+	cfg.TLSConfig.CAFile = ep.ConsulCACert
+	cfg.TLSConfig.CertFile = ep.ConsulClientCert
+	cfg.TLSConfig.KeyFile = ep.ConsulClientKey
+	return consulapi.NewClient(cfg)
+}
+
+// NomadClient returns a client of the Nomad servers of the named cluster, or
+// of the default one if cluster is empty.
+func (ctx *Context) NomadClient(cluster string) (*nomadapi.Client, error) {
+	ep, err := ctx.Endpoints(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if ep.NomadAddr == "" {
+		return nil, fmt.Errorf("cluster has no Nomad servers")
+	}
+	cfg := nomadapi.DefaultConfig()
+	cfg.Address = ep.NomadAddr
+	cfg.TLSConfig.CACert = ep.NomadCACert
+	cfg.TLSConfig.ClientCert = ep.NomadClientCert
+	cfg.TLSConfig.ClientKey = ep.NomadClientKey
+	return nomadapi.NewClient(cfg)
+}
+
+// VaultClient returns a client of the Vault servers of the named cluster,
+// or of the default one if cluster is empty, using the root token.
+func (ctx *Context) VaultClient(cluster string) (*vaultapi.Client, error) {
+	ep, err := ctx.Endpoints(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if ep.VaultAddr == "" {
+		return nil, fmt.Errorf("cluster has no Vault servers")
+	}
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = ep.VaultAddr
+	err = cfg.ConfigureTLS(&vaultapi.TLSConfig{
+		CACert:     ep.VaultCACert,
+		ClientCert: ep.VaultClientCert,
+		ClientKey:  ep.VaultClientKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cli, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cli.SetToken(ep.VaultToken)
+	return cli, nil
+}
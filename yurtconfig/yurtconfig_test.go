@@ -0,0 +1,126 @@
+package yurtconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/yurt/export"
+)
+
+func TestLoadSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "config")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Contexts) != 0 || c.CurrentContext != "" {
+		t.Fatalf("expected an empty config for a missing file, got %+v", c)
+	}
+
+	c.Set(Context{
+		Name:     "lab",
+		WorkDir:  "/tmp/yurt",
+		Clusters: export.Clusters{"dc1": {VaultAddr: "http://127.0.0.1:8200", VaultToken: "root"}},
+	})
+	c.CurrentContext = "lab"
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected config to be private, got mode %v", fi.Mode())
+	}
+
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Fatalf("got %+v, expected %+v", got, c)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("contextz: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected error loading config with unknown key")
+	}
+}
+
+func TestContexts(t *testing.T) {
+	c := &Config{}
+	if _, err := c.Select(""); err == nil {
+		t.Fatal("expected error selecting with no current context")
+	}
+
+	c.Set(Context{Name: "b", WorkDir: "/b"})
+	c.Set(Context{Name: "a", WorkDir: "/a"})
+	c.Set(Context{Name: "b", WorkDir: "/b2"})
+	if got := strings.Join(c.Names(), ","); got != "a,b" {
+		t.Fatalf("expected contexts a,b, got %s", got)
+	}
+	ctx, err := c.Select("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.WorkDir != "/b2" {
+		t.Fatalf("expected Set to replace b, got %+v", ctx)
+	}
+	if _, err := c.Select("nosuch"); err == nil {
+		t.Fatal("expected error selecting missing context")
+	}
+
+	c.CurrentContext = "a"
+	if ctx, err := c.Select(""); err != nil || ctx.Name != "a" {
+		t.Fatalf("expected current context a, got %+v, %v", ctx, err)
+	}
+	if !c.Remove("a") || c.CurrentContext != "" {
+		t.Fatalf("expected a to be removed and no longer current, got %+v", c)
+	}
+	if c.Remove("a") {
+		t.Fatal("expected removing a again to fail")
+	}
+	if got := strings.Join(c.Names(), ","); got != "b" {
+		t.Fatalf("expected context b to remain, got %s", got)
+	}
+}
+
+func TestContextEndpoints(t *testing.T) {
+	ctx := &Context{
+		Name:           "lab",
+		DefaultCluster: "dc2",
+		Clusters: export.Clusters{
+			"dc1": {ConsulHTTPAddr: "http://127.0.0.1:8500"},
+			"dc2": {NomadAddr: "http://127.0.0.1:4646"},
+		},
+	}
+	ep, err := ctx.Endpoints("")
+	if err != nil || ep.NomadAddr == "" {
+		t.Fatalf("expected the default cluster's endpoints, got %+v, %v", ep, err)
+	}
+	if _, err := ctx.ConsulClient(""); err == nil {
+		t.Fatal("expected error getting Consul client of cluster without Consul")
+	}
+	if _, err := ctx.ConsulClient("dc1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Endpoints("nosuch"); err == nil {
+		t.Fatal("expected error for missing cluster")
+	}
+
+	var sb strings.Builder
+	if err := ctx.WriteExports(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := "export NOMAD_ADDR='http://127.0.0.1:4646'\nexport DC1_CONSUL_HTTP_ADDR='http://127.0.0.1:8500'\n"
+	if sb.String() != want {
+		t.Fatalf("got:\n%s\nexpected:\n%s", sb.String(), want)
+	}
+}